@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ------------------------- admin -------------------------
+
+// requireAdmin пропускает запрос только с заголовком Authorization: Bearer <ADMIN_TOKEN>.
+// Если ADMIN_TOKEN не задан, админские эндпоинты выключены.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if checkAdmin(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// checkAdmin проверяет токен ADMIN_TOKEN; при отказе сам отвечает клиенту.
+// Нужен и вне админских маршрутов — для админских режимов обычных эндпоинтов.
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := env("ADMIN_TOKEN", "")
+	if token == "" {
+		writeError(w, CodeAdminDisabled, "admin api disabled")
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		writeError(w, CodeUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
+
+type RenameRequest struct {
+	Name       string `json:"name"`        // текущее имя товара
+	ProductID  string `json:"product_id"`  // либо id товара из CSV
+	NewName    string `json:"new_name"`    // новое имя
+	OnConflict string `json:"on_conflict"` // merge (по умолчанию) | fail
+}
+
+type RenameResponse struct {
+	Matched int `json:"matched"` // сколько строк подошло под условие
+	Renamed int `json:"renamed"` // сколько строк переименовано
+	Merged  int `json:"merged"`  // сколько строк удалено, т.к. после переименования они совпали бы с уже существующими
+}
+
+// errRenameConflict — переименование упирается в UNIQUE, а вызывающий попросил не сливать строки.
+var errRenameConflict = errors.New("rename conflicts with existing rows")
+
+func handleRename(db *sql.DB, rollups *rollupRefresher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RenameRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, CodeInvalidJSON, "invalid json")
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		req.ProductID = strings.TrimSpace(req.ProductID)
+		req.NewName = strings.TrimSpace(req.NewName)
+
+		if req.Name == "" && req.ProductID == "" {
+			writeError(w, CodeInvalidRequest, "name or product_id required")
+			return
+		}
+		if req.NewName == "" {
+			writeError(w, CodeInvalidRequest, "new_name required")
+			return
+		}
+		switch req.OnConflict {
+		case "":
+			req.OnConflict = "merge"
+		case "merge", "fail":
+		default:
+			writeError(w, CodeInvalidRequest, "on_conflict must be merge or fail")
+			return
+		}
+
+		resp, err := retryDB(r.Context(), "rename product", func() (RenameResponse, error) {
+			return renameProduct(r.Context(), db, req)
+		})
+		if errors.Is(err, errRenameConflict) {
+			writeError(w, CodeConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeErrorFrom(w, dbError("db rename failed", err))
+			return
+		}
+
+		if resp.Renamed > 0 || resp.Merged > 0 {
+			rollups.request()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func renameProduct(ctx context.Context, db *sql.DB, req RenameRequest) (RenameResponse, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return RenameResponse{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Пустой параметр означает "не фильтровать по этому полю".
+	const match = `($1 = '' OR p.name = $1) AND ($2 = '' OR p.product_id = $2)`
+	args := []any{req.Name, req.ProductID, req.NewName}
+
+	var resp RenameResponse
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM prices p WHERE `+match, args[:2]...).
+		Scan(&resp.Matched); err != nil {
+		return RenameResponse{}, err
+	}
+
+	// Ключи дубля — как в prices_uniq_ci: name и category без учёта регистра и пробелов по краям,
+	// а для двух строк с ignore_date — как в prices_uniq_no_date_ci, без даты.
+	// 1) строки, которые после переименования совпадут с уже существующей строкой под новым именем
+	//    (сама она не переименовывается — иначе "milk" -> "Milk" совпала бы сама с собой)
+	const collideExisting = `
+		FROM prices p
+		WHERE ` + match + ` AND p.name <> $3
+		  AND EXISTS (
+			SELECT 1 FROM prices q
+			WHERE lower(trim(q.name)) = lower(trim($3))
+			  AND (q.created_at = p.created_at OR q.ignore_date AND p.ignore_date)
+			  AND lower(trim(q.category)) = lower(trim(p.category)) AND q.price = p.price
+			  AND (($1 = '' OR q.name = $1) AND ($2 = '' OR q.product_id = $2) AND q.name <> $3) IS NOT TRUE
+		  )`
+	// 2) строки с разными старыми именами (один product_id), совпадающие между собой; оставляем минимальный id
+	const collideEachOther = `
+		FROM prices p
+		WHERE ` + match + ` AND p.name <> $3
+		  AND EXISTS (
+			SELECT 1 FROM prices q
+			WHERE ($1 = '' OR q.name = $1) AND ($2 = '' OR q.product_id = $2) AND q.name <> $3
+			  AND q.id < p.id AND (q.created_at = p.created_at OR q.ignore_date AND p.ignore_date)
+			  AND lower(trim(q.category)) = lower(trim(p.category)) AND q.price = p.price
+		  )`
+
+	if req.OnConflict == "fail" {
+		var n int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) `+collideExisting, args...).Scan(&n); err != nil {
+			return RenameResponse{}, err
+		}
+		if n == 0 {
+			if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) `+collideEachOther, args...).Scan(&n); err != nil {
+				return RenameResponse{}, err
+			}
+		}
+		if n > 0 {
+			return RenameResponse{}, errRenameConflict
+		}
+	}
+
+	for _, q := range []string{collideExisting, collideEachOther} {
+		res, err := tx.ExecContext(ctx, `DELETE FROM prices WHERE id IN (SELECT p.id `+q+`)`, args...)
+		if err != nil {
+			return RenameResponse{}, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return RenameResponse{}, err
+		}
+		resp.Merged += int(n)
+	}
+
+	res, err := tx.ExecContext(ctx, `UPDATE prices p SET name = $3 WHERE `+match+` AND p.name <> $3`, args...)
+	if err != nil {
+		return RenameResponse{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return RenameResponse{}, err
+	}
+	resp.Renamed = int(n)
+
+	if err := tx.Commit(); err != nil {
+		return RenameResponse{}, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- alert rules -------------------------
+
+// AlertRule — порог на метрику загрузки, например
+// {"name": "price_jump", "metric": "total_price_growth", "op": ">", "threshold": 0.2, "notify": ["ops"]}.
+type AlertRule struct {
+	Name      string   `json:"name"`
+	Metric    string   `json:"metric"`
+	Op        string   `json:"op"`
+	Threshold float64  `json:"threshold"`
+	Notify    []string `json:"notify"` // имена из ALERT_NOTIFIERS
+}
+
+// Метрики, которые считаются после каждой загрузки.
+var alertMetrics = []string{
+	"total_price_growth", // рост суммы цен по всей БД за загрузку, доля: 0.2 — на 20%
+	"category_avg_ratio", // средняя цена категории после загрузки / до неё, по каждой затронутой категории
+	"duplicate_rate",     // duplicates_count / total_count загрузки
+	"total_count",        // строк в файле
+	"total_items",        // вставлено строк
+}
+
+var alertOps = []string{">", ">=", "<", "<="}
+
+func (r AlertRule) matches(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	}
+	return v <= r.Threshold
+}
+
+// Alert — сработавшее правило; так же уходит в тело webhook.
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Metric    string    `json:"metric"`
+	Op        string    `json:"op"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"`
+	Category  string    `json:"category,omitempty"`
+	UploadID  int64     `json:"upload_id"`
+	Supplier  string    `json:"supplier,omitempty"`
+	Message   string    `json:"message"`
+	FiredAt   time.Time `json:"fired_at"`
+}
+
+// Alerting проверяет правила после загрузок и рассылает оповещения. nil — правил нет.
+type Alerting struct {
+	db        *sql.DB
+	rules     []AlertRule
+	notifiers map[string]notifier
+}
+
+type notifier func(ctx context.Context, a Alert) error
+
+// loadAlerting читает ALERT_NOTIFIERS и ALERT_RULES. Ошибка в правиле или ссылка на
+// неизвестного получателя — ошибка запуска, чтобы оповещение не пропало молча.
+func loadAlerting(db *sql.DB) (*Alerting, error) {
+	s := env("ALERT_RULES", "")
+	if s == "" {
+		return nil, nil
+	}
+	a := &Alerting{db: db, notifiers: map[string]notifier{}}
+	if err := json.Unmarshal([]byte(s), &a.rules); err != nil {
+		return nil, fmt.Errorf("ALERT_RULES: %w", err)
+	}
+
+	var cfgs map[string]NotifierConfig
+	if s := env("ALERT_NOTIFIERS", ""); s != "" {
+		if err := json.Unmarshal([]byte(s), &cfgs); err != nil {
+			return nil, fmt.Errorf("ALERT_NOTIFIERS: %w", err)
+		}
+	}
+	client := &http.Client{Timeout: envDuration("ALERT_NOTIFY_TIMEOUT", 10*time.Second)}
+	for name, cfg := range cfgs {
+		n, err := cfg.notifier(client)
+		if err != nil {
+			return nil, fmt.Errorf("ALERT_NOTIFIERS: %s: %w", name, err)
+		}
+		a.notifiers[name] = n
+	}
+
+	for i, r := range a.rules {
+		switch {
+		case r.Name == "":
+			return nil, fmt.Errorf("ALERT_RULES: rule %d: name is required", i)
+		case !slices.Contains(alertMetrics, r.Metric):
+			return nil, fmt.Errorf("ALERT_RULES: %s: unknown metric %q, expected one of %s", r.Name, r.Metric, strings.Join(alertMetrics, ", "))
+		case !slices.Contains(alertOps, r.Op):
+			return nil, fmt.Errorf("ALERT_RULES: %s: unknown op %q, expected one of %s", r.Name, r.Op, strings.Join(alertOps, " "))
+		}
+		for _, n := range r.Notify {
+			if _, ok := a.notifiers[n]; !ok {
+				return nil, fmt.Errorf("ALERT_RULES: %s: unknown notifier %s", r.Name, n)
+			}
+		}
+	}
+	return a, nil
+}
+
+// check проверяет правила в фоне: ответ на загрузку не ждёт ни запросов, ни рассылки.
+func (a *Alerting) check(ev UploadEvent) {
+	if a == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := a.evaluate(ctx, ev); err != nil {
+			log.Printf("alerts: upload %d: %v", ev.ID, err)
+		}
+	}()
+}
+
+func (a *Alerting) evaluate(ctx context.Context, ev UploadEvent) error {
+	var (
+		resp   = ev.Response
+		ratios map[string]float64 // считаются один раз на все правила по категориям
+	)
+	for _, r := range a.rules {
+		switch r.Metric {
+		case "total_price_growth":
+			// До загрузки в БД было TotalPrice - InsertedPrice; для первой загрузки рост не определён.
+			if before := resp.TotalPrice - ev.InsertedPrice; before > 0 {
+				a.test(ctx, r, ev, "", ev.InsertedPrice/before)
+			}
+		case "duplicate_rate":
+			if resp.TotalCount > 0 {
+				a.test(ctx, r, ev, "", float64(resp.DuplicatesCount)/float64(resp.TotalCount))
+			}
+		case "total_count":
+			a.test(ctx, r, ev, "", float64(resp.TotalCount))
+		case "total_items":
+			a.test(ctx, r, ev, "", float64(resp.TotalItems))
+		case "category_avg_ratio":
+			if ratios == nil {
+				var err error
+				if ratios, err = a.categoryAvgRatios(ctx, ev); err != nil {
+					return err
+				}
+			}
+			for _, c := range slices.Sorted(maps.Keys(ratios)) {
+				a.test(ctx, r, ev, c, ratios[c])
+			}
+		}
+	}
+	return nil
+}
+
+// categoryAvgRatios сравнивает среднюю цену затронутых категорий с той, что была до загрузки.
+// Считается уже после коммита, поэтому параллельная загрузка в ту же категорию может
+// немного сдвинуть значение. Новые категории пропускаются.
+func (a *Alerting) categoryAvgRatios(ctx context.Context, ev UploadEvent) (map[string]float64, error) {
+	out := map[string]float64{}
+	if len(ev.Inserted) == 0 {
+		return out, nil
+	}
+	rows, err := a.db.QueryContext(ctx,
+		`SELECT category, COUNT(*), SUM(price) FROM prices WHERE category = ANY($1) GROUP BY category`,
+		pq.Array(slices.Sorted(maps.Keys(ev.Inserted))))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			category string
+			n        int
+			total    float64
+		)
+		if err := rows.Scan(&category, &n, &total); err != nil {
+			return nil, err
+		}
+		d := ev.Inserted[category]
+		if n <= d.Rows {
+			continue
+		}
+		before := (total - d.Total) / float64(n-d.Rows)
+		if before > 0 {
+			out[category] = (total / float64(n)) / before
+		}
+	}
+	return out, rows.Err()
+}
+
+// test записывает и рассылает оповещение, если значение метрики нарушает правило.
+func (a *Alerting) test(ctx context.Context, r AlertRule, ev UploadEvent, category string, v float64) {
+	if !r.matches(v) {
+		return
+	}
+	al := Alert{
+		Rule: r.Name, Metric: r.Metric, Op: r.Op, Threshold: r.Threshold, Value: v,
+		Category: category, UploadID: ev.ID, Supplier: ev.Supplier, FiredAt: time.Now().UTC(),
+	}
+	al.Message = fmt.Sprintf("alert %s: %s = %.4g %s %g after upload %d", r.Name, r.Metric, v, r.Op, r.Threshold, ev.ID)
+	if category != "" {
+		al.Message += fmt.Sprintf(", category %q", category)
+	}
+	if ev.Supplier != "" {
+		al.Message += fmt.Sprintf(", supplier %q", ev.Supplier)
+	}
+
+	var errs []error
+	for _, name := range r.Notify {
+		if err := a.notifiers[name](ctx, al); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	var notifyErr sql.NullString
+	if err := errors.Join(errs...); err != nil {
+		notifyErr = sql.NullString{String: err.Error(), Valid: true}
+		log.Printf("alerts: %s: notify: %v", r.Name, err)
+	}
+
+	_, err := a.db.ExecContext(ctx, `
+		INSERT INTO alerts (fired_at, rule, metric, op, threshold, value, category, upload_id, message, notify_error)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10);
+	`, al.FiredAt, al.Rule, al.Metric, al.Op, al.Threshold, al.Value, al.Category, al.UploadID, al.Message, notifyErr)
+	if err != nil {
+		log.Printf("alerts: %s: record: %v", r.Name, err)
+	}
+}
+
+// ------------------------- notifiers -------------------------
+
+// NotifierConfig — получатель оповещений из ALERT_NOTIFIERS, например
+// {"ops": {"type": "slack", "url": "https://hooks.slack.com/services/..."}, "mail": {"type": "email", "to": ["team@example.com"]}}.
+type NotifierConfig struct {
+	Type string   `json:"type"` // webhook, slack или email
+	URL  string   `json:"url"`  // webhook и slack
+	To   []string `json:"to"`   // email
+}
+
+func (c NotifierConfig) notifier(client *http.Client) (notifier, error) {
+	switch c.Type {
+	case "webhook":
+		if c.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		return func(ctx context.Context, a Alert) error { return postJSON(ctx, client, c.URL, a) }, nil
+	case "slack":
+		if c.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		return func(ctx context.Context, a Alert) error {
+			return postJSON(ctx, client, c.URL, map[string]string{"text": a.Message})
+		}, nil
+	case "email":
+		addr, from := env("SMTP_ADDR", ""), env("SMTP_FROM", "")
+		if len(c.To) == 0 || addr == "" || from == "" {
+			return nil, errors.New("email needs to, SMTP_ADDR and SMTP_FROM")
+		}
+		var auth smtp.Auth
+		if user := env("SMTP_USERNAME", ""); user != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			auth = smtp.PlainAuth("", user, env("SMTP_PASSWORD", ""), host)
+		}
+		return func(ctx context.Context, a Alert) error {
+			msg := "From: " + from + "\r\n" +
+				"To: " + strings.Join(c.To, ", ") + "\r\n" +
+				"Subject: [prices] " + a.Rule + "\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+				a.Message + "\r\n"
+			return smtp.SendMail(addr, auth, from, c.To, []byte(msg))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q, expected webhook, slack or email", c.Type)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("http status " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,959 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ------------------------- aggregate -------------------------
+
+// Измерения и метрики задаются только из этих списков: в SQL попадают выражения отсюда,
+// а не пользовательский ввод.
+var aggregateDimensions = map[string]string{
+	"category": "category",
+	"name":     "name",
+	"day":      "to_char(created_at, 'YYYY-MM-DD')",
+	"week":     "to_char(date_trunc('week', created_at), 'YYYY-MM-DD')",
+	"month":    "to_char(created_at, 'YYYY-MM')",
+	"year":     "to_char(created_at, 'YYYY')",
+	"unit":     "unit",
+}
+
+var aggregateMetrics = map[string]string{
+	"count": "COUNT(*)",
+	"sum":   "ROUND(SUM(price), 2)",
+	"avg":   "ROUND(AVG(price), 2)",
+	"min":   "MIN(price)",
+	"max":   "MAX(price)",
+	// Цена за единицу — только по строкам с unit; сравнима внутри одной единицы (group_by=unit).
+	"avg_unit_price": "ROUND(AVG(unit_price), 4)",
+	"min_unit_price": "MIN(unit_price)",
+	"max_unit_price": "MAX(unit_price)",
+}
+
+func handleAggregate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		dims, dimsErr := parseWhitelist(q.Get("group_by"), aggregateDimensions, "group_by")
+		metrics, metricsErr := parseWhitelist(q.Get("metrics"), aggregateMetrics, "metrics")
+		f, filterErr := parseRequestFilter(r)
+		// Большой лимит — защита от group_by=name,day по всей таблице.
+		page, pageErr := parsePage(q, 1000, 10000)
+		// category_depth=1 — category свёрнута до верхнего уровня: dairy вместо dairy/milk.
+		var errs ValidationErrors
+		depth := intParam(q, "category_depth", "", 0, 1, maxCategoryDepth, &errs)
+		if err := mergeErrors(dimsErr, metricsErr, filterErr, pageErr, errs.err()); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		if len(metrics) == 0 {
+			metrics = []string{"count", "sum"}
+		}
+
+		result, total, err := aggregatePrices(r.Context(), db, f, dims, metrics, depth, page)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		filters := f.echo()
+		filters["group_by"] = dims
+		filters["metrics"] = metrics
+		if depth > 0 {
+			filters["category_depth"] = depth
+		}
+		writeList(w, r, result, len(result), total, page, filters)
+	}
+}
+
+// parseWhitelist разбирает список через запятую, проверяя каждое имя по словарю.
+func parseWhitelist(s string, allowed map[string]string, param string) ([]string, error) {
+	var (
+		out  []string
+		errs ValidationErrors
+	)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := allowed[name]; !ok {
+			errs.add(param, name, "expected one of "+strings.Join(slices.Sorted(maps.Keys(allowed)), ", "))
+			continue
+		}
+		out = append(out, name)
+	}
+	return out, errs.err()
+}
+
+// aggregatePrices считает метрики по измерениям dims; при categoryDepth > 0 category
+// сворачивается до этого уровня пути.
+func aggregatePrices(ctx context.Context, db *sql.DB, f PriceFilter, dims, metrics []string, categoryDepth int, page PageInfo) ([]map[string]any, int, error) {
+	// Если хватает дневного предагрегата (нет разреза по name и unit, метрик цены за единицу
+	// и фильтров по цене/имени) — читаем его.
+	source, metricExprs := "prices", aggregateMetrics
+	rollup := f.rollupCompatible() && !slices.Contains(dims, "name") && !slices.Contains(dims, "unit")
+	for _, m := range metrics {
+		if _, ok := rollupMetrics[m]; !ok {
+			rollup = false
+		}
+	}
+	if rollup {
+		source, metricExprs = "prices_daily_rollup", rollupMetrics
+	}
+
+	var (
+		sel   []string
+		group []string
+	)
+	for _, d := range dims {
+		expr := aggregateDimensions[d]
+		if d == "category" && categoryDepth > 0 {
+			expr = categoryDepthExpr("category", categoryDepth)
+		}
+		sel = append(sel, expr+" AS "+d)
+		group = append(group, expr)
+	}
+	for _, m := range metrics {
+		sel = append(sel, metricExprs[m]+" AS "+m)
+	}
+	sel = append(sel, "COUNT(*) OVER ()")
+
+	cond, args := f.where(1)
+	sb := strings.Builder{}
+	sb.WriteString("SELECT " + strings.Join(sel, ", ") + " FROM " + source + " WHERE 1=1" + cond)
+	if len(group) > 0 {
+		sb.WriteString(" GROUP BY " + strings.Join(group, ", ") + " ORDER BY " + strings.Join(group, ", "))
+	}
+	base := sb.String()
+	sb.WriteString(fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset))
+
+	rows, err := db.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		result = []map[string]any{}
+		total  int
+	)
+	for rows.Next() {
+		var (
+			dimVals    = make([]sql.NullString, len(dims))
+			metricVals = make([]sql.NullFloat64, len(metrics))
+			dest       = make([]any, 0, len(dims)+len(metrics)+1)
+		)
+		for i := range dimVals {
+			dest = append(dest, &dimVals[i])
+		}
+		for i := range metricVals {
+			dest = append(dest, &metricVals[i])
+		}
+		dest = append(dest, &total)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, 0, err
+		}
+
+		row := make(map[string]any, len(dest))
+		for i, d := range dims {
+			row[d] = dimVals[i].String
+		}
+		for i, m := range metrics {
+			if metricVals[i].Valid {
+				row[m] = metricVals[i].Float64
+			} else {
+				row[m] = nil // avg/min/max по пустой выборке
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	total, err = pageTotal(ctx, db, len(result), total, page, base, args...)
+	return result, total, err
+}
+
+// ------------------------- stats -------------------------
+
+// handleDatasetStats отдаёт итоги по БД и период, который она покрывает, чтобы перед отчётом
+// сразу видеть, есть ли данные за нужные даты. Ключ с категориями видит итоги только по ним.
+// С as_of — итоги на прошлый момент, как в уже опубликованном отчёте.
+func handleDatasetStats(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var f PriceFilter
+		if err := f.parseAsOf(r.URL.Query()); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		stats, err := queryDatasetStats(r.Context(), db, categoryScope(r), f.AsOf)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// ------------------------- trend -------------------------
+
+// TrendPoint — средняя цена категории за интервал и скользящее среднее за окно,
+// которое заканчивается этим интервалом.
+type TrendPoint struct {
+	Bucket     string  `json:"bucket"` // начало интервала, YYYY-MM-DD
+	Category   string  `json:"category"`
+	Rows       int     `json:"rows"`
+	AvgPrice   float64 `json:"avg_price"`
+	MovingAvg  float64 `json:"moving_avg"`  // взвешено по числу строк в окне
+	WindowRows int     `json:"window_rows"` // строк во всём окне
+}
+
+// trendBuckets — интервалы тренда, единицы date_trunc и INTERVAL.
+var trendBuckets = []string{"day", "week", "month"}
+
+func handleTrend(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		var errs ValidationErrors
+		bucket := strings.TrimSpace(q.Get("bucket"))
+		if bucket == "" {
+			bucket = "day"
+		}
+		if !slices.Contains(trendBuckets, bucket) {
+			errs.add("bucket", bucket, "expected day, week or month")
+		}
+		window := intParam(q, "window", "TREND_WINDOW", 7, 1, 366, &errs)
+		f, filterErr := parseRequestFilter(r)
+		page, pageErr := parsePage(q, 1000, 10000)
+		if err := mergeErrors(errs.err(), filterErr, pageErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		points, total, err := trend(r.Context(), db, f, bucket, window, page)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		filters := f.echo()
+		filters["bucket"] = bucket
+		filters["window"] = window
+		writeList(w, r, points, len(points), total, page, filters)
+	}
+}
+
+// trend считает скользящее среднее оконной функцией по категориям. Окно — window интервалов
+// по календарю (RANGE), а не по строкам: пропущенные дни не растягивают окно.
+// Данные читаются с запасом в window-1 интервал до start, чтобы первые точки периода
+// тоже усреднялись по полному окну.
+func trend(ctx context.Context, db *sql.DB, f PriceFilter, bucket string, window int, page PageInfo) ([]TrendPoint, int, error) {
+	from := f
+	var since time.Time
+	if f.HasStart {
+		since = truncateBucket(f.StartDate, bucket)
+		from.StartDate = addBuckets(since, bucket, 1-window)
+	}
+
+	source, rows, total := "prices", "COUNT(*)", "SUM(price)"
+	if f.rollupCompatible() {
+		source, rows, total = "prices_daily_rollup", "SUM(rows)", "SUM(total_price)"
+	}
+
+	cond, args := from.where(1)
+	args = append(args, since)
+	// bucket и window проверены выше, в запрос подставляются только они.
+	query := fmt.Sprintf(`
+		WITH b AS (
+			SELECT date_trunc('%[1]s', created_at)::date AS bucket, category, %[2]s AS rows, %[3]s AS total
+			FROM %[4]s
+			WHERE 1=1%[5]s
+			GROUP BY 1, 2
+		), t AS (
+			SELECT bucket, category, rows,
+				ROUND(total / rows, 2) AS avg_price,
+				ROUND(SUM(total) OVER w / SUM(rows) OVER w, 2) AS moving_avg,
+				SUM(rows) OVER w AS window_rows
+			FROM b
+			WINDOW w AS (PARTITION BY category ORDER BY bucket RANGE BETWEEN INTERVAL '%[6]d %[1]s' PRECEDING AND CURRENT ROW)
+		)
+		SELECT to_char(bucket, 'YYYY-MM-DD'), category, rows, avg_price, moving_avg, window_rows, COUNT(*) OVER ()
+		FROM t
+		WHERE bucket >= $%[7]d
+		ORDER BY category, bucket`,
+		bucket, rows, total, source, cond, window-1, len(args))
+
+	rs, err := db.QueryContext(ctx, query+fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rs.Close()
+
+	var (
+		points = []TrendPoint{}
+		count  int
+	)
+	for rs.Next() {
+		var p TrendPoint
+		if err := rs.Scan(&p.Bucket, &p.Category, &p.Rows, &p.AvgPrice, &p.MovingAvg, &p.WindowRows, &count); err != nil {
+			return nil, 0, err
+		}
+		points = append(points, p)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, 0, err
+	}
+	count, err = pageTotal(ctx, db, len(points), count, page, query, args...)
+	return points, count, err
+}
+
+// truncateBucket — начало интервала, как date_trunc: неделя начинается с понедельника.
+func truncateBucket(d time.Time, bucket string) time.Time {
+	switch bucket {
+	case "week":
+		return d.AddDate(0, 0, -(int(d.Weekday())+6)%7)
+	case "month":
+		return time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, d.Location())
+	}
+	return d
+}
+
+func addBuckets(d time.Time, bucket string, n int) time.Time {
+	switch bucket {
+	case "week":
+		return d.AddDate(0, 0, 7*n)
+	case "month":
+		return d.AddDate(0, n, 0)
+	}
+	return d.AddDate(0, 0, n)
+}
+
+// ------------------------- forecast -------------------------
+
+// Forecast — наивный прогноз средней цены категории на horizon интервалов вперёд.
+type Forecast struct {
+	Category string          `json:"category"`
+	Method   string          `json:"method"` // linear или last; linear по одной точке считается как last
+	Points   int             `json:"points"` // интервалов с данными в истории
+	Slope    float64         `json:"slope"`  // изменение средней цены за интервал, для last — 0
+	Forecast []ForecastPoint `json:"forecast"`
+}
+
+type ForecastPoint struct {
+	Bucket   string  `json:"bucket"` // начало интервала, YYYY-MM-DD
+	AvgPrice float64 `json:"avg_price"`
+}
+
+var forecastMethods = []string{"linear", "last"}
+
+func handleForecast(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		var errs ValidationErrors
+		bucket := strings.TrimSpace(q.Get("bucket"))
+		if bucket == "" {
+			bucket = "week"
+		}
+		if !slices.Contains(trendBuckets, bucket) {
+			errs.add("bucket", bucket, "expected day, week or month")
+		}
+		method := strings.TrimSpace(q.Get("method"))
+		if method == "" {
+			method = "linear"
+		}
+		if !slices.Contains(forecastMethods, method) {
+			errs.add("method", method, "expected linear or last")
+		}
+		history := intParam(q, "history", "FORECAST_HISTORY", 12, 1, 366, &errs)
+		horizon := intParam(q, "horizon", "FORECAST_HORIZON", 4, 1, 366, &errs)
+		f, filterErr := parseRequestFilter(r)
+		page, pageErr := parsePage(q, 100, 1000)
+		if err := mergeErrors(errs.err(), filterErr, pageErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		all, err := forecast(r.Context(), db, f, bucket, method, history, horizon)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		filters := f.echo()
+		filters["bucket"] = bucket
+		filters["method"] = method
+		filters["history"] = history
+		filters["horizon"] = horizon
+		items := all[min(page.Offset, len(all)):min(page.Offset+page.Limit, len(all))]
+		writeList(w, r, items, len(items), len(all), page, filters)
+	}
+}
+
+// forecast строит прогноз по средним ценам за последние history интервалов. История
+// заканчивается интервалом с end, а без end — последним интервалом с данными.
+// Прогноз не опускается ниже нуля: цены положительны.
+func forecast(ctx context.Context, db *sql.DB, f PriceFilter, bucket, method string, history, horizon int) ([]Forecast, error) {
+	source, rows, total := "prices", "COUNT(*)", "SUM(price)"
+	if f.rollupCompatible() {
+		source, rows, total = "prices_daily_rollup", "SUM(rows)", "SUM(total_price)"
+	}
+
+	last := f.EndDate
+	if !f.HasEnd {
+		cond, args := f.where(1)
+		var maxDate sql.NullTime
+		if err := db.QueryRowContext(ctx, `SELECT MAX(created_at) FROM `+source+` WHERE 1=1`+cond, args...).Scan(&maxDate); err != nil {
+			return nil, err
+		}
+		if !maxDate.Valid {
+			return []Forecast{}, nil
+		}
+		last = maxDate.Time
+	}
+	last = truncateBucket(last, bucket)
+	first := addBuckets(last, bucket, 1-history)
+
+	from := f
+	if !from.HasStart || from.StartDate.Before(first) {
+		from.HasStart, from.StartDate = true, first
+	}
+	from.HasEnd, from.EndDate = true, addBuckets(last, bucket, 1).AddDate(0, 0, -1)
+
+	cond, args := from.where(1)
+	// bucket проверен вызывающим.
+	query := fmt.Sprintf(`
+		SELECT category, date_trunc('%s', created_at)::date, %s, %s
+		FROM %s
+		WHERE 1=1%s
+		GROUP BY 1, 2
+		ORDER BY 1, 2;`, bucket, rows, total, source, cond)
+	rs, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	type point struct{ x, y float64 }
+	var (
+		categories []string
+		series     = map[string][]point{}
+	)
+	for rs.Next() {
+		var (
+			category string
+			day      time.Time
+			n        int
+			sum      float64
+		)
+		if err := rs.Scan(&category, &day, &n, &sum); err != nil {
+			return nil, err
+		}
+		if _, ok := series[category]; !ok {
+			categories = append(categories, category)
+		}
+		// x — номер интервала от начала истории: пропуски в данных не сдвигают точки.
+		series[category] = append(series[category], point{x: float64(bucketIndex(first, day, bucket)), y: sum / float64(n)})
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]Forecast, 0, len(categories))
+	for _, c := range categories {
+		pts := series[c]
+		fc := Forecast{Category: c, Method: method, Points: len(pts), Forecast: make([]ForecastPoint, horizon)}
+
+		// Последнее значение переносится вперёд; для linear — прямая наименьших квадратов.
+		lastPt := pts[len(pts)-1]
+		intercept := lastPt.y - fc.Slope*lastPt.x
+		if method == "linear" && len(pts) > 1 {
+			var sx, sy, sxx, sxy float64
+			for _, p := range pts {
+				sx, sy, sxx, sxy = sx+p.x, sy+p.y, sxx+p.x*p.x, sxy+p.x*p.y
+			}
+			n := float64(len(pts))
+			fc.Slope = (n*sxy - sx*sy) / (n*sxx - sx*sx)
+			intercept = (sy - fc.Slope*sx) / n
+		} else {
+			fc.Method = "last"
+		}
+
+		for i := range fc.Forecast {
+			x := float64(history + i)
+			fc.Forecast[i] = ForecastPoint{
+				Bucket:   addBuckets(first, bucket, history+i).Format("2006-01-02"),
+				AvgPrice: math.Round(max(0, intercept+fc.Slope*x)*100) / 100,
+			}
+		}
+		fc.Slope = math.Round(fc.Slope*100) / 100
+		out = append(out, fc)
+	}
+	return out, nil
+}
+
+// bucketIndex — сколько интервалов от first до начала интервала day.
+func bucketIndex(first, day time.Time, bucket string) int {
+	switch bucket {
+	case "week":
+		return int(day.Sub(first).Hours()/24) / 7
+	case "month":
+		return (day.Year()-first.Year())*12 + int(day.Month()-first.Month())
+	}
+	return int(day.Sub(first).Hours() / 24)
+}
+
+// ------------------------- pivot -------------------------
+
+// Pivot — сумма цен по категориям (строки) и месяцам (столбцы).
+type Pivot struct {
+	Months     []string             // YYYY-MM без пропусков от первого до последнего
+	Categories []string             // по алфавиту
+	Cells      map[string][]float64 // category -> сумма по каждому месяцу из Months
+}
+
+func handlePivot(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		var formatErr error
+		format := strings.TrimSpace(q.Get("format"))
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "xlsx" {
+			formatErr = fieldError("format", format, "expected csv or xlsx")
+		}
+
+		f, err := parseRequestFilter(r)
+		if err := mergeErrors(formatErr, err); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		p, err := buildPivot(r.Context(), db, f)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		table := p.table()
+		switch format {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="pivot.csv"`)
+			if envBool("EXPORT_FORMULA_ESCAPE", true) {
+				table = escapeFormulaTable(table)
+			}
+			cw := csv.NewWriter(w)
+			_ = cw.WriteAll(table)
+		case "xlsx":
+			b, err := pivotXLSX(table)
+			if err != nil {
+				writeError(w, CodeExportFailed, "failed to build xlsx")
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			w.Header().Set("Content-Disposition", `attachment; filename="pivot.xlsx"`)
+			_, _ = w.Write(b)
+		}
+	}
+}
+
+func buildPivot(ctx context.Context, db *sql.DB, f PriceFilter) (Pivot, error) {
+	source, sum := "prices", "SUM(price)"
+	if f.rollupCompatible() {
+		source, sum = "prices_daily_rollup", "SUM(total_price)"
+		if f.monthAligned() {
+			source = "prices_monthly_rollup"
+		}
+	}
+
+	cond, args := f.where(1)
+	q := `
+		SELECT category, to_char(created_at, 'YYYY-MM') AS month, ` + sum + `
+		FROM ` + source + `
+		WHERE 1=1` + cond + `
+		GROUP BY category, month;
+	`
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return Pivot{}, err
+	}
+	defer rows.Close()
+
+	type cell struct{ category, month string }
+	var (
+		sums        = make(map[cell]float64)
+		categories  = make(map[string]struct{})
+		first, last string
+	)
+	for rows.Next() {
+		var (
+			c   cell
+			sum float64
+		)
+		if err := rows.Scan(&c.category, &c.month, &sum); err != nil {
+			return Pivot{}, err
+		}
+		sums[c] = sum
+		categories[c.category] = struct{}{}
+		if first == "" || c.month < first {
+			first = c.month
+		}
+		if c.month > last {
+			last = c.month
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return Pivot{}, err
+	}
+
+	// Выбранный диапазон важнее фактических данных: пустые месяцы тоже нужны в таблице.
+	if f.HasStart {
+		first = f.StartDate.Format("2006-01")
+	}
+	if f.HasEnd {
+		last = f.EndDate.Format("2006-01")
+	}
+
+	p := Pivot{Cells: make(map[string][]float64)}
+	if first != "" && last != "" {
+		start, _ := time.Parse("2006-01", first)
+		end, _ := time.Parse("2006-01", last)
+		for m := start; !m.After(end); m = m.AddDate(0, 1, 0) {
+			p.Months = append(p.Months, m.Format("2006-01"))
+		}
+	}
+	for c := range categories {
+		p.Categories = append(p.Categories, c)
+	}
+	sort.Strings(p.Categories)
+
+	for _, c := range p.Categories {
+		vals := make([]float64, len(p.Months))
+		for i, m := range p.Months {
+			vals[i] = sums[cell{c, m}]
+		}
+		p.Cells[c] = vals
+	}
+	return p, nil
+}
+
+// table раскладывает сводную в строки с заголовком и итогами по строкам и столбцам.
+func (p Pivot) table() [][]string {
+	header := append([]string{"category"}, p.Months...)
+	header = append(header, "total")
+	out := [][]string{header}
+
+	colTotals := make([]float64, len(p.Months))
+	var grand float64
+	for _, c := range p.Categories {
+		rec := []string{c}
+		var rowTotal float64
+		for i, v := range p.Cells[c] {
+			rec = append(rec, formatMoney(v))
+			rowTotal += v
+			colTotals[i] += v
+		}
+		grand += rowTotal
+		out = append(out, append(rec, formatMoney(rowTotal)))
+	}
+
+	totals := []string{"total"}
+	for _, v := range colTotals {
+		totals = append(totals, formatMoney(v))
+	}
+	return append(out, append(totals, formatMoney(grand)))
+}
+
+func pivotXLSX(table [][]string) ([]byte, error) {
+	xf := excelize.NewFile()
+	defer func() { _ = xf.Close() }()
+
+	const sheet = "Sheet1"
+	for i, rec := range table {
+		row := make([]any, len(rec))
+		for j, v := range rec {
+			// первая строка и первый столбец — подписи, остальное — числа
+			if i == 0 || j == 0 {
+				row[j] = v
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, err
+			}
+			row[j] = f
+		}
+		cellName, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return nil, err
+		}
+		if err := xf.SetSheetRow(sheet, cellName, &row); err != nil {
+			return nil, err
+		}
+	}
+
+	buf, err := xf.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ------------------------- monthly report -------------------------
+
+type MonthlyReport struct {
+	Month        string            `json:"month"`
+	Totals       MonthlyTotals     `json:"totals"`
+	Categories   []CategorySummary `json:"categories"`
+	NewProducts  []NewProduct      `json:"new_products"`  // имена, которых не было до начала месяца
+	PriceChanges []PriceChange     `json:"price_changes"` // крупнейшие изменения средней цены к прошлому месяцу
+}
+
+type MonthlyTotals struct {
+	Rows       int     `json:"rows"`
+	TotalPrice float64 `json:"total_price"`
+	AvgPrice   float64 `json:"avg_price"`
+	Categories int     `json:"categories"`
+	Products   int     `json:"products"`
+}
+
+type CategorySummary struct {
+	Category   string  `json:"category"`
+	Rows       int     `json:"rows"`
+	TotalPrice float64 `json:"total_price"`
+	AvgPrice   float64 `json:"avg_price"`
+}
+
+type NewProduct struct {
+	Name      string `json:"name"`
+	Category  string `json:"category"`
+	FirstSeen string `json:"first_seen"`
+	Rows      int    `json:"rows"`
+}
+
+type PriceChange struct {
+	Name        string  `json:"name"`
+	PreviousAvg float64 `json:"previous_avg"`
+	CurrentAvg  float64 `json:"current_avg"`
+	ChangePct   float64 `json:"change_pct"`
+}
+
+const maxReportNewProducts = 1000
+
+func handleMonthlyReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		var errs ValidationErrors
+
+		monthStr := strings.TrimSpace(q.Get("month"))
+		month, err := time.Parse("2006-01", monthStr)
+		if err != nil {
+			errs.add("month", monthStr, "expected YYYY-MM")
+		}
+
+		format := strings.TrimSpace(q.Get("format"))
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			errs.add("format", format, "expected json or csv")
+		}
+
+		top := 10
+		if s := strings.TrimSpace(q.Get("top")); s != "" {
+			i, err := strconv.Atoi(s)
+			if err != nil || i <= 0 || i > 1000 {
+				errs.add("top", s, "expected integer 1..1000")
+			} else {
+				top = i
+			}
+		}
+
+		if len(errs) > 0 {
+			writeErrorFrom(w, errs)
+			return
+		}
+
+		report, err := monthlyReport(r.Context(), db, month, top, categoryScope(r))
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="report-`+report.Month+`.csv"`)
+			table := report.table()
+			if envBool("EXPORT_FORMULA_ESCAPE", true) {
+				table = escapeFormulaTable(table)
+			}
+			_ = csv.NewWriter(w).WriteAll(table)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
+
+func monthlyReport(ctx context.Context, db *sql.DB, month time.Time, top int, scope []string) (MonthlyReport, error) {
+	from := month
+	to := month.AddDate(0, 1, 0)
+	prevFrom := month.AddDate(0, -1, 0)
+
+	// Все запросы — на одном снимке данных, чтобы части отчёта сходились между собой.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return MonthlyReport{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rep := MonthlyReport{
+		Month:        month.Format("2006-01"),
+		Categories:   []CategorySummary{},
+		NewProducts:  []NewProduct{},
+		PriceChanges: []PriceChange{},
+	}
+
+	// Ключ API с ограничением категорий видит отчёт только по ним; условие — последним аргументом.
+	scoped := func(argN int, args ...any) (string, []any) {
+		cond, scopeArgs := scopeCond("category", scope, argN)
+		return cond, append(args, scopeArgs...)
+	}
+
+	cond, args := scoped(3, from, to)
+	qTotals := `
+		SELECT COUNT(*), COALESCE(SUM(price), 0), COALESCE(ROUND(AVG(price), 2), 0),
+		       COUNT(DISTINCT category), COUNT(DISTINCT name)
+		FROM prices
+		WHERE created_at >= $1 AND created_at < $2` + cond
+	t := &rep.Totals
+	if err := tx.QueryRowContext(ctx, qTotals, args...).
+		Scan(&t.Rows, &t.TotalPrice, &t.AvgPrice, &t.Categories, &t.Products); err != nil {
+		return MonthlyReport{}, err
+	}
+
+	cond, args = scoped(3, from, to)
+	qCategories := `
+		SELECT category, COUNT(*), SUM(price), ROUND(AVG(price), 2)
+		FROM prices
+		WHERE created_at >= $1 AND created_at < $2` + cond + `
+		GROUP BY category
+		ORDER BY SUM(price) DESC, category;
+	`
+	if err := queryEach(ctx, tx, qCategories, args, func(rows *sql.Rows) error {
+		var c CategorySummary
+		if err := rows.Scan(&c.Category, &c.Rows, &c.TotalPrice, &c.AvgPrice); err != nil {
+			return err
+		}
+		rep.Categories = append(rep.Categories, c)
+		return nil
+	}); err != nil {
+		return MonthlyReport{}, err
+	}
+
+	cond, args = scoped(4, from, to, maxReportNewProducts)
+	qNew := `
+		SELECT p.name, MIN(p.category), MIN(p.created_at), COUNT(*)
+		FROM prices p
+		WHERE p.created_at >= $1 AND p.created_at < $2` + cond + `
+		GROUP BY p.name
+		HAVING NOT EXISTS (SELECT 1 FROM prices o WHERE o.name = p.name AND o.created_at < $1)
+		ORDER BY p.name
+		LIMIT $3;
+	`
+	if err := queryEach(ctx, tx, qNew, args, func(rows *sql.Rows) error {
+		var (
+			np        NewProduct
+			firstSeen time.Time
+		)
+		if err := rows.Scan(&np.Name, &np.Category, &firstSeen, &np.Rows); err != nil {
+			return err
+		}
+		np.FirstSeen = firstSeen.Format("2006-01-02")
+		rep.NewProducts = append(rep.NewProducts, np)
+		return nil
+	}); err != nil {
+		return MonthlyReport{}, err
+	}
+
+	cond, args = scoped(5, from, to, prevFrom, top)
+	qChanges := `
+		WITH cur AS (
+			SELECT name, AVG(price) AS a FROM prices
+			WHERE created_at >= $1 AND created_at < $2` + cond + ` GROUP BY name
+		), prev AS (
+			SELECT name, AVG(price) AS a FROM prices
+			WHERE created_at >= $3 AND created_at < $1` + cond + ` GROUP BY name
+		)
+		SELECT cur.name, ROUND(prev.a, 2), ROUND(cur.a, 2), ROUND((cur.a - prev.a) / prev.a * 100, 2) AS pct
+		FROM cur JOIN prev USING (name)
+		WHERE cur.a <> prev.a
+		ORDER BY abs((cur.a - prev.a) / prev.a) DESC, cur.name
+		LIMIT $4;
+	`
+	if err := queryEach(ctx, tx, qChanges, args, func(rows *sql.Rows) error {
+		var pc PriceChange
+		if err := rows.Scan(&pc.Name, &pc.PreviousAvg, &pc.CurrentAvg, &pc.ChangePct); err != nil {
+			return err
+		}
+		rep.PriceChanges = append(rep.PriceChanges, pc)
+		return nil
+	}); err != nil {
+		return MonthlyReport{}, err
+	}
+
+	return rep, tx.Commit()
+}
+
+// table — плоское CSV-представление отчёта: раздел, объект и значения.
+func (rep MonthlyReport) table() [][]string {
+	out := [][]string{{"section", "item", "rows", "total_price", "avg_price", "previous_avg", "change_pct"}}
+	t := rep.Totals
+	out = append(out, []string{"totals", rep.Month, strconv.Itoa(t.Rows), formatMoney(t.TotalPrice), formatMoney(t.AvgPrice), "", ""})
+	for _, c := range rep.Categories {
+		out = append(out, []string{"category", c.Category, strconv.Itoa(c.Rows), formatMoney(c.TotalPrice), formatMoney(c.AvgPrice), "", ""})
+	}
+	for _, np := range rep.NewProducts {
+		out = append(out, []string{"new_product", np.Name, strconv.Itoa(np.Rows), "", "", "", ""})
+	}
+	for _, pc := range rep.PriceChanges {
+		out = append(out, []string{"price_change", pc.Name, "", "", formatMoney(pc.CurrentAvg), formatMoney(pc.PreviousAvg), formatMoney(pc.ChangePct)})
+	}
+	return out
+}
+
+// queryEach выполняет запрос и вызывает fn для каждой строки результата.
+func queryEach(ctx context.Context, tx *sql.Tx, q string, args []any, fn func(*sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
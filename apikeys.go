@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- api keys -------------------------
+
+// APIKey — ключ из API_KEYS, например
+// {"north": {"token": "...", "categories": ["food", "drinks"]}, "bi": {"token": "..."}}.
+// Пустой categories — доступ ко всем категориям.
+type APIKey struct {
+	Token      string   `json:"token"`
+	Categories []string `json:"categories"`
+}
+
+// APIKeys — ключи доступа к /api/*. nil — API_KEYS не задан, API открыт, как раньше.
+type APIKeys struct {
+	keys map[string]APIKey // имя → ключ; categories уже в виде lower(trim(...))
+}
+
+// loadAPIKeys читает API_KEYS. Пустой или повторяющийся токен и имена admin и anonymous,
+// под которыми учитывается трафик без ключа, — ошибка запуска.
+func loadAPIKeys() (*APIKeys, error) {
+	s := env("API_KEYS", "")
+	if s == "" {
+		return nil, nil
+	}
+	k := &APIKeys{}
+	if err := json.Unmarshal([]byte(s), &k.keys); err != nil {
+		return nil, fmt.Errorf("API_KEYS: %w", err)
+	}
+	tokens := map[string]string{}
+	for name, key := range k.keys {
+		if name == adminKeyName || name == "anonymous" {
+			return nil, fmt.Errorf("API_KEYS: %s is a reserved key name", name)
+		}
+		if key.Token == "" {
+			return nil, fmt.Errorf("API_KEYS: %s: token is required", name)
+		}
+		if other, ok := tokens[key.Token]; ok {
+			return nil, fmt.Errorf("API_KEYS: %s and %s share a token", other, name)
+		}
+		tokens[key.Token] = name
+		for i, c := range key.Categories {
+			key.Categories[i] = normalizeKeyPart(c)
+		}
+	}
+	return k, nil
+}
+
+type (
+	scopeCtxKey   struct{}
+	keyNameCtxKey struct{}
+)
+
+// adminKeyName — имя, под которым учитываются запросы с ADMIN_TOKEN.
+const adminKeyName = "admin"
+
+// middleware пускает к /api/* только с Authorization: Bearer <token> одного из ключей или
+// ADMIN_TOKEN и запоминает в контексте запроса имя и категории ключа. /health, /ready и /metrics открыты.
+func (k *APIKeys) middleware(next http.Handler) http.Handler {
+	if k == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if admin := env("ADMIN_TOKEN", ""); admin != "" && subtle.ConstantTimeCompare([]byte(got), []byte(admin)) == 1 {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyNameCtxKey{}, adminKeyName)))
+			return
+		}
+		for name, key := range k.keys {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(key.Token)) == 1 {
+				ctx := context.WithValue(r.Context(), keyNameCtxKey{}, name)
+				if len(key.Categories) > 0 {
+					ctx = context.WithValue(ctx, scopeCtxKey{}, key.Categories)
+				}
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+		writeError(w, CodeUnauthorized, "unauthorized")
+	})
+}
+
+// categoryScope — категории, которыми ограничен ключ запроса (lower(trim(...))); nil — все.
+func categoryScope(r *http.Request) []string {
+	cats, _ := r.Context().Value(scopeCtxKey{}).([]string)
+	return cats
+}
+
+// apiKeyName — имя ключа запроса из API_KEYS, admin для ADMIN_TOKEN;
+// без API_KEYS ключи не проверяются, и все запросы — anonymous.
+func apiKeyName(r *http.Request) string {
+	if name, ok := r.Context().Value(keyNameCtxKey{}).(string); ok {
+		return name
+	}
+	return "anonymous"
+}
+
+// uploadOwner — чьи загрузки видит запрос: ключ с ограничением категорий — только сделанные
+// им самим (uploads.api_key); пусто — все загрузки: ключ без ограничения, ADMIN_TOKEN или
+// API_KEYS не задан.
+func uploadOwner(r *http.Request) string {
+	if categoryScope(r) == nil {
+		return ""
+	}
+	return apiKeyName(r)
+}
+
+// uploadVisible — видна ли запросу загрузка, сделанная ключом owner. Чужая загрузка
+// для него не существует: 404, как у несуществующей.
+func uploadVisible(r *http.Request, owner string) bool {
+	k := uploadOwner(r)
+	return k == "" || k == owner
+}
+
+// scopeCond — условие " AND ..." на колонку категории для ключа с ограничением; без него — пусто.
+func scopeCond(column string, scope []string, argN int) (string, []any) {
+	if scope == nil {
+		return "", nil
+	}
+	return fmt.Sprintf(" AND lower(trim(%s)) = ANY($%d)", column, argN), []any{pq.Array(scope)}
+}
+
+// parseRequestFilter — parsePriceFilter с ограничением категорий ключа запроса.
+// Все выборки из prices по фильтрам должны идти через него.
+func parseRequestFilter(r *http.Request) (PriceFilter, error) {
+	f, err := parsePriceFilter(r.URL.Query())
+	f.Scope = categoryScope(r)
+	return f, err
+}
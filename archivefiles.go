@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+)
+
+// ------------------------- csv files of an upload -------------------------
+
+// singleCSVName — имя файла загрузки без архива: type=csv или сжатый поток (gzip, zstd, xz).
+const singleCSVName = "data.csv"
+
+// csvFiles — CSV-файлы одной загрузки по порядку: подходящие под files= записи архива
+// или единственный поток. Все файлы загружаются одним прогоном, в одной транзакции.
+type csvFiles interface {
+	// next отдаёт следующий файл; после последнего — io.EOF. Предыдущий файл к этому
+	// моменту либо дочитан, либо больше не нужен.
+	next() (name string, r io.Reader, err error)
+	Close() error
+}
+
+// singleCSV — загрузка из одного файла.
+type singleCSV struct {
+	rc   io.ReadCloser
+	done bool
+}
+
+func singleFile(rc io.ReadCloser) csvFiles {
+	return &singleCSV{rc: rc}
+}
+
+func (s *singleCSV) next() (string, io.Reader, error) {
+	if s.done {
+		return "", nil, io.EOF
+	}
+	s.done = true
+	return singleCSVName, s.rc, nil
+}
+
+func (s *singleCSV) Close() error {
+	return s.rc.Close()
+}
+
+// archiveEntry — подходящая запись zip или 7z; открывается, только когда до неё дойдёт очередь.
+type archiveEntry struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// entryFiles — файлы архива с произвольным доступом (zip, 7z): список известен заранее.
+type entryFiles struct {
+	entries []archiveEntry
+	opts    ArchiveOptions
+	cur     io.ReadCloser
+
+	// concurrent — записи можно читать одновременно (zip). В 7z запись solid-блока
+	// распаковывается вместе с предыдущими, там только по порядку.
+	concurrent bool
+}
+
+// splitFiles — файлы, которые можно разобрать одновременно, каждый отдельно (см. parseFiles).
+type splitFiles interface {
+	// split отдаёт по csvFiles на файл, в исходном порядке; nil — только по порядку через next.
+	split() []csvFiles
+}
+
+func (f *entryFiles) split() []csvFiles {
+	if !f.concurrent || len(f.entries) < 2 {
+		return nil
+	}
+	parts := make([]csvFiles, len(f.entries))
+	for i, e := range f.entries {
+		parts[i] = &entryFiles{entries: []archiveEntry{e}, opts: f.opts}
+	}
+	f.entries = nil
+	return parts
+}
+
+func (f *entryFiles) next() (string, io.Reader, error) {
+	_ = f.Close()
+	if len(f.entries) == 0 {
+		return "", nil, io.EOF
+	}
+	e := f.entries[0]
+	f.entries = f.entries[1:]
+	rc, err := e.open()
+	if err != nil {
+		return "", nil, err
+	}
+	f.cur = f.opts.limitCSV(e.name, rc, func() { _ = rc.Close() })
+	return e.name, f.cur, nil
+}
+
+func (f *entryFiles) Close() error {
+	if f.cur != nil {
+		_ = f.cur.Close()
+		f.cur = nil
+	}
+	return nil
+}
+
+// tarFiles — файлы tar: поток читается один раз, поэтому следующий файл ищется, когда
+// предыдущий уже загружен. Проверки записей — те же, что у zip, по мере чтения.
+type tarFiles struct {
+	tr      *tar.Reader
+	opts    ArchiveOptions
+	total   archiveTotal
+	entries int
+	pending *tar.Header // первый файл, найденный ещё в openCSVFromTar
+	served  bool
+	close   func()
+}
+
+// scan доходит до следующей подходящей записи; io.EOF — записей больше нет.
+func (t *tarFiles) scan() (*tar.Header, error) {
+	for ; ; t.entries++ {
+		hdr, err := t.tr.Next()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, codedError(CodeArchiveInvalid, "invalid tar archive")
+		}
+		if t.entries >= t.opts.MaxEntries {
+			return nil, t.opts.tooManyEntries()
+		}
+		if err := checkArchiveEntry(hdr.Name, hdr.FileInfo().Mode()); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			return nil, codedError(CodeArchiveInvalid, "link or special file in archive: "+hdr.Name)
+		}
+		if err := t.total.add(uint64(max(hdr.Size, 0))); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && t.opts.archiveMember(hdr.Name) {
+			if err := t.opts.checkEntrySize(hdr.Name, uint64(max(hdr.Size, 0))); err != nil {
+				return nil, err
+			}
+			t.entries++
+			return hdr, nil
+		}
+	}
+}
+
+func (t *tarFiles) next() (string, io.Reader, error) {
+	if t.opts.Single && t.served {
+		// filename=: остаток архива не читаем.
+		return "", nil, io.EOF
+	}
+	t.served = true
+	hdr := t.pending
+	t.pending = nil
+	if hdr == nil {
+		var err error
+		if hdr, err = t.scan(); err != nil {
+			return "", nil, err
+		}
+	}
+	// Заголовку не верим: фактический поток тоже режем по лимиту.
+	return hdr.Name, t.opts.limitCSV(hdr.Name, t.tr, func() {}), nil
+}
+
+func (t *tarFiles) Close() error {
+	t.close()
+	return nil
+}
+
+// lineCounter считает строки прочитанного файла: номера строк следующего файла загрузки
+// продолжают нумерацию, чтобы строка однозначно определялась номером.
+type lineCounter struct {
+	r     io.Reader
+	lines int
+	last  byte
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.lines += bytes.Count(p[:n], []byte{'\n'})
+		c.last = p[n-1]
+	}
+	return n, err
+}
+
+// total — число строк файла, включая последнюю без перевода строки.
+func (c *lineCounter) total() int {
+	if c.last != 0 && c.last != '\n' {
+		return c.lines + 1
+	}
+	return c.lines
+}
+
+// UploadFile — итоги одного CSV-файла загрузки из нескольких файлов.
+type UploadFile struct {
+	Name            string `json:"name"`
+	FirstLine       int    `json:"first_line"` // номера строк — сквозные по всем файлам загрузки
+	LastLine        int    `json:"last_line"`
+	TotalCount      int    `json:"total_count"`
+	TotalItems      int    `json:"total_items"`
+	DuplicatesCount int    `json:"duplicates_count"`
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ------------------------- as_of -------------------------
+
+// as_of= у GET /api/v0/prices и GET /api/v0/stats: данные такими, какими они были в
+// прошлый момент, — без загрузок после него и с теми строками, которые потом удалили
+// (откат импорта, чистка дублей) или изменили (прайс, on_duplicate=replace, переименование).
+// Нужно, чтобы воспроизвести уже опубликованный отчёт. Версии строк хранит prices_history
+// (миграция 023): изменения до миграции не восстанавливаются.
+
+// asOfColumns — колонки prices, общие с prices_history.
+const asOfColumns = `id, product_id, created_at, name, category, price, currency, quantity,
+		unit, unit_size, unit_price, upload_id, backfill, price_list, ignore_date`
+
+// pricesAsOf — подзапрос с версиями строк, текущими в момент $argN, под именем prices:
+// условия where и выборки пишутся так же, как для таблицы. Версия видна, если записана не
+// позже момента (NULL — строка старше истории) и заменена или удалена после него.
+func pricesAsOf(argN int) string {
+	return fmt.Sprintf(`(
+		SELECT %[2]s FROM prices
+		WHERE ingested_at IS NULL OR ingested_at <= $%[1]d
+		UNION ALL
+		SELECT %[2]s FROM prices_history
+		WHERE (ingested_at IS NULL OR ingested_at <= $%[1]d) AND superseded_at > $%[1]d
+	) prices`, argN, asOfColumns)
+}
+
+// parseAsOf читает as_of=: момент в RFC 3339 (2024-03-01T12:00:00Z или с часовым поясом).
+func (f *PriceFilter) parseAsOf(q url.Values) error {
+	s := strings.TrimSpace(q.Get("as_of"))
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fieldError("as_of", s, "expected RFC 3339 timestamp, e.g. 2024-03-01T12:00:00Z")
+	}
+	f.AsOf = t.UTC()
+	return nil
+}
+
+// from — источник строк выборки: prices или, с as_of, prices на тот момент; аргументы
+// нумеруются с argN, условия where — после них.
+func (f PriceFilter) from(argN int) (string, []any) {
+	if f.AsOf.IsZero() {
+		return "prices", nil
+	}
+	return pricesAsOf(argN), []any{f.AsOf}
+}
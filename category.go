@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ------------------------- category hierarchy -------------------------
+
+// Иерархия категорий — без отдельной схемы: категория — путь через "/" (dairy/milk,
+// dairy/cheese), родитель — путь без последнего уровня. Плоские категории поставщиков
+// переводятся в пути при загрузке через CATEGORY_MAP. Отчёты показывают и каждую
+// подкатегорию, и итог по родителю: GET /api/v0/stats/categories, category_depth у
+// aggregate и subcategories=true у фильтра.
+
+// categorySep разделяет уровни пути категории.
+const categorySep = "/"
+
+// maxCategoryDepth — верхняя граница category_depth и depth.
+const maxCategoryDepth = 20
+
+// normalizeCategoryPath убирает пробелы вокруг уровней и пустые уровни: " dairy / milk/" — dairy/milk.
+func normalizeCategoryPath(s string) string {
+	if !strings.Contains(s, categorySep) {
+		return s
+	}
+	var parts []string
+	for _, p := range strings.Split(s, categorySep) {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, categorySep)
+}
+
+// parseCategoryMap разбирает CATEGORY_MAP: пары категория=путь через запятую,
+// milk=dairy/milk,cheese=dairy/cheese. Категория — без учёта регистра и пробелов по краям.
+func parseCategoryMap(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = normalizeKeyPart(from), normalizeCategoryPath(strings.TrimSpace(to))
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("expected category=path pairs separated by commas, got %q", strings.TrimSpace(pair))
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// mapCategory — категория строки после CATEGORY_MAP: путь из словаря или сама категория
+// с нормализованными уровнями. Белый список и категории ключа сверяются уже с результатом.
+func (v ValidationRules) mapCategory(c string) string {
+	if p, ok := v.CategoryMap[normalizeKeyPart(c)]; ok {
+		return p
+	}
+	return normalizeCategoryPath(c)
+}
+
+// categoryDepthExpr — SQL-выражение: первые depth уровней пути колонки column (константа).
+func categoryDepthExpr(column string, depth int) string {
+	return fmt.Sprintf("array_to_string((string_to_array(%s, '%s'))[1:%d], '%s')", column, categorySep, depth, categorySep)
+}
+
+// categoryCond — условие на категорию из списка, а с subtree — и на её подкатегории;
+// аргументы нумеруются с argN.
+func categoryCond(cats []string, subtree bool, argN int) (string, []any) {
+	var args []any
+	cond := "category IN (" + placeholders(argN, len(cats)) + ")"
+	for _, c := range cats {
+		args = append(args, c)
+	}
+	if !subtree {
+		return cond, args
+	}
+	// По одному LIKE на категорию: каждый может идти по prices_category_pattern.
+	conds := []string{cond}
+	for i, c := range cats {
+		conds = append(conds, fmt.Sprintf("category LIKE $%d", argN+len(cats)+i))
+		args = append(args, escapeLike(c)+categorySep+"%")
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// ------------------------- category tree -------------------------
+
+// CategoryNode — категория дерева с итогами по ней вместе с подкатегориями.
+type CategoryNode struct {
+	Category string `json:"category"`         // путь: dairy/milk
+	Parent   string `json:"parent,omitempty"` // пусто — верхний уровень
+	Depth    int    `json:"depth"`            // 1 — верхний уровень
+	Rows     int64  `json:"rows"`             // со всеми подкатегориями
+	// OwnRows — строки ровно этой категории, без подкатегорий.
+	OwnRows int64   `json:"own_rows"`
+	Sum     float64 `json:"sum"`
+	Avg     float64 `json:"avg"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+}
+
+// handleCategoryTree отдаёт дерево категорий выборки: у каждого пути — итоги по нему
+// вместе с подкатегориями, dairy — это dairy/milk и dairy/cheese вместе. depth — сколько
+// уровней показать (глубже — в итогах предков), по умолчанию все.
+func handleCategoryTree(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var errs ValidationErrors
+		depth := intParam(q, "depth", "", maxCategoryDepth, 1, maxCategoryDepth, &errs)
+		f, filterErr := parseRequestFilter(r)
+		page, pageErr := parsePage(q, 1000, 10000)
+		if err := mergeErrors(errs.err(), filterErr, pageErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		nodes, err := categoryTree(r.Context(), db, f, depth)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		total := len(nodes)
+		nodes = nodes[min(page.Offset, total):min(page.Offset+page.Limit, total)]
+
+		filters := f.echo()
+		if q.Get("depth") != "" {
+			filters["depth"] = depth
+		}
+		writeList(w, r, nodes, len(nodes), total, page, filters)
+	}
+}
+
+// categoryTree считает итоги по каждой категории выборки и складывает их в предков.
+// Родитель в выдаче стоит перед своими подкатегориями.
+func categoryTree(ctx context.Context, db *sql.DB, f PriceFilter, depth int) ([]CategoryNode, error) {
+	// Итоги по категориям есть в дневном предагрегате, если фильтр его допускает.
+	source, metrics := "prices", "COUNT(*), SUM(price), MIN(price), MAX(price)"
+	if f.rollupCompatible() {
+		source, metrics = "prices_daily_rollup", "SUM(rows), SUM(total_price), MIN(min_price), MAX(max_price)"
+	}
+	cond, args := f.where(1)
+	rows, err := db.QueryContext(ctx, "SELECT category, "+metrics+" FROM "+source+" WHERE 1=1"+cond+" GROUP BY category", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byPath := map[string]*CategoryNode{}
+	for rows.Next() {
+		var (
+			category        string
+			n               int64
+			sum, minP, maxP float64
+		)
+		if err := rows.Scan(&category, &n, &sum, &minP, &maxP); err != nil {
+			return nil, err
+		}
+		parts := strings.Split(category, categorySep)
+		for i := range min(len(parts), depth) {
+			path := strings.Join(parts[:i+1], categorySep)
+			node, ok := byPath[path]
+			if !ok {
+				node = &CategoryNode{Category: path, Parent: strings.Join(parts[:i], categorySep), Depth: i + 1, Min: minP, Max: maxP}
+				byPath[path] = node
+			}
+			node.Rows += n
+			node.Sum += sum
+			node.Min, node.Max = min(node.Min, minP), max(node.Max, maxP)
+			if path == category {
+				node.OwnRows += n
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]CategoryNode, 0, len(byPath))
+	for _, node := range byPath {
+		if node.Rows > 0 {
+			node.Avg = math.Round(node.Sum/float64(node.Rows)*100) / 100
+		}
+		node.Sum = math.Round(node.Sum*100) / 100
+		out = append(out, *node)
+	}
+	slices.SortFunc(out, func(a, b CategoryNode) int {
+		return slices.Compare(strings.Split(a.Category, categorySep), strings.Split(b.Category, categorySep))
+	})
+	return out, nil
+}
@@ -0,0 +1,180 @@
+// Package client — Go-клиент сервиса цен: загрузка архивов и CSV, выгрузка с фильтрами
+// и сводная статистика. Повторяет запросы при сетевых сбоях и перегрузке сервера.
+//
+//	c := client.New("http://localhost:8080")
+//	res, err := c.UploadCSV(ctx, f, client.UploadOptions{})
+//	err = c.Query(ctx, client.Filter{Categories: []string{"food"}}, func(p client.Price) error { ... })
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------- client -------------------------
+
+// Client — клиент API. Поля можно менять после New, но не во время запросов.
+type Client struct {
+	BaseURL    string       // например http://localhost:8080, без /api/v0
+	HTTPClient *http.Client // по умолчанию http.DefaultClient; таймауты лучше задавать через ctx
+	Header     http.Header  // добавляется к каждому запросу, например Authorization или X-API-Key
+
+	MaxRetries int           // повторов после первой попытки, по умолчанию 3
+	RetryWait  time.Duration // пауза перед первым повтором, дальше удваивается; по умолчанию 500ms
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		Header:     http.Header{},
+		MaxRetries: 3,
+		RetryWait:  500 * time.Millisecond,
+	}
+}
+
+// APIError — ответ сервера с ошибкой. Code — стабильный код из openapi.yaml.
+type APIError struct {
+	StatusCode int
+	Code       string       `json:"code"`
+	Message    string       `json:"error"`
+	Fields     []FieldError `json:"fields,omitempty"`
+}
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("prices api: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsCode сообщает, что err — ошибка API с кодом code.
+func IsCode(err error, code string) bool {
+	var ae *APIError
+	return errors.As(err, &ae) && ae.Code == code
+}
+
+// request — один вызов API; body вызывается заново на каждую попытку.
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	header      http.Header
+	contentType string
+	body        func() (io.Reader, error) // nil — без тела
+	replayable  bool                      // тело можно отправить повторно
+	idempotent  bool                      // повтор безопасен и после ответа 500
+}
+
+// do выполняет запрос с повторами и возвращает ответ 2xx; остальные статусы — *APIError.
+// Повторяем сетевые ошибки, 429, 502, 503, 504, а для идемпотентных запросов и 500.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	u := c.BaseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req, u)
+		if err == nil && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+
+		retry := attempt < c.MaxRetries && (req.body == nil || req.replayable) && ctx.Err() == nil
+		if err != nil {
+			if !retry {
+				return nil, err
+			}
+		} else {
+			apiErr := readAPIError(resp)
+			if !retry || !retryStatus(resp.StatusCode, req.idempotent) {
+				return nil, apiErr
+			}
+			if d, ok := retryAfter(resp); ok {
+				wait = d
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request, u string) (*http.Response, error) {
+	var body io.Reader
+	if req.body != nil {
+		b, err := req.body()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	hr, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		hr.Header[k] = v
+	}
+	for k, v := range req.header {
+		hr.Header[k] = v
+	}
+	if req.contentType != "" {
+		hr.Header.Set("Content-Type", req.contentType)
+	}
+	return c.HTTPClient.Do(hr)
+}
+
+func retryStatus(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusInternalServerError:
+		return idempotent
+	}
+	return false
+}
+
+// retryAfter читает Retry-After в секундах.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	s, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || s < 0 {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+func readAPIError(resp *http.Response) error {
+	defer resp.Body.Close()
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(b, apiErr) != nil || apiErr.Code == "" {
+		apiErr.Code = "INTERNAL"
+		apiErr.Message = strings.TrimSpace(string(b))
+	}
+	return apiErr
+}
+
+func decodeJSON(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("prices api: decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package client
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ------------------------- filter -------------------------
+
+// Filter — фильтры GET /api/v0/prices и /api/v0/aggregate; нулевые поля не передаются.
+type Filter struct {
+	Start, End        time.Time // по дате создания, включительно
+	Min, Max          int       // цена в основных единицах, > 0
+	Categories        []string
+	ExcludeCategories []string
+	Subcategories     bool        // Categories и ExcludeCategories — вместе с подкатегориями (dairy — и dairy/milk)
+	Dates             []time.Time // конкретные дни
+	NamePrefix        string
+	NameExact         string
+	Unit              string // только строки с этой базовой единицей: l, kg, m или pc (схема 3)
+	Limit, Offset     int    // постраничная выгрузка; Limit = 0 — всё
+	// AsOf — выгрузить данные такими, какими они были в этот момент. Только Query и
+	// Download: Stats считает по текущим данным.
+	AsOf time.Time
+}
+
+func (f Filter) values() url.Values {
+	q := url.Values{}
+	setDate(q, "start", f.Start)
+	setDate(q, "end", f.End)
+	setInt(q, "min", f.Min)
+	setInt(q, "max", f.Max)
+	for _, c := range f.Categories {
+		q.Add("category", c)
+	}
+	for _, c := range f.ExcludeCategories {
+		q.Add("exclude_category", c)
+	}
+	if f.Subcategories {
+		q.Set("subcategories", "true")
+	}
+	if len(f.Dates) > 0 {
+		dates := make([]string, len(f.Dates))
+		for i, d := range f.Dates {
+			dates[i] = d.Format(time.DateOnly)
+		}
+		q.Set("dates", strings.Join(dates, ","))
+	}
+	setString(q, "name_prefix", f.NamePrefix)
+	setString(q, "name_exact", f.NameExact)
+	if f.Unit != "" {
+		q.Add("filter", `unit:eq("`+strings.ReplaceAll(f.Unit, `"`, `""`)+`")`)
+	}
+	setInt(q, "limit", f.Limit)
+	setInt(q, "offset", f.Offset)
+	if !f.AsOf.IsZero() {
+		q.Set("as_of", f.AsOf.UTC().Format(time.RFC3339))
+	}
+	return q
+}
+
+func setString(q url.Values, key, v string) {
+	if v != "" {
+		q.Set(key, v)
+	}
+}
+
+func setInt(q url.Values, key string, v int) {
+	if v != 0 {
+		q.Set(key, strconv.Itoa(v))
+	}
+}
+
+func setDate(q url.Values, key string, t time.Time) {
+	if !t.IsZero() {
+		q.Set(key, t.Format(time.DateOnly))
+	}
+}
+
+// ------------------------- query -------------------------
+
+// Price — строка выгрузки.
+type Price struct {
+	ID        int64
+	Name      string
+	Category  string
+	Price     float64
+	CreatedAt time.Time
+}
+
+// Query выгружает строки по фильтру и вызывает fn для каждой по мере чтения ответа,
+// не собирая выгрузку в памяти. Ошибка fn прерывает выгрузку и возвращается как есть.
+func (c *Client) Query(ctx context.Context, f Filter, fn func(Price) error) error {
+	q := f.values()
+	// zst читается потоком, в отличие от zip; экранирование формул клиенту не нужно.
+	q.Set("format", "zst")
+	q.Set("formula_escape", "false")
+
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/v0/prices", query: q, idempotent: true})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	cr := csv.NewReader(dec)
+	cr.FieldsPerRecord = 5
+	if _, err := cr.Read(); err != nil { // заголовок
+		return fmt.Errorf("prices api: read export: %w", err)
+	}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// В т.ч. оборванный сервером поток: неполную выгрузку за целую не примем.
+			return fmt.Errorf("prices api: read export: %w", err)
+		}
+		p, err := parsePrice(rec)
+		if err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+}
+
+func parsePrice(rec []string) (Price, error) {
+	var (
+		p   = Price{Name: rec[1], Category: rec[2]}
+		err error
+	)
+	if p.ID, err = strconv.ParseInt(rec[0], 10, 64); err != nil {
+		return p, fmt.Errorf("prices api: bad id %q", rec[0])
+	}
+	if p.Price, err = strconv.ParseFloat(rec[3], 64); err != nil {
+		return p, fmt.Errorf("prices api: bad price %q", rec[3])
+	}
+	if p.CreatedAt, err = time.Parse(time.DateOnly, rec[4]); err != nil {
+		return p, fmt.Errorf("prices api: bad create_date %q", rec[4])
+	}
+	return p, nil
+}
+
+// DownloadOptions — оформление выгружаемого архива, см. параметры GET /api/v0/prices.
+type DownloadOptions struct {
+	Format     string // zip (по умолчанию), zst или csv — data.csv без архива
+	Headers    string // схема заголовков из EXPORT_HEADERS
+	QuoteAll   bool
+	CRLF       bool
+	Password   string // зашифровать zip, уходит в X-Export-Password
+	Sign       bool
+	RawFormula bool    // не экранировать формулы
+	Sample     float64 // доля строк, 0 < Sample <= 1; 0 — все
+	SampleSeed int64   // с тем же seed выгружаются те же строки
+}
+
+// Download пишет архив выгрузки в w как есть, например в файл для пересылки.
+// Повторы возможны только до начала ответа; оборванная выгрузка возвращает ошибку.
+func (c *Client) Download(ctx context.Context, f Filter, opts DownloadOptions, w io.Writer) (int64, error) {
+	q := f.values()
+	setString(q, "format", opts.Format)
+	setString(q, "headers", opts.Headers)
+	if opts.QuoteAll {
+		q.Set("quote", "always")
+	}
+	if opts.CRLF {
+		q.Set("line_ending", "crlf")
+	}
+	if opts.Sign {
+		q.Set("sign", "true")
+	}
+	if opts.RawFormula {
+		q.Set("formula_escape", "false")
+	}
+	if opts.Sample > 0 {
+		q.Set("sample", strconv.FormatFloat(opts.Sample, 'g', -1, 64))
+		q.Set("sample_seed", strconv.FormatInt(opts.SampleSeed, 10))
+	}
+	header := http.Header{}
+	if opts.Password != "" {
+		header.Set("X-Export-Password", opts.Password)
+	}
+
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/v0/prices", query: q, header: header, idempotent: true})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// ------------------------- stats -------------------------
+
+// Stats — сводка по ценам, подходящим под фильтр.
+type Stats struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Avg   float64 `json:"avg"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// Stats считает количество, сумму, среднее, минимум и максимум цены через /api/v0/aggregate.
+// Limit и Offset фильтра не учитываются.
+func (c *Client) Stats(ctx context.Context, f Filter) (*Stats, error) {
+	q := f.values()
+	q.Del("limit")
+	q.Del("offset")
+	q.Del("as_of")
+	q.Set("metrics", "count,sum,avg,min,max")
+
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/v0/aggregate", query: q, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	var env struct {
+		Data []Stats `json:"data"`
+	}
+	if err := decodeJSON(resp, &env); err != nil {
+		return nil, err
+	}
+	if len(env.Data) == 0 {
+		return &Stats{}, nil
+	}
+	return &env.Data[0], nil
+}
+
+// UnitStats — цена за единицу по одной базовой единице: сравнивать 0,5 и 1 л по ней, а не по цене.
+type UnitStats struct {
+	Unit  string  `json:"unit"` // l, kg, m или pc
+	Count int64   `json:"count"`
+	Avg   float64 `json:"avg_unit_price"`
+	Min   float64 `json:"min_unit_price"`
+	Max   float64 `json:"max_unit_price"`
+}
+
+// UnitStats считает среднюю, минимальную и максимальную цену за единицу по каждой единице
+// через /api/v0/aggregate?group_by=unit. Строки без единицы не входят.
+func (c *Client) UnitStats(ctx context.Context, f Filter) ([]UnitStats, error) {
+	q := f.values()
+	q.Del("limit")
+	q.Del("offset")
+	q.Del("as_of")
+	q.Set("group_by", "unit")
+	q.Set("metrics", "count,avg_unit_price,min_unit_price,max_unit_price")
+
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/v0/aggregate", query: q, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	var env struct {
+		Data []UnitStats `json:"data"`
+	}
+	if err := decodeJSON(resp, &env); err != nil {
+		return nil, err
+	}
+	out := []UnitStats{}
+	for _, s := range env.Data {
+		if s.Unit != "" {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// ------------------------- category tree -------------------------
+
+// CategoryNode — категория-путь (dairy/milk) с итогами вместе с подкатегориями.
+type CategoryNode struct {
+	Category string  `json:"category"`
+	Parent   string  `json:"parent"` // пусто — верхний уровень
+	Depth    int     `json:"depth"`
+	Rows     int64   `json:"rows"`
+	OwnRows  int64   `json:"own_rows"` // строки ровно этой категории
+	Sum      float64 `json:"sum"`
+	Avg      float64 `json:"avg"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+}
+
+// CategoryTree возвращает дерево категорий под фильтром через /api/v0/stats/categories:
+// родитель перед подкатегориями. depth — сколько уровней, 0 — все. Limit и Offset фильтра
+// листают узлы (по умолчанию первые 1000).
+func (c *Client) CategoryTree(ctx context.Context, f Filter, depth int) ([]CategoryNode, error) {
+	q := f.values()
+	q.Del("as_of")
+	setInt(q, "depth", depth)
+
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/v0/stats/categories", query: q, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	var env struct {
+		Data []CategoryNode `json:"data"`
+	}
+	if err := decodeJSON(resp, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
@@ -0,0 +1,442 @@
+package client
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ------------------------- upload -------------------------
+
+// UploadOptions — параметры POST /api/v0/prices; пустые поля не передаются.
+type UploadOptions struct {
+	Type       string // zip, tar, zst, tar.zst, gzip, tar.gz, xz, tar.xz, 7z, csv, xlsx, json, ndjson; пусто — сервер определит по сигнатуре
+	Dedupe     string // full, no_date или price_list
+	Files      string // шаблон имён CSV-файлов архива, например prices_*.csv; пусто — ARCHIVE_FILES сервера
+	Filename   string // один файл архива по имени или шаблону, вместо Files
+	Sheet      string // лист книги для Type "xlsx": имя или номер с 1; пусто — первый
+	MaxDepth   int
+	MaxEntries int
+	Password   string // пароль зашифрованного архива, уходит в X-Archive-Password
+	Schema     string // версия раскладки CSV (X-Schema-Version): 1 — 5 колонок, 2 — с currency и quantity, 3 — ещё с unit и unit_size
+	Supplier   string // поставщик для статистики загрузок (X-Supplier)
+	HasHeader  string // true, false или auto: заголовок ли первая строка каждого CSV-файла
+	Columns    string // strict, trim_empty, ignore_extra или reject_file: что делать с лишними колонками
+	Delimiter  string // auto, comma, semicolon, tab или pipe; пусто — CSV_DELIMITER сервера
+	Encoding   string // auto, utf-8, windows-1251, koi8-r, utf-16le или utf-16be; пусто — CSV_ENCODING сервера
+	// DateFormats — форматы create_date через запятую, например "YYYY-MM-DD,DD.MM.YYYY".
+	DateFormats string
+	// LazyQuotes — допускать неэкранированные кавычки внутри поля.
+	LazyQuotes bool
+	// OnDuplicate — skip, replace или error: что делать со строкой, которая уже есть в БД.
+	// При error такая строка отменяет загрузку с *APIError (409, CONFLICT).
+	OnDuplicate string
+	// IdempotencyKey уходит в Idempotency-Key: повтор с тем же ключом получает ответ
+	// исходной загрузки, а не загружает файл заново.
+	IdempotencyKey string
+	// ReportConflicts — вернуть в UploadResult.Conflicts строки, уже бывшие в БД.
+	ReportConflicts bool
+	// Backfill — перенос истории без окна дат; нужен Authorization: Bearer ADMIN_TOKEN в Config.Header.
+	Backfill bool
+	// Quarantine — строки ждут проверки (UploadResult.Status "pending") и попадут в базу после approve.
+	Quarantine bool
+	// Detach — сервер доведёт загрузку до конца, даже если ctx отменят раньше ответа.
+	Detach bool
+	// SplitCounts — заполнить FileDuplicates, DBDuplicates и InvalidRows в UploadResult.
+	SplitCounts bool
+}
+
+// UploadResult — статистика загрузки.
+type UploadResult struct {
+	TotalCount      int     `json:"total_count"`
+	DuplicatesCount int     `json:"duplicates_count"`
+	TotalItems      int     `json:"total_items"`
+	TotalCategories int     `json:"total_categories"`
+	TotalProducts   int     `json:"total_products"`
+	TotalPrice      float64 `json:"total_price"`
+
+	// Inserted — итоги только по строкам, вставленным загрузкой; nil, если вставок не было.
+	Inserted *InsertedStats `json:"inserted"`
+
+	// NewCategories — категории, впервые появившиеся в БД с этой загрузкой: частая причина —
+	// опечатка в категории у поставщика.
+	NewCategories []NewCategory `json:"new_categories"`
+
+	// FirstDate и LastDate — период create_date в БД после загрузки, YYYY-MM-DD.
+	FirstDate string `json:"first_date"`
+	LastDate  string `json:"last_date"`
+
+	// Только при SplitCounts: слагаемые DuplicatesCount.
+	FileDuplicates int `json:"file_duplicates"`
+	DBDuplicates   int `json:"db_duplicates"`
+	InvalidRows    int `json:"invalid_rows"`
+
+	// UpdatedCount — только при Dedupe "price_list" (строки прайса, у которых изменилась цена)
+	// и OnDuplicate "replace" (обновлённые строки БД).
+	UpdatedCount int `json:"updated_count"`
+
+	// UploadID — номер загрузки. Только при Quarantine: её статус и сколько строк ждёт проверки.
+	UploadID    int64  `json:"upload_id"`
+	Status      string `json:"status"`
+	StagedCount int    `json:"staged_count"`
+
+	// RejectedURL не пуст, если отклонённые строки можно скачать (DownloadRejected).
+	RejectedURL string `json:"rejected_url"`
+
+	// DuplicateUpload — тот же архив недавно уже загружался; поля выше — из исходной загрузки.
+	DuplicateUpload  bool  `json:"duplicate_upload"`
+	OriginalUploadID int64 `json:"original_upload_id"`
+
+	Conflicts          []Conflict `json:"conflicts"`
+	ConflictsTruncated bool       `json:"conflicts_truncated"`
+
+	// Errors — отклонённые строки с причиной (не больше ROW_ERRORS_LIMIT сервера).
+	Errors          []RowError `json:"errors"`
+	ErrorsTruncated bool       `json:"errors_truncated"`
+
+	// RejectReasons — сколько строк отклонено по каждой причине; AdjustedRows — сколько принятых
+	// строк исправлено по Columns (trailing_empty_columns, extra_columns).
+	RejectReasons map[string]int `json:"reject_reasons"`
+	AdjustedRows  map[string]int `json:"adjusted_rows"`
+
+	// Files — итоги по файлам, только если в архиве их было больше одного.
+	Files []UploadFile `json:"files"`
+}
+
+// UploadFile — итоги одного CSV-файла архива. Номера строк сквозные по всей загрузке,
+// как и RowError.Line.
+type UploadFile struct {
+	Name            string `json:"name"`
+	FirstLine       int    `json:"first_line"`
+	LastLine        int    `json:"last_line"`
+	TotalCount      int    `json:"total_count"`
+	TotalItems      int    `json:"total_items"`
+	DuplicatesCount int    `json:"duplicates_count"`
+}
+
+// NewCategory — новая категория и сколько строк в неё вставлено.
+type NewCategory struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+}
+
+// RowError — строка data.csv, не попавшая в базу. Reason — например invalid_price,
+// duplicate_in_file или duplicate_in_db.
+type RowError struct {
+	Line   int      `json:"line"`
+	Values []string `json:"values"`
+	Reason string   `json:"reason"`
+}
+
+// Conflict — строка файла, совпавшая с уже сохранёнными строками DBIDs.
+type Conflict struct {
+	Line       int     `json:"line"`
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	CreateDate string  `json:"create_date"`
+	DBIDs      []int64 `json:"db_ids"`
+}
+
+// Job — фоновая загрузка, см. UploadZipAsync.
+type Job struct {
+	ID            string        `json:"id"`
+	Status        string        `json:"status"` // queued, running, done или failed
+	ProcessedRows int64         `json:"processed_rows"`
+	HTTPStatus    int           `json:"http_status"`
+	Result        *UploadResult `json:"result"` // при done
+	Error         *APIError     `json:"error"`  // при failed; StatusCode — из HTTPStatus
+	CreatedAt     time.Time     `json:"created_at"`
+	StartedAt     *time.Time    `json:"started_at"`
+	FinishedAt    *time.Time    `json:"finished_at"`
+}
+
+// UploadZip загружает готовый архив (тип — opts.Type или по сигнатуре).
+// Если archive — io.ReadSeeker (например *os.File), при сбоях запрос повторяется.
+// Повторная загрузка безопасна: строки, уже попавшие в базу, учитываются как дубли.
+func (c *Client) UploadZip(ctx context.Context, archive io.Reader, opts UploadOptions) (*UploadResult, error) {
+	resp, err := c.do(ctx, uploadRequest(archive, opts, false))
+	if err != nil {
+		return nil, err
+	}
+	var res UploadResult
+	return &res, decodeJSON(resp, &res)
+}
+
+// UploadZipAsync отправляет архив на фоновый разбор (async=true) и сразу возвращает задачу;
+// итоги — через Job. При заполненной очереди запрос повторяется, как и при других 503.
+func (c *Client) UploadZipAsync(ctx context.Context, archive io.Reader, opts UploadOptions) (*Job, error) {
+	resp, err := c.do(ctx, uploadRequest(archive, opts, true))
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	return &job, decodeJSON(resp, &job)
+}
+
+// Job возвращает состояние фоновой загрузки.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/v0/jobs/" + url.PathEscape(id), idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := decodeJSON(resp, &job); err != nil {
+		return nil, err
+	}
+	if job.Error != nil {
+		job.Error.StatusCode = job.HTTPStatus
+	}
+	return &job, nil
+}
+
+// InsertedStats — цены строк, вставленных загрузкой.
+type InsertedStats struct {
+	Rows       int      `json:"rows"`
+	Sum        float64  `json:"sum"`
+	Avg        float64  `json:"avg"`
+	Min        float64  `json:"min"`
+	Max        float64  `json:"max"`
+	Categories []string `json:"categories"`
+}
+
+// ImportRollback — итог RollbackImport.
+type ImportRollback struct {
+	UploadID    int64  `json:"upload_id"`
+	Status      string `json:"status"`
+	DeletedRows int64  `json:"deleted_rows"`
+}
+
+// RollbackImport удаляет строки, вставленные загрузкой uploadID; нужен Authorization: Bearer
+// ADMIN_TOKEN в Config.Header. Загрузку, обновившую существующие строки, сервер не откатывает (409).
+func (c *Client) RollbackImport(ctx context.Context, uploadID int64) (*ImportRollback, error) {
+	resp, err := c.do(ctx, request{method: http.MethodDelete, path: "/api/v0/imports/" + strconv.FormatInt(uploadID, 10)})
+	if err != nil {
+		return nil, err
+	}
+	var res ImportRollback
+	return &res, decodeJSON(resp, &res)
+}
+
+// DownloadRejected пишет в w rejected.csv загрузки uploadID: отклонённые строки и колонку reason.
+func (c *Client) DownloadRejected(ctx context.Context, uploadID int64, w io.Writer) (int64, error) {
+	path := "/api/v0/imports/" + strconv.FormatInt(uploadID, 10) + "/rejected"
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: path, idempotent: true})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// RejectGroup — отклонённые строки с одной причиной в одной колонке.
+type RejectGroup struct {
+	Reason      string `json:"reason"`
+	Column      string `json:"column,omitempty"`       // пусто — причина во всей строке
+	ColumnIndex int    `json:"column_index,omitempty"` // номер колонки в файле, с 1
+	Rows        int    `json:"rows"`
+	FirstLines  []int  `json:"first_lines,omitempty"`
+	Message     string `json:"message"`
+}
+
+// UploadSummary — отчёт о качестве файла загрузки.
+type UploadSummary struct {
+	UploadID      int64          `json:"upload_id"`
+	TotalCount    int            `json:"total_count"`
+	TotalItems    int            `json:"total_items"`
+	RejectedCount int            `json:"rejected_count"`
+	Reasons       []RejectGroup  `json:"reasons"`
+	ByReason      map[string]int `json:"by_reason"`
+	ByColumn      []struct {
+		Column      string `json:"column"`
+		ColumnIndex int    `json:"column_index"`
+		Rows        int    `json:"rows"`
+	} `json:"by_column"`
+	RejectedURL string    `json:"rejected_url,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// Import просит сервер скачать файл по fileURL (http или https) и загрузить его, как UploadZip:
+// тип — opts.Type или по ответу сервера с файлом. Файл не проходит через клиента.
+// С opts.Detach загрузка не прервётся, если ответа не дождаться.
+func (c *Client) Import(ctx context.Context, fileURL string, opts UploadOptions) (*UploadResult, error) {
+	resp, err := c.do(ctx, importRequest(map[string]string{"url": fileURL}, opts, false))
+	if err != nil {
+		return nil, err
+	}
+	var res UploadResult
+	return &res, decodeJSON(resp, &res)
+}
+
+// ImportAsync — Import с фоновым разбором (async=true): ответ приходит, как только файл
+// скачан и проверен; итоги — через Job.
+func (c *Client) ImportAsync(ctx context.Context, fileURL string, opts UploadOptions) (*Job, error) {
+	resp, err := c.do(ctx, importRequest(map[string]string{"url": fileURL}, opts, true))
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	return &job, decodeJSON(resp, &job)
+}
+
+// ImportS3 просит сервер загрузить объект key из бакета bucket хранилища S3 или MinIO,
+// настроенного на сервере (S3_ENDPOINT и ключи доступа). Ответ — как у UploadZip.
+func (c *Client) ImportS3(ctx context.Context, bucket, key string, opts UploadOptions) (*UploadResult, error) {
+	resp, err := c.do(ctx, importRequest(map[string]string{"bucket": bucket, "key": key}, opts, false))
+	if err != nil {
+		return nil, err
+	}
+	var res UploadResult
+	return &res, decodeJSON(resp, &res)
+}
+
+// importRequest: source — url или bucket и key.
+func importRequest(source map[string]string, opts UploadOptions, async bool) request {
+	// Параметры — те же, что у загрузки, но тип передаётся в теле вместе с источником.
+	req := uploadRequest(nil, opts, async)
+	req.query.Del("type")
+	source["type"] = opts.Type
+	body, _ := json.Marshal(source)
+	req.path, req.contentType, req.replayable = "/api/v0/prices/import", "application/json", true
+	req.body = func() (io.Reader, error) { return bytes.NewReader(body), nil }
+	return req
+}
+
+// UploadSummary возвращает отклонённые строки загрузки uploadID по причине и колонке.
+func (c *Client) UploadSummary(ctx context.Context, uploadID int64) (*UploadSummary, error) {
+	path := "/api/v0/uploads/" + strconv.FormatInt(uploadID, 10) + "/summary"
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: path, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	var s UploadSummary
+	return &s, decodeJSON(resp, &s)
+}
+
+func uploadRequest(archive io.Reader, opts UploadOptions, async bool) request {
+	q := url.Values{}
+	setString(q, "type", opts.Type)
+	setString(q, "dedupe", opts.Dedupe)
+	setString(q, "files", opts.Files)
+	setString(q, "filename", opts.Filename)
+	setString(q, "sheet", opts.Sheet)
+	setString(q, "has_header", opts.HasHeader)
+	setString(q, "columns", opts.Columns)
+	setString(q, "delimiter", opts.Delimiter)
+	setString(q, "encoding", opts.Encoding)
+	setString(q, "date_formats", opts.DateFormats)
+	setString(q, "on_duplicate", opts.OnDuplicate)
+	setInt(q, "max_depth", opts.MaxDepth)
+	setInt(q, "max_entries", opts.MaxEntries)
+	if opts.ReportConflicts {
+		q.Set("report_conflicts", "true")
+	}
+	if opts.LazyQuotes {
+		q.Set("lazy_quotes", "true")
+	}
+	if opts.Backfill {
+		q.Set("backfill", "true")
+	}
+	if opts.Quarantine {
+		q.Set("quarantine", "true")
+	}
+	if opts.Detach {
+		q.Set("detach", "true")
+	}
+	if opts.SplitCounts {
+		q.Set("split_counts", "true")
+	}
+	if async {
+		q.Set("async", "true")
+	}
+
+	req := request{
+		method:      http.MethodPost,
+		path:        "/api/v0/prices",
+		query:       q,
+		header:      http.Header{},
+		contentType: "application/octet-stream",
+		// NopCloser: транспорт закрывает тело запроса, а reader принадлежит вызывающему.
+		body: func() (io.Reader, error) { return io.NopCloser(archive), nil },
+	}
+	if s, ok := archive.(io.ReadSeeker); ok {
+		req.replayable = true
+		req.body = func() (io.Reader, error) {
+			_, err := s.Seek(0, io.SeekStart)
+			return io.NopCloser(s), err
+		}
+	}
+	if opts.Password != "" {
+		req.header.Set("X-Archive-Password", opts.Password)
+	}
+	if opts.Schema != "" {
+		req.header.Set("X-Schema-Version", opts.Schema)
+	}
+	if opts.Supplier != "" {
+		req.header.Set("X-Supplier", opts.Supplier)
+	}
+	if opts.IdempotencyKey != "" {
+		req.header.Set("Idempotency-Key", opts.IdempotencyKey)
+	}
+	return req
+}
+
+// UploadCSV упаковывает data.csv в zip и загружает его. Архив собирается во временном
+// файле, поэтому повторы работают и для потокового csv.
+func (c *Client) UploadCSV(ctx context.Context, csv io.Reader, opts UploadOptions) (*UploadResult, error) {
+	f, err := os.CreateTemp("", "prices-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	zw := zip.NewWriter(f)
+	fw, err := zw.Create("data.csv")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(fw, csv); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	opts.Type, opts.Password = "zip", ""
+	return c.UploadZip(ctx, f, opts)
+}
+
+// UploadItem — строка цены для UploadJSON; поля — колонки схемы загрузки.
+type UploadItem struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	CreateDate string  `json:"create_date"`         // в формате из date_formats, по умолчанию YYYY-MM-DD
+	Currency   string  `json:"currency,omitempty"`  // схемы 2 и 3
+	Quantity   float64 `json:"quantity,omitempty"`  // схемы 2 и 3
+	Unit       string  `json:"unit,omitempty"`      // только схема 3: l, ml, kg, g, m, cm, pcs…
+	UnitSize   float64 `json:"unit_size,omitempty"` // только схема 3: 0.5 — бутылка 0,5 л при unit l
+}
+
+// UploadJSON загружает строки без CSV и архива: массивом JSON (type=json). Ответ — тот же,
+// что у UploadZip; line в Errors — номер элемента items, с 1.
+func (c *Client) UploadJSON(ctx context.Context, items []UploadItem, opts UploadOptions) (*UploadResult, error) {
+	b, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	opts.Type, opts.Password = "json", ""
+	return c.UploadZip(ctx, bytes.NewReader(b), opts)
+}
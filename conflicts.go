@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- duplicate conflicts -------------------------
+
+// Conflict — строка файла, которая не вставлена, потому что такая строка уже есть в БД.
+type Conflict struct {
+	Line       int     `json:"line"` // номер строки в data.csv, с 1
+	InputID    string  `json:"id"`   // id из файла
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	CreateDate string  `json:"create_date"`
+	DBIDs      []int64 `json:"db_ids"` // id совпавших строк в БД
+}
+
+// conflictingIDsTx ищет строки БД, с которыми столкнулась r, по тому же ключу, что и insertPricesTx:
+// в режиме no_date — любая строка с теми же name, category и price, иначе — ещё и с той же датой;
+// name и category сравниваются без учёта регистра и пробелов по краям. В режиме price_list к ним
+// добавляется строка прайса того же товара за ту же дату с той же ценой.
+func conflictingIDsTx(ctx context.Context, tx *sql.Tx, r PriceRow, opts IngestOptions) ([]int64, error) {
+	const key = `lower(trim(name)) = lower(trim($1)) AND lower(trim(category)) = lower(trim($2)) AND price = $3`
+	q := `SELECT id FROM prices WHERE ` + key + ` AND created_at = $4::date ORDER BY id`
+	args := []any{r.Name, r.Category, r.Price, r.CreatedAt}
+	switch {
+	case opts.IgnoreDate:
+		q = `SELECT id FROM prices WHERE ` + key + ` ORDER BY id LIMIT 100`
+		args = args[:3]
+	case opts.PriceList:
+		q = `SELECT id FROM prices WHERE created_at = $4::date AND (` + key + ` OR (price_list AND product_id = $5
+			AND lower(trim(category)) = lower(trim($2)) AND price = $3)) ORDER BY id`
+		args = append(args, r.InputID)
+	}
+	var ids []int64
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(array_agg(id), '{}') FROM (`+q+`) t`, args...).Scan(pq.Array(&ids)); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
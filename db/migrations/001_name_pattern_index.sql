@@ -0,0 +1,3 @@
+-- Индекс для name_prefix / name_exact: text_pattern_ops позволяет использовать btree для LIKE 'abc%'
+-- независимо от collation базы.
+CREATE INDEX IF NOT EXISTS idx_prices_name_pattern ON prices (name text_pattern_ops);
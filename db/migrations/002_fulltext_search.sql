@@ -0,0 +1,11 @@
+-- Полнотекстовый поиск по name/category сразу в русской и английской конфигурациях.
+-- Генерируемая колонка пересчитывается самой БД при вставке и при переименовании.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS search_tsv tsvector
+  GENERATED ALWAYS AS (
+    setweight(to_tsvector('russian'::regconfig, name), 'A') ||
+    setweight(to_tsvector('english'::regconfig, name), 'A') ||
+    setweight(to_tsvector('russian'::regconfig, category), 'B') ||
+    setweight(to_tsvector('english'::regconfig, category), 'B')
+  ) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_prices_search ON prices USING GIN (search_tsv);
@@ -0,0 +1,4 @@
+-- Нечёткий поиск имён по триграммам (pg_trgm — trusted-расширение, владельцу БД хватает прав).
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_prices_name_trgm ON prices USING GIN (name gin_trgm_ops);
@@ -0,0 +1,24 @@
+-- Предагрегаты по категориям за день и за месяц. Колонка даты называется created_at,
+-- чтобы к ним применялись те же фильтры, что и к prices.
+-- Уникальные индексы нужны для REFRESH MATERIALIZED VIEW CONCURRENTLY.
+CREATE MATERIALIZED VIEW IF NOT EXISTS prices_daily_rollup AS
+SELECT created_at, category,
+       COUNT(*)   AS rows,
+       SUM(price) AS total_price,
+       MIN(price) AS min_price,
+       MAX(price) AS max_price
+FROM prices
+GROUP BY created_at, category;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_prices_daily_rollup ON prices_daily_rollup (created_at, category);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS prices_monthly_rollup AS
+SELECT date_trunc('month', created_at)::date AS created_at, category,
+       COUNT(*)   AS rows,
+       SUM(price) AS total_price,
+       MIN(price) AS min_price,
+       MAX(price) AS max_price
+FROM prices
+GROUP BY 1, category;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_prices_monthly_rollup ON prices_monthly_rollup (created_at, category);
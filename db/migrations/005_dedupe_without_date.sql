@@ -0,0 +1,6 @@
+-- Режим дедупликации без даты (DEDUPE_KEY=no_date или ?dedupe=no_date при загрузке):
+-- такие строки помечаются ignore_date и уникальны по (name, category, price) независимо от даты.
+-- Строки, загруженные в обычном режиме, под частичный индекс не попадают.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS ignore_date BOOLEAN NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS prices_uniq_no_date ON prices (name, category, price) WHERE ignore_date;
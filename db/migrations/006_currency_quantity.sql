@@ -0,0 +1,4 @@
+-- Схема входного CSV версии 2 (X-Schema-Version: 2): к пяти колонкам добавлены валюта и количество.
+-- Строки, загруженные по схеме 1, оставляют их пустыми (NULL). В уникальность строк они не входят.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS currency TEXT;
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS quantity NUMERIC(14,3) CHECK (quantity > 0);
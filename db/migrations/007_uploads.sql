@@ -0,0 +1,17 @@
+-- Итоги каждой загрузки (те же цифры, что в ответе POST /api/v0/prices) — для графиков
+-- объёма загрузок и доли дублей по поставщикам: GET /api/v0/uploads/stats.
+CREATE TABLE IF NOT EXISTS uploads (
+  id               BIGSERIAL PRIMARY KEY,
+  uploaded_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  supplier         TEXT NOT NULL DEFAULT '',  -- X-Supplier или ?supplier=, пусто — не указан
+  schema_version   TEXT NOT NULL,
+  dedupe           TEXT NOT NULL,             -- full или no_date
+  total_count      INTEGER NOT NULL,
+  duplicates_count INTEGER NOT NULL,
+  total_items      INTEGER NOT NULL,
+  total_categories INTEGER NOT NULL,
+  total_price      NUMERIC(20,2) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS uploads_uploaded_at ON uploads (uploaded_at);
+CREATE INDEX IF NOT EXISTS uploads_supplier_uploaded_at ON uploads (supplier, uploaded_at);
@@ -0,0 +1,16 @@
+-- Сработавшие правила оповещений (ALERT_RULES), проверяемых после каждой загрузки.
+CREATE TABLE IF NOT EXISTS alerts (
+  id           BIGSERIAL PRIMARY KEY,
+  fired_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+  rule         TEXT NOT NULL,
+  metric       TEXT NOT NULL,
+  op           TEXT NOT NULL,
+  threshold    DOUBLE PRECISION NOT NULL,
+  value        DOUBLE PRECISION NOT NULL,
+  category     TEXT,                        -- только для метрик по категориям
+  upload_id    BIGINT REFERENCES uploads (id),
+  message      TEXT NOT NULL,
+  notify_error TEXT                         -- NULL — все получатели уведомлены
+);
+
+CREATE INDEX IF NOT EXISTS alerts_fired_at ON alerts (fired_at);
@@ -0,0 +1,5 @@
+-- SHA-256 загруженного архива: повтор того же файла в пределах UPLOAD_DEDUPE_WINDOW
+-- не разбирается заново, а получает ответ исходной загрузки.
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS file_sha256 TEXT;
+
+CREATE INDEX IF NOT EXISTS uploads_file_sha256 ON uploads (file_sha256, uploaded_at) WHERE file_sha256 IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Строки, загруженные в режиме ?backfill=1 (перенос истории) без ограничений по датам.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS backfill BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,42 @@
+-- Ключ дубля без учёта регистра и пробелов по краям: " Milk" и "milk" — один товар.
+-- Уже накопившиеся такие дубли миграция не удаляет: пока они есть, уникальный индекс не
+-- создать, и миграция останавливается с ошибкой UD001. Сервис тогда поднимает только
+-- отчёт и чистку дублей (см. serveMigrationCleanup): GET /api/v0/admin/duplicates,
+-- POST /api/v0/admin/dedupe — сначала dry_run, затем с confirm. После чистки — перезапуск.
+DO $$
+DECLARE
+  groups bigint;
+BEGIN
+  SELECT COUNT(*) INTO groups FROM (
+    SELECT 1 FROM prices
+    GROUP BY created_at, lower(trim(name)), lower(trim(category)), price
+    HAVING COUNT(*) > 1
+  ) g;
+  IF groups > 0 THEN
+    RAISE EXCEPTION 'prices has % groups of rows that differ only in case or surrounding spaces', groups
+      USING ERRCODE = 'UD001',
+            HINT = 'review them with GET /api/v0/admin/duplicates?keys=ci_all, remove with POST /api/v0/admin/dedupe {"key": "ci_all"} (dry_run first), then restart';
+  END IF;
+
+  -- То же для строк режима no_date (миграция 005).
+  SELECT COUNT(*) INTO groups FROM (
+    SELECT 1 FROM prices
+    WHERE ignore_date
+    GROUP BY lower(trim(name)), lower(trim(category)), price
+    HAVING COUNT(*) > 1
+  ) g;
+  IF groups > 0 THEN
+    RAISE EXCEPTION 'prices has % groups of no_date rows that differ only in case or surrounding spaces', groups
+      USING ERRCODE = 'UD001',
+            HINT = 'review them with GET /api/v0/admin/duplicates?keys=ci_no_date, remove with POST /api/v0/admin/dedupe {"key": "ci_no_date"} (dry_run first), then restart';
+  END IF;
+END;
+$$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS prices_uniq_ci ON prices (created_at, lower(trim(name)), lower(trim(category)), price);
+
+DROP INDEX IF EXISTS prices_uniq_no_date;
+CREATE UNIQUE INDEX IF NOT EXISTS prices_uniq_no_date_ci ON prices (lower(trim(name)), lower(trim(category)), price) WHERE ignore_date;
+
+-- Поиск совпадений за любую дату (no_date, отчёт о конфликтах) по всем строкам.
+CREATE INDEX IF NOT EXISTS prices_ci_key ON prices (lower(trim(name)), lower(trim(category)), price);
@@ -0,0 +1,8 @@
+-- Режим dedupe=price_list — дневной прайс-лист как в ERP: одна цена на (product_id, category, created_at),
+-- повторная загрузка того же товара за ту же дату обновляет цену, а не добавляет строку.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS price_list BOOLEAN NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS prices_uniq_price_list ON prices (product_id, lower(trim(category)), created_at) WHERE price_list;
+
+-- Сколько строк прайса загрузка обновила (в ответе — updated_count).
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS updated_count INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,20 @@
+-- Карантин загрузок: с quarantine=true строки файла ложатся в staged_prices, а в prices попадают
+-- только после POST /api/v0/uploads/{id}/approve. Отклонённая загрузка удаляет свои строки.
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'committed'; -- committed, pending, approved или rejected
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS backfill BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS reviewed_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS staged_prices (
+  upload_id  BIGINT NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+  line       INTEGER NOT NULL, -- номер строки в data.csv
+  product_id TEXT NOT NULL,
+  created_at DATE NOT NULL,
+  name       TEXT NOT NULL,
+  category   TEXT NOT NULL,
+  price      NUMERIC(12,2) NOT NULL,
+  currency   TEXT,
+  quantity   NUMERIC(14,3),
+  PRIMARY KEY (upload_id, line)
+);
+
+CREATE INDEX IF NOT EXISTS uploads_pending ON uploads (uploaded_at) WHERE status = 'pending';
@@ -0,0 +1,10 @@
+-- Трафик API по ключам и дням для внутренних расчётов: сколько байт ключ прислал и получил.
+-- Счётчики копятся в памяти и дописываются сюда раз в USAGE_FLUSH_INTERVAL.
+CREATE TABLE IF NOT EXISTS api_usage (
+  day       DATE NOT NULL,   -- UTC
+  api_key   TEXT NOT NULL,   -- имя ключа из API_KEYS, admin или anonymous
+  requests  BIGINT NOT NULL DEFAULT 0,
+  bytes_in  BIGINT NOT NULL DEFAULT 0,  -- тела запросов
+  bytes_out BIGINT NOT NULL DEFAULT 0,  -- тела ответов
+  PRIMARY KEY (day, api_key)
+);
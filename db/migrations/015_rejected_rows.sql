@@ -0,0 +1,12 @@
+-- Отклонённые строки загрузок для GET /api/v0/imports/{id}/rejected: строка файла как пришла
+-- (в CSV) и причина. Дубли строк БД сюда не пишутся. Больше REJECTED_ROWS_LIMIT строк на загрузку
+-- не сохраняется, тогда uploads.rejected_truncated = true.
+CREATE TABLE IF NOT EXISTS rejected_rows (
+  upload_id BIGINT NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+  line      INTEGER NOT NULL, -- номер строки в data.csv
+  record    TEXT NOT NULL,
+  reason    TEXT NOT NULL,
+  PRIMARY KEY (upload_id, line)
+);
+
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS rejected_truncated BOOLEAN NOT NULL DEFAULT false;
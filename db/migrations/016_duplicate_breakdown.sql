@@ -0,0 +1,6 @@
+-- duplicates_count по отдельности: дубли внутри файла, дубли строк БД и строки, не прошедшие
+-- разбор и проверки. У загрузок до этой миграции все три — 0.
+ALTER TABLE uploads
+  ADD COLUMN IF NOT EXISTS file_duplicates INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS db_duplicates   INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS invalid_rows    INTEGER NOT NULL DEFAULT 0;
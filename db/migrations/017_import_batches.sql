@@ -0,0 +1,19 @@
+-- Партии импорта: каждая загрузка уже записана в uploads, здесь добавляется то, чего не хватало
+-- для истории импортов (GET /api/v0/imports), а строки prices помечаются своей загрузкой.
+ALTER TABLE uploads
+  ADD COLUMN IF NOT EXISTS finished_at  TIMESTAMPTZ,                -- конец разбора или approve
+  ADD COLUMN IF NOT EXISTS archive_type TEXT NOT NULL DEFAULT '',   -- zip, tar, ..., csv
+  ADD COLUMN IF NOT EXISTS archive_size BIGINT NOT NULL DEFAULT 0;  -- байт в теле запроса
+
+-- Последняя загрузка, записавшая строку (вставка, обновление прайса или on_duplicate=replace).
+-- У строк до этой миграции — NULL.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS upload_id BIGINT REFERENCES uploads (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS prices_upload_id ON prices (upload_id) WHERE upload_id IS NOT NULL;
+
+-- Те же данные под привычными для отчётов именами.
+CREATE OR REPLACE VIEW import_batches AS
+SELECT id, uploaded_at AS started_at, finished_at, supplier, status, archive_type, archive_size,
+       total_count, duplicates_count, total_items, updated_count, total_categories, total_price,
+       file_duplicates, db_duplicates, invalid_rows
+FROM uploads;
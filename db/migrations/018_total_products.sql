@@ -0,0 +1,9 @@
+-- Число разных товаров в БД после загрузки (total_products в ответе), как total_categories.
+-- Товар — name без учёта регистра и пробелов по краям, как в ключе дубля. У старых загрузок — 0.
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS total_products INTEGER NOT NULL DEFAULT 0;
+
+CREATE OR REPLACE VIEW import_batches AS
+SELECT id, uploaded_at AS started_at, finished_at, supplier, status, archive_type, archive_size,
+       total_count, duplicates_count, total_items, updated_count, total_categories, total_price,
+       file_duplicates, db_duplicates, invalid_rows, total_products
+FROM uploads;
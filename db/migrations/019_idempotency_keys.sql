@@ -0,0 +1,10 @@
+-- Idempotency-Key у POST /api/v0/prices: повтор запроса с тем же ключом (например, после
+-- таймаута сети) получает сохранённый ответ исходной загрузки, а не загружается заново.
+-- Ключи свои у каждого ключа API: api_key — имя ключа, admin или anonymous.
+ALTER TABLE uploads
+  ADD COLUMN IF NOT EXISTS api_key         TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS idempotency_key TEXT,
+  ADD COLUMN IF NOT EXISTS response        JSONB; -- ответ загрузки, только при idempotency_key
+
+CREATE INDEX IF NOT EXISTS uploads_idempotency_key ON uploads (api_key, idempotency_key, uploaded_at)
+  WHERE idempotency_key IS NOT NULL;
@@ -0,0 +1,8 @@
+-- Настройки, меняемые на лету через PUT /api/v0/admin/settings: переопределяют переменные
+-- окружения из runtimeSettingDefs на всех экземплярах. Об изменении экземпляры узнают
+-- по NOTIFY settings_changed.
+CREATE TABLE IF NOT EXISTS settings (
+  key        TEXT PRIMARY KEY,
+  value      TEXT NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
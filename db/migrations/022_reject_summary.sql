@@ -0,0 +1,12 @@
+-- Отклонённые строки загрузки по причине и колонке для GET /api/v0/uploads/{id}/summary.
+-- Считаются все строки, в т.ч. сверх REJECTED_ROWS_LIMIT; дубли строк БД — в uploads.db_duplicates.
+-- У загрузок до этой миграции сводки нет.
+CREATE TABLE IF NOT EXISTS upload_reject_summary (
+  upload_id    BIGINT NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+  reason       TEXT NOT NULL,
+  column_name  TEXT NOT NULL,   -- пусто — причина относится ко всей строке
+  column_index INTEGER NOT NULL, -- номер колонки в файле, с 1; 0 — вся строка
+  rows         INTEGER NOT NULL,
+  first_lines  INTEGER[] NOT NULL, -- первые номера строк, для примера
+  PRIMARY KEY (upload_id, reason, column_name)
+);
@@ -0,0 +1,74 @@
+-- Состояние prices на прошлый момент для as_of= у GET /api/v0/prices и GET /api/v0/stats —
+-- чтобы воспроизвести уже опубликованный отчёт после новых загрузок, откатов и чисток.
+-- Каждая версия строки помечена временем записи; удалённые и изменённые версии
+-- переносятся триггером в prices_history со временем, когда они перестали быть текущими.
+
+-- Когда записана текущая версия строки (now() транзакции). NULL — строка старше истории:
+-- она была всегда.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS ingested_at TIMESTAMPTZ;
+
+-- Строкам, записанным загрузкой, — конец этой загрузки.
+UPDATE prices p SET ingested_at = COALESCE(u.finished_at, u.uploaded_at)
+FROM uploads u
+WHERE p.upload_id = u.id AND p.ingested_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS prices_history (
+  id            BIGINT NOT NULL,  -- prices.id версии
+  product_id    TEXT,
+  created_at    DATE NOT NULL,
+  name          TEXT NOT NULL,
+  category      TEXT NOT NULL,
+  price         NUMERIC(12,2) NOT NULL,
+  currency      TEXT,
+  quantity      NUMERIC(14,3),
+  upload_id     BIGINT,           -- без внешнего ключа: загрузку могли откатить
+  backfill      BOOLEAN NOT NULL,
+  price_list    BOOLEAN NOT NULL,
+  ignore_date   BOOLEAN NOT NULL,
+  ingested_at   TIMESTAMPTZ,          -- когда версия была записана
+  superseded_at TIMESTAMPTZ NOT NULL  -- когда её удалили или заменили
+);
+
+CREATE INDEX IF NOT EXISTS prices_history_superseded_at ON prices_history (superseded_at);
+
+-- Новая версия строки — только если изменились данные: on_duplicate=replace с теми же
+-- значениями и загрузкой версию не плодит. search_tsv не сравнивается: в BEFORE-триггере
+-- генерируемая колонка ещё не пересчитана.
+CREATE OR REPLACE FUNCTION prices_stamp_version() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' OR
+     (OLD.product_id, OLD.created_at, OLD.name, OLD.category, OLD.price, OLD.currency, OLD.quantity,
+      OLD.upload_id, OLD.backfill, OLD.price_list, OLD.ignore_date)
+     IS DISTINCT FROM
+     (NEW.product_id, NEW.created_at, NEW.name, NEW.category, NEW.price, NEW.currency, NEW.quantity,
+      NEW.upload_id, NEW.backfill, NEW.price_list, NEW.ignore_date) THEN
+    NEW.ingested_at := now();
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- UPDATE без изменения данных версию не заменяет. Версия, записанная и заменённая в одной
+-- транзакции, никому не была видна — её не храним.
+CREATE OR REPLACE FUNCTION prices_keep_version() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'UPDATE' AND NEW.ingested_at IS NOT DISTINCT FROM OLD.ingested_at THEN
+    RETURN NULL;
+  END IF;
+  IF OLD.ingested_at IS DISTINCT FROM now() THEN
+    INSERT INTO prices_history (id, product_id, created_at, name, category, price, currency, quantity,
+                                upload_id, backfill, price_list, ignore_date, ingested_at, superseded_at)
+    VALUES (OLD.id, OLD.product_id, OLD.created_at, OLD.name, OLD.category, OLD.price, OLD.currency, OLD.quantity,
+            OLD.upload_id, OLD.backfill, OLD.price_list, OLD.ignore_date, OLD.ingested_at, now());
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS prices_stamp_version ON prices;
+CREATE TRIGGER prices_stamp_version BEFORE INSERT OR UPDATE ON prices
+  FOR EACH ROW EXECUTE FUNCTION prices_stamp_version();
+
+DROP TRIGGER IF EXISTS prices_keep_version ON prices;
+CREATE TRIGGER prices_keep_version AFTER DELETE OR UPDATE ON prices
+  FOR EACH ROW EXECUTE FUNCTION prices_keep_version();
@@ -0,0 +1,3 @@
+-- subcategories=true: category LIKE 'dairy/%' для подкатегорий. text_pattern_ops — чтобы
+-- btree подходил для LIKE по префиксу независимо от collation базы, как idx_prices_name_pattern.
+CREATE INDEX IF NOT EXISTS prices_category_pattern ON prices (category text_pattern_ops);
@@ -0,0 +1,49 @@
+-- Цена за единицу (схема входного CSV 3): unit — базовая единица (l, kg, m, pc), unit_size —
+-- размер в ней (бутылка 500 мл — 0.5 l), unit_price — цена за одну базовую единицу. Строки
+-- схем 1 и 2 оставляют их пустыми (NULL). В уникальность строк они не входят.
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS unit TEXT;
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS unit_size NUMERIC(16,6) CHECK (unit_size > 0);
+ALTER TABLE prices ADD COLUMN IF NOT EXISTS unit_price NUMERIC(16,4)
+  GENERATED ALWAYS AS (round(price / unit_size, 4)) STORED;
+
+-- Фильтры и группировка по unit_price имеют смысл только внутри одной единицы.
+CREATE INDEX IF NOT EXISTS prices_unit_price ON prices (unit, unit_price) WHERE unit IS NOT NULL;
+
+ALTER TABLE staged_prices ADD COLUMN IF NOT EXISTS unit TEXT;
+ALTER TABLE staged_prices ADD COLUMN IF NOT EXISTS unit_size NUMERIC(16,6);
+
+ALTER TABLE prices_history ADD COLUMN IF NOT EXISTS unit TEXT;
+ALTER TABLE prices_history ADD COLUMN IF NOT EXISTS unit_size NUMERIC(16,6);
+ALTER TABLE prices_history ADD COLUMN IF NOT EXISTS unit_price NUMERIC(16,4);
+
+-- Версии строк из миграции 023 — теперь и с единицей.
+CREATE OR REPLACE FUNCTION prices_stamp_version() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' OR
+     (OLD.product_id, OLD.created_at, OLD.name, OLD.category, OLD.price, OLD.currency, OLD.quantity,
+      OLD.unit, OLD.unit_size, OLD.upload_id, OLD.backfill, OLD.price_list, OLD.ignore_date)
+     IS DISTINCT FROM
+     (NEW.product_id, NEW.created_at, NEW.name, NEW.category, NEW.price, NEW.currency, NEW.quantity,
+      NEW.unit, NEW.unit_size, NEW.upload_id, NEW.backfill, NEW.price_list, NEW.ignore_date) THEN
+    NEW.ingested_at := now();
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION prices_keep_version() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'UPDATE' AND NEW.ingested_at IS NOT DISTINCT FROM OLD.ingested_at THEN
+    RETURN NULL;
+  END IF;
+  IF OLD.ingested_at IS DISTINCT FROM now() THEN
+    INSERT INTO prices_history (id, product_id, created_at, name, category, price, currency, quantity,
+                                unit, unit_size, unit_price,
+                                upload_id, backfill, price_list, ignore_date, ingested_at, superseded_at)
+    VALUES (OLD.id, OLD.product_id, OLD.created_at, OLD.name, OLD.category, OLD.price, OLD.currency, OLD.quantity,
+            OLD.unit, OLD.unit_size, OLD.unit_price,
+            OLD.upload_id, OLD.backfill, OLD.price_list, OLD.ignore_date, OLD.ingested_at, now());
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,3 @@
+-- prices_category из бывшей миграции 020 повторял idx_prices_category из 10-init.sql и
+-- удваивал стоимость записи. Базы, где она успела примениться, его теряют.
+DROP INDEX IF EXISTS prices_category;
@@ -0,0 +1,3 @@
+-- Отклонённая строка хранится байтами, как пришла в файле: в ней может быть NUL или
+-- невалидный UTF-8 (причина control_chars), а в TEXT Postgres их не принимает.
+ALTER TABLE rejected_rows ALTER COLUMN record TYPE BYTEA USING convert_to(record, 'UTF8');
@@ -0,0 +1,3 @@
+-- Отпечаток параметров разбора загрузки (IngestOptions.fingerprint): повтор того же файла
+-- отдаёт итоги исходной загрузки, только если файл разбирали так же и тем же ключом API.
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS ingest_options TEXT NOT NULL DEFAULT '';
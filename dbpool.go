@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- db pool self-healing -------------------------
+
+// После failover Postgres соединения пула остаются открытыми к старому серверу: он либо
+// упал, либо стал репликой и отвечает «read-only transaction». database/sql сам выбрасывает
+// только соединения, на которых драйвер вернул driver.ErrBadConn, поэтому остальные
+// продолжали бы отдавать ошибки до перезапуска сервиса.
+//
+// Каждое соединение помечено поколением пула. Ошибка разорванного соединения сбрасывает
+// пул — увеличивает поколение, и все соединения старого поколения закрываются, как только
+// database/sql возьмёт их из пула или вернёт в него, — и в фоне пингует БД новыми
+// соединениями, пока она не ответит.
+
+// dbPool — пул соединений с PostgreSQL и его счётчики для /metrics.
+type dbPool struct {
+	db         *sql.DB
+	generation atomic.Int64
+	healing    atomic.Bool
+
+	opened     atomic.Int64 // открыто соединений
+	broken     atomic.Int64 // ошибок разорванного соединения
+	resets     atomic.Int64 // сбросов пула
+	reconnects atomic.Int64 // восстановлений связи после сброса
+}
+
+// pgPool — пул сервиса; db заполняет connectDB.
+var pgPool = &dbPool{}
+
+// connector открывает соединения pq и помечает их текущим поколением пула.
+func (p *dbPool) connector(dsn string) (driver.Connector, error) {
+	c, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &poolConnector{Connector: c, pool: p}, nil
+}
+
+type poolConnector struct {
+	driver.Connector
+	pool *dbPool
+}
+
+func (c *poolConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.pool.opened.Add(1)
+	return &poolConn{Conn: conn, pool: c.pool, generation: c.pool.generation.Load()}, nil
+}
+
+// brokenConnError — ошибка, после которой соединению нельзя доверять: оно оборвано,
+// сервер остановлен администратором или после failover стал репликой.
+func brokenConnError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) {
+		return true
+	}
+	var pe *pq.Error
+	if !errors.As(err, &pe) {
+		return false
+	}
+	switch pe.Code {
+	case "25006", // read_only_sql_transaction: соединение смотрит на бывший primary
+		"57P01", // admin_shutdown
+		"57P02": // crash_shutdown
+		return true
+	}
+	return pe.Code.Class() == "08" // connection_exception
+}
+
+// noteError учитывает ошибку соединения поколения gen и при необходимости сбрасывает пул.
+// Ошибки соединений прошлых поколений уже учтены прошлым сбросом.
+func (p *dbPool) noteError(gen int64, err error) error {
+	if err == nil || !brokenConnError(err) {
+		return err
+	}
+	p.broken.Add(1)
+	if p.db != nil && gen == p.generation.Load() && p.healing.CompareAndSwap(false, true) {
+		go p.heal(err)
+	}
+	return err
+}
+
+// heal сбрасывает пул и пингует БД, пока она не ответит, но не дольше DB_HEAL_TIMEOUT
+// (по умолчанию минута). Дальше пул восстанавливается сам по следующей ошибке или
+// пробе /ready.
+func (p *dbPool) heal(cause error) {
+	defer p.healing.Store(false)
+	p.generation.Add(1)
+	p.resets.Add(1)
+	slog.Warn("db connection broken, resetting pool", "error", cause)
+
+	deadline := time.Now().Add(envDuration("DB_HEAL_TIMEOUT", time.Minute))
+	backoff := 200 * time.Millisecond
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), envDuration("DB_HEALTH_TIMEOUT", 2*time.Second))
+		err := p.db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			p.reconnects.Add(1)
+			slog.Info("db connection restored")
+			return
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			slog.Error("db still unavailable after pool reset", "error", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
+
+// writeMetrics дописывает в /metrics состояние пула и счётчики переподключений.
+func (p *dbPool) writeMetrics(w io.Writer) {
+	if p.db == nil {
+		return
+	}
+	st := p.db.Stats()
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"db_open_connections", "gauge", "Open connections to PostgreSQL, in use and idle.", int64(st.OpenConnections)},
+		{"db_in_use_connections", "gauge", "Connections currently in use.", int64(st.InUse)},
+		{"db_wait_count_total", "counter", "Times a query waited for a free connection.", st.WaitCount},
+		{"db_connections_opened_total", "counter", "Connections opened to PostgreSQL.", p.opened.Load()},
+		{"db_broken_connections_total", "counter", "Queries failed on a broken or stale connection.", p.broken.Load()},
+		{"db_pool_resets_total", "counter", "Connection pool resets after a broken connection.", p.resets.Load()},
+		{"db_reconnects_total", "counter", "Successful reconnects after a pool reset.", p.reconnects.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+// poolConn — соединение pq с поколением пула. Повторяет интерфейсы pq.conn, которыми
+// пользуется database/sql, и проверяет их ошибки.
+type poolConn struct {
+	driver.Conn
+	pool       *dbPool
+	generation int64
+}
+
+func (c *poolConn) stale() bool {
+	return c.generation != c.pool.generation.Load()
+}
+
+func (c *poolConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	st, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	return st, c.pool.noteError(c.generation, err)
+}
+
+func (c *poolConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	return tx, c.pool.noteError(c.generation, err)
+}
+
+func (c *poolConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	return rows, c.pool.noteError(c.generation, err)
+}
+
+func (c *poolConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	return res, c.pool.noteError(c.generation, err)
+}
+
+func (c *poolConn) Ping(ctx context.Context) error {
+	return c.pool.noteError(c.generation, c.Conn.(driver.Pinger).Ping(ctx))
+}
+
+// ResetSession вызывается перед повторным использованием соединения без возврата в пул.
+func (c *poolConn) ResetSession(ctx context.Context) error {
+	if c.stale() {
+		return driver.ErrBadConn
+	}
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+// IsValid — false для соединений до сброса пула: database/sql их закроет.
+func (c *poolConn) IsValid() bool {
+	return !c.stale() && c.Conn.(driver.Validator).IsValid()
+}
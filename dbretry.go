@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- transient db errors -------------------------
+
+// pqErrorCode классифицирует ошибку сервера PostgreSQL по SQLSTATE. Пустой код — ошибка
+// не временная или это не ошибка сервера.
+func pqErrorCode(err error) ErrorCode {
+	var pe *pq.Error
+	if !errors.As(err, &pe) {
+		return ""
+	}
+	switch pe.Code {
+	case "53300", // too_many_connections
+		"57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now: БД запускается или восстанавливается
+		return CodeDBUnavailable
+	case "40001", // serialization_failure
+		"40P01", // deadlock_detected
+		"55P03": // lock_not_available
+		return CodeDBBusy
+	case "25006": // read_only_sql_transaction: после failover, пул уже сбрасывается
+		return CodeDBUnavailable
+	}
+	if pe.Code.Class() == "08" { // connection_exception
+		return CodeDBUnavailable
+	}
+	return ""
+}
+
+// transientDBError — ошибка БД, после которой тот же запрос стоит повторить: соединение
+// оборвалось, кончились слоты соединений, транзакцию выбрал жертвой deadlock.
+func transientDBError(err error) bool {
+	switch errorCode(err) {
+	case CodeDBUnavailable, CodeDBBusy:
+		return true
+	case CodeInternal:
+		// Ошибка драйвера, ещё не обёрнутая в dbError.
+		return pqErrorCode(err) != "" || errors.Is(err, driver.ErrBadConn)
+	}
+	return false
+}
+
+// setRetryAfter подсказывает клиенту, когда повторить запрос после временной ошибки БД.
+func setRetryAfter(w http.ResponseWriter) {
+	secs := int64(envDuration("DB_RETRY_AFTER", 5*time.Second) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(max(secs, 1), 10))
+}
+
+// retryDB выполняет fn и повторяет её после временных ошибок БД: до DB_RETRY_ATTEMPTS
+// попыток (по умолчанию 3) с паузой от DB_RETRY_BACKOFF (100ms), удваивая её каждый раз.
+// fn должна быть безопасна для повтора: вся работа — в одной транзакции, которая
+// при ошибке откатывается, а входные данные уже в памяти.
+func retryDB[T any](ctx context.Context, op string, fn func() (T, error)) (T, error) {
+	attempts := max(envInt64("DB_RETRY_ATTEMPTS", 3), 1)
+	backoff := envDuration("DB_RETRY_BACKOFF", 100*time.Millisecond)
+	for attempt := int64(1); ; attempt++ {
+		v, err := fn()
+		if err == nil || attempt >= attempts || !transientDBError(err) || ctx.Err() != nil {
+			return v, err
+		}
+		slog.Warn("transient db error, retrying", "op", op, "attempt", attempt, "error", err)
+		// Разброс, чтобы столкнувшиеся в deadlock транзакции не повторялись одновременно.
+		pause := backoff + rand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return v, err
+		case <-time.After(pause):
+		}
+		backoff *= 2
+	}
+}
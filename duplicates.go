@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------- duplicates -------------------------
+
+// dupKey — альтернативное определение дубля: набор SQL-выражений по таблице prices.
+// Выражения берутся только из этого списка, пользовательский ввод в SQL не попадает.
+type dupKey struct {
+	Name        string
+	Description string
+	Exprs       []string
+	Where       string // только строки под этим условием; пусто — все
+}
+
+// from — строки prices, среди которых ищутся дубли ключа.
+func (k dupKey) from() string {
+	if k.Where == "" {
+		return "prices"
+	}
+	return "prices WHERE " + k.Where
+}
+
+var duplicateKeys = []dupKey{
+	{
+		Name:        "no_date",
+		Description: "name, category, price (created_at ignored)",
+		Exprs:       []string{"name", "category", "price"},
+	},
+	{
+		Name:        "ci_name",
+		Description: "created_at, lower(trim(name)), category, price",
+		Exprs:       []string{"created_at", "lower(trim(name))", "category", "price"},
+	},
+	{
+		Name:        "ci_all",
+		Description: "created_at, lower(trim(name)), lower(trim(category)), price",
+		Exprs:       []string{"created_at", "lower(trim(name))", "lower(trim(category))", "price"},
+	},
+	{
+		Name:        "ci_no_date",
+		Description: "lower(trim(name)), lower(trim(category)), price among no_date rows",
+		Exprs:       []string{"lower(trim(name))", "lower(trim(category))", "price"},
+		Where:       "ignore_date",
+	},
+	{
+		Name:        "no_price",
+		Description: "created_at, name, category (price ignored)",
+		Exprs:       []string{"created_at", "name", "category"},
+	},
+}
+
+func findDupKey(name string) (dupKey, bool) {
+	for _, k := range duplicateKeys {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return dupKey{}, false
+}
+
+type DuplicateGroup struct {
+	Key   json.RawMessage `json:"key"`   // значения полей ключа
+	Count int             `json:"count"` // сколько строк в группе
+	IDs   json.RawMessage `json:"ids"`   // id строк группы по возрастанию
+}
+
+type DuplicateKeyReport struct {
+	Key         string           `json:"key"`
+	Description string           `json:"description"`
+	Groups      int              `json:"groups"`      // групп с более чем одной строкой
+	Rows        int              `json:"rows"`        // строк в этих группах
+	ExcessRows  int              `json:"excess_rows"` // сколько строк пришлось бы удалить, оставив по одной на группу
+	TopGroups   []DuplicateGroup `json:"top_groups"`  // крупнейшие группы
+}
+
+func handleDuplicatesReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs ValidationErrors
+
+		keys := duplicateKeys
+		if s := strings.TrimSpace(r.URL.Query().Get("keys")); s != "" {
+			keys = nil
+			for _, name := range strings.Split(s, ",") {
+				name = strings.TrimSpace(name)
+				k, ok := findDupKey(name)
+				if !ok {
+					errs.add("keys", name, "unknown duplicate key")
+					continue
+				}
+				keys = append(keys, k)
+			}
+		}
+
+		limit := 10
+		if s := strings.TrimSpace(r.URL.Query().Get("limit")); s != "" {
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 || i > 1000 {
+				errs.add("limit", s, "expected integer 0..1000")
+			} else {
+				limit = i
+			}
+		}
+
+		if len(errs) > 0 {
+			writeErrorFrom(w, errs)
+			return
+		}
+
+		report := make([]DuplicateKeyReport, 0, len(keys))
+		for _, k := range keys {
+			kr, err := scanDuplicates(r.Context(), db, k, limit)
+			if err != nil {
+				writeErrorFrom(w, dbError("db query failed", err))
+				return
+			}
+			report = append(report, kr)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
+
+func scanDuplicates(ctx context.Context, db *sql.DB, k dupKey, limit int) (DuplicateKeyReport, error) {
+	group := strings.Join(k.Exprs, ", ")
+	kr := DuplicateKeyReport{Key: k.Name, Description: k.Description, TopGroups: []DuplicateGroup{}}
+
+	q := `
+		SELECT COUNT(*), COALESCE(SUM(cnt), 0)
+		FROM (SELECT COUNT(*) AS cnt FROM ` + k.from() + ` GROUP BY ` + group + ` HAVING COUNT(*) > 1) g;
+	`
+	if err := db.QueryRowContext(ctx, q).Scan(&kr.Groups, &kr.Rows); err != nil {
+		return DuplicateKeyReport{}, err
+	}
+	kr.ExcessRows = kr.Rows - kr.Groups
+
+	if limit == 0 || kr.Groups == 0 {
+		return kr, nil
+	}
+
+	q = `
+		SELECT json_build_array(` + group + `), COUNT(*), json_agg(id ORDER BY id)
+		FROM ` + k.from() + `
+		GROUP BY ` + group + `
+		HAVING COUNT(*) > 1
+		ORDER BY COUNT(*) DESC, MIN(id)
+		LIMIT $1;
+	`
+	rows, err := db.QueryContext(ctx, q, limit)
+	if err != nil {
+		return DuplicateKeyReport{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			g        DuplicateGroup
+			key, ids []byte
+		)
+		if err := rows.Scan(&key, &g.Count, &ids); err != nil {
+			return DuplicateKeyReport{}, err
+		}
+		g.Key, g.IDs = key, ids
+		kr.TopGroups = append(kr.TopGroups, g)
+	}
+	return kr, rows.Err()
+}
+
+// ------------------------- dedupe job -------------------------
+
+// DedupeJob — фоновая чистка строк, нарушающих выбранное определение дубля.
+// Сначала запускается dry_run (только отчёт), затем настоящий прогон со ссылкой на него в confirm.
+type DedupeJob struct {
+	ID         string              `json:"id"`
+	Key        string              `json:"key"`
+	Keep       string              `json:"keep"` // earliest | latest
+	DryRun     bool                `json:"dry_run"`
+	Status     string              `json:"status"` // running | done | failed
+	Total      int                 `json:"total"`  // сколько строк нужно удалить
+	Deleted    int                 `json:"deleted"`
+	Error      string              `json:"error,omitempty"`
+	Report     *DuplicateKeyReport `json:"report,omitempty"`
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt *time.Time          `json:"finished_at,omitempty"`
+}
+
+type DedupeRequest struct {
+	Key     string `json:"key"`
+	Keep    string `json:"keep"`
+	DryRun  bool   `json:"dry_run"`
+	Confirm string `json:"confirm"` // id завершённого dry-run с теми же key/keep
+}
+
+const dedupeBatchSize = 1000
+
+var dedupeJobs = struct {
+	sync.Mutex
+	m       map[string]*DedupeJob
+	running bool
+}{m: make(map[string]*DedupeJob)}
+
+func handleDedupeStart(db *sql.DB, rollups *rollupRefresher, readOnly *readOnlyMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DedupeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, CodeInvalidJSON, "invalid json")
+			return
+		}
+		k, ok := findDupKey(req.Key)
+		if !ok {
+			writeError(w, CodeInvalidRequest, "unknown key")
+			return
+		}
+		switch req.Keep {
+		case "":
+			req.Keep = "earliest"
+		case "earliest", "latest":
+		default:
+			writeError(w, CodeInvalidRequest, "keep must be earliest or latest")
+			return
+		}
+		// Пробный прогон только читает данные и разрешён и в режиме только для чтения.
+		if !req.DryRun && readOnly.reject(w) {
+			return
+		}
+
+		dedupeJobs.Lock()
+		forgetExpiredDedupeJobs(time.Now().UTC())
+		if !req.DryRun {
+			prev, ok := dedupeJobs.m[req.Confirm]
+			if !ok || !prev.DryRun || prev.Status != "done" || prev.Key != req.Key || prev.Keep != req.Keep {
+				dedupeJobs.Unlock()
+				writeError(w, CodeInvalidRequest, "confirm must reference a finished dry run with the same key and keep")
+				return
+			}
+			if dedupeJobs.running {
+				dedupeJobs.Unlock()
+				writeError(w, CodeJobRunning, "another dedupe job is running")
+				return
+			}
+			dedupeJobs.running = true
+		}
+		job := &DedupeJob{
+			ID:        newID(),
+			Key:       req.Key,
+			Keep:      req.Keep,
+			DryRun:    req.DryRun,
+			Status:    "running",
+			StartedAt: time.Now().UTC(),
+		}
+		dedupeJobs.m[job.ID] = job
+		snapshot := *job
+		dedupeJobs.Unlock()
+
+		// Работа идёт в фоне и не должна зависеть от жизни запроса.
+		go runDedupeJob(context.Background(), db, rollups, job, k)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(snapshot)
+	}
+}
+
+func handleDedupeStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dedupeJobs.Lock()
+		job, ok := dedupeJobs.m[r.PathValue("id")]
+		var snapshot DedupeJob
+		if ok {
+			snapshot = *job
+		}
+		dedupeJobs.Unlock()
+
+		if !ok {
+			writeError(w, CodeNotFound, "job not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(snapshot)
+	}
+}
+
+func runDedupeJob(ctx context.Context, db *sql.DB, rollups *rollupRefresher, job *DedupeJob, k dupKey) {
+	err := dedupe(ctx, db, job, k)
+	if !job.DryRun {
+		rollups.request()
+	}
+
+	dedupeJobs.Lock()
+	defer dedupeJobs.Unlock()
+	if !job.DryRun {
+		dedupeJobs.running = false
+	}
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	if err != nil {
+		log.Printf("dedupe job %s: %v", job.ID, err)
+		job.Status = "failed"
+		job.Error = err.Error()
+		return
+	}
+	job.Status = "done"
+}
+
+func dedupe(ctx context.Context, db *sql.DB, job *DedupeJob, k dupKey) error {
+	report, err := scanDuplicates(ctx, db, k, 10)
+	if err != nil {
+		return err
+	}
+	dedupeJobs.Lock()
+	job.Report = &report
+	job.Total = report.ExcessRows
+	dedupeJobs.Unlock()
+
+	if job.DryRun {
+		return nil
+	}
+
+	order := "created_at, id"
+	if job.Keep == "latest" {
+		order = "created_at DESC, id DESC"
+	}
+	// Лишние строки считаются один раз — во временную таблицу сессии вместе с id строки,
+	// которая остаётся в группе, — и удаляются из неё пачками, чтобы не держать долгие
+	// блокировки. Строка удаляется, только пока оставляемая цела: откат загрузки во время
+	// чистки не оставит группу без последней копии.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer func() { _, _ = conn.ExecContext(context.Background(), `DROP TABLE IF EXISTS dedupe_victims`) }()
+
+	if _, err := conn.ExecContext(ctx, `
+		DROP TABLE IF EXISTS dedupe_victims;
+		CREATE TEMP TABLE dedupe_victims (id BIGINT PRIMARY KEY, keep_id BIGINT NOT NULL);
+	`); err != nil {
+		return err
+	}
+	res, err := conn.ExecContext(ctx, `
+		INSERT INTO dedupe_victims (id, keep_id)
+		SELECT id, keep_id FROM (
+			SELECT id, ROW_NUMBER() OVER w AS rn, FIRST_VALUE(id) OVER w AS keep_id
+			FROM `+k.from()+`
+			WINDOW w AS (PARTITION BY `+strings.Join(k.Exprs, ", ")+` ORDER BY `+order+`)
+		) t
+		WHERE rn > 1;
+	`)
+	if err != nil {
+		return err
+	}
+	remaining, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	dedupeJobs.Lock()
+	job.Total = int(remaining)
+	dedupeJobs.Unlock()
+
+	const q = `
+		WITH batch AS (
+			DELETE FROM dedupe_victims
+			WHERE id IN (SELECT id FROM dedupe_victims ORDER BY id LIMIT $1)
+			RETURNING id, keep_id
+		)
+		DELETE FROM prices p
+		USING batch b
+		WHERE p.id = b.id AND EXISTS (SELECT 1 FROM prices k WHERE k.id = b.keep_id);
+	`
+	for ; remaining > 0; remaining -= dedupeBatchSize {
+		res, err := conn.ExecContext(ctx, q, dedupeBatchSize)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		dedupeJobs.Lock()
+		job.Deleted += int(n)
+		dedupeJobs.Unlock()
+	}
+	return nil
+}
+
+// forgetExpiredDedupeJobs удаляет задачи, завершённые раньше чем DEDUPE_JOB_TTL назад
+// (по умолчанию 24h). Вызывается под dedupeJobs.
+func forgetExpiredDedupeJobs(now time.Time) {
+	ttl := envDuration("DEDUPE_JOB_TTL", 24*time.Hour)
+	for id, job := range dedupeJobs.m {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > ttl {
+			delete(dedupeJobs.m, id)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// ------------------------- csv encoding -------------------------
+
+// csvEncodings — допустимые значения encoding= и CSV_ENCODING (и charset в Content-Type)
+// и к чему они сводятся.
+var csvEncodings = map[string]string{
+	"auto":         "auto",
+	"utf-8":        "utf-8",
+	"utf8":         "utf-8",
+	"windows-1251": "windows-1251",
+	"cp1251":       "windows-1251",
+	"koi8-r":       "koi8-r",
+	"koi8r":        "koi8-r",
+	"utf-16":       "utf-16le",
+	"utf-16le":     "utf-16le",
+	"utf-16be":     "utf-16be",
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// detectEncoding определяет кодировку по началу файла: BOM, затем корректность UTF-8.
+// Иначе это однобайтовая кириллица из старых систем: Windows-1251 или KOI8-R, что даёт
+// больше частых русских букв.
+func detectEncoding(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, utf8BOM):
+		return "utf-8-bom"
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	}
+	// Последний символ мог обрезаться границей буфера.
+	valid := head
+	for i := 0; i < utf8.UTFMax && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+	if utf8.Valid(valid) {
+		return "utf-8"
+	}
+	if cyrillicScore(charmap.KOI8R, head) > cyrillicScore(charmap.Windows1251, head) {
+		return "koi8-r"
+	}
+	return "windows-1251"
+}
+
+// cyrillicScore — сколько самых частых строчных русских букв в head, прочитанном как enc.
+// В Windows-1251 и KOI8-R строчные и заглавные буквы поменяны местами, поэтому чужая
+// кодировка даёт в основном заглавные вперемешку.
+func cyrillicScore(enc *charmap.Charmap, head []byte) int {
+	text, err := enc.NewDecoder().Bytes(head)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, r := range string(text) {
+		if strings.ContainsRune("оеаинтсрвлкмдпуяы", r) {
+			n++
+		}
+	}
+	return n
+}
+
+// decodeCSV перекодирует файл загрузки в UTF-8 по encoding= (при auto — по началу файла)
+// и убирает BOM, чтобы он не попал в первую колонку заголовка. Возвращает и кодировку,
+// которой файл прочитан, — её показывает предпросмотр.
+func (o IngestOptions) decodeCSV(r io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	head, err := br.Peek(64 << 10)
+	var ae *apiError
+	if errors.As(err, &ae) {
+		// ошибка распаковки или лимита
+		return nil, "", err
+	}
+	name := o.Encoding
+	if name == "auto" {
+		name = detectEncoding(head)
+	}
+
+	var dec *encoding.Decoder
+	switch name {
+	case "utf-8", "utf-8-bom":
+		if bytes.HasPrefix(head, utf8BOM) {
+			_, _ = br.Discard(len(utf8BOM))
+		}
+		return br, name, nil
+	case "windows-1251":
+		dec = charmap.Windows1251.NewDecoder()
+	case "koi8-r":
+		dec = charmap.KOI8R.NewDecoder()
+	case "utf-16le":
+		// BOM, если он есть, важнее заданного порядка байт и из текста убирается.
+		dec = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder()
+	case "utf-16be":
+		dec = unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewDecoder()
+	}
+	return transform.NewReader(br, dec), name, nil
+}
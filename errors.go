@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ------------------------- error codes -------------------------
+
+// ErrorCode — стабильный машиночитаемый код ошибки. Клиенты завязываются на него,
+// а не на текст; список кодов продублирован в openapi.yaml.
+type ErrorCode string
+
+const (
+	CodeInvalidParams    ErrorCode = "INVALID_PARAMS"     // параметры запроса не прошли проверку, см. fields
+	CodeInvalidJSON      ErrorCode = "INVALID_JSON"       // тело запроса — не JSON нужной формы
+	CodeInvalidRequest   ErrorCode = "INVALID_REQUEST"    // JSON разобран, но значения полей недопустимы
+	CodeBodyReadFailed   ErrorCode = "BODY_READ_FAILED"   // не удалось дочитать тело запроса
+	CodeLimitExceeded    ErrorCode = "LIMIT_EXCEEDED"     // превышен лимит размера
+	CodeUnsupportedMedia ErrorCode = "UNSUPPORTED_MEDIA"  // Content-Type тела запроса не поддерживается
+	CodeArchiveInvalid   ErrorCode = "ARCHIVE_INVALID"    // битый zip/tar
+	CodeArchiveNotFound  ErrorCode = "ARCHIVE_NOT_FOUND"  // в архиве нет data.csv
+	CodeArchivePassword  ErrorCode = "ARCHIVE_PASSWORD"   // архив зашифрован, а пароль не передан или неверен
+	CodeCSVInvalid       ErrorCode = "CSV_INVALID"        // CSV не разбирается
+	CodeDBUnavailable    ErrorCode = "DB_UNAVAILABLE"     // нет соединения с БД
+	CodeDBBusy           ErrorCode = "DB_BUSY"            // deadlock или конфликт блокировок, запрос можно повторить
+	CodeDBError          ErrorCode = "DB_ERROR"           // запрос к БД завершился ошибкой
+	CodeExportFailed     ErrorCode = "EXPORT_FAILED"      // не удалось собрать zip/xlsx
+	CodeImportFailed     ErrorCode = "IMPORT_FAILED"      // не удалось скачать файл по url импорта
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"       // неверный или отсутствующий токен
+	CodeAdminDisabled    ErrorCode = "ADMIN_DISABLED"     // ADMIN_TOKEN не задан
+	CodeEndpointDisabled ErrorCode = "ENDPOINT_DISABLED"  // эндпоинт выключен через DISABLED_FEATURES
+	CodeNotFound         ErrorCode = "NOT_FOUND"          // объект не найден
+	CodeConflict         ErrorCode = "CONFLICT"           // операция конфликтует с данными
+	CodeJobRunning       ErrorCode = "JOB_RUNNING"        // уже выполняется другая фоновая задача
+	CodeQueueFull        ErrorCode = "QUEUE_FULL"         // очередь фоновых загрузок заполнена
+	CodeReadOnly         ErrorCode = "READ_ONLY"          // включён режим только для чтения
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED" // метод не поддерживается
+	CodeInternal         ErrorCode = "INTERNAL"           // всё остальное
+)
+
+// status — HTTP-статус ответа с этим кодом. Статус выбирается только здесь, по коду,
+// а не в каждом обработчике: 4xx — виноват запрос, 5xx — сервер или БД.
+func (c ErrorCode) status() int {
+	switch c {
+	case CodeInvalidParams, CodeInvalidJSON, CodeBodyReadFailed:
+		return http.StatusBadRequest
+	case CodeInvalidRequest, CodeArchiveInvalid, CodeArchiveNotFound, CodeArchivePassword, CodeCSVInvalid:
+		// Запрос разобран, но содержимое (поля JSON, архив, data.csv) не проходит проверку.
+		return http.StatusUnprocessableEntity
+	case CodeLimitExceeded:
+		return http.StatusRequestEntityTooLarge
+	case CodeUnsupportedMedia:
+		return http.StatusUnsupportedMediaType
+	case CodeUnauthorized:
+		return http.StatusUnauthorized
+	case CodeAdminDisabled, CodeEndpointDisabled:
+		return http.StatusForbidden
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case CodeConflict, CodeJobRunning:
+		return http.StatusConflict
+	case CodeDBUnavailable, CodeDBBusy, CodeQueueFull, CodeReadOnly:
+		return http.StatusServiceUnavailable
+	case CodeImportFailed:
+		// Виноват не запрос и не сервис, а сервер, с которого скачиваем.
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// httpStatus — статус ответа на ошибку err; ошибка драйвера без кода, но временная, — тоже 503.
+func httpStatus(err error) int {
+	if transientDBError(err) {
+		return http.StatusServiceUnavailable
+	}
+	return errorCode(err).status()
+}
+
+// apiError — ошибка с кодом, которую можно отдать клиенту как есть.
+type apiError struct {
+	Code    ErrorCode
+	Message string
+	Err     error // исходная причина, в ответ не попадает
+}
+
+func (e *apiError) Error() string { return e.Message }
+func (e *apiError) Unwrap() error { return e.Err }
+
+func codedError(code ErrorCode, msg string) error {
+	return &apiError{Code: code, Message: msg}
+}
+
+// dbError оборачивает ошибку драйвера; обрыв соединения и другие временные ошибки
+// (см. transientDBError) отличаем от ошибки самого запроса.
+func dbError(msg string, err error) error {
+	return &apiError{Code: dbErrorCode(err), Message: msg, Err: err}
+}
+
+func dbErrorCode(err error) ErrorCode {
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return CodeDBUnavailable
+	}
+	if code := pqErrorCode(err); code != "" {
+		return code
+	}
+	return CodeDBError
+}
+
+// errorCode достаёт код из цепочки ошибок; ошибки без кода считаются внутренними.
+func errorCode(err error) ErrorCode {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return ae.Code
+	}
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		return CodeInvalidParams
+	}
+	return CodeInternal
+}
+
+// ErrorResponse — тело любого ответа с ошибкой.
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Code   ErrorCode    `json:"code"`
+	Fields []FieldError `json:"fields,omitempty"` // только для INVALID_PARAMS
+}
+
+// writeError отвечает ошибкой с кодом code; статус — code.status().
+func writeError(w http.ResponseWriter, code ErrorCode, msg string) {
+	writeErrorResponse(w, code.status(), ErrorResponse{Error: msg, Code: code})
+}
+
+// writeErrorFrom отвечает ошибкой err; код и статус берутся из самой ошибки (см. httpStatus).
+// Временная ошибка БД — 503 с Retry-After.
+func writeErrorFrom(w http.ResponseWriter, err error) {
+	if transientDBError(err) {
+		setRetryAfter(w)
+	}
+	writeErrorResponse(w, httpStatus(err), errorResponse(err))
+}
+
+// errorResponse — тело ответа для ошибки err.
+func errorResponse(err error) ErrorResponse {
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		return ErrorResponse{Error: "invalid query parameters", Code: CodeInvalidParams, Fields: verrs}
+	}
+	return ErrorResponse{Error: err.Error(), Code: errorCode(err)}
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, resp ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ------------------------- validation errors -------------------------
+
+// FieldError — ошибка одного параметра запроса: что пришло и что ожидалось.
+type FieldError struct {
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// ValidationErrors собирает ошибки всех параметров сразу, чтобы клиент мог показать их разом.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	parts := make([]string, len(e))
+	for i, fe := range e {
+		parts[i] = "invalid " + fe.Field + ": " + fe.Reason
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (e *ValidationErrors) add(field, value, reason string) {
+	*e = append(*e, FieldError{Field: field, Value: value, Reason: reason})
+}
+
+// err возвращает nil, если ошибок нет (а не типизированный nil внутри интерфейса).
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// fieldError — короткая запись для одиночной ошибки параметра.
+func fieldError(field, value, reason string) error {
+	return ValidationErrors{{Field: field, Value: value, Reason: reason}}
+}
+
+// mergeErrors объединяет ошибки валидации из нескольких парсеров в одну.
+func mergeErrors(errs ...error) error {
+	var out ValidationErrors
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var verrs ValidationErrors
+		if !errors.As(err, &verrs) {
+			return err
+		}
+		out = append(out, verrs...)
+	}
+	return out.err()
+}
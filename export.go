@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------- export options -------------------------
+
+// exportColumns — колонки data.csv в порядке выгрузки; они же заголовки по умолчанию.
+var exportColumns = []string{"id", "name", "category", "price", "create_date"}
+
+// HeaderSchemes — наборы заголовков выгрузки из EXPORT_HEADERS: схема -> колонка -> заголовок.
+// Колонки, не указанные в схеме, выгружаются с заголовком по умолчанию.
+type HeaderSchemes map[string]map[string]string
+
+// loadHeaderSchemes читает EXPORT_HEADERS, например
+// {"ru": {"id": "Код", "name": "Наименование", "category": "Категория", "price": "Цена", "create_date": "Дата"}}.
+func loadHeaderSchemes() (HeaderSchemes, error) {
+	s := env("EXPORT_HEADERS", "")
+	if s == "" {
+		return HeaderSchemes{}, nil
+	}
+	var hs HeaderSchemes
+	if err := json.Unmarshal([]byte(s), &hs); err != nil {
+		return nil, fmt.Errorf("EXPORT_HEADERS: %w", err)
+	}
+	for name, m := range hs {
+		for col := range m {
+			if !slices.Contains(exportColumns, col) {
+				return nil, fmt.Errorf("EXPORT_HEADERS: scheme %s: unknown column %s", name, col)
+			}
+		}
+	}
+	return hs, nil
+}
+
+func (hs HeaderSchemes) names() []string {
+	out := make([]string, 0, len(hs))
+	for name := range hs {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// header собирает строку заголовков по схеме; пустое имя — заголовки по умолчанию.
+func (hs HeaderSchemes) header(name string) ([]string, bool) {
+	if name == "" {
+		return exportColumns, true
+	}
+	m, ok := hs[name]
+	if !ok {
+		return nil, false
+	}
+	out := make([]string, len(exportColumns))
+	for i, col := range exportColumns {
+		out[i] = col
+		if title, ok := m[col]; ok {
+			out[i] = title
+		}
+	}
+	return out, true
+}
+
+// ExportOptions — как оформить data.csv при выгрузке.
+type ExportOptions struct {
+	Header   []string
+	QuoteAll bool   // quote=always: каждое поле в кавычках, как требуют некоторые загрузчики
+	CRLF     bool   // line_ending=crlf
+	Format   string // zip (по умолчанию), zst — data.csv, сжатый zstd, или csv — data.csv как есть
+	// EscapeFormulas — экранировать значения, которые Excel принял бы за формулу (см. escapeFormula).
+	EscapeFormulas bool
+	Password       string          // непустой — data.csv в zip шифруется AES-256
+	Signer         *ExportSigner   // не nil — в zip добавляются data.csv.sha256 и data.csv.sig
+	Manifest       *ExportManifest // не nil — в zip добавляется manifest.json
+}
+
+func parseExportOptions(r *http.Request, hs HeaderSchemes, signer *ExportSigner) (ExportOptions, error) {
+	var errs ValidationErrors
+	q := r.URL.Query()
+
+	scheme := strings.TrimSpace(q.Get("headers"))
+	header, ok := hs.header(scheme)
+	if !ok {
+		reason := "no header schemes configured"
+		if len(hs) > 0 {
+			reason = "expected one of " + strings.Join(hs.names(), ", ")
+		}
+		errs.add("headers", scheme, reason)
+	}
+
+	opts := ExportOptions{Header: header, Format: "zip"}
+
+	switch s := strings.TrimSpace(q.Get("format")); s {
+	case "":
+		opts.Format = negotiateExportFormat(r.Header.Get("Accept"))
+	case "zip", "zst", "csv":
+		opts.Format = s
+	default:
+		errs.add("format", s, "expected zip, zst or csv")
+	}
+
+	switch s := strings.TrimSpace(q.Get("quote")); s {
+	case "", "minimal":
+	case "always":
+		opts.QuoteAll = true
+	default:
+		errs.add("quote", s, "expected minimal or always")
+	}
+
+	switch s := strings.TrimSpace(q.Get("line_ending")); s {
+	case "", "lf":
+	case "crlf":
+		opts.CRLF = true
+	default:
+		errs.add("line_ending", s, "expected lf or crlf")
+	}
+
+	// По умолчанию экранируем: выгрузки открывают прямо в Excel.
+	opts.EscapeFormulas = envBool("EXPORT_FORMULA_ESCAPE", true)
+	if s := strings.TrimSpace(q.Get("formula_escape")); s != "" {
+		if b, err := strconv.ParseBool(s); err != nil {
+			errs.add("formula_escape", s, "expected true or false")
+		} else {
+			opts.EscapeFormulas = b
+		}
+	}
+
+	opts.parsePassword(r, &errs)
+
+	if s := strings.TrimSpace(q.Get("sign")); s != "" {
+		sign, err := strconv.ParseBool(s)
+		switch {
+		case err != nil:
+			errs.add("sign", s, "expected true or false")
+		case sign && signer == nil:
+			errs.add("sign", s, "export signing is not configured")
+		case sign && opts.Format != "zip":
+			errs.add("format", opts.Format, "signing is supported only for zip")
+		case sign:
+			opts.Signer = signer
+		}
+	}
+
+	// Манифест включён по умолчанию только для zip: в zst и csv без архива ему негде лежать.
+	manifest := envBool("EXPORT_MANIFEST", true) && opts.Format == "zip"
+	if s := strings.TrimSpace(q.Get("manifest")); s != "" {
+		b, err := strconv.ParseBool(s)
+		switch {
+		case err != nil:
+			errs.add("manifest", s, "expected true or false")
+		case b && opts.Format != "zip":
+			errs.add("format", opts.Format, "manifest is supported only for zip")
+		default:
+			manifest = b
+		}
+	}
+	if manifest {
+		opts.Manifest = &ExportManifest{
+			ManifestVersion: 1,
+			File:            "data.csv",
+			SchemaVersion:   "1",
+			HeaderScheme:    scheme,
+			Columns:         header,
+			Instance:        exportInstance(),
+		}
+	}
+
+	return opts, errs.err()
+}
+
+// exportMediaTypes — форматы выгрузки по типу из Accept.
+var exportMediaTypes = map[string]string{
+	"application/zip":  "zip",
+	"application/zstd": "zst",
+	"text/csv":         "csv",
+}
+
+// negotiateExportFormat выбирает формат по заголовку Accept, если format не задан явно:
+// побеждает тип с наибольшим q, при равенстве — zip. Без подходящих типов (в т.ч. */*)
+// остаётся zip, как раньше: 406 сломал бы клиентов, шлющих Accept по привычке.
+func negotiateExportFormat(accept string) string {
+	best, bestQ := "zip", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		format, ok := exportMediaTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ || (q == bestQ && format == "zip") {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// parsePassword берёт пароль архива из X-Export-Password, а при encrypt=true без него —
+// выводит из X-API-Key (см. derivedExportPassword). Пароль в URL не принимаем: он попадёт в логи.
+func (o *ExportOptions) parsePassword(r *http.Request, errs *ValidationErrors) {
+	encrypt := false
+	if s := strings.TrimSpace(r.URL.Query().Get("encrypt")); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			errs.add("encrypt", s, "expected true or false")
+		}
+		encrypt = b
+	}
+
+	o.Password = r.Header.Get("X-Export-Password")
+	if o.Password == "" && encrypt {
+		secret := env("EXPORT_PASSWORD_SECRET", "")
+		key := r.Header.Get("X-API-Key")
+		switch {
+		case secret == "":
+			errs.add("encrypt", "true", "password by API key is not configured, send X-Export-Password")
+		case key == "":
+			errs.add("encrypt", "true", "requires X-Export-Password or X-API-Key header")
+		default:
+			o.Password = derivedExportPassword(secret, key)
+		}
+	}
+
+	if o.Password != "" && o.Format != "zip" {
+		errs.add("format", o.Format, "encryption is supported only for zip")
+	}
+}
+
+// derivedExportPassword — пароль архива для ключа API: первые 24 символа
+// base64url(HMAC-SHA256(EXPORT_PASSWORD_SECRET, key)). Получателю его сообщают
+// отдельно, сервис паролей не хранит.
+func derivedExportPassword(secret, key string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:24]
+}
+
+// escapeFormula защищает от CSV/formula injection: значение, начинающееся с =, +, -, @,
+// табуляции или CR, Excel выполнит как формулу. Такому значению дописываем ' в начало.
+// Обычные числа (в т.ч. отрицательные) не трогаем.
+func escapeFormula(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return s
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	return "'" + s
+}
+
+// escapeFormulaTable экранирует все ячейки отчёта перед записью в CSV.
+func escapeFormulaTable(table [][]string) [][]string {
+	for _, row := range table {
+		for i := range row {
+			row[i] = escapeFormula(row[i])
+		}
+	}
+	return table
+}
+
+// ------------------------- export manifest -------------------------
+
+// ExportManifest — manifest.json в zip-выгрузке: по нему получатель проверяет, что data.csv
+// пришёл целиком, прежде чем обрабатывать его.
+type ExportManifest struct {
+	ManifestVersion int            `json:"manifest_version"`
+	File            string         `json:"file"`
+	Rows            int64          `json:"rows"`   // строк данных в data.csv, без заголовка
+	SHA256          string         `json:"sha256"` // data.csv до шифрования
+	TotalPrice      string         `json:"total_price"`
+	Categories      int64          `json:"categories"`
+	SchemaVersion   string         `json:"schema_version"` // раскладка колонок, как X-Schema-Version загрузки
+	HeaderScheme    string         `json:"header_scheme,omitempty"`
+	Columns         []string       `json:"columns"`
+	Filters         map[string]any `json:"filters"`
+	GeneratedAt     time.Time      `json:"generated_at"`
+	Instance        string         `json:"instance"`
+}
+
+// exportInstance — кто сформировал выгрузку: INSTANCE_ID или имя хоста.
+func exportInstance() string {
+	if s := env("INSTANCE_ID", ""); s != "" {
+		return s
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// ------------------------- csv writer -------------------------
+
+// recordWriter — общее у csv.Writer и quoteAllWriter.
+type recordWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+func (o ExportOptions) newCSVWriter(w io.Writer) recordWriter {
+	if o.QuoteAll {
+		return &quoteAllWriter{w: bufio.NewWriter(w), crlf: o.CRLF}
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = ','
+	cw.UseCRLF = o.CRLF
+	return cw
+}
+
+// quoteAllWriter пишет CSV, заключая в кавычки каждое поле: encoding/csv так не умеет.
+type quoteAllWriter struct {
+	w    *bufio.Writer
+	crlf bool
+	err  error
+}
+
+func (q *quoteAllWriter) Write(record []string) error {
+	if q.err != nil {
+		return q.err
+	}
+	for i, field := range record {
+		if i > 0 {
+			_ = q.w.WriteByte(',')
+		}
+		_ = q.w.WriteByte('"')
+		_, _ = q.w.WriteString(strings.ReplaceAll(field, `"`, `""`))
+		_ = q.w.WriteByte('"')
+	}
+	if q.crlf {
+		_, q.err = q.w.WriteString("\r\n")
+	} else {
+		q.err = q.w.WriteByte('\n')
+	}
+	return q.err
+}
+
+func (q *quoteAllWriter) Flush() {
+	if err := q.w.Flush(); err != nil && q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *quoteAllWriter) Error() error { return q.err }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ------------------------- feature flags -------------------------
+
+// Группы эндпоинтов, которые можно выключить через DISABLED_FEATURES. Один и тот же бинарник
+// так обслуживает разные роли: например, публичная реплика только на чтение — DISABLED_FEATURES=upload,admin.
+var featureNames = []string{
+	"upload",    // POST /api/v0/prices, prices/preview, карантин uploads/{id}/*, jobs/{id}, imports, imports/{id} и imports/{id}/rejected
+	"export",    // GET /api/v0/prices и prices/sample
+	"exports",   // /api/v0/exports/*: ключ и проверка подписи
+	"search",    // search, search/similar, autocomplete
+	"analytics", // aggregate, reports/*, uploads/stats, stats/* и usage
+	"admin",     // /api/v0/admin/*
+	"metrics",   // /metrics
+}
+
+// Features — выключенные группы эндпоинтов. Набор можно сменить на лету через
+// таблицу settings, поэтому gate смотрит на него при каждом запросе.
+type Features struct {
+	cur atomic.Pointer[featureSet]
+}
+
+// featureSet — выключенные группы и как отвечать на запросы к ним.
+type featureSet struct {
+	disabled map[string]bool
+	status   int // 404 (по умолчанию) — эндпоинт как будто не существует, или 403
+}
+
+// loadFeatures читает DISABLED_FEATURES (через запятую) и DISABLED_FEATURES_STATUS (404 или 403).
+// Неизвестное имя — ошибка запуска, чтобы опечатка не оставила эндпоинт включённым.
+func loadFeatures() (*Features, error) {
+	fs, err := parseFeatures(env)
+	if err != nil {
+		return nil, err
+	}
+	f := &Features{}
+	f.cur.Store(fs)
+	return f, nil
+}
+
+// reload перечитывает настройки; при ошибке остаётся прежний набор.
+func (f *Features) reload() error {
+	fs, err := parseFeatures(env)
+	if err != nil {
+		return err
+	}
+	f.cur.Store(fs)
+	return nil
+}
+
+// parseFeatures разбирает DISABLED_FEATURES и DISABLED_FEATURES_STATUS; get — как env.
+func parseFeatures(get func(key, def string) string) (*featureSet, error) {
+	f := &featureSet{disabled: map[string]bool{}, status: http.StatusNotFound}
+	for _, name := range strings.Split(get("DISABLED_FEATURES", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(featureNames, name) {
+			return f, fmt.Errorf("DISABLED_FEATURES: unknown feature %s, expected one of %s", name, strings.Join(featureNames, ", "))
+		}
+		f.disabled[name] = true
+	}
+	switch s := get("DISABLED_FEATURES_STATUS", "404"); s {
+	case "404":
+	case "403":
+		f.status = http.StatusForbidden
+	default:
+		return f, fmt.Errorf("DISABLED_FEATURES_STATUS: expected 404 or 403, got %s", s)
+	}
+	return f, nil
+}
+
+// gate пропускает запрос, только если группа name включена. Выключенные эндпоинты
+// отвечают одинаково, вне зависимости от метода и параметров.
+func (f *Features) gate(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fs := f.cur.Load()
+		if !fs.disabled[name] {
+			next(w, r)
+			return
+		}
+		if fs.status == http.StatusForbidden {
+			writeError(w, CodeEndpointDisabled, "endpoint disabled")
+			return
+		}
+		writeError(w, CodeNotFound, "not found")
+	}
+}
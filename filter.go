@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------- filter expressions -------------------------
+
+// filterField — поле, доступное в filter=, и его колонка в prices.
+type filterField struct {
+	Column string
+	Kind   string // int, number, text или date
+}
+
+var filterFields = map[string]filterField{
+	"id":          {"id", "int"},
+	"name":        {"name", "text"},
+	"category":    {"category", "text"},
+	"price":       {"price", "number"},
+	"create_date": {"created_at", "date"},
+	"date":        {"created_at", "date"},
+	"unit":        {"unit", "text"},
+	"unit_size":   {"unit_size", "number"},
+	"unit_price":  {"unit_price", "number"},
+}
+
+// filterOps — операции и число аргументов: -1 — от одного до maxFilterArgs.
+var filterOps = map[string]int{
+	"eq": 1, "ne": 1,
+	"in": -1, "nin": -1,
+	"gt": 1, "gte": 1, "lt": 1, "lte": 1,
+	"between":  2,
+	"contains": 1, "prefix": 1,
+}
+
+// Сравнения осмысленны не для всех типов: больше/меньше — только для чисел и дат,
+// поиск подстроки — только для текста.
+var (
+	orderedOps = []string{"gt", "gte", "lt", "lte", "between"}
+	textOps    = []string{"contains", "prefix"}
+)
+
+const (
+	maxFilterExprs = 20
+	maxFilterArgs  = 1000
+)
+
+// filterExpr — одно условие вида price:gte(100).
+type filterExpr struct {
+	Field string
+	Op    string
+	Args  []any // уже приведены к типу поля
+	text  string
+}
+
+// parseFilterExprs разбирает filter=category:in(food,drinks);price:gte(100);name:contains(milk).
+// Условия объединяются через AND, в том числе между несколькими параметрами filter.
+// Значение с , ; ( ) берётся в двойные кавычки, кавычка внутри удваивается: name:eq("Молоко ""Весёлое""").
+func parseFilterExprs(values []string, errs *ValidationErrors) []filterExpr {
+	var out []filterExpr
+	for _, v := range values {
+		for _, s := range splitOutsideQuotes(v, ';') {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			e, err := parseFilterExpr(s)
+			if err != "" {
+				errs.add("filter", s, err)
+				continue
+			}
+			out = append(out, e)
+		}
+	}
+	if len(out) > maxFilterExprs {
+		errs.add("filter", strconv.Itoa(len(out))+" expressions", "expected at most "+strconv.Itoa(maxFilterExprs)+" expressions")
+	}
+	return out
+}
+
+// parseFilterExpr возвращает условие или причину ошибки.
+func parseFilterExpr(s string) (filterExpr, string) {
+	name, rest, ok := strings.Cut(s, ":")
+	open := strings.IndexByte(rest, '(')
+	if !ok || open < 0 || !strings.HasSuffix(rest, ")") {
+		return filterExpr{}, "expected field:op(value,...)"
+	}
+	e := filterExpr{Field: strings.TrimSpace(name), Op: strings.TrimSpace(rest[:open]), text: s}
+
+	field, ok := filterFields[e.Field]
+	if !ok {
+		return e, "unknown field, expected one of " + strings.Join(filterFieldNames(), ", ")
+	}
+	arity, ok := filterOps[e.Op]
+	if !ok {
+		return e, "unknown op, expected one of eq, ne, in, nin, gt, gte, lt, lte, between, contains, prefix"
+	}
+	switch {
+	case slices.Contains(orderedOps, e.Op) && field.Kind == "text":
+		return e, e.Op + " is not supported for " + e.Field
+	case slices.Contains(textOps, e.Op) && field.Kind != "text":
+		return e, e.Op + " is supported only for name, category and unit"
+	}
+
+	raw, err := splitFilterArgs(rest[open+1 : len(rest)-1])
+	if err != "" {
+		return e, err
+	}
+	switch {
+	case arity > 0 && len(raw) != arity:
+		return e, fmt.Sprintf("%s expects %d argument(s)", e.Op, arity)
+	case arity < 0 && (len(raw) == 0 || len(raw) > maxFilterArgs):
+		return e, fmt.Sprintf("%s expects 1..%d arguments", e.Op, maxFilterArgs)
+	}
+
+	for _, a := range raw {
+		v, err := field.parse(a)
+		if err != "" {
+			return e, err
+		}
+		e.Args = append(e.Args, v)
+	}
+	return e, ""
+}
+
+func (f filterField) parse(s string) (any, string) {
+	switch f.Kind {
+	case "int":
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, "expected integer, got " + strconv.Quote(s)
+		}
+		return v, ""
+	case "number":
+		v, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", "."), 64)
+		if err != nil {
+			return nil, "expected number, got " + strconv.Quote(s)
+		}
+		return v, ""
+	case "date":
+		v, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, "expected YYYY-MM-DD, got " + strconv.Quote(s)
+		}
+		return v, ""
+	}
+	if s == "" {
+		return nil, "empty value"
+	}
+	return s, ""
+}
+
+// cond — условие " AND ..." с плейсхолдерами начиная с argN. В SQL попадают только
+// имя колонки из filterFields и оператор из таблицы ниже, значения — аргументами.
+func (e filterExpr) cond(argN int) (string, []any) {
+	col := filterFields[e.Field].Column
+	switch e.Op {
+	case "in", "nin":
+		not := ""
+		if e.Op == "nin" {
+			not = "NOT "
+		}
+		return fmt.Sprintf(" AND %s %sIN (%s)", col, not, placeholders(argN, len(e.Args))), e.Args
+	case "between":
+		return fmt.Sprintf(" AND %s BETWEEN $%d AND $%d", col, argN, argN+1), e.Args
+	case "contains":
+		return fmt.Sprintf(" AND %s ILIKE $%d", col, argN), []any{"%" + escapeLike(e.Args[0].(string)) + "%"}
+	case "prefix":
+		return fmt.Sprintf(" AND %s LIKE $%d", col, argN), []any{escapeLike(e.Args[0].(string)) + "%"}
+	}
+	op := map[string]string{"eq": "=", "ne": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}[e.Op]
+	return fmt.Sprintf(" AND %s %s $%d", col, op, argN), e.Args
+}
+
+func filterFieldNames() []string {
+	out := make([]string, 0, len(filterFields))
+	for name := range filterFields {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// splitOutsideQuotes делит s по sep, не заглядывая в двойные кавычки и скобки.
+func splitOutsideQuotes(s string, sep rune) []string {
+	var (
+		out      []string
+		start    int
+		depth    int
+		inQuotes bool
+	)
+	for i, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == sep && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+// splitFilterArgs делит аргументы по запятым и снимает кавычки.
+func splitFilterArgs(s string) ([]string, string) {
+	if strings.TrimSpace(s) == "" {
+		return nil, ""
+	}
+	var out []string
+	for _, a := range splitOutsideQuotes(s, ',') {
+		a = strings.TrimSpace(a)
+		if strings.HasPrefix(a, `"`) {
+			if len(a) < 2 || !strings.HasSuffix(a, `"`) {
+				return nil, "unterminated quoted value"
+			}
+			a = strings.ReplaceAll(a[1:len(a)-1], `""`, `"`)
+		}
+		out = append(out, a)
+	}
+	return out, ""
+}
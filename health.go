@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------- dependency health -------------------------
+
+// Зависимости проверяются в фоне раз в HEALTH_CHECK_INTERVAL, каждая со своим таймаутом.
+// /ready и /metrics отдают последний результат, поэтому частые пробы не нагружают зависимости.
+
+// DependencyStatus — состояние одной зависимости в ответе /ready.
+type DependencyStatus struct {
+	Name        string     `json:"name"`
+	Up          bool       `json:"up"`
+	Critical    bool       `json:"critical"` // недоступность критичной зависимости делает сервис not ready
+	Error       string     `json:"error,omitempty"`
+	LatencyMS   int64      `json:"latency_ms"`
+	CheckedAt   *time.Time `json:"checked_at,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+
+	latency time.Duration // точное значение для метрик
+}
+
+type dependency struct {
+	name     string
+	timeout  time.Duration
+	critical bool
+	check    func(ctx context.Context) error
+
+	status DependencyStatus
+}
+
+// healthChecker хранит зависимости и результаты их последних проверок.
+type healthChecker struct {
+	mu   sync.RWMutex
+	deps []*dependency
+}
+
+// newHealthChecker собирает проверки: БД всегда, внешние зависимости — из DEPENDENCIES.
+func newHealthChecker(db *sql.DB) (*healthChecker, error) {
+	h := &healthChecker{}
+	h.add("postgres", envDuration("DB_HEALTH_TIMEOUT", 2*time.Second), true, db.PingContext)
+	if err := h.loadDependencies(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// add регистрирует зависимость; вызывается до start. Интеграции (S3, Kafka и т.п.)
+// добавляют сюда свои проверки при настройке.
+func (h *healthChecker) add(name string, timeout time.Duration, critical bool, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deps = append(h.deps, &dependency{
+		name:     name,
+		timeout:  timeout,
+		critical: critical,
+		check:    check,
+		status:   DependencyStatus{Name: name, Critical: critical},
+	})
+}
+
+// start проверяет зависимости сразу и дальше по расписанию.
+func (h *healthChecker) start(interval time.Duration) {
+	h.checkAll(context.Background())
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			h.checkAll(context.Background())
+		}
+	}()
+}
+
+// checkAll проверяет зависимости параллельно: медленная не задерживает остальные.
+func (h *healthChecker) checkAll(ctx context.Context) {
+	h.mu.RLock()
+	deps := h.deps
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, d := range deps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.checkOne(ctx, d)
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) checkOne(ctx context.Context, d *dependency) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := d.check(ctx)
+	now := time.Now().UTC()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	wasUp := d.status.Up || d.status.CheckedAt == nil
+	d.status.Up = err == nil
+	d.status.latency = time.Since(start)
+	d.status.LatencyMS = d.status.latency.Milliseconds()
+	d.status.CheckedAt = &now
+	d.status.Error = ""
+	if err != nil {
+		d.status.Error = err.Error()
+		if wasUp {
+			log.Printf("dependency %s is down: %v", d.name, err)
+		}
+	} else {
+		d.status.LastSuccess = &now
+	}
+}
+
+// snapshot возвращает копию состояний и общий вердикт готовности.
+func (h *healthChecker) snapshot() ([]DependencyStatus, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ready := true
+	out := make([]DependencyStatus, len(h.deps))
+	for i, d := range h.deps {
+		out[i] = d.status
+		if d.critical && !d.status.Up {
+			ready = false
+		}
+	}
+	return out, ready
+}
+
+// ------------------------- configured dependencies -------------------------
+
+// DependencyConfig — внешняя зависимость из DEPENDENCIES.
+type DependencyConfig struct {
+	URL      string `json:"url"`      // tcp://host:port, redis://host:port, http(s)://...
+	Timeout  string `json:"timeout"`  // по умолчанию DEPENDENCY_TIMEOUT (2s)
+	Optional bool   `json:"optional"` // не влияет на готовность, только видна в /ready и метриках
+}
+
+// loadDependencies регистрирует проверки из DEPENDENCIES, например
+// {"kafka": {"url": "tcp://kafka:9092"}, "webhook": {"url": "https://hooks.example.com/health", "optional": true}}.
+func (h *healthChecker) loadDependencies() error {
+	s := env("DEPENDENCIES", "")
+	if s == "" {
+		return nil
+	}
+	var deps map[string]DependencyConfig
+	if err := json.Unmarshal([]byte(s), &deps); err != nil {
+		return fmt.Errorf("DEPENDENCIES: %w", err)
+	}
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defTimeout := envDuration("DEPENDENCY_TIMEOUT", 2*time.Second)
+	for _, name := range names {
+		cfg := deps[name]
+		timeout := defTimeout
+		if cfg.Timeout != "" {
+			d, err := time.ParseDuration(cfg.Timeout)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("DEPENDENCIES: %s: invalid timeout %q", name, cfg.Timeout)
+			}
+			timeout = d
+		}
+		check, err := dependencyCheck(cfg.URL)
+		if err != nil {
+			return fmt.Errorf("DEPENDENCIES: %s: %w", name, err)
+		}
+		h.add(name, timeout, !cfg.Optional, check)
+	}
+	return nil
+}
+
+func dependencyCheck(raw string) (func(ctx context.Context) error, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return func(ctx context.Context) error { return dialCheck(ctx, u.Host) }, nil
+	case "redis":
+		return func(ctx context.Context) error { return redisCheck(ctx, u.Host) }, nil
+	case "http", "https":
+		return func(ctx context.Context) error { return httpCheck(ctx, raw) }, nil
+	}
+	return nil, fmt.Errorf("unsupported url scheme %q, expected tcp, redis, http or https", u.Scheme)
+}
+
+func dialCheck(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// redisCheck отправляет PING. -NOAUTH тоже означает, что сервер жив: пароль проверяет сама интеграция.
+func redisCheck(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimSpace(line); line != "+PONG" && !strings.HasPrefix(line, "-NOAUTH") {
+		return fmt.Errorf("unexpected reply %q", line)
+	}
+	return nil
+}
+
+func httpCheck(ctx context.Context, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New("http status " + resp.Status)
+	}
+	return nil
+}
+
+// ------------------------- handlers -------------------------
+
+// ReadyResponse — тело /ready.
+type ReadyResponse struct {
+	Status       string             `json:"status"` // ready или not_ready
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// handleReady отвечает 200, если доступны все критичные зависимости, иначе 503.
+// В отличие от /health (жив ли процесс), по /ready балансировщик решает, слать ли трафик.
+func handleReady(h *healthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deps, ready := h.snapshot()
+		resp, status := ReadyResponse{Status: "ready", Dependencies: deps}, http.StatusOK
+		if !ready {
+			resp.Status, status = "not_ready", http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// handleMetrics отдаёт состояние зависимостей в текстовом формате Prometheus.
+func handleMetrics(h *healthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deps, _ := h.snapshot()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintln(w, "# HELP dependency_up Whether the last check of the dependency succeeded.")
+		fmt.Fprintln(w, "# TYPE dependency_up gauge")
+		for _, d := range deps {
+			fmt.Fprintf(w, "dependency_up{name=\"%s\",critical=\"%t\"} %d\n", promLabel(d.Name), d.Critical, boolGauge(d.Up))
+		}
+		fmt.Fprintln(w, "# HELP dependency_check_duration_seconds Duration of the last dependency check.")
+		fmt.Fprintln(w, "# TYPE dependency_check_duration_seconds gauge")
+		for _, d := range deps {
+			fmt.Fprintf(w, "dependency_check_duration_seconds{name=\"%s\"} %g\n", promLabel(d.Name), d.latency.Seconds())
+		}
+		fmt.Fprintln(w, "# HELP dependency_last_success_timestamp_seconds Unix time of the last successful check.")
+		fmt.Fprintln(w, "# TYPE dependency_last_success_timestamp_seconds gauge")
+		for _, d := range deps {
+			var ts int64
+			if d.LastSuccess != nil {
+				ts = d.LastSuccess.Unix()
+			}
+			fmt.Fprintf(w, "dependency_last_success_timestamp_seconds{name=\"%s\"} %d\n", promLabel(d.Name), ts)
+		}
+		pgPool.writeMetrics(w)
+	}
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(s string) string { return promLabelEscaper.Replace(s) }
+
+func boolGauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
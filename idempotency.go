@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ------------------------- Idempotency-Key -------------------------
+
+// maxIdempotencyKeyLen — предельная длина заголовка Idempotency-Key.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyKey достаёт Idempotency-Key запроса. Ключ — печатные символы ASCII: обычно UUID,
+// который клиент генерирует один раз на загрузку и повторяет при переотправке.
+func idempotencyKey(r *http.Request, errs *ValidationErrors) string {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > maxIdempotencyKeyLen || strings.IndexFunc(key, func(c rune) bool { return c < 0x21 || c > 0x7E }) >= 0 {
+		errs.add("Idempotency-Key", key, "expected at most 255 printable ASCII characters without spaces")
+		return ""
+	}
+	return key
+}
+
+// findIdempotentUpload ищет загрузку с тем же Idempotency-Key от того же ключа API за последние
+// IDEMPOTENCY_KEY_TTL и возвращает её сохранённый ответ. Загрузки, отклонённые из карантина
+// или откатанные, не в счёт: их можно повторить. Ключ, уже использованный для другого файла, —
+// CONFLICT: скорее всего, клиент переиспользовал ключ по ошибке.
+func findIdempotentUpload(ctx context.Context, db rowQuerier, opts IngestOptions) (PostResponse, bool, error) {
+	ttl := envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+	if opts.IdempotencyKey == "" || ttl <= 0 {
+		return PostResponse{}, false, nil
+	}
+	var (
+		raw []byte
+		sha string
+	)
+	err := db.QueryRowContext(ctx, `
+		SELECT response, COALESCE(file_sha256, '')
+		FROM uploads
+		WHERE api_key = $1 AND idempotency_key = $2 AND response IS NOT NULL
+		  AND status NOT IN ('rejected', 'rolled_back')
+		  AND uploaded_at > now() - make_interval(secs => $3)
+		ORDER BY id DESC
+		LIMIT 1;
+	`, opts.KeyName, opts.IdempotencyKey, ttl.Seconds()).Scan(&raw, &sha)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PostResponse{}, false, nil
+	}
+	if err != nil {
+		return PostResponse{}, false, dbError("db query failed", err)
+	}
+	if sha != opts.FileSHA256 {
+		return PostResponse{}, false, codedError(CodeConflict, "idempotency key already used for a different file")
+	}
+	var resp PostResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return PostResponse{}, false, dbError("db query failed", err)
+	}
+	return resp, true, nil
+}
+
+// lockIdempotencyKeyTx не даёт двум одновременным запросам с одним ключом оба пройти
+// findIdempotentUpload: второй ждёт коммита первого и получает его ответ.
+func lockIdempotencyKeyTx(ctx context.Context, tx *sql.Tx, opts IngestOptions) error {
+	if opts.IdempotencyKey == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 1))`,
+		opts.KeyName+"\x00"+opts.IdempotencyKey)
+	return err
+}
+
+// storeUploadResponseTx сохраняет ответ загрузки для повторов с тем же Idempotency-Key.
+func storeUploadResponseTx(ctx context.Context, tx *sql.Tx, id int64, opts IngestOptions, resp PostResponse) error {
+	if opts.IdempotencyKey == "" {
+		return nil
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE uploads SET response = $2 WHERE id = $1`, id, b)
+	return err
+}
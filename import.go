@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ------------------------- import from url -------------------------
+
+// POST /api/v0/prices/import: сервис сам скачивает архив по url или из бакета S3 (см. s3.go)
+// и загружает его так же, как POST /api/v0/prices, — клиенту с файлами на HTTP-хранилище
+// (S3, CDN, файловый сервер) не нужно прокачивать гигабайты через свою машину.
+// Параметры загрузки — те же, в query.
+
+// ImportRequest — тело POST /api/v0/prices/import: url или bucket и key.
+type ImportRequest struct {
+	URL    string `json:"url"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Type   string `json:"type"` // как ?type= у POST /api/v0/prices; пусто — по Content-Type ответа и сигнатуре
+	// Password — пароль архива; можно и в X-Archive-Password.
+	Password string `json:"password"`
+}
+
+// importSource — откуда скачать файл импорта.
+type importSource struct {
+	req    *http.Request // контекст задаёт downloadImport
+	client *http.Client
+	name   string // для журнала и ошибок: без учётных данных и подписи
+}
+
+// errImportPrivate — адрес url во внутренней сети, а IMPORT_ALLOW_PRIVATE не включён.
+var errImportPrivate = errors.New("url resolves to a private or loopback address")
+
+// receiveImport — uploadReceiver для импорта: разбирает тело, скачивает файл во
+// временный файл и открывает его, как receiveUpload — тело запроса.
+func receiveImport(w http.ResponseWriter, r *http.Request) (opts IngestOptions, files csvFiles, cleanup func(), ok bool) {
+	var req ImportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, CodeInvalidJSON, "invalid json: expected {\"url\": \"...\"} or {\"bucket\": \"...\", \"key\": \"...\"}")
+		return opts, nil, nil, false
+	}
+	var (
+		src importSource
+		err error
+	)
+	switch {
+	case req.URL != "" && (req.Bucket != "" || req.Key != ""):
+		err = codedError(CodeInvalidRequest, "use either url or bucket and key, not both")
+	case req.Bucket != "" || req.Key != "":
+		src, err = s3Source(req.Bucket, req.Key)
+	default:
+		src, err = urlSource(req.URL)
+	}
+	if err != nil {
+		writeErrorFrom(w, err)
+		return opts, nil, nil, false
+	}
+	archiveType, defaultType, ok := uploadType(w, req.Type)
+	if !ok {
+		return opts, nil, nil, false
+	}
+	if opts, ok = receiveIngestOptions(w, r); !ok {
+		return opts, nil, nil, false
+	}
+
+	body, size, ct, err := downloadImport(r.Context(), src)
+	if err != nil {
+		writeErrorFrom(w, err)
+		return opts, nil, nil, false
+	}
+	// Страница ошибки или входа вместо файла: без явного type не разбираем её как zip.
+	if archiveType == "" && unsupportedUploadType(ct) {
+		removeSpool(body)
+		writeError(w, CodeUnsupportedMedia, "url returned content type "+ct+": expected an archive or a data file, pass type to override")
+		return opts, nil, nil, false
+	}
+	opts.Archive.Password = r.Header.Get("X-Archive-Password")
+	if opts.Archive.Password == "" {
+		opts.Archive.Password = req.Password
+	}
+	slog.Info("import downloaded", "source", src.name, "size", size, "content_type", ct)
+	return openUpload(w, opts, archiveType, defaultType, ct, body, size)
+}
+
+// urlSource — скачивание по url импорта.
+func urlSource(s string) (importSource, error) {
+	u, err := importURL(s)
+	if err != nil {
+		return importSource{}, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return importSource{}, codedError(CodeInvalidRequest, "url must be an absolute http or https url")
+	}
+	return importSource{req: req, client: importClient(), name: importLogURL(u)}, nil
+}
+
+// importURL проверяет url импорта: http или https, хост из IMPORT_ALLOWED_HOSTS, если он задан.
+func importURL(s string) (*url.URL, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, codedError(CodeInvalidRequest, "url required")
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, codedError(CodeInvalidRequest, "url must be an absolute http or https url")
+	}
+	if !importHostAllowed(u.Hostname()) {
+		return nil, codedError(CodeInvalidRequest, "url host "+u.Hostname()+" is not in IMPORT_ALLOWED_HOSTS")
+	}
+	return u, nil
+}
+
+// importHostAllowed — хост есть в IMPORT_ALLOWED_HOSTS (через запятую; *.example.com —
+// любой поддомен). Пустой список — любой хост.
+func importHostAllowed(host string) bool {
+	list := strings.TrimSpace(env("IMPORT_ALLOWED_HOSTS", ""))
+	if list == "" {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, h := range strings.Split(list, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch {
+		case h == "":
+		case h == host:
+			return true
+		case strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// importLogURL — url без учётных данных и query: в query подписанных ссылок S3 лежит подпись.
+func importLogURL(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.EscapedPath()
+}
+
+// importClient — HTTP-клиент импорта. Без IMPORT_ALLOW_PRIVATE соединения с внутренними
+// адресами запрещены на уровне сокета: проверяется адрес, к которому действительно
+// подключаемся, в т.ч. после редиректа или смены DNS, а не имя из url. Прокси из
+// окружения не используется — иначе проверялся бы адрес прокси.
+func importClient() *http.Client {
+	allowPrivate := envBool("IMPORT_ALLOW_PRIVATE", false)
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip != nil && !allowPrivate && privateIP(ip) {
+				return errImportPrivate
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if _, err := importURL(req.URL.String()); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// downloadImport скачивает файл src во временный файл — не больше IMPORT_MAX_SIZE байт
+// (по умолчанию MAX_UPLOAD_SIZE) и не дольше IMPORT_TIMEOUT (по умолчанию 10 минут).
+// Возвращает файл, его размер и Content-Type ответа; файл удаляет вызывающий через removeSpool.
+func downloadImport(ctx context.Context, src importSource) (_ *os.File, size int64, ct string, err error) {
+	maxSize := envInt64("IMPORT_MAX_SIZE", envInt64("MAX_UPLOAD_SIZE", 50<<20))
+	ctx, cancel := context.WithTimeout(ctx, envDuration("IMPORT_TIMEOUT", 10*time.Minute))
+	defer cancel()
+
+	resp, err := src.client.Do(src.req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, "", importError(ctx, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, "", codedError(CodeImportFailed, "download failed: "+src.name+" returned "+resp.Status+s3ErrorCode(resp))
+	}
+	if resp.ContentLength > maxSize {
+		return nil, 0, "", codedError(CodeLimitExceeded, fmt.Sprintf("file at url exceeds %d bytes", maxSize))
+	}
+
+	f, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxSize+1))
+	switch {
+	case err != nil:
+		err = importError(ctx, err)
+	case n > maxSize:
+		err = codedError(CodeLimitExceeded, fmt.Sprintf("file at url exceeds %d bytes", maxSize))
+	case resp.ContentLength >= 0 && n != resp.ContentLength:
+		err = codedError(CodeImportFailed, "download failed: connection closed before the end of the file")
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(f)
+		return nil, 0, "", err
+	}
+	return f, n, resp.Header.Get("Content-Type"), nil
+}
+
+// importError — ошибка скачивания с кодом: внутренний адрес — ошибка запроса,
+// таймаут и сетевые ошибки — IMPORT_FAILED.
+func importError(ctx context.Context, err error) error {
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		// Редирект на url, который не прошёл importURL.
+		return ae
+	case errors.Is(err, errImportPrivate):
+		return codedError(CodeInvalidRequest, errImportPrivate.Error()+": set IMPORT_ALLOW_PRIVATE=true to allow it")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &apiError{Code: CodeImportFailed, Message: "download timed out", Err: err}
+	}
+	return &apiError{Code: CodeImportFailed, Message: "download failed", Err: err}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ------------------------- ingest jobs -------------------------
+
+// IngestJob — фоновая загрузка (POST /api/v0/prices?async=true).
+type IngestJob struct {
+	ID            string         `json:"id"`
+	Status        string         `json:"status"`         // queued | running | done | failed
+	ProcessedRows int64          `json:"processed_rows"` // сколько строк data.csv уже прочитано
+	HTTPStatus    int            `json:"http_status,omitempty"`
+	Result        *PostResponse  `json:"result,omitempty"` // тот же ответ, что у синхронной загрузки
+	Error         *ErrorResponse `json:"error,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	StartedAt     *time.Time     `json:"started_at,omitempty"`
+	FinishedAt    *time.Time     `json:"finished_at,omitempty"`
+
+	progress *atomic.Int64
+}
+
+// ingestTask — работа одной задачи: загрузка и удаление временного файла после неё.
+type ingestTask struct {
+	job     *IngestJob
+	run     func(ctx context.Context) (PostResponse, int, error)
+	cleanup func()
+}
+
+// ingestJobs — очередь фоновых загрузок и их статусы. Статусы живут в памяти процесса:
+// после перезапуска задача не найдётся, а её загрузку видно в uploads/stats.
+type ingestJobs struct {
+	mu    sync.Mutex
+	m     map[string]*IngestJob
+	queue chan ingestTask
+	ttl   time.Duration // сколько помнить завершённые задачи
+}
+
+// startIngestJobs запускает INGEST_JOB_WORKERS воркеров; в очереди ждут до INGEST_JOB_QUEUE задач.
+func startIngestJobs() *ingestJobs {
+	j := &ingestJobs{
+		m:     make(map[string]*IngestJob),
+		queue: make(chan ingestTask, min(max(envInt64("INGEST_JOB_QUEUE", 100), 1), 10000)),
+		ttl:   envDuration("INGEST_JOB_TTL", 24*time.Hour),
+	}
+	for range min(max(envInt64("INGEST_JOB_WORKERS", 2), 1), 64) {
+		go j.worker()
+	}
+	return j
+}
+
+// submit ставит загрузку в очередь и возвращает снимок задачи; при полной очереди — QUEUE_FULL.
+func (j *ingestJobs) submit(run func(ctx context.Context) (PostResponse, int, error), progress *atomic.Int64, cleanup func()) (IngestJob, error) {
+	job := &IngestJob{ID: newID(), Status: "queued", CreatedAt: time.Now().UTC(), progress: progress}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	select {
+	case j.queue <- ingestTask{job: job, run: run, cleanup: cleanup}:
+	default:
+		return IngestJob{}, codedError(CodeQueueFull, "ingest queue is full")
+	}
+	j.forgetExpired(job.CreatedAt)
+	j.m[job.ID] = job
+	return job.snapshot(), nil
+}
+
+func (j *ingestJobs) worker() {
+	for t := range j.queue {
+		j.update(t.job, func(job *IngestJob) {
+			now := time.Now().UTC()
+			job.Status, job.StartedAt = "running", &now
+		})
+
+		// Клиент уже получил ответ: загрузка не должна зависеть от жизни запроса.
+		resp, status, err := t.run(context.Background())
+		t.cleanup()
+
+		j.update(t.job, func(job *IngestJob) {
+			now := time.Now().UTC()
+			job.FinishedAt, job.HTTPStatus = &now, status
+			if err != nil {
+				slog.Info("ingest job failed", "job_id", job.ID, "error", err)
+				e := errorResponse(err)
+				job.Status, job.Error = "failed", &e
+				return
+			}
+			job.Status, job.Result = "done", &resp
+		})
+	}
+}
+
+func (j *ingestJobs) update(job *IngestJob, fn func(*IngestJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(job)
+}
+
+// forgetExpired удаляет задачи, завершённые раньше чем ttl назад. Вызывается под j.mu.
+func (j *ingestJobs) forgetExpired(now time.Time) {
+	for id, job := range j.m {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > j.ttl {
+			delete(j.m, id)
+		}
+	}
+}
+
+func (j *ingestJobs) get(id string) (IngestJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.m[id]
+	if !ok {
+		return IngestJob{}, false
+	}
+	return job.snapshot(), true
+}
+
+// snapshot — копия для ответа с текущим прогрессом. Вызывается под j.mu.
+func (job *IngestJob) snapshot() IngestJob {
+	out := *job
+	if job.progress != nil {
+		out.ProcessedRows = job.progress.Load()
+	}
+	return out
+}
+
+func handleJobStatus(jobs *ingestJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.get(r.PathValue("id"))
+		if !ok {
+			writeError(w, CodeNotFound, "job not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(job)
+	}
+}
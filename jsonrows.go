@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+)
+
+// ------------------------- json and ndjson -------------------------
+
+// Загрузка без CSV и архива для программных клиентов: массив объектов цен (type=json,
+// Content-Type: application/json) или по объекту на строку (type=ndjson,
+// Content-Type: application/x-ndjson). Объекты переводятся в строки CSV по колонкам схемы
+// и проходят тот же разбор, валидацию, дедупликацию и вставку, что и data.csv.
+
+// jsonUploadType — тип загрузки по Content-Type: json, ndjson или пусто.
+func jsonUploadType(ct string) string {
+	mt, _, _ := mime.ParseMediaType(ct)
+	switch mt {
+	case "application/json":
+		return "json"
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return "ndjson"
+	}
+	return ""
+}
+
+// sniffJSON — json, если тело начинается с '[', ndjson — с '{'.
+func sniffJSON(head []byte) string {
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if bytes.HasPrefix(head, utf8BOM) {
+		head = bytes.TrimLeft(head[len(utf8BOM):], " \t\r\n")
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("[")):
+		return "json"
+	case bytes.HasPrefix(head, []byte("{")):
+		return "ndjson"
+	}
+	return ""
+}
+
+// openJSONRows отдаёт тело загрузки как один CSV-файл без заголовка: строка CSV номер N —
+// N-й объект массива (json) или N-я строка файла (ndjson), так что line в errors указывает
+// на объект. Поля объекта — колонки схемы (id, name, category, price, create_date, в
+// схеме 2 ещё currency и quantity, в схеме 3 — и unit, unit_size); строки и числа берутся как есть, null — пустое поле,
+// остальные поля объекта не читаются.
+func openJSONRows(r io.ReadCloser, kind string, opts IngestOptions) csvFiles {
+	name := "data." + kind
+	pr, pw := io.Pipe()
+	go func() {
+		write := writeJSONArrayCSV
+		if kind == "ndjson" {
+			write = writeNDJSONCSV
+		}
+		pw.CloseWithError(write(r, opts.Schema.Columns, csv.NewWriter(pw), name))
+	}()
+	return &jsonRows{name: name, r: opts.Archive.limitCSV(name, pr, func() { _ = pr.Close() }), body: r}
+}
+
+type jsonRows struct {
+	name string
+	r    io.ReadCloser
+	body io.Closer
+	done bool
+}
+
+func (j *jsonRows) next() (string, io.Reader, error) {
+	if j.done {
+		return "", nil, io.EOF
+	}
+	j.done = true
+	return j.name, j.r, nil
+}
+
+func (j *jsonRows) Close() error {
+	_ = j.r.Close()
+	return j.body.Close()
+}
+
+func writeJSONArrayCSV(r io.Reader, columns []string, cw *csv.Writer, name string) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return codedError(CodeCSVInvalid, "invalid json in "+name+": expected an array of price objects")
+	}
+	for n := 1; dec.More(); n++ {
+		var obj map[string]any
+		if err := dec.Decode(&obj); err != nil {
+			return codedError(CodeCSVInvalid, fmt.Sprintf("invalid json in %s: element %d: expected a price object", name, n))
+		}
+		if err := writeJSONRecord(cw, obj, columns, name, n); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return codedError(CodeCSVInvalid, "invalid json in "+name+": unterminated array")
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeNDJSONCSV: пустые строки файла становятся пустыми строками CSV — их пропустит
+// разбор, а номера следующих строк не собьются.
+func writeNDJSONCSV(r io.Reader, columns []string, cw *csv.Writer, name string) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 1 {
+			line = bytes.TrimPrefix(line, utf8BOM)
+		}
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			_ = cw.Write([]string{""})
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		var obj map[string]any
+		if err := dec.Decode(&obj); err != nil || dec.More() {
+			return codedError(CodeCSVInvalid, fmt.Sprintf("invalid json in %s: line %d: expected a price object", name, n))
+		}
+		if err := writeJSONRecord(cw, obj, columns, name, n); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSONRecord пишет объект строкой CSV в порядке колонок схемы.
+func writeJSONRecord(cw *csv.Writer, obj map[string]any, columns []string, name string, n int) error {
+	rec := make([]string, len(columns))
+	for i, col := range columns {
+		switch v := obj[col].(type) {
+		case nil:
+		case string:
+			rec[i] = v
+		case json.Number:
+			rec[i] = v.String()
+		case bool:
+			rec[i] = strconv.FormatBool(v)
+		default:
+			return codedError(CodeCSVInvalid, fmt.Sprintf("invalid json in %s: object %d: %s must be a string or a number", name, n, col))
+		}
+	}
+	return cw.Write(rec)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// ------------------------- kafka consumer -------------------------
+
+// Потоковая загрузка без второго сервиса: с KAFKA_BROKERS и KAFKA_TOPIC сервис читает из
+// топика сообщения с ценами — по JSON-объекту на сообщение, как строка ndjson-загрузки — и
+// складывает их пачками в обычные загрузки: те же разбор, валидация, дедупликация, история
+// импортов, предагрегаты и оповещения. Итоги пачки пишутся в журнал и, с KAFKA_STATS_TOPIC,
+// публикуются в Kafka. Смещения фиксируются после загрузки пачки: при падении пачка
+// читается заново, а повтор строк отсекает дедупликация.
+
+// KafkaBatchStats — итоги пачки сообщений; так же публикуются в KAFKA_STATS_TOPIC.
+type KafkaBatchStats struct {
+	Topic      string           `json:"topic"`
+	Partitions []KafkaPartition `json:"partitions"`
+	Messages   int              `json:"messages"`
+	// InvalidMessages — сообщения, которые не JSON-объект: в загрузку не попали.
+	InvalidMessages int           `json:"invalid_messages"`
+	UploadID        int64         `json:"upload_id,omitempty"`
+	Upload          *PostResponse `json:"upload,omitempty"`
+	// Error и Code — загрузка пачки отклонена целиком (on_duplicate=error, columns=reject_file).
+	Error      string    `json:"error,omitempty"`
+	Code       ErrorCode `json:"code,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// KafkaPartition — смещения пачки в одной партиции, включительно.
+type KafkaPartition struct {
+	Partition   int   `json:"partition"`
+	FirstOffset int64 `json:"first_offset"`
+	LastOffset  int64 `json:"last_offset"`
+}
+
+type kafkaConsumer struct {
+	reader *kafka.Reader
+	stats  *kafka.Writer // nil — итоги только в журнал
+	topic  string
+
+	db       *sql.DB
+	rules    *liveRules
+	rollups  *rollupRefresher
+	alerts   *Alerting
+	readOnly *readOnlyMode
+	opts     IngestOptions
+
+	batchSize int
+	batchWait time.Duration
+}
+
+// startKafkaConsumer запускает чтение топика, если заданы KAFKA_BROKERS и KAFKA_TOPIC;
+// без них ничего не делает. Ошибка — настройки неверны.
+func startKafkaConsumer(db *sql.DB, rules *liveRules, rollups *rollupRefresher, alerts *Alerting, readOnly *readOnlyMode) error {
+	brokers := nonEmptyValues(strings.Split(env("KAFKA_BROKERS", ""), ","))
+	topic := strings.TrimSpace(env("KAFKA_TOPIC", ""))
+	if len(brokers) == 0 && topic == "" {
+		return nil
+	}
+	if len(brokers) == 0 || topic == "" {
+		return fmt.Errorf("set both KAFKA_BROKERS and KAFKA_TOPIC")
+	}
+	mechanism, err := kafkaSASL()
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if envBool("KAFKA_TLS", false) {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	opts, err := kafkaIngestOptions(topic)
+	if err != nil {
+		return err
+	}
+
+	c := &kafkaConsumer{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     brokers,
+			GroupID:     env("KAFKA_GROUP_ID", "prices-api"),
+			Topic:       topic,
+			MaxBytes:    10 << 20,
+			StartOffset: kafka.FirstOffset,
+			Dialer:      &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true, SASLMechanism: mechanism, TLS: tlsConfig},
+		}),
+		topic:     topic,
+		db:        db,
+		rules:     rules,
+		rollups:   rollups,
+		alerts:    alerts,
+		readOnly:  readOnly,
+		opts:      opts,
+		batchSize: int(envInt64("KAFKA_BATCH_SIZE", 1000)),
+		batchWait: envDuration("KAFKA_BATCH_WAIT", 5*time.Second),
+	}
+	if c.batchSize <= 0 {
+		return fmt.Errorf("KAFKA_BATCH_SIZE: expected a positive integer")
+	}
+	if statsTopic := strings.TrimSpace(env("KAFKA_STATS_TOPIC", "")); statsTopic != "" {
+		c.stats = &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        statsTopic,
+			RequiredAcks: kafka.RequireAll,
+			Transport:    &kafka.Transport{SASL: mechanism, TLS: tlsConfig},
+		}
+	}
+	slog.Info("kafka consumer started", "topic", topic, "group_id", env("KAFKA_GROUP_ID", "prices-api"),
+		"batch_size", c.batchSize, "batch_wait", c.batchWait)
+	go c.run(context.Background())
+	return nil
+}
+
+// kafkaSASL — механизм SASL из KAFKA_SASL_MECHANISM (plain, scram-sha-256, scram-sha-512)
+// с KAFKA_USERNAME и KAFKA_PASSWORD; пусто — без аутентификации.
+func kafkaSASL() (sasl.Mechanism, error) {
+	user, password := env("KAFKA_USERNAME", ""), env("KAFKA_PASSWORD", "")
+	switch m := strings.ToLower(env("KAFKA_SASL_MECHANISM", "")); m {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: user, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, user, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, user, password)
+	default:
+		return nil, fmt.Errorf("KAFKA_SASL_MECHANISM: expected plain, scram-sha-256 or scram-sha-512, got %q", m)
+	}
+}
+
+// kafkaIngestOptions — настройки загрузки пачек: параметры POST /api/v0/prices из
+// KAFKA_INGEST_PARAMS (schema=2&dedupe=no_date&on_duplicate=replace) и их умолчания.
+// Поставщик по умолчанию — kafka:<топик>.
+func kafkaIngestOptions(topic string) (IngestOptions, error) {
+	q, err := url.ParseQuery(env("KAFKA_INGEST_PARAMS", ""))
+	if err != nil {
+		return IngestOptions{}, fmt.Errorf("KAFKA_INGEST_PARAMS: %w", err)
+	}
+	if q.Get("supplier") == "" {
+		q.Set("supplier", "kafka:"+topic)
+	}
+	opts, err := parseIngestOptions(&http.Request{URL: &url.URL{RawQuery: q.Encode()}, Header: http.Header{}})
+	if err != nil {
+		return opts, fmt.Errorf("KAFKA_INGEST_PARAMS: %w", err)
+	}
+	if opts.Async || opts.Detach {
+		return opts, fmt.Errorf("KAFKA_INGEST_PARAMS: async and detach do not apply to kafka batches")
+	}
+	// Сообщения — объекты по колонкам схемы, как в ndjson-загрузке.
+	opts.Delimiter, opts.Encoding, opts.HasHeader = ",", "utf-8", "false"
+	opts.ArchiveType = "kafka"
+	return opts, nil
+}
+
+// run читает пачки, пока жив процесс. Пачка, которую не удалось записать из-за временной
+// ошибки БД, повторяется, пока не запишется: смещения не двигаются.
+func (c *kafkaConsumer) run(ctx context.Context) {
+	retry := envDuration("DB_RETRY_AFTER", 5*time.Second)
+	var batch []kafka.Message
+	for {
+		if c.readOnly.get().Enabled {
+			// В режиме только для чтения сообщения копятся в топике.
+			time.Sleep(retry)
+			continue
+		}
+		if len(batch) == 0 {
+			var err error
+			if batch, err = c.fetch(ctx); err != nil {
+				slog.Error("kafka fetch failed", "topic", c.topic, "error", err)
+				time.Sleep(retry)
+				continue
+			}
+		}
+
+		stats, err := c.ingest(ctx, batch)
+		if err != nil && transientDBError(err) {
+			slog.Warn("kafka batch will be retried", "topic", c.topic, "messages", len(batch), "error", err)
+			time.Sleep(retry)
+			continue
+		}
+		c.publish(ctx, stats)
+		if err := c.reader.CommitMessages(ctx, batch...); err != nil {
+			// Пачка придёт снова после перебалансировки; повтор строк отсечёт дедупликация.
+			slog.Error("kafka commit failed", "topic", c.topic, "error", err)
+		}
+		batch = nil
+	}
+}
+
+// fetch ждёт первое сообщение сколько угодно, а следующие — не дольше KAFKA_BATCH_WAIT
+// от первого или до KAFKA_BATCH_SIZE сообщений.
+func (c *kafkaConsumer) fetch(ctx context.Context) ([]kafka.Message, error) {
+	m, err := c.reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch := []kafka.Message{m}
+	waitCtx, cancel := context.WithTimeout(ctx, c.batchWait)
+	defer cancel()
+	for len(batch) < c.batchSize {
+		m, err := c.reader.FetchMessage(waitCtx)
+		if err != nil {
+			// KAFKA_BATCH_WAIT вышел или чтение сбоит: записываем то, что уже прочитано.
+			break
+		}
+		batch = append(batch, m)
+	}
+	return batch, nil
+}
+
+// ingest записывает пачку одной загрузкой. Сообщение N пачки — строка N загрузки: так
+// line в отклонённых строках указывает на сообщение. Ошибка — только временная ошибка БД,
+// остальные отказы попадают в итоги.
+func (c *kafkaConsumer) ingest(ctx context.Context, batch []kafka.Message) (KafkaBatchStats, error) {
+	start := time.Now()
+	stats := KafkaBatchStats{Topic: c.topic, Partitions: kafkaPartitions(batch), Messages: len(batch)}
+
+	var buf bytes.Buffer
+	for _, m := range batch {
+		value := bytes.TrimSpace(m.Value)
+		if !bytes.HasPrefix(value, []byte("{")) || json.Compact(&buf, value) != nil {
+			// Пустая строка пропускается разбором, а номера следующих строк не сбиваются.
+			stats.InvalidMessages++
+		}
+		buf.WriteByte('\n')
+	}
+
+	opts := c.opts
+	opts.ArchiveSize = int64(buf.Len())
+	files := openJSONRows(io.NopCloser(&buf), "ndjson", opts)
+	defer files.Close()
+	ev, err := ingestCSV(ctx, c.db, c.rules.get().forUpload(opts), opts, files)
+	switch {
+	case err != nil && transientDBError(err):
+		return stats, err
+	case err != nil:
+		stats.Error, stats.Code = err.Error(), errorCode(err)
+	default:
+		if ev.Response.Status != uploadPending {
+			ev.afterCommit(c.rollups, c.alerts, opts.Backfill)
+		}
+		resp := opts.response(ev.Response)
+		stats.UploadID, stats.Upload = ev.ID, &resp
+	}
+	stats.DurationMS = time.Since(start).Milliseconds()
+	stats.FinishedAt = time.Now().UTC()
+	return stats, nil
+}
+
+// kafkaPartitions — первое и последнее смещение пачки в каждой партиции.
+func kafkaPartitions(batch []kafka.Message) []KafkaPartition {
+	var out []KafkaPartition
+	idx := map[int]int{}
+	for _, m := range batch {
+		i, ok := idx[m.Partition]
+		if !ok {
+			idx[m.Partition] = len(out)
+			out = append(out, KafkaPartition{Partition: m.Partition, FirstOffset: m.Offset, LastOffset: m.Offset})
+			continue
+		}
+		out[i].FirstOffset, out[i].LastOffset = min(out[i].FirstOffset, m.Offset), max(out[i].LastOffset, m.Offset)
+	}
+	return out
+}
+
+// publish пишет итоги пачки в журнал и в KAFKA_STATS_TOPIC. Сбой публикации не останавливает
+// чтение: итоги есть и в журнале, и в истории импортов.
+func (c *kafkaConsumer) publish(ctx context.Context, stats KafkaBatchStats) {
+	attrs := []any{"topic", stats.Topic, "messages", stats.Messages, "invalid_messages", stats.InvalidMessages,
+		"duration_ms", stats.DurationMS}
+	switch {
+	case stats.Error != "":
+		slog.Warn("kafka batch rejected", append(attrs, "code", stats.Code, "error", stats.Error)...)
+	case stats.Upload != nil:
+		slog.Info("kafka batch ingested", append(attrs, "upload_id", stats.UploadID, "total_count", stats.Upload.TotalCount,
+			"total_items", stats.Upload.TotalItems, "duplicates_count", stats.Upload.DuplicatesCount)...)
+	}
+	if c.stats == nil {
+		return
+	}
+	body, err := json.Marshal(stats)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := c.stats.WriteMessages(ctx, kafka.Message{Key: []byte(stats.Topic), Value: body}); err != nil {
+		slog.Error("kafka stats publish failed", "topic", c.stats.Topic, "error", err)
+	}
+}
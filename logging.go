@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ------------------------- logging -------------------------
+
+// Логи пишутся через log/slog сразу в несколько приёмников из LOG_OUTPUTS; старые вызовы
+// log.Printf попадают туда же с уровнем INFO. Уровень меняется на лету админским
+// эндпоинтом — например, чтобы включить debug во время инцидента без перезапуска.
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// setupLogging настраивает slog по LOG_OUTPUTS (stdout, stderr, file, syslog через запятую),
+// LOG_LEVEL и LOG_FORMAT (text или json). Возвращает уровень, который можно менять на лету.
+func setupLogging() (*slog.LevelVar, error) {
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(env("LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+
+	var sinks []io.Writer
+	for _, name := range strings.Split(env("LOG_OUTPUTS", "stdout"), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "stdout":
+			sinks = append(sinks, os.Stdout)
+		case "stderr":
+			sinks = append(sinks, os.Stderr)
+		case "file":
+			f, err := openRotatingFile(env("LOG_FILE", "prices-service.log"),
+				envInt64("LOG_FILE_MAX_SIZE", 100<<20), int(envInt64("LOG_FILE_MAX_BACKUPS", 5)))
+			if err != nil {
+				return nil, fmt.Errorf("LOG_FILE: %w", err)
+			}
+			sinks = append(sinks, f)
+		case "syslog":
+			w, err := openSyslog(env("LOG_SYSLOG_TAG", "prices-service"))
+			if err != nil {
+				return nil, fmt.Errorf("syslog: %w", err)
+			}
+			sinks = append(sinks, w)
+		default:
+			return nil, fmt.Errorf("LOG_OUTPUTS: unknown output %s, expected stdout, stderr, file or syslog", name)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format := env("LOG_FORMAT", "text"); format {
+	case "text":
+		h = slog.NewTextHandler(fanout(sinks), opts)
+	case "json":
+		h = slog.NewJSONHandler(fanout(sinks), opts)
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT: expected text or json, got %s", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return level, nil
+}
+
+// fanout пишет каждую запись во все приёмники. В отличие от io.MultiWriter, отказ одного
+// (переполненный диск, недоступный syslog) не мешает остальным.
+type fanout []io.Writer
+
+func (f fanout) Write(p []byte) (int, error) {
+	for _, w := range f {
+		_, _ = w.Write(p)
+	}
+	return len(p), nil
+}
+
+// ------------------------- rotating file -------------------------
+
+// rotatingFile — файл лога, который при превышении maxSize переименовывается в path.1
+// (прежний path.1 — в path.2 и т.д.); хранится не больше backups старых файлов.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.backups > 0 {
+		_ = os.Rename(r.path, r.path+".1")
+	} else {
+		_ = os.Remove(r.path)
+	}
+	return r.open()
+}
+
+// ------------------------- handlers -------------------------
+
+// LogLevel — тело GET/PUT /api/v0/admin/log-level.
+type LogLevel struct {
+	Level string `json:"level"` // debug, info, warn или error
+}
+
+func handleLogLevelGet(level *slog.LevelVar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(LogLevel{Level: strings.ToLower(level.Level().String())})
+	}
+}
+
+// handleLogLevelSet меняет уровень логирования на этом экземпляре до перезапуска
+// или следующего изменения: {"level": "debug"}.
+func handleLogLevelSet(level *slog.LevelVar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LogLevel
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, CodeInvalidJSON, "invalid json")
+			return
+		}
+		var l slog.Level
+		name := strings.ToLower(strings.TrimSpace(req.Level))
+		if err := l.UnmarshalText([]byte(name)); err != nil || !slices.Contains(logLevelNames, name) {
+			writeError(w, CodeInvalidRequest, "level: expected one of "+strings.Join(logLevelNames, ", "))
+			return
+		}
+		if old := level.Level(); old != l {
+			level.Set(l)
+			log.Printf("log level changed: %s -> %s", old, l)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(LogLevel{Level: name})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// openSyslog подключается к локальному syslog или к LOG_SYSLOG_ADDR (udp://host:514, tcp://host:514).
+// Уровень записи виден в тексте сообщения, приоритет syslog у всех записей — info.
+func openSyslog(tag string) (io.Writer, error) {
+	if addr := env("LOG_SYSLOG_ADDR", ""); addr != "" {
+		network, raddr, ok := strings.Cut(addr, "://")
+		if !ok {
+			network, raddr = "udp", addr
+		}
+		return syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	}
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
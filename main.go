@@ -5,23 +5,38 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"maps"
 	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/lib/pq"
 )
 
 type PostResponse struct {
@@ -29,7 +44,135 @@ type PostResponse struct {
 	DuplicatesCount int     `json:"duplicates_count"` // Количество дубликатов (дубль = совпадают все поля кроме id) + дубли в БД
 	TotalItems      int     `json:"total_items"`      // Количество успешно добавленных элементов в текущей загрузке
 	TotalCategories int     `json:"total_categories"` // Общее количество категорий по всей БД
+	TotalProducts   int     `json:"total_products"`   // Разных товаров (name без учёта регистра) по всей БД
 	TotalPrice      float64 `json:"total_price"`      // Суммарная стоимость по всей БД (в основных единицах, напр. 1000.50)
+
+	// Inserted — итоги по строкам, вставленным этой загрузкой, а не по всей БД: по ним
+	// автоматические проверки судят о самом файле. Нет, если ничего не вставлено.
+	Inserted *InsertedStats `json:"inserted,omitempty"`
+
+	// NewCategories — категории, которых не было в БД до этой загрузки, и сколько строк в них
+	// вставлено. Опечатка в категории заводит новую, и без этого списка её видно лишь по stats.
+	NewCategories []NewCategory `json:"new_categories,omitempty"`
+
+	// Какой период покрывает БД после загрузки: самая ранняя и самая поздняя create_date.
+	// Нет в ответе на повтор файла (duplicate_upload).
+	FirstDate string `json:"first_date,omitempty"`
+	LastDate  string `json:"last_date,omitempty"`
+
+	// Только dedupe=price_list (строки прайса, у которых изменилась цена) и on_duplicate=replace.
+	UpdatedCount int `json:"updated_count,omitempty"`
+
+	// UploadID — номер загрузки в uploads. Только для карантина (quarantine=true) и его approve:
+	// статус (pending или approved) и сколько строк ждёт проверки.
+	UploadID    int64  `json:"upload_id,omitempty"`
+	Status      string `json:"status,omitempty"`
+	StagedCount int    `json:"staged_count,omitempty"`
+
+	// RejectedURL — где скачать rejected.csv, если в файле были отклонённые строки.
+	RejectedURL string `json:"rejected_url,omitempty"`
+
+	// Повтор файла, уже загруженного в пределах UPLOAD_DEDUPE_WINDOW: строки не вставлялись,
+	// остальные поля — из ответа исходной загрузки.
+	DuplicateUpload  bool  `json:"duplicate_upload,omitempty"`
+	OriginalUploadID int64 `json:"original_upload_id,omitempty"`
+
+	// Только при report_conflicts=true: какие строки файла совпали с какими строками БД.
+	Conflicts          []Conflict `json:"conflicts,omitempty"`
+	ConflictsTruncated bool       `json:"conflicts_truncated,omitempty"` // список обрезан до CONFLICTS_REPORT_LIMIT
+
+	// Строки, не попавшие в базу, с причиной: их число входит в duplicates_count.
+	Errors          []RowError `json:"errors,omitempty"`
+	ErrorsTruncated bool       `json:"errors_truncated,omitempty"` // список обрезан до ROW_ERRORS_LIMIT
+
+	// RejectReasons — сколько строк отклонено по каждой причине, без обрезки.
+	RejectReasons map[string]int `json:"reject_reasons,omitempty"`
+	// AdjustedRows — сколько строк принято после отбрасывания колонок (политика columns):
+	// trailing_empty_columns или extra_columns.
+	AdjustedRows map[string]int `json:"adjusted_rows,omitempty"`
+
+	// Files — итоги по файлам, если в архиве их несколько; line в errors и conflicts —
+	// сквозной номер строки, файл находится по first_line и last_line.
+	Files []UploadFile `json:"files,omitempty"`
+
+	// Только при split_counts=true: из чего сложился duplicates_count.
+	*DuplicateCounts
+}
+
+// InsertedStats — цены строк, вставленных загрузкой (обновлённые строки прайса не входят).
+type InsertedStats struct {
+	Rows       int      `json:"rows"`
+	Sum        float64  `json:"sum"`
+	Avg        float64  `json:"avg"`
+	Min        float64  `json:"min"`
+	Max        float64  `json:"max"`
+	Categories []string `json:"categories"` // затронутые категории, по алфавиту
+}
+
+// NewCategory — категория, впервые появившаяся в БД с этой загрузкой.
+type NewCategory struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"` // строк, вставленных в неё загрузкой
+}
+
+// DuplicateCounts раскладывает duplicates_count на дубли в файле, дубли строк БД и
+// строки, не прошедшие разбор и проверки; в сумме — duplicates_count.
+type DuplicateCounts struct {
+	FileDuplicates int `json:"file_duplicates"`
+	DBDuplicates   int `json:"db_duplicates"`
+	InvalidRows    int `json:"invalid_rows"`
+}
+
+// duplicateCounts — счётчики по причинам отказа из rowErrors.counts.
+func (e *rowErrors) duplicateCounts() *DuplicateCounts {
+	c := &DuplicateCounts{
+		FileDuplicates: e.counts["duplicate_in_file"],
+		DBDuplicates:   e.counts["duplicate_in_db"],
+	}
+	for reason, n := range e.counts {
+		if reason != "duplicate_in_file" && reason != "duplicate_in_db" {
+			c.InvalidRows += n
+		}
+	}
+	return c
+}
+
+// RowError — отклонённая строка data.csv.
+type RowError struct {
+	Line   int      `json:"line"`             // номер строки в data.csv, с 1
+	Values []string `json:"values,omitempty"` // строка как есть; нет для дублей, найденных при approve
+	Reason string   `json:"reason"`           // причина из parseRecord, duplicate_in_file или duplicate_in_db
+}
+
+// rowErrors копит RowError не больше limit (ROW_ERRORS_LIMIT); 0 — не копит.
+// Число строк по причинам считается всегда.
+type rowErrors struct {
+	list      []RowError
+	truncated bool
+	limit     int
+	counts    map[string]int
+}
+
+func newRowErrors() rowErrors {
+	return rowErrors{
+		limit:  int(min(max(envInt64("ROW_ERRORS_LIMIT", 100), 0), 100_000)),
+		counts: map[string]int{},
+	}
+}
+
+// full — новые ошибки в список уже не попадут.
+func (e *rowErrors) full() bool {
+	return len(e.list) >= e.limit
+}
+
+// add запоминает строку; values копируется, потому что csv.Reader переиспользует запись.
+func (e *rowErrors) add(line int, values []string, reason string) {
+	e.counts[reason]++
+	if e.full() {
+		e.truncated = e.limit > 0
+		return
+	}
+	e.list = append(e.list, RowError{Line: line, Values: slices.Clone(values), Reason: reason})
 }
 
 // Входной ряд из CSV (id мы читаем, но НЕ вставляем в БД как id)
@@ -39,6 +182,12 @@ type PriceRow struct {
 	Name      string
 	Category  string
 	Price     float64
+	Currency  string   // схемы 2 и 3: код ISO 4217
+	Quantity  float64  // схемы 2 и 3; 0 — не задано
+	Unit      string   // только схема 3: базовая единица l, kg, m или pc, см. parseUnit
+	UnitSize  float64  // только схема 3: размер в базовых единицах; 0 — не задано
+	Line      int      // номер строки в data.csv, с 1
+	Raw       []string // строка как есть, пока есть место в errors ответа
 }
 
 // Ряд из БД для экспорта
@@ -51,7 +200,47 @@ type DBRow struct {
 }
 
 func main() {
-	db, err := connectDB()
+	logLevel, err := setupLogging()
+	if err != nil {
+		log.Printf("logging: %v", err)
+		return
+	}
+
+	if err := loadSecrets(); err != nil {
+		log.Printf("secrets: %v", err)
+		return
+	}
+
+	rules, err := newLiveRules()
+	if err != nil {
+		log.Printf("validation rules: %v", err)
+		return
+	}
+
+	headers, err := loadHeaderSchemes()
+	if err != nil {
+		log.Printf("export headers: %v", err)
+		return
+	}
+
+	signer, err := loadExportSigner()
+	if err != nil {
+		log.Printf("export signing: %v", err)
+		return
+	}
+
+	features, err := loadFeatures()
+	if err != nil {
+		log.Printf("features: %v", err)
+		return
+	}
+
+	dsn, err := postgresDSN()
+	if err != nil {
+		log.Printf("db config: %v", err)
+		return
+	}
+	db, err := connectDB(dsn)
 	if err != nil {
 		log.Printf("db connect: %v", err)
 		return
@@ -60,6 +249,59 @@ func main() {
 		_ = db.Close()
 	}()
 
+	if err := migrate(context.Background(), db); err != nil {
+		if migrationBlocked(err) {
+			serveMigrationCleanup(db, err)
+			return
+		}
+		log.Printf("db migrate: %v", err)
+		return
+	}
+
+	// Переопределения из settings действуют поверх окружения, проверенного выше.
+	runtimeSettings.onChange = append(runtimeSettings.onChange, func() {
+		if err := rules.reload(); err != nil {
+			slog.Error("validation rules from settings", "error", err)
+		}
+		if err := features.reload(); err != nil {
+			slog.Error("features from settings", "error", err)
+		}
+	})
+	if err := runtimeSettings.reload(context.Background(), db); err != nil {
+		log.Printf("runtime settings: %v", err)
+		return
+	}
+	runtimeSettings.watch(db, dsn)
+
+	rollups := startRollupRefresher(db)
+
+	alerts, err := loadAlerting(db)
+	if err != nil {
+		log.Printf("alerts: %v", err)
+		return
+	}
+	readOnly := newReadOnlyMode()
+	jobs := startIngestJobs()
+	usage := startUsageMeter(db)
+
+	if err := startKafkaConsumer(db, rules, rollups, alerts, readOnly); err != nil {
+		log.Printf("kafka: %v", err)
+		return
+	}
+
+	apiKeys, err := loadAPIKeys()
+	if err != nil {
+		log.Printf("api keys: %v", err)
+		return
+	}
+
+	health, err := newHealthChecker(db)
+	if err != nil {
+		log.Printf("health checks: %v", err)
+		return
+	}
+	health.start(envDuration("HEALTH_CHECK_INTERVAL", 15*time.Second))
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -67,26 +309,71 @@ func main() {
 		_, _ = w.Write([]byte("ok"))
 	})
 
+	mux.HandleFunc("GET /ready", handleReady(health))
+	mux.HandleFunc("GET /metrics", features.gate("metrics", handleMetrics(health)))
+
 	mux.HandleFunc("/api/v0/prices", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
-			handlePricesPost(db)(w, r)
+			features.gate("upload", readOnly.guard(handlePricesPost(receiveUpload, db, rules, rollups, alerts, jobs)))(w, r)
 			return
 		case http.MethodGet:
-			handlePricesGet(db)(w, r)
+			features.gate("export", handlePricesGet(db, headers, signer))(w, r)
 			return
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, CodeMethodNotAllowed, "method not allowed")
 			return
 		}
 	})
 
+	mux.HandleFunc("GET /api/v0/prices/sample", features.gate("export", handlePricesSample(db)))
+	mux.HandleFunc("POST /api/v0/prices/preview", features.gate("upload", handlePricesPreview(rules)))
+	mux.HandleFunc("POST /api/v0/prices/import", features.gate("upload", readOnly.guard(handlePricesPost(receiveImport, db, rules, rollups, alerts, jobs))))
+
+	mux.HandleFunc("GET /api/v0/exports/public-key", features.gate("exports", handleExportPublicKey(signer)))
+	mux.HandleFunc("POST /api/v0/exports/verify", features.gate("exports", handleExportVerify(signer)))
+
+	mux.HandleFunc("GET /api/v0/search", features.gate("search", handleSearch(db)))
+	mux.HandleFunc("GET /api/v0/search/similar", features.gate("search", handleSimilarNames(db)))
+	mux.HandleFunc("GET /api/v0/autocomplete", features.gate("search", handleAutocomplete(db)))
+	mux.HandleFunc("GET /api/v0/stats", features.gate("analytics", handleDatasetStats(db)))
+	mux.HandleFunc("GET /api/v0/stats/trend", features.gate("analytics", handleTrend(db)))
+	mux.HandleFunc("GET /api/v0/stats/forecast", features.gate("analytics", handleForecast(db)))
+	mux.HandleFunc("GET /api/v0/stats/profile", features.gate("analytics", handleDataProfile(db)))
+	mux.HandleFunc("GET /api/v0/stats/categories", features.gate("analytics", handleCategoryTree(db)))
+	mux.HandleFunc("GET /api/v0/uploads/stats", features.gate("analytics", handleUploadStats(db)))
+	mux.HandleFunc("GET /api/v0/usage", features.gate("analytics", requireAdmin(handleUsage(db))))
+	mux.HandleFunc("GET /api/v0/imports", features.gate("upload", handleImports(db)))
+	mux.HandleFunc("DELETE /api/v0/imports/{id}", features.gate("upload", requireAdmin(readOnly.guard(handleImportRollback(db, rollups)))))
+	mux.HandleFunc("GET /api/v0/imports/{id}/rejected", features.gate("upload", handleRejectedRows(db)))
+	mux.HandleFunc("GET /api/v0/jobs/{id}", features.gate("upload", handleJobStatus(jobs)))
+	mux.HandleFunc("GET /api/v0/uploads/{id}/summary", features.gate("upload", handleUploadSummary(db)))
+	mux.HandleFunc("GET /api/v0/uploads/{id}/preview", features.gate("upload", handleUploadPreview(db)))
+	mux.HandleFunc("POST /api/v0/uploads/{id}/approve", features.gate("upload", requireAdmin(readOnly.guard(handleUploadApprove(db, rollups, alerts)))))
+	mux.HandleFunc("POST /api/v0/uploads/{id}/reject", features.gate("upload", requireAdmin(readOnly.guard(handleUploadReject(db)))))
+	mux.HandleFunc("GET /api/v0/aggregate", features.gate("analytics", handleAggregate(db)))
+	mux.HandleFunc("GET /api/v0/reports/pivot", features.gate("analytics", handlePivot(db)))
+	mux.HandleFunc("GET /api/v0/reports/monthly", features.gate("analytics", handleMonthlyReport(db)))
+
+	// Выключенная группа admin отвечает раньше проверки токена, как будто эндпоинтов нет.
+	mux.HandleFunc("POST /api/v0/admin/products/rename", features.gate("admin", requireAdmin(readOnly.guard(handleRename(db, rollups)))))
+	mux.HandleFunc("GET /api/v0/admin/duplicates", features.gate("admin", requireAdmin(handleDuplicatesReport(db))))
+	mux.HandleFunc("POST /api/v0/admin/dedupe", features.gate("admin", requireAdmin(handleDedupeStart(db, rollups, readOnly))))
+	mux.HandleFunc("GET /api/v0/admin/dedupe/{id}", features.gate("admin", requireAdmin(handleDedupeStatus())))
+	mux.HandleFunc("GET /api/v0/admin/audit", features.gate("admin", requireAdmin(handleAudit(db, rules))))
+	mux.HandleFunc("GET /api/v0/admin/read-only", features.gate("admin", requireAdmin(handleReadOnlyGet(readOnly))))
+	mux.HandleFunc("PUT /api/v0/admin/read-only", features.gate("admin", requireAdmin(handleReadOnlySet(readOnly))))
+	mux.HandleFunc("GET /api/v0/admin/log-level", features.gate("admin", requireAdmin(handleLogLevelGet(logLevel))))
+	mux.HandleFunc("PUT /api/v0/admin/log-level", features.gate("admin", requireAdmin(handleLogLevelSet(logLevel))))
+	mux.HandleFunc("GET /api/v0/admin/settings", features.gate("admin", requireAdmin(handleSettingsGet())))
+	mux.HandleFunc("PUT /api/v0/admin/settings", features.gate("admin", requireAdmin(readOnly.guard(handleSettingsSet(db)))))
+
 	addr := env("HTTP_ADDR", ":8080")
 	log.Printf("listening on %s", addr)
 
 	srv := &http.Server{
 		Addr:              addr,
-		Handler:           mux,
+		Handler:           apiKeys.middleware(usage.middleware(mux)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
@@ -96,20 +383,48 @@ func main() {
 	}
 }
 
-func connectDB() (*sql.DB, error) {
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		env("POSTGRES_HOST", "127.0.0.1"),
-		env("POSTGRES_PORT", "5432"),
-		env("POSTGRES_USER", "validator"),
-		env("POSTGRES_PASSWORD", "val1dat0r"),
-		env("POSTGRES_DB", "project-sem-1"),
-	)
+// postgresDSN собирает строку подключения. DATABASE_URL (postgres://…?sslmode=verify-full
+// или key=value) берётся как есть; иначе — из POSTGRES_* и настроек TLS: POSTGRES_SSLMODE
+// (disable, require, verify-ca, verify-full), POSTGRES_SSLROOTCERT, POSTGRES_SSLCERT, POSTGRES_SSLKEY.
+func postgresDSN() (string, error) {
+	if url := env("DATABASE_URL", ""); url != "" {
+		return url, nil
+	}
+	sslmode := env("POSTGRES_SSLMODE", "disable")
+	if !slices.Contains([]string{"disable", "require", "verify-ca", "verify-full"}, sslmode) {
+		return "", fmt.Errorf("POSTGRES_SSLMODE: expected disable, require, verify-ca or verify-full, got %s", sslmode)
+	}
+	params := [][2]string{
+		{"host", env("POSTGRES_HOST", "127.0.0.1")},
+		{"port", env("POSTGRES_PORT", "5432")},
+		{"user", env("POSTGRES_USER", "validator")},
+		{"password", env("POSTGRES_PASSWORD", "val1dat0r")},
+		{"dbname", env("POSTGRES_DB", "project-sem-1")},
+		{"sslmode", sslmode},
+		{"sslrootcert", env("POSTGRES_SSLROOTCERT", "")},
+		{"sslcert", env("POSTGRES_SSLCERT", "")},
+		{"sslkey", env("POSTGRES_SSLKEY", "")},
+	}
+	var b strings.Builder
+	for _, p := range params {
+		if p[1] == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		// Значение в кавычках: пароль может содержать пробелы и кавычки.
+		b.WriteString(p[0] + "='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p[1]) + "'")
+	}
+	return b.String(), nil
+}
 
-	db, err := sql.Open("postgres", dsn)
+func connectDB(dsn string) (*sql.DB, error) {
+	connector, err := pgPool.connector(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("db open: %w", err)
 	}
+	db := sql.OpenDB(connector)
 
 	db.SetMaxOpenConns(10)
 	db.SetMaxIdleConns(5)
@@ -120,461 +435,2446 @@ func connectDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("db ping: %w", err)
 	}
 
+	pgPool.db = db
 	return db, nil
 }
 
 // ------------------------- POST -------------------------
 
-func handlePricesPost(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+// uploadReceiver принимает загрузку из запроса: receiveUpload — из тела, receiveImport — по URL.
+type uploadReceiver func(w http.ResponseWriter, r *http.Request) (opts IngestOptions, files csvFiles, cleanup func(), ok bool)
 
-		archiveType := strings.TrimSpace(r.URL.Query().Get("type"))
-		if archiveType == "" {
-			archiveType = "zip"
-		}
-		if archiveType != "zip" && archiveType != "tar" {
-			http.Error(w, "type must be zip or tar", http.StatusBadRequest)
+func handlePricesPost(receive uploadReceiver, db *sql.DB, liveRules *liveRules, rollups *rollupRefresher, alerts *Alerting, jobs *ingestJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, files, cleanup, ok := receive(w, r)
+		if !ok {
 			return
 		}
-
-		body, err := io.ReadAll(io.LimitReader(r.Body, 50<<20)) // 50MB
-		if err != nil {
-			http.Error(w, "failed to read body", http.StatusBadRequest)
+		// Правила — на момент запроса: смена настроек не затронет уже принятую загрузку.
+		rules := liveRules.get()
+
+		if opts.Async {
+			// Архив остаётся во временном файле до конца задачи, удалит его воркер.
+			job, err := jobs.submit(func(ctx context.Context) (PostResponse, int, error) {
+				return ingestUpload(ctx, db, rules, rollups, alerts, opts, files)
+			}, opts.Progress, cleanup)
+			if err != nil {
+				cleanup()
+				w.Header().Set("Retry-After", "30")
+				writeErrorFrom(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", "/api/v0/jobs/"+job.ID)
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(job)
 			return
 		}
+		defer cleanup()
 
-		var csvRC io.ReadCloser
-		switch archiveType {
-		case "zip":
-			csvRC, err = openCSVFromZipBytes(body)
-		case "tar":
-			csvRC, err = openCSVFromTarBytes(body)
+		ctx := r.Context()
+		if opts.Detach {
+			// Загрузка доводится до конца и попадает в историю, даже если клиент не дождался ответа.
+			ctx = context.WithoutCancel(ctx)
 		}
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		resp, status, err := ingestUpload(ctx, db, rules, rollups, alerts, opts, files)
+		if status == statusClientClosed {
 			return
 		}
-		defer csvRC.Close()
-
-		resp, err := ingestCSV(ctx, db, csvRC)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeErrorFrom(w, err)
 			return
 		}
-
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
 		_ = json.NewEncoder(w).Encode(resp)
 	}
 }
 
-func openCSVFromZipBytes(zipBytes []byte) (io.ReadCloser, error) {
-	zr, err := zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+// statusClientClosed — клиент закрыл соединение до ответа (как 499 у nginx); клиенту не отправляется.
+const statusClientClosed = 499
+
+// ingestUpload загружает принятый data.csv и возвращает ответ и его HTTP-статус:
+// 200, 202 для карантина или статус ошибки. Общая часть синхронной загрузки и фоновой задачи.
+func ingestUpload(ctx context.Context, db *sql.DB, rules ValidationRules, rollups *rollupRefresher, alerts *Alerting,
+	opts IngestOptions, files csvFiles) (PostResponse, int, error) {
+	// Повтор запроса с тем же Idempotency-Key получает ответ исходной загрузки как есть.
+	if resp, ok, err := findIdempotentUpload(ctx, db, opts); err != nil {
+		return PostResponse{}, httpStatus(err), err
+	} else if ok {
+		slog.Debug("idempotent replay", "upload_id", resp.UploadID, "idempotency_key", opts.IdempotencyKey)
+		if resp.Status == uploadPending {
+			return opts.response(resp), http.StatusAccepted, nil
+		}
+		return opts.response(resp), http.StatusOK, nil
+	}
+	// Повтор того же файла (шлюз поставщика повторяет запросы десятками) не разбираем.
+	if resp, ok, err := findRepeatedUpload(ctx, db, opts); err != nil {
+		err = dbError("db query failed", err)
+		return PostResponse{}, httpStatus(err), err
+	} else if ok {
+		slog.Debug("repeated upload", "original_upload_id", resp.OriginalUploadID, "sha256", opts.FileSHA256)
+		resp = opts.response(resp)
+		if resp.Status == uploadPending {
+			return resp, http.StatusAccepted, nil
+		}
+		return resp, http.StatusOK, nil
+	}
+
+	ev, err := ingestCSV(ctx, db, rules.forUpload(opts), opts, files)
+	if err != nil && ctx.Err() != nil {
+		// Транзакция уже откатывается вместе с контекстом, а ответ отдавать некому.
+		slog.Info("upload aborted: client disconnected", "supplier", opts.Supplier, "error", err)
+		return PostResponse{}, statusClientClosed, ctx.Err()
+	}
 	if err != nil {
-		return nil, errors.New("invalid zip archive")
+		slog.Debug("upload rejected", "error", err)
+		// Плохой файл — 4xx (on_duplicate=error — 409), сбой БД — 5xx: временный (503)
+		// клиенту стоит повторить, файл в порядке.
+		return PostResponse{}, httpStatus(err), err
+	}
+	slog.Debug("upload ingested", "upload_id", ev.ID, "total_count", ev.Response.TotalCount,
+		"total_items", ev.Response.TotalItems, "duplicates_count", ev.Response.DuplicatesCount)
+	switch {
+	case ev.Response.Status == uploadPending:
+		// В prices ничего не попало: отчёты и оповещения — после approve.
+		return opts.response(ev.Response), http.StatusAccepted, nil
+	case !ev.Response.DuplicateUpload && !ev.Replayed:
+		ev.afterCommit(rollups, alerts, opts.Backfill)
 	}
+	return opts.response(ev.Response), http.StatusOK, nil
+}
 
-	for _, f := range zr.File {
-		if strings.EqualFold(path.Base(f.Name), "data.csv") {
-			rc, err := f.Open()
-			if err != nil {
-				return nil, errors.New("failed to open data.csv")
-			}
-			return rc, nil
-		}
+// response убирает из ответа то, о чём клиент не просил: раскладку duplicates_count
+// прежние клиенты не ждут.
+func (o IngestOptions) response(resp PostResponse) PostResponse {
+	if !o.SplitCounts {
+		resp.DuplicateCounts = nil
 	}
-	return nil, errors.New("data.csv not found in archive")
+	return resp
 }
 
-func openCSVFromTarBytes(tarBytes []byte) (io.ReadCloser, error) {
-	tr := tar.NewReader(bytes.NewReader(tarBytes))
+// receiveUpload разбирает параметры загрузки, принимает архив и находит в нём CSV-файлы.
+// При ошибке сам отвечает клиенту и возвращает ok=false; иначе вызывающий должен вызвать cleanup.
+func receiveUpload(w http.ResponseWriter, r *http.Request) (opts IngestOptions, files csvFiles, cleanup func(), ok bool) {
+	archiveType, defaultType, ok := uploadType(w, r.URL.Query().Get("type"))
+	if !ok {
+		return opts, nil, nil, false
+	}
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
+	if ct := r.Header.Get("Content-Type"); unsupportedUploadType(ct) {
+		writeError(w, CodeUnsupportedMedia, "unsupported content type "+ct+": expected an archive, text/csv, application/json, application/x-ndjson or multipart/form-data")
+		return opts, nil, nil, false
+	}
+
+	if opts, ok = receiveIngestOptions(w, r); !ok {
+		return opts, nil, nil, false
+	}
+
+	body, size, password, ok := receiveBody(w, r)
+	if !ok {
+		return opts, nil, nil, false
+	}
+	opts.Archive.Password = password
+	return openUpload(w, opts, archiveType, defaultType, r.Header.Get("Content-Type"), body, size)
+}
+
+// uploadType проверяет тип загрузки из ?type= (или поля type). Без него тип берётся из
+// UPLOAD_DEFAULT_TYPE (defaultType); auto — по Content-Type и сигнатуре. UPLOAD_REQUIRE_TYPE
+// запрещает загрузки без типа: конвейер, забывший ?type=tar, получит 400, а не
+// ARCHIVE_INVALID от tar, прочитанного как zip. При ошибке сам отвечает клиенту.
+func uploadType(w http.ResponseWriter, archiveType string) (_, defaultType string, ok bool) {
+	archiveType = strings.TrimSpace(archiveType)
+	if archiveType == "" {
+		if envBool("UPLOAD_REQUIRE_TYPE", false) {
+			writeErrorFrom(w, fieldError("type", "", "type is required: one of "+strings.Join(archiveTypes, ", ")))
+			return "", "", false
 		}
-		if err != nil {
-			return nil, errors.New("invalid tar archive")
+		if defaultType = env("UPLOAD_DEFAULT_TYPE", "auto"); defaultType == "auto" {
+			defaultType = ""
 		}
-		if hdr == nil {
-			continue
+	}
+	for _, t := range []string{archiveType, defaultType} {
+		if t != "" && !slices.Contains(archiveTypes, t) {
+			writeErrorFrom(w, fieldError("type", t, "expected one of "+strings.Join(archiveTypes, ", ")))
+			return "", "", false
 		}
+	}
+	return archiveType, defaultType, true
+}
 
-		if strings.EqualFold(path.Base(hdr.Name), "data.csv") {
-			b, err := io.ReadAll(tr)
-			if err != nil {
-				return nil, errors.New("failed to read data.csv from tar")
-			}
-			return io.NopCloser(bytes.NewReader(b)), nil
-		}
+// receiveIngestOptions разбирает параметры загрузки из query и заголовков.
+// При ошибке сам отвечает клиенту.
+func receiveIngestOptions(w http.ResponseWriter, r *http.Request) (IngestOptions, bool) {
+	opts, err := parseIngestOptions(r)
+	if err != nil {
+		writeErrorFrom(w, err)
+		return opts, false
 	}
-	return nil, errors.New("data.csv not found in archive")
+	if opts.Backfill && !checkAdmin(w, r) {
+		return opts, false
+	}
+	w.Header().Set("X-Schema-Version", opts.Schema.Version)
+	return opts, true
 }
 
-func ingestCSV(ctx context.Context, db *sql.DB, csvStream io.Reader) (PostResponse, error) {
-	// 1) Сначала читаем CSV целиком и валидируем
-	br := bufio.NewReader(csvStream)
-	cr := csv.NewReader(br)
-	cr.FieldsPerRecord = -1
-	cr.Comma = ','
+// openUpload определяет тип принятого файла body (по archiveType, Content-Type ct,
+// defaultType или сигнатуре) и находит в нём CSV-файлы. При ошибке удаляет body и сам
+// отвечает клиенту; иначе вызывающий должен вызвать cleanup.
+func openUpload(w http.ResponseWriter, opts IngestOptions, archiveType, defaultType, ct string, body *os.File, size int64) (_ IngestOptions, files csvFiles, cleanup func(), ok bool) {
+	var err error
+	// backfill не сравнивается с обычными загрузками: его повторяют как раз после отказа по датам.
+	// С Idempotency-Key хеш нужен всегда: ключ не должен подойти к другому файлу.
+	if (envDuration("UPLOAD_DEDUPE_WINDOW", 10*time.Minute) > 0 && !opts.Backfill) || opts.IdempotencyKey != "" {
+		if opts.FileSHA256, err = fileSHA256(body); err != nil {
+			removeSpool(body)
+			writeError(w, CodeBodyReadFailed, "failed to read body")
+			return opts, nil, nil, false
+		}
+	}
 
-	// header
-	_, _ = cr.Read()
+	switch {
+	case archiveType != "":
+	case isCSVContentType(ct):
+		// Небольшой файл можно прислать без архива: Content-Type: text/csv.
+		archiveType = "csv"
+	case isXlsxContentType(ct):
+		archiveType = "xlsx"
+	case jsonUploadType(ct) != "":
+		archiveType = jsonUploadType(ct)
+	case defaultType != "":
+		archiveType = defaultType
+	default:
+		// Тип не указан — определяем по сигнатуре; неизвестное по-прежнему считаем zip.
+		if archiveType, err = detectArchiveType(body); err != nil {
+			removeSpool(body)
+			writeError(w, CodeBodyReadFailed, "failed to read body")
+			return opts, nil, nil, false
+		}
+	}
+	if opts.Archive.Sheet != "" && archiveType != "xlsx" {
+		removeSpool(body)
+		writeErrorFrom(w, fieldError("sheet", opts.Archive.Sheet, "sheet applies only to type=xlsx"))
+		return opts, nil, nil, false
+	}
+	switch archiveType {
+	case "xlsx":
+		// Лист переводится в CSV в UTF-8 с запятой, что бы ни было в delimiter= и encoding=.
+		opts.Delimiter, opts.Encoding = ",", "utf-8"
+	case "json", "ndjson":
+		// Объекты — строки данных по колонкам схемы, заголовка нет.
+		opts.Delimiter, opts.Encoding, opts.HasHeader = ",", "utf-8", "false"
+	}
+	opts.ArchiveType, opts.ArchiveSize = archiveType, size
+	opts.Archive.compressedSize = size
+	slog.Debug("upload received", "type", archiveType, "size", size, "schema", opts.Schema.Version,
+		"supplier", opts.Supplier, "encrypted", opts.Archive.Password != "")
+
+	switch archiveType {
+	case "zip":
+		files, err = openCSVFromZip(body, size, opts.Archive)
+	case "tar":
+		files, err = openCSVFromTar(body, opts.Archive, func() {})
+	case "zst":
+		files, err = openCSVFromZstd(body, opts.Archive)
+	case "tar.zst":
+		files, err = openTarZstd(body, opts.Archive)
+	case "gzip":
+		files, err = openCSVFromGzip(body, opts.Archive)
+	case "tar.gz":
+		files, err = openTarGzip(body, opts.Archive)
+	case "xz":
+		files, err = openCSVFromXz(body, opts.Archive)
+	case "tar.xz":
+		files, err = openTarXz(body, opts.Archive)
+	case "7z":
+		files, err = openCSVFrom7z(body, size, opts.Archive)
+	case "csv":
+		// Файл закроет removeSpool.
+		files = singleFile(io.NopCloser(body))
+	case "xlsx":
+		files, err = openCSVFromXlsx(body, size, opts.Archive)
+	case "json", "ndjson":
+		// Файл закроет removeSpool.
+		files = openJSONRows(io.NopCloser(body), archiveType, opts)
+	}
+	if err != nil {
+		removeSpool(body)
+		writeErrorFrom(w, err)
+		return opts, nil, nil, false
+	}
+	return opts, files, func() {
+		_ = files.Close()
+		removeSpool(body)
+	}, true
+}
 
+// receiveBody сохраняет тело запроса (или часть file формы) во временный файл и достаёт
+// пароль архива — из заголовка X-Archive-Password или поля формы, но не из URL: он попал бы в логи.
+// При ошибке сам отвечает клиенту; иначе вызывающий удаляет файл через removeSpool.
+func receiveBody(w http.ResponseWriter, r *http.Request) (body *os.File, size int64, password string, ok bool) {
+	maxUpload := envInt64("MAX_UPLOAD_SIZE", 50<<20) // 50MB
+	body, size, formPassword, err := spoolUpload(w, r, maxUpload)
 	var (
-		totalCount int
+		tooLarge *http.MaxBytesError
+		ae       *apiError
+	)
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, CodeLimitExceeded, fmt.Sprintf("body exceeds %d bytes", maxUpload))
+		return nil, 0, "", false
+	case errors.As(err, &ae):
+		writeErrorFrom(w, err)
+		return nil, 0, "", false
+	case err != nil:
+		writeError(w, CodeBodyReadFailed, "failed to read body")
+		return nil, 0, "", false
+	}
 
-		// Дубликаты во входном файле считаем по всем полям кроме id:
-		// created_at | name | category | price
-		seenNoID = make(map[string]struct{})
+	password = r.Header.Get("X-Archive-Password")
+	if password == "" {
+		password = formPassword
+	}
+	return body, size, password, true
+}
+
+// archiveTypes — допустимые значения ?type= при загрузке.
+// csv — не архив, а сам data.csv в теле запроса, xlsx — книга Excel, json и ndjson —
+// объекты цен (см. openJSONRows).
+var archiveTypes = []string{"zip", "tar", "zst", "tar.zst", "gzip", "tar.gz", "xz", "tar.xz", "7z", "csv", "xlsx", "json", "ndjson"}
+
+// IngestOptions — настройки загрузки, которые можно переопределить на запрос.
+type IngestOptions struct {
+	// IgnoreDate — дубль определяется по (name, category, price) без даты.
+	IgnoreDate bool
+	// PriceList — одна цена на (product_id, category, created_at): повтор обновляет цену.
+	PriceList bool
+	// Schema — раскладка колонок data.csv.
+	Schema InputSchema
+	// HasHeader — первая строка data.csv: true — заголовок, false — данные,
+	// auto — заголовок, если она не разбирается как строка данных.
+	HasHeader string
+	// Columns — что делать со строкой, где колонок не столько, сколько в схеме:
+	// strict, trim_empty, ignore_extra или reject_file (см. fitColumns).
+	Columns string
+	// Delimiter — разделитель колонок: ",", ";", "\t", "|" или auto — по первой строке каждого файла.
+	Delimiter string
+	// DateLayouts — форматы create_date из date_formats= или CSV_DATE_FORMATS (см. dateFormats).
+	DateLayouts []string
+	// Encoding — кодировка файлов: utf-8, windows-1251, koi8-r, utf-16le, utf-16be или auto —
+	// по BOM и содержимому каждого файла (см. decodeCSV).
+	Encoding string
+	// LazyQuotes — допускать кавычки внутри поля без экранирования (csv.Reader.LazyQuotes).
+	LazyQuotes bool
+	// Supplier — кто прислал файл, для статистики загрузок.
+	Supplier string
+	// ReportConflicts — перечислить в ответе строки, совпавшие со строками БД.
+	ReportConflicts bool
+	// FileSHA256 — хеш архива для поиска повторных загрузок; пусто — не проверять.
+	FileSHA256 string
+	// IdempotencyKey — заголовок Idempotency-Key: повтор с тем же ключом от того же ключа API
+	// (KeyName) получает сохранённый ответ. Пусто — не задан.
+	IdempotencyKey string
+	KeyName        string
+	// ArchiveType и ArchiveSize — что и сколько байт прислали, для истории импортов.
+	ArchiveType string
+	ArchiveSize int64
+	// Backfill — перенос истории: правила ValidationRules.forBackfill, строки помечаются backfill.
+	// Только с токеном администратора.
+	Backfill bool
+	// Scope — категории ключа API: строки других категорий отклоняются, итоги по БД — только по ним.
+	Scope []string
+	// Quarantine — строки ложатся в staged_prices и ждут approve, в prices ничего не пишется.
+	Quarantine bool
+	// Async — загрузка идёт фоновой задачей (GET /api/v0/jobs/{id}), а не в запросе.
+	Async bool
+	// Detach — не прерывать загрузку, если клиент отключился: итоги останутся в uploads.
+	Detach bool
+	// SplitCounts — вернуть file_duplicates, db_duplicates и invalid_rows рядом с duplicates_count.
+	SplitCounts bool
+	// OnDuplicate — что делать со строкой, которая уже есть в БД: skip — пропустить,
+	// replace — обновить в ней остальные поля, error — отменить всю загрузку.
+	OnDuplicate string
+	// Progress — не nil — сюда пишется число прочитанных строк data.csv (для async).
+	Progress *atomic.Int64
+
+	Archive ArchiveOptions
+}
+
+// ArchiveOptions — как искать data.csv внутри архива.
+type ArchiveOptions struct {
+	MaxDepth   int    // сколько уровней каталогов просматривать; 0 — только корень
+	MaxEntries int    // сколько записей архива просматривать, прежде чем сдаться
+	Files      string // шаблон имён загружаемых файлов (path.Match), по умолчанию *.csv
+	Single     bool   // filename=: загрузить только первый файл под шаблоном
+	Sheet      string // sheet=: лист книги xlsx, по умолчанию первый
 
-		validRows     []PriceRow
-		rejectedAsDup int // сюда же складываем и “плохие строки”, т.к. отдельного поля в ответе нет
+	MaxEntrySize int64 // предельный размер data.csv внутри архива, байт
+	MaxTotalSize int64 // предельный суммарный распакованный размер просмотренных записей, байт
+	MaxRatio     int64 // во сколько раз data.csv может быть больше самого архива; 0 — без ограничения
+
+	compressedSize int64 // размер принятого архива, для MaxRatio
+
+	Password string // для зашифрованных zip и 7z
+}
+
+func parseIngestOptions(r *http.Request) (IngestOptions, error) {
+	var (
+		opts IngestOptions
+		errs ValidationErrors
+		q    = r.URL.Query()
 	)
 
-	for {
-		rec, err := cr.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return PostResponse{}, errors.New("invalid csv")
+	// Версия схемы — из заголовка или параметра; без них — INPUT_SCHEMA_VERSION, чтобы
+	// старые загрузчики продолжали работать без изменений.
+	version := strings.TrimSpace(r.Header.Get("X-Schema-Version"))
+	if version == "" {
+		version = strings.TrimSpace(q.Get("schema"))
+	}
+	if version == "" {
+		version = env("INPUT_SCHEMA_VERSION", "1")
+	}
+	if s, ok := findInputSchema(version); ok {
+		opts.Schema = s
+	} else {
+		errs.add("schema", version, "expected one of "+strings.Join(inputSchemaVersions(), ", "))
+	}
+
+	dedupe := strings.TrimSpace(q.Get("dedupe"))
+	if dedupe == "" {
+		dedupe = env("DEDUPE_KEY", "full")
+	}
+	if !opts.setDedupe(dedupe) {
+		errs.add("dedupe", dedupe, "expected full, no_date or price_list")
+	}
+
+	opts.HasHeader = strings.ToLower(strings.TrimSpace(q.Get("has_header")))
+	if opts.HasHeader == "" {
+		opts.HasHeader = env("CSV_HAS_HEADER", "auto")
+	}
+	if opts.HasHeader != "auto" {
+		if b, err := strconv.ParseBool(opts.HasHeader); err != nil {
+			errs.add("has_header", opts.HasHeader, "expected true, false or auto")
+		} else {
+			opts.HasHeader = strconv.FormatBool(b)
 		}
+	}
 
-		totalCount++
+	opts.Columns = strings.TrimSpace(q.Get("columns"))
+	if opts.Columns == "" {
+		opts.Columns = env("CSV_COLUMNS_POLICY", "strict")
+	}
+	if !slices.Contains(columnPolicies, opts.Columns) {
+		errs.add("columns", opts.Columns, "expected one of "+strings.Join(columnPolicies, ", "))
+	}
 
-		if len(rec) != 5 {
-			rejectedAsDup++
-			continue
+	// Пробел не обрезаем: tab — законное значение (%09).
+	delimiter := q.Get("delimiter")
+	if delimiter == "" {
+		delimiter = env("CSV_DELIMITER", "auto")
+	}
+	var okDelim bool
+	if opts.Delimiter, okDelim = csvDelimiters[strings.ToLower(delimiter)]; !okDelim {
+		errs.add("delimiter", delimiter, "expected auto, comma, semicolon, tab, pipe or the character itself")
+	}
+
+	// Кодировка: encoding=, иначе charset из Content-Type (text/csv; charset=windows-1251),
+	// иначе CSV_ENCODING.
+	encodingParam, encoding := "encoding", strings.TrimSpace(q.Get("encoding"))
+	if ct := r.Header.Get("Content-Type"); encoding == "" && isCSVContentType(ct) {
+		if _, params, err := mime.ParseMediaType(ct); err == nil && params["charset"] != "" {
+			encodingParam, encoding = "charset", params["charset"]
 		}
+	}
+	if encoding == "" {
+		encoding = env("CSV_ENCODING", "auto")
+	}
+	var okEnc bool
+	if opts.Encoding, okEnc = csvEncodings[strings.ToLower(encoding)]; !okEnc {
+		errs.add(encodingParam, encoding, "expected auto, utf-8, windows-1251, koi8-r, utf-16le or utf-16be")
+	}
 
-		inputID := strings.TrimSpace(rec[0])
-		name := strings.TrimSpace(rec[1])
-		category := strings.TrimSpace(rec[2])
-		priceStr := strings.TrimSpace(rec[3])
-		createdAtStr := strings.TrimSpace(rec[4])
+	dateFormats := strings.TrimSpace(q.Get("date_formats"))
+	if dateFormats == "" {
+		dateFormats = env("CSV_DATE_FORMATS", defaultDateFormats)
+	}
+	var err error
+	if opts.DateLayouts, err = parseDateFormats(dateFormats); err != nil {
+		errs.add("date_formats", dateFormats, err.Error())
+	}
 
-		if inputID == "" || createdAtStr == "" || name == "" || category == "" || priceStr == "" {
-			rejectedAsDup++
-			continue
+	opts.LazyQuotes = envBool("CSV_LAZY_QUOTES", false)
+	if s := strings.TrimSpace(q.Get("lazy_quotes")); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			errs.add("lazy_quotes", s, "expected true or false")
 		}
+		opts.LazyQuotes = b
+	}
+
+	opts.Scope = categoryScope(r)
+	opts.KeyName = apiKeyName(r)
+	opts.IdempotencyKey = idempotencyKey(r, &errs)
+
+	opts.Supplier = strings.TrimSpace(r.Header.Get("X-Supplier"))
+	if opts.Supplier == "" {
+		opts.Supplier = strings.TrimSpace(q.Get("supplier"))
+	}
+	if utf8.RuneCountInString(opts.Supplier) > maxSupplierLen {
+		errs.add("supplier", opts.Supplier, "expected at most "+strconv.Itoa(maxSupplierLen)+" characters")
+	}
 
-		createdAt, err := time.Parse("2006-01-02", createdAtStr)
+	if s := strings.TrimSpace(q.Get("backfill")); s != "" {
+		b, err := strconv.ParseBool(s)
 		if err != nil {
-			rejectedAsDup++
-			continue
+			errs.add("backfill", s, "expected true or false")
 		}
+		opts.Backfill = b
+	}
 
-		price, err := parsePrice(priceStr) // float64
+	opts.Quarantine = envBool("UPLOAD_QUARANTINE", false)
+	if s := strings.TrimSpace(q.Get("quarantine")); s != "" {
+		b, err := strconv.ParseBool(s)
 		if err != nil {
-			rejectedAsDup++
-			continue
+			errs.add("quarantine", s, "expected true or false")
 		}
+		opts.Quarantine = b
+	}
 
-		keyNoID := fmt.Sprintf("%s|%s|%s|%.2f", createdAtStr, name, category, price)
-		if _, ok := seenNoID[keyNoID]; ok {
-			// дубль во входном файле (id игнорируем)
-			rejectedAsDup++
-			continue
+	if s := strings.TrimSpace(q.Get("async")); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			errs.add("async", s, "expected true or false")
 		}
-		seenNoID[keyNoID] = struct{}{}
+		opts.Async = b
+	}
+	if opts.Async {
+		opts.Progress = new(atomic.Int64)
+	}
 
-		validRows = append(validRows, PriceRow{
-			InputID:   inputID,
-			CreatedAt: createdAt,
-			Name:      name,
-			Category:  category,
-			Price:     price,
-		})
+	if s := strings.TrimSpace(q.Get("detach")); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			errs.add("detach", s, "expected true or false")
+		}
+		opts.Detach = b
 	}
 
-	// 2) Вся вставка + подсчёт статистики — в одной транзакции
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
-	if err != nil {
-		return PostResponse{}, errors.New("db begin failed")
+	if s := strings.TrimSpace(q.Get("report_conflicts")); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			errs.add("report_conflicts", s, "expected true or false")
+		}
+		opts.ReportConflicts = b
 	}
-	defer func() { _ = tx.Rollback() }()
 
-	var (
-		totalItems      int
-		duplicatesCount = rejectedAsDup
-	)
+	opts.OnDuplicate = strings.TrimSpace(q.Get("on_duplicate"))
+	if opts.OnDuplicate == "" {
+		opts.OnDuplicate = env("ON_DUPLICATE", "skip")
+	}
+	switch {
+	case !slices.Contains(duplicatePolicies, opts.OnDuplicate):
+		errs.add("on_duplicate", opts.OnDuplicate, "expected one of "+strings.Join(duplicatePolicies, ", "))
+	case opts.OnDuplicate == "replace" && opts.IgnoreDate:
+		// Строка no_date совпадает со строками за любые даты: какую из них обновлять, не определить.
+		errs.add("on_duplicate", opts.OnDuplicate, "expected skip or error with dedupe=no_date")
+	case opts.OnDuplicate != "skip" && opts.Quarantine:
+		// approve переносит строки по правилам, сохранённым в uploads, а там политики нет.
+		errs.add("on_duplicate", opts.OnDuplicate, "expected skip with quarantine=true")
+	}
 
-	for _, r := range validRows {
-		inserted, err := insertPriceTx(ctx, tx, r)
+	if s := strings.TrimSpace(q.Get("split_counts")); s != "" {
+		b, err := strconv.ParseBool(s)
 		if err != nil {
-			return PostResponse{}, errors.New("db insert failed")
+			errs.add("split_counts", s, "expected true or false")
 		}
-		if !inserted {
-			// дубль уже есть в БД (по уникальности “все поля кроме id”)
-			duplicatesCount++
-			continue
-		}
-		totalItems++
+		opts.SplitCounts = b
 	}
 
-	totalCategories, totalPrice, err := statsTx(ctx, tx)
-	if err != nil {
-		return PostResponse{}, errors.New("db stats failed")
+	opts.Archive.MaxDepth = intParam(q, "max_depth", "ARCHIVE_MAX_DEPTH", 10, 0, 100, &errs)
+	opts.Archive.MaxEntries = intParam(q, "max_entries", "ARCHIVE_MAX_ENTRIES", 10000, 1, 1_000_000, &errs)
+	opts.Archive.Files = strings.TrimSpace(q.Get("files"))
+	filesParam := "files"
+	if name := strings.TrimSpace(q.Get("filename")); name != "" {
+		if opts.Archive.Files != "" {
+			errs.add("filename", name, "use either files or filename, not both")
+		}
+		opts.Archive.Files, opts.Archive.Single, filesParam = name, true, "filename"
 	}
-
-	if err := tx.Commit(); err != nil {
-		return PostResponse{}, errors.New("db commit failed")
+	if opts.Archive.Files == "" {
+		opts.Archive.Files = env("ARCHIVE_FILES", "*.csv")
 	}
+	opts.Archive.Sheet = strings.TrimSpace(q.Get("sheet"))
+	if _, err := path.Match(opts.Archive.Files, ""); err != nil {
+		errs.add(filesParam, opts.Archive.Files, "expected a file name or a glob pattern like *.csv or prices_*.csv")
+	}
+	opts.Archive.MaxEntrySize = envInt64("ARCHIVE_MAX_ENTRY_SIZE", 200<<20)
+	opts.Archive.MaxTotalSize = envInt64("ARCHIVE_MAX_TOTAL_SIZE", 1<<30)
+	opts.Archive.MaxRatio = envInt64("ARCHIVE_MAX_RATIO", 1000)
 
-	return PostResponse{
-		TotalCount:      totalCount,
-		DuplicatesCount: duplicatesCount,
-		TotalItems:      totalItems,
-		TotalCategories: totalCategories,
-		TotalPrice:      totalPrice,
-	}, nil
+	return opts, errs.err()
 }
 
-func parsePrice(s string) (float64, error) {
-	s = strings.TrimSpace(s)
-	s = strings.ReplaceAll(s, ",", ".")
-	f, err := strconv.ParseFloat(s, 64)
-	if err != nil || f <= 0 {
-		return 0, errors.New("invalid price")
+// duplicatePolicies — значения ?on_duplicate=.
+var duplicatePolicies = []string{"skip", "replace", "error"}
+
+// columnPolicies — значения ?columns=.
+var columnPolicies = []string{"strict", "trim_empty", "ignore_extra", "reject_file"}
+
+// fitColumns приводит запись к числу колонок схемы по политике o.Columns:
+//   - strict и reject_file — запись как есть (reject_file отклоняет весь файл, см. ingestCSV);
+//   - trim_empty — лишние колонки отбрасываются, если все они пустые (запятые в конце строки);
+//   - ignore_extra — лишние колонки отбрасываются всегда.
+//
+// fix — что отброшено: trailing_empty_columns или extra_columns; ok=false — колонок всё равно не столько, сколько нужно.
+func (o IngestOptions) fitColumns(rec []string) (out []string, fix string, ok bool) {
+	n := len(o.Schema.Columns)
+	if len(rec) <= n || o.Columns == "strict" || o.Columns == "reject_file" {
+		return rec, "", len(rec) == n
 	}
-	// нормализуем до 2 знаков
-	f = math.Round(f*100) / 100
-	if f <= 0 {
-		return 0, errors.New("invalid price")
+	fix = "trailing_empty_columns"
+	for _, v := range rec[n:] {
+		if strings.TrimSpace(v) != "" {
+			fix = "extra_columns"
+			break
+		}
 	}
-	return f, nil
+	if fix == "extra_columns" && o.Columns != "ignore_extra" {
+		return rec, "", false
+	}
+	return rec[:n], fix, true
 }
 
-func insertPriceTx(ctx context.Context, tx *sql.Tx, r PriceRow) (bool, error) {
-	// ВАЖНО:
-	// - id НЕ вставляем (должен генерироваться)
-	// - product_id можно хранить как отдельное поле, но наружу его не отдаём.
-	// Уникальность “все поля кроме id” должна быть обеспечена constraint'ом в БД:
-	// UNIQUE(created_at, name, category, price)
-	const q = `
-		INSERT INTO prices (product_id, created_at, name, category, price)
-		VALUES ($1, $2::date, $3, $4, $5)
-		ON CONFLICT DO NOTHING;
-	`
-	res, err := tx.ExecContext(ctx, q, r.InputID, r.CreatedAt, r.Name, r.Category, r.Price)
-	if err != nil {
-		return false, err
+// isHeader решает, заголовок ли первая строка data.csv. В режиме auto строка считается данными,
+// если в ней столько колонок, сколько в схеме, а цена и дата разбираются; иначе — заголовком,
+// как раньше, когда первая строка пропускалась всегда.
+func (o IngestOptions) isHeader(rec []string, rules ValidationRules) bool {
+	switch o.HasHeader {
+	case "true":
+		return true
+	case "false":
+		return false
 	}
-	n, err := res.RowsAffected()
-	if err != nil {
-		return false, err
+	if len(rec) != len(o.Schema.Columns) || headerMatches(rec, o.Schema.Columns) {
+		return true
 	}
-	return n == 1, nil
+	if _, err := rules.parseDate(strings.TrimSpace(rec[4])); err != nil {
+		return true
+	}
+	_, err := parsePrice(strings.TrimSpace(rec[3]))
+	return err != nil
 }
 
-func statsTx(ctx context.Context, tx *sql.Tx) (totalCategories int, totalPrice float64, err error) {
-	// Одним запросом
-	const q = `
-		SELECT
-			COUNT(DISTINCT category) AS total_categories,
-			COALESCE(SUM(price), 0)  AS total_price
-		FROM prices;
-	`
-	if err := tx.QueryRowContext(ctx, q).Scan(&totalCategories, &totalPrice); err != nil {
-		return 0, 0, err
+// setDedupe включает режим дублей по имени: full, no_date или price_list.
+func (o *IngestOptions) setDedupe(name string) bool {
+	switch name {
+	case "full":
+	case "no_date":
+		o.IgnoreDate = true
+	case "price_list":
+		o.PriceList = true
+	default:
+		return false
+	}
+	return true
+}
+
+// InputSchema — версия раскладки колонок входного data.csv.
+type InputSchema struct {
+	Version string
+	Columns []string
+}
+
+// inputSchemas — поддерживаемые версии. Новые колонки добавляются только новой версией,
+// старые версии не меняются.
+var inputSchemas = []InputSchema{
+	{Version: "1", Columns: []string{"id", "name", "category", "price", "create_date"}},
+	{Version: "2", Columns: []string{"id", "name", "category", "price", "create_date", "currency", "quantity"}},
+	{Version: "3", Columns: []string{"id", "name", "category", "price", "create_date", "currency", "quantity", "unit", "unit_size"}},
+}
+
+func findInputSchema(version string) (InputSchema, bool) {
+	for _, s := range inputSchemas {
+		if s.Version == version {
+			return s, true
+		}
+	}
+	return InputSchema{}, false
+}
+
+func inputSchemaVersions() []string {
+	out := make([]string, len(inputSchemas))
+	for i, s := range inputSchemas {
+		out[i] = s.Version
+	}
+	return out
+}
+
+// intParam читает целый query-параметр с умолчанием из переменной окружения.
+// Ошибка в параметре попадает в errs; некорректное значение в окружении — в лог.
+func intParam(q url.Values, name, envKey string, def, lo, hi int, errs *ValidationErrors) int {
+	if s := env(envKey, ""); s != "" {
+		if i, err := strconv.Atoi(s); err == nil && i >= lo && i <= hi {
+			def = i
+		} else {
+			log.Printf("env %s: invalid value %q, using %d", envKey, s, def)
+		}
+	}
+	s := strings.TrimSpace(q.Get(name))
+	if s == "" {
+		return def
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < lo || i > hi {
+		errs.add(name, s, fmt.Sprintf("expected integer %d..%d", lo, hi))
+		return def
+	}
+	return i
+}
+
+// archiveMember решает, загружать ли запись архива: имя подходит под files= (без учёта
+// регистра; шаблон со слешем сверяется со всем путём, без — с именем файла). Скрытые записи
+// и служебные каталоги macOS (__MACOSX/, ._data.csv) пропускаются, как и слишком глубоко вложенные.
+func (o ArchiveOptions) archiveMember(name string) bool {
+	name = strings.ReplaceAll(name, `\`, "/") // 7z и zip из Windows
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	for _, p := range parts {
+		if strings.HasPrefix(p, ".") || p == "__MACOSX" {
+			return false
+		}
+	}
+	if len(parts)-1 > o.MaxDepth {
+		return false
+	}
+	target := parts[len(parts)-1]
+	if strings.Contains(o.Files, "/") {
+		target = strings.Join(parts, "/")
+	}
+	ok, _ := path.Match(strings.ToLower(o.Files), strings.ToLower(target))
+	return ok
+}
+
+func (o ArchiveOptions) filesNotFound() error {
+	return codedError(CodeArchiveNotFound, "no files matching "+o.Files+" found in archive")
+}
+
+// checkArchiveEntry отклоняет архив с записью по опасному пути, ссылкой или устройством.
+// Мы ничего не распаковываем на диск, но такие записи в прайс-листе не нужны, а ссылка
+// с именем data.csv молча подменила бы файл пустым.
+func checkArchiveEntry(name string, mode fs.FileMode) error {
+	if unsafeArchivePath(name) {
+		return codedError(CodeArchiveInvalid, "unsafe path in archive: "+name)
+	}
+	if mode&(fs.ModeSymlink|fs.ModeDevice|fs.ModeCharDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0 {
+		return codedError(CodeArchiveInvalid, "link or special file in archive: "+name)
+	}
+	return nil
+}
+
+// unsafeArchivePath — абсолютный путь или выход за пределы архива через "..".
+// Мы ничего не распаковываем на диск, но такой архив заведомо собран со злым умыслом.
+func unsafeArchivePath(name string) bool {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return true
+	}
+	return slices.Contains(strings.Split(name, "/"), "..")
+}
+
+func (o ArchiveOptions) tooManyEntries() error {
+	return codedError(CodeLimitExceeded, fmt.Sprintf("archive has more than %d entries", o.MaxEntries))
+}
+
+// entryLimit — сколько байт CSV-файла name можно распаковать: ARCHIVE_MAX_ENTRY_SIZE, а для
+// маленького архива — не больше MaxRatio его размеров. Так архив в килобайт, который
+// разворачивается в сотни мегабайт (zip-бомба), отклоняется, не дойдя до общего лимита.
+func (o ArchiveOptions) entryLimit(name string) (int64, string) {
+	if o.MaxRatio > 0 && o.compressedSize > 0 && o.compressedSize <= o.MaxEntrySize/o.MaxRatio {
+		return o.MaxRatio * o.compressedSize,
+			fmt.Sprintf("%s is more than %d times larger than the archive", name, o.MaxRatio)
+	}
+	return o.MaxEntrySize, fmt.Sprintf("%s exceeds %d bytes", name, o.MaxEntrySize)
+}
+
+// checkEntrySize сверяет с лимитами размер файла, заявленный в заголовке архива.
+func (o ArchiveOptions) checkEntrySize(name string, size uint64) error {
+	if n, msg := o.entryLimit(name); size > uint64(n) {
+		return codedError(CodeLimitExceeded, msg)
+	}
+	return nil
+}
+
+// limitCSV режет фактический поток файла по entryLimit: заголовкам архива не верим.
+func (o ArchiveOptions) limitCSV(name string, r io.Reader, closeFn func()) io.ReadCloser {
+	n, msg := o.entryLimit(name)
+	return &limitedCSV{r: r, n: n, name: name, msg: msg, close: closeFn}
+}
+
+// archiveTotal считает распакованный размер просмотренных записей: тысяча записей по
+// ARCHIVE_MAX_ENTRY_SIZE без data.csv — тоже бомба, особенно для сжатого tar, где
+// пропуск записи означает её распаковку.
+type archiveTotal struct {
+	n, max int64
+}
+
+func (t *archiveTotal) add(size uint64) error {
+	if size > uint64(t.max-t.n) {
+		return codedError(CodeLimitExceeded, fmt.Sprintf("archive entries exceed %d bytes uncompressed", t.max))
+	}
+	t.n += int64(size)
+	return nil
+}
+
+// spoolUpload сохраняет тело запроса во временный файл: zip читается с произвольным
+// доступом, а архив (в т.ч. Zip64 больше 4 ГБ) не должен целиком лежать в памяти.
+// Кроме «голого» архива принимается multipart/form-data с частью file и полем password.
+func spoolUpload(w http.ResponseWriter, r *http.Request, max int64) (f *os.File, n int64, password string, err error) {
+	f, err = os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	body := http.MaxBytesReader(w, r.Body, max)
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		n, password, err = spoolMultipart(f, r, body)
+	} else {
+		n, err = io.Copy(f, body)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(f)
+		return nil, 0, "", err
+	}
+	return f, n, password, nil
+}
+
+func spoolMultipart(f *os.File, r *http.Request, body io.ReadCloser) (n int64, password string, err error) {
+	r.Body = body
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return 0, "", err
+	}
+	gotFile := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		switch part.FormName() {
+		case "file":
+			if n, err = io.Copy(f, part); err != nil {
+				return 0, "", err
+			}
+			gotFile = true
+		case "password":
+			b, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				return 0, "", err
+			}
+			password = string(b)
+		}
+	}
+	if !gotFile {
+		return 0, "", codedError(CodeInvalidRequest, "multipart upload requires a file part")
+	}
+	return n, password, nil
+}
+
+func removeSpool(f *os.File) {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
+
+// detectArchiveType определяет тип загрузки по сигнатуре в начале файла.
+// Для zstd смотрим, что внутри: tar опознаётся по "ustar" в заголовке первой записи.
+func detectArchiveType(f *os.File) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	head = head[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("7z\xBC\xAF\x27\x1C")):
+		return "7z", nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xB5, 0x2F, 0xFD}):
+		dec, err := newZstdReader(f)
+		if err != nil {
+			return "zst", nil
+		}
+		inner := make([]byte, 512)
+		m, _ := io.ReadFull(dec, inner)
+		dec.Close()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if isTarHeader(inner[:m]) {
+			return "tar.zst", nil
+		}
+		return "zst", nil
+	case bytes.HasPrefix(head, xzMagic):
+		// Заголовок xz читается при открытии, поэтому файл возвращаем в начало в любом случае.
+		inner, m := make([]byte, 512), 0
+		if dec, err := newXzReader(f); err == nil {
+			m, _ = io.ReadFull(dec, inner)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if isTarHeader(inner[:m]) {
+			return "tar.xz", nil
+		}
+		return "xz", nil
+	case bytes.HasPrefix(head, []byte{0x1F, 0x8B}):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "gzip", nil
+		}
+		inner := make([]byte, 512)
+		m, _ := io.ReadFull(gz, inner)
+		_ = gz.Close()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if isTarHeader(inner[:m]) {
+			return "tar.gz", nil
+		}
+		return "gzip", nil
+	case isTarHeader(head):
+		return "tar", nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) && isXlsxZip(f):
+		return "xlsx", nil
+	case sniffJSON(head) != "":
+		return sniffJSON(head), nil
+	}
+	return "zip", nil
+}
+
+// isCSVContentType — тело запроса и есть data.csv: text/csv или application/csv, с любыми параметрами.
+func isCSVContentType(ct string) bool {
+	mt, _, _ := mime.ParseMediaType(ct)
+	return mt == "text/csv" || mt == "application/csv"
+}
+
+// unsupportedUploadType — Content-Type, с которым тело заведомо не архив и не CSV: XML, HTML,
+// JSON другого вида (+json). Сам application/json — загрузка объектов цен (type=json).
+// Остальные типы, в т.ч. application/x-www-form-urlencoded от curl --data-binary без -H,
+// принимаются: тип архива берётся из ?type= или по сигнатуре.
+func unsupportedUploadType(ct string) bool {
+	if ct == "" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return true
+	}
+	switch {
+	case mt == "application/xml", mt == "text/xml", mt == "text/html",
+		strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	return false
+}
+
+func isTarHeader(b []byte) bool {
+	return len(b) >= 262 && bytes.Equal(b[257:262], []byte("ustar"))
+}
+
+// openCSVFromZip проверяет все записи zip и отдаёт подходящие под files= по порядку.
+func openCSVFromZip(ra io.ReaderAt, size int64, opts ArchiveOptions) (csvFiles, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, codedError(CodeArchiveInvalid, "invalid zip archive")
+	}
+
+	var entries []archiveEntry
+	total := archiveTotal{max: opts.MaxTotalSize}
+	for i, f := range zr.File {
+		if i >= opts.MaxEntries {
+			return nil, opts.tooManyEntries()
+		}
+		if err := checkArchiveEntry(f.Name, f.Mode()); err != nil {
+			return nil, err
+		}
+		if err := total.add(f.UncompressedSize64); err != nil {
+			return nil, err
+		}
+		if f.FileInfo().IsDir() || !opts.archiveMember(f.Name) {
+			continue
+		}
+		if err := opts.checkEntrySize(f.Name, f.UncompressedSize64); err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{name: f.Name, open: func() (io.ReadCloser, error) {
+			if zipEncrypted(f) {
+				return openEncryptedZipFile(f, opts.Password)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, codedError(CodeArchiveInvalid, "failed to open "+f.Name)
+			}
+			return rc, nil
+		}})
+	}
+	if len(entries) == 0 {
+		return nil, opts.filesNotFound()
+	}
+	if opts.Single {
+		entries = entries[:1]
+	}
+	// archive/zip и так не отдаст больше UncompressedSize64, но расшифровка наша,
+	// а лишние байты от archive/zip пришли бы как ошибка формата, а не лимита.
+	return &entryFiles{entries: entries, opts: opts, concurrent: true}, nil
+}
+
+// openCSVFromTar читает CSV-файлы tar прямо из записей, не загружая в память: тело запроса
+// уже лежит во временном файле, как и для zip. Первый подходящий файл ищется сразу, чтобы
+// ARCHIVE_NOT_FOUND пришёл до начала загрузки, остальные — по мере чтения. closeFn
+// освобождает r (декодер сжатого tar) — при ошибке сразу, иначе при закрытии csvFiles.
+func openCSVFromTar(r io.Reader, opts ArchiveOptions, closeFn func()) (_ csvFiles, err error) {
+	defer func() {
+		if err != nil {
+			closeFn()
+		}
+	}()
+	t := &tarFiles{tr: tar.NewReader(r), opts: opts, total: archiveTotal{max: opts.MaxTotalSize}, close: closeFn}
+	if t.pending, err = t.scan(); err == io.EOF {
+		return nil, opts.filesNotFound()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// openCSVFrom7z ищет CSV-файлы в 7z по тем же правилам, что и в zip.
+func openCSVFrom7z(ra io.ReaderAt, size int64, opts ArchiveOptions) (csvFiles, error) {
+	zr, err := sevenzip.NewReaderWithPassword(ra, size, opts.Password)
+	if err != nil {
+		return nil, codedError(CodeArchiveInvalid, "invalid 7z archive or wrong password")
+	}
+
+	var entries []archiveEntry
+	total := archiveTotal{max: opts.MaxTotalSize}
+	for i, f := range zr.File {
+		if i >= opts.MaxEntries {
+			return nil, opts.tooManyEntries()
+		}
+		if err := checkArchiveEntry(f.Name, f.FileInfo().Mode()); err != nil {
+			return nil, err
+		}
+		if err := total.add(f.UncompressedSize); err != nil {
+			return nil, err
+		}
+		if f.FileInfo().IsDir() || !opts.archiveMember(f.Name) {
+			continue
+		}
+		if err := opts.checkEntrySize(f.Name, f.UncompressedSize); err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{name: f.Name, open: func() (io.ReadCloser, error) {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, codedError(CodeArchiveInvalid, "failed to open "+f.Name)
+			}
+			return rc, nil
+		}})
+	}
+	if len(entries) == 0 {
+		return nil, opts.filesNotFound()
+	}
+	if opts.Single {
+		entries = entries[:1]
+	}
+	// Размеру из заголовка 7z не верим — entryFiles режет фактический поток.
+	return &entryFiles{entries: entries, opts: opts}, nil
+}
+
+// newZstdReader ограничивает окно декодера, чтобы заголовок кадра не мог
+// заставить нас выделить сотни мегабайт.
+func newZstdReader(r io.Reader) (*zstd.Decoder, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(64<<20))
+	if err != nil {
+		return nil, codedError(CodeArchiveInvalid, "invalid zstd stream")
+	}
+	return dec, nil
+}
+
+// openCSVFromZstd — загрузка одним data.csv, сжатым zstd (.csv.zst).
+func openCSVFromZstd(r io.Reader, opts ArchiveOptions) (csvFiles, error) {
+	dec, err := newZstdReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return singleFile(opts.limitCSV(singleCSVName, dec, dec.Close)), nil
+}
+
+// openTarZstd — tar, сжатый zstd (.tar.zst): дальше те же проверки, что у tar.
+func openTarZstd(r io.Reader, opts ArchiveOptions) (csvFiles, error) {
+	dec, err := newZstdReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return openCSVFromTar(dec, opts, dec.Close)
+}
+
+// openCSVFromGzip — загрузка одним data.csv, сжатым gzip (.csv.gz).
+func openCSVFromGzip(r io.Reader, opts ArchiveOptions) (csvFiles, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, codedError(CodeArchiveInvalid, "invalid gzip stream")
+	}
+	return singleFile(opts.limitCSV(singleCSVName, gz, func() { _ = gz.Close() })), nil
+}
+
+// openTarGzip — tar, сжатый gzip (.tar.gz, .tgz): дальше те же проверки, что у tar.
+func openTarGzip(r io.Reader, opts ArchiveOptions) (csvFiles, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, codedError(CodeArchiveInvalid, "invalid gzip stream")
+	}
+	return openCSVFromTar(gz, opts, func() { _ = gz.Close() })
+}
+
+// limitedCSV отдаёт не больше n байт распакованного файла name; дальше — LIMIT_EXCEEDED с текстом msg.
+type limitedCSV struct {
+	r     io.Reader
+	n     int64
+	name  string
+	msg   string
+	close func()
+}
+
+func (l *limitedCSV) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Лимит исчерпан: если данные ещё есть, файл слишком большой.
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			return 0, codedError(CodeLimitExceeded, l.msg)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	var ae *apiError
+	if err != nil && !errors.Is(err, io.EOF) && !errors.As(err, &ae) {
+		// Ошибки с кодом (JSON и лист xlsx, переведённые в CSV) — как есть.
+		err = codedError(CodeArchiveInvalid, "failed to read "+l.name+" from archive")
+	}
+	return n, err
+}
+
+func (l *limitedCSV) Close() error {
+	l.close()
+	return nil
+}
+
+// ingestCSV построчно читает CSV-файлы прямо из архива и вставляет валидные строки пачками
+// по INGEST_BATCH_SIZE в одной транзакции: в памяти — ограниченная очередь разобранных
+// впереди пачек (parseAheadBatches) и ключи дублей, а не весь файл. Битый CSV в любом месте откатывает всю загрузку, как и раньше. Файлы
+// архива загружаются подряд, как один: дубли ищутся по всем сразу, строки нумеруются сквозь.
+func ingestCSV(ctx context.Context, db *sql.DB, rules ValidationRules, opts IngestOptions, csvs csvFiles) (UploadEvent, error) {
+	// Повторяется только начало транзакции: строки data.csv читаются из потока один раз,
+	// поэтому ошибку посреди загрузки получает клиент (503, см. httpStatus).
+	tx, err := retryDB(ctx, "begin upload", func() (*sql.Tx, error) {
+		return db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	})
+	if err != nil {
+		return UploadEvent{}, dbError("db begin failed", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Тот же файл или запрос с тем же Idempotency-Key мог закоммитить параллельный запрос,
+	// пока этот принимал архив.
+	if err := lockIdempotencyKeyTx(ctx, tx, opts); err != nil {
+		return UploadEvent{}, dbError("db lock failed", err)
+	}
+	if resp, ok, err := findIdempotentUpload(ctx, tx, opts); err != nil {
+		return UploadEvent{}, err
+	} else if ok {
+		return UploadEvent{ID: resp.UploadID, Supplier: opts.Supplier, Response: resp, Replayed: true}, nil
+	}
+	if err := lockUploadHashTx(ctx, tx, opts); err != nil {
+		return UploadEvent{}, dbError("db lock failed", err)
+	}
+	if resp, ok, err := findRepeatedUpload(ctx, tx, opts); err != nil {
+		return UploadEvent{}, dbError("db query failed", err)
+	} else if ok {
+		return UploadEvent{ID: resp.OriginalUploadID, Supplier: opts.Supplier, Response: resp}, nil
+	}
+
+	// Строки карантина и отклонённые строки ссылаются на загрузку, поэтому она записывается
+	// до них, а итоги — в конце.
+	uploadID, err := recordUploadTx(ctx, tx, opts, PostResponse{})
+	if err != nil {
+		return UploadEvent{}, dbError("db insert failed", err)
+	}
+	var stageID int64
+	if opts.Quarantine {
+		stageID = uploadID
+	}
+	rejects := newRejectWriter(uploadID, opts.Schema)
+
+	var (
+		totalCount int
+		files      []UploadFile
+		lineOffset int // строк в уже прочитанных файлах
+
+		// Дубликаты во входном файле считаем по всем полям кроме id:
+		// created_at | name | category | price (без created_at при opts.IgnoreDate),
+		// а при opts.PriceList — ещё и по product_id | category | created_at.
+		// Храним 16-байтовый хеш ключа, а не саму строку.
+		seenNoID = make(map[[16]byte]struct{})
+
+		rejectedAsDup int // сюда же складываем и “плохие строки”, причины — в ins.rowErrors
+		adjusted      = map[string]int{}
+
+		batchSize = ingestBatchSize()
+		batch     = make([]PriceRow, 0, batchSize)
+		ins       = batchInserter{
+			opts:           opts,
+			uploadID:       uploadID,
+			stageID:        stageID,
+			ev:             UploadEvent{Supplier: opts.Supplier, Inserted: map[string]CategoryDelta{}},
+			conflictsLimit: int(envInt64("CONFLICTS_REPORT_LIMIT", 1000)),
+			rowErrors:      newRowErrors(),
+		}
+	)
+
+	// Файлы разбираются впереди вставки, записи zip — параллельно (см. parseFiles);
+	// здесь строки идут уже по порядку файлов.
+	parser := parseFiles(ctx, csvs, rules, opts)
+	defer parser.stop()
+	for {
+		pf, ok := parser.next()
+		if !ok {
+			break
+		}
+		file := UploadFile{FirstLine: lineOffset + 1}
+		countBefore, dupBefore, itemsBefore := totalCount, rejectedAsDup+ins.duplicates, ins.inserted
+		for parsed := range pf.rows {
+			parser.release(parsed)
+			for _, p := range parsed.rows {
+				// Клиент отключился: не дочитываем файл, а сразу отпускаем транзакцию и соединение с БД.
+				if err := ctx.Err(); err != nil {
+					return UploadEvent{}, err
+				}
+
+				totalCount++
+				if opts.Progress != nil {
+					opts.Progress.Store(int64(totalCount))
+				}
+
+				line := p.line + lineOffset
+				if p.rejectFile {
+					return UploadEvent{}, codedError(CodeCSVInvalid, fmt.Sprintf("line %d: expected %d columns, got %d",
+						line, len(opts.Schema.Columns), len(p.rec)))
+				}
+				reason := p.reason
+				if reason == "" && seenHashes(seenNoID, p.keys) {
+					// дубль во входном файле (id игнорируем)
+					reason = "duplicate_in_file"
+				}
+				if reason != "" {
+					rejectedAsDup++
+					ins.rowErrors.add(line, p.rec, reason)
+					if err := rejects.add(ctx, tx, line, p.rec, reason); err != nil {
+						return UploadEvent{}, err
+					}
+					continue
+				}
+				row := p.row
+				row.Line = line
+				if p.fix != "" {
+					adjusted[p.fix]++
+				}
+
+				if !ins.rowErrors.full() {
+					// Понадобится, если строка окажется дублем строки БД.
+					row.Raw = p.rec
+				}
+
+				if batch = append(batch, row); len(batch) == batchSize {
+					if err := ins.flush(ctx, tx, batch); err != nil {
+						return UploadEvent{}, err
+					}
+					batch = batch[:0]
+				}
+			}
+		}
+		if pf.err != nil {
+			return UploadEvent{}, pf.err
+		}
+		// Пачка не переходит через границу файлов, чтобы итоги файла были точными.
+		if err := ins.flush(ctx, tx, batch); err != nil {
+			return UploadEvent{}, err
+		}
+		batch = batch[:0]
+
+		lineOffset += pf.lines
+		file.Name = pf.name
+		file.LastLine = lineOffset
+		file.TotalCount = totalCount - countBefore
+		file.DuplicatesCount = rejectedAsDup + ins.duplicates - dupBefore
+		file.TotalItems = ins.inserted - itemsBefore
+		files = append(files, file)
+	}
+	if err := rejects.flush(ctx, tx); err != nil {
+		return UploadEvent{}, err
+	}
+	if err := rejects.saveSummary(ctx, tx); err != nil {
+		return UploadEvent{}, err
+	}
+
+	stats, err := queryDatasetStats(ctx, tx, opts.Scope, time.Time{})
+	if err != nil {
+		return UploadEvent{}, dbError("db stats failed", err)
+	}
+	newCategories, err := ins.newCategories(ctx, tx)
+	if err != nil {
+		return UploadEvent{}, dbError("db query failed", err)
+	}
+
+	ev := ins.ev
+	ev.Response = PostResponse{
+		TotalCount:      totalCount,
+		DuplicatesCount: rejectedAsDup + ins.duplicates,
+		TotalItems:      ins.inserted,
+		UpdatedCount:    ins.updated,
+		TotalCategories: stats.TotalCategories,
+		TotalProducts:   stats.TotalProducts,
+		TotalPrice:      stats.TotalPrice,
+		FirstDate:       stats.FirstDate,
+		LastDate:        stats.LastDate,
+		Inserted:        ins.insertedStats(),
+		NewCategories:   newCategories,
+
+		Conflicts:          ins.conflicts,
+		ConflictsTruncated: ins.conflictsTruncated,
+
+		Errors:          ins.rowErrors.list,
+		ErrorsTruncated: ins.rowErrors.truncated,
+		RejectReasons:   ins.rowErrors.counts,
+		AdjustedRows:    adjusted,
+		DuplicateCounts: ins.rowErrors.duplicateCounts(),
+
+		UploadID:    uploadID,
+		RejectedURL: rejects.rejectedURL(),
+	}
+	if len(files) > 1 {
+		ev.Response.Files = files
+	}
+	ev.ID = uploadID
+	if opts.Quarantine {
+		ev.Response.Status, ev.Response.StagedCount = uploadPending, ins.staged
+	}
+	// Итоги пишутся в той же транзакции: откаченная загрузка в статистику не попадает.
+	if err := updateUploadTx(ctx, tx, uploadID, ev.Response, rejects.truncated); err != nil {
+		return UploadEvent{}, dbError("db update failed", err)
+	}
+	if err := storeUploadResponseTx(ctx, tx, uploadID, opts, ev.Response); err != nil {
+		return UploadEvent{}, dbError("db update failed", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return UploadEvent{}, dbError("db commit failed", err)
+	}
+
+	return ev, nil
+}
+
+// csvDelimiters — допустимые значения delimiter= и CSV_DELIMITER.
+var csvDelimiters = map[string]string{
+	"auto":      "auto",
+	",":         ",",
+	"comma":     ",",
+	";":         ";",
+	"semicolon": ";",
+	"\t":        "\t",
+	"tab":       "\t",
+	"|":         "|",
+	"pipe":      "|",
+}
+
+// csvReader настраивает csv.Reader одного файла загрузки по delimiter= и lazy_quotes=.
+// При auto разделитель — самый частый из , ; \t | в первой строке файла. Возвращает и
+// выбранный разделитель — его показывает предпросмотр.
+func (o IngestOptions) csvReader(r io.Reader) (*csv.Reader, string, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	delimiter := o.Delimiter
+	if delimiter == "auto" {
+		head, err := br.Peek(64 << 10)
+		var ae *apiError
+		if errors.As(err, &ae) {
+			// ошибка распаковки или лимита
+			return nil, "", err
+		}
+		delimiter = detectDelimiter(head)
+	}
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	cr.Comma = rune(delimiter[0])
+	cr.LazyQuotes = o.LazyQuotes
+	return cr, delimiter, nil
+}
+
+// ingestBatchSize — сколько строк вставляется одним запросом (INGEST_BATCH_SIZE).
+func ingestBatchSize() int {
+	return int(min(max(envInt64("INGEST_BATCH_SIZE", 1000), 1), 10000))
+}
+
+// dedupeHash сжимает ключ дубля до 16 байт: для файла в миллионы строк множество
+// ключей иначе занимает больше памяти, чем сами строки в пачке.
+func dedupeHash(key string) [16]byte {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	var out [16]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// batchInserter копит итоги вставки пачек одной загрузки.
+type batchInserter struct {
+	opts     IngestOptions
+	ev       UploadEvent // InsertedPrice и Inserted по категориям
+	uploadID int64       // записанные строки prices помечаются этой загрузкой
+
+	stageID int64 // не 0 — пачки уходят в staged_prices этой загрузки (карантин)
+	staged  int
+
+	inserted   int
+	updated    int // строки прайса с новой ценой (dedupe=price_list)
+	duplicates int // дубли уже сохранённых строк
+
+	minPrice, maxPrice float64 // по вставленным строкам
+
+	conflicts          []Conflict
+	conflictsTruncated bool
+	conflictsLimit     int
+
+	rowErrors rowErrors
+}
+
+func (b *batchInserter) flush(ctx context.Context, tx *sql.Tx, batch []PriceRow) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if b.stageID != 0 {
+		if err := stageRowsTx(ctx, tx, b.stageID, batch); err != nil {
+			return dbError("db insert failed", err)
+		}
+		b.staged += len(batch)
+		return nil
+	}
+	written, err := insertPricesTx(ctx, tx, b.uploadID, batch, b.opts)
+	if err != nil {
+		return dbError("db insert failed", err)
+	}
+	for _, r := range batch {
+		if updated, ok := written[b.opts.rowKey(r)]; ok && updated {
+			// Прежняя цена не возвращается, поэтому в InsertedPrice и Inserted обновления не попадают.
+			b.updated++
+			continue
+		} else if ok {
+			if b.inserted == 0 || r.Price < b.minPrice {
+				b.minPrice = r.Price
+			}
+			b.maxPrice = max(b.maxPrice, r.Price)
+			b.inserted++
+			b.ev.InsertedPrice += r.Price
+			d := b.ev.Inserted[r.Category]
+			d.Rows++
+			d.Total += r.Price
+			b.ev.Inserted[r.Category] = d
+			continue
+		}
+		// дубль уже есть в БД (по уникальности “все поля кроме id”)
+		if b.opts.OnDuplicate == "error" {
+			return codedError(CodeConflict, fmt.Sprintf("line %d: row already exists in db", r.Line))
+		}
+		b.duplicates++
+		b.rowErrors.add(r.Line, r.Raw, "duplicate_in_db")
+		if !b.opts.ReportConflicts {
+			continue
+		}
+		if len(b.conflicts) == b.conflictsLimit {
+			b.conflictsTruncated = true
+			continue
+		}
+		ids, err := conflictingIDsTx(ctx, tx, r, b.opts)
+		if err != nil {
+			return dbError("db query failed", err)
+		}
+		b.conflicts = append(b.conflicts, Conflict{
+			Line: r.Line, InputID: r.InputID, Name: r.Name, Category: r.Category, Price: r.Price,
+			CreateDate: r.CreatedAt.Format("2006-01-02"), DBIDs: ids,
+		})
+	}
+	return nil
+}
+
+// insertedStats — итоги по вставленным строкам для ответа; nil, если вставок не было.
+func (b *batchInserter) insertedStats() *InsertedStats {
+	if b.inserted == 0 {
+		return nil
+	}
+	sum := math.Round(b.ev.InsertedPrice*100) / 100
+	return &InsertedStats{
+		Rows:       b.inserted,
+		Sum:        sum,
+		Avg:        math.Round(b.ev.InsertedPrice/float64(b.inserted)*100) / 100,
+		Min:        b.minPrice,
+		Max:        b.maxPrice,
+		Categories: slices.Sorted(maps.Keys(b.ev.Inserted)),
+	}
+}
+
+// newCategories — категории вставленных строк, которых в БД нет ни у одной строки другой
+// загрузки, по алфавиту. Сравнение точное, как у total_categories: "Food" и "food" — разные.
+func (b *batchInserter) newCategories(ctx context.Context, tx *sql.Tx) ([]NewCategory, error) {
+	if b.inserted == 0 {
+		return nil, nil
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c FROM unnest($1::text[]) AS c
+		WHERE NOT EXISTS (
+			SELECT 1 FROM prices p WHERE p.category = c AND p.upload_id IS DISTINCT FROM $2
+		)
+		ORDER BY c`, pq.Array(slices.Collect(maps.Keys(b.ev.Inserted))), b.uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []NewCategory
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, NewCategory{Name: name, Rows: b.ev.Inserted[name].Rows})
+	}
+	return out, rows.Err()
+}
+
+func parsePrice(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	s = strings.ReplaceAll(s, ",", ".")
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return 0, errors.New("invalid price")
+	}
+	// нормализуем до 2 знаков
+	f = math.Round(f*100) / 100
+	if f <= 0 {
+		return 0, errors.New("invalid price")
+	}
+	return f, nil
+}
+
+// parseRecord разбирает и проверяет одну строку data.csv. reason — почему строка отклонена
+// (пусто — строка валидна): имя правила валидации или одно из column_count, empty_field,
+// invalid_date, invalid_price, invalid_currency, invalid_quantity, invalid_unit, invalid_unit_size.
+func parseRecord(rec []string, rules ValidationRules, schema InputSchema) (PriceRow, string) {
+	if len(rec) != len(schema.Columns) {
+		return PriceRow{}, "column_count"
+	}
+
+	inputID := strings.TrimSpace(rec[0])
+	name := strings.TrimSpace(rec[1])
+	category := strings.TrimSpace(rec[2])
+	priceStr := strings.TrimSpace(rec[3])
+	createdAtStr := strings.TrimSpace(rec[4])
+
+	inputID, idRule := rules.clean(inputID)
+	name, nameRule := rules.clean(name)
+	category, categoryRule := rules.clean(category)
+	for _, rule := range []string{idRule, nameRule, categoryRule} {
+		if rule != "" {
+			return PriceRow{}, rule
+		}
+	}
+	category = rules.mapCategory(category)
+
+	if inputID == "" || createdAtStr == "" || name == "" || category == "" || priceStr == "" {
+		return PriceRow{}, "empty_field"
+	}
+
+	createdAt, err := rules.parseDate(createdAtStr)
+	if err != nil {
+		return PriceRow{}, "invalid_date"
+	}
+
+	price, err := parsePrice(priceStr) // float64
+	if err != nil {
+		return PriceRow{}, "invalid_price"
+	}
+
+	if rule := rules.check(createdAt, name, category, price); rule != "" {
+		return PriceRow{}, rule
+	}
+
+	row := PriceRow{
+		InputID:   inputID,
+		CreatedAt: createdAt,
+		Name:      name,
+		Category:  category,
+		Price:     price,
+	}
+	if schema.Version != "1" {
+		if row.Currency, err = parseCurrency(rec[5]); err != nil {
+			return PriceRow{}, "invalid_currency"
+		}
+		if row.Quantity, err = parseQuantity(rec[6]); err != nil {
+			return PriceRow{}, "invalid_quantity"
+		}
+	}
+	if schema.Version == "3" {
+		row.Unit, row.UnitSize, err = parseUnit(rec[7], rec[8])
+		switch {
+		case errors.Is(err, errUnit):
+			return PriceRow{}, "invalid_unit"
+		case err != nil:
+			return PriceRow{}, "invalid_unit_size"
+		}
+	}
+	return row, ""
+}
+
+// dedupeKey — ключ дубля во входном файле: все поля кроме id (без даты при ignoreDate),
+// name и category без учёта регистра и пробелов по краям — как в индексе prices_uniq_ci.
+func (r PriceRow) dedupeKey(ignoreDate bool) string {
+	name, category := normalizeKeyPart(r.Name), normalizeKeyPart(r.Category)
+	if ignoreDate {
+		return fmt.Sprintf("%s|%s|%.2f", name, category, r.Price)
+	}
+	return fmt.Sprintf("%s|%s|%s|%.2f", r.CreatedAt.Format("2006-01-02"), name, category, r.Price)
+}
+
+// priceListKey — ключ строки прайса в режиме price_list, как в индексе prices_uniq_price_list.
+func (r PriceRow) priceListKey() string {
+	return fmt.Sprintf("%s|%s|%s", r.InputID, normalizeKeyPart(r.Category), r.CreatedAt.Format("2006-01-02"))
+}
+
+// rowKey — ключ, по которому insertPricesTx сообщает о записанной строке.
+func (o IngestOptions) rowKey(r PriceRow) string {
+	if o.PriceList {
+		return r.priceListKey()
+	}
+	return r.dedupeKey(o.IgnoreDate)
+}
+
+// fileKeys — ключи дубля во входном файле. В режиме price_list строка не должна совпадать
+// с другой ни по ключу прайса, ни по prices_uniq_ci: такие пары в одной пачке сломали бы вставку.
+func (o IngestOptions) fileKeys(r PriceRow) []string {
+	if o.PriceList {
+		return []string{r.priceListKey(), r.dedupeKey(false)}
+	}
+	return []string{r.dedupeKey(o.IgnoreDate)}
+}
+
+// seen отмечает ключи в множестве и сообщает, встречался ли уже хотя бы один из них.
+func seen(set map[[16]byte]struct{}, keys []string) bool {
+	return seenHashes(set, keyHashes(keys))
+}
+
+// keyHashes — dedupeHash каждого ключа; считается при разборе файла, до seenHashes.
+func keyHashes(keys []string) [][16]byte {
+	hashes := make([][16]byte, len(keys))
+	for i, k := range keys {
+		hashes[i] = dedupeHash(k)
+	}
+	return hashes
+}
+
+// seenHashes — seen по уже посчитанным хешам ключей.
+func seenHashes(set map[[16]byte]struct{}, hashes [][16]byte) bool {
+	for _, h := range hashes {
+		if _, ok := set[h]; ok {
+			return true
+		}
+	}
+	for _, h := range hashes {
+		set[h] = struct{}{}
+	}
+	return false
+}
+
+// normalizeKeyPart — Go-аналог lower(trim(...)) из индексов дублей.
+func normalizeKeyPart(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// parseCurrency принимает трёхбуквенный код ISO 4217 в любом регистре.
+func parseCurrency(s string) (string, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) != 3 || strings.Trim(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", errors.New("invalid currency")
+	}
+	return s, nil
+}
+
+// parseQuantity — положительное количество, до 3 знаков после запятой (вес, объём).
+func parseQuantity(s string) (float64, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", ".")
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 || math.IsInf(f, 0) {
+		return 0, errors.New("invalid quantity")
+	}
+	f = math.Round(f*1000) / 1000
+	if f <= 0 {
+		return 0, errors.New("invalid quantity")
+	}
+	return f, nil
+}
+
+// insertPricesTx вставляет пачку одним запросом и возвращает ключи opts.rowKey записанных строк:
+// true — строка обновлена (price_list или on_duplicate=replace), false — вставлена; остальные
+// совпали с уже сохранёнными. Внутри пачки ключи уникальны — это проверено при чтении.
+func insertPricesTx(ctx context.Context, tx *sql.Tx, uploadID int64, rows []PriceRow, opts IngestOptions) (map[string]bool, error) {
+	// ВАЖНО:
+	// - id НЕ вставляем (должен генерироваться)
+	// - product_id можно хранить как отдельное поле, но наружу его не отдаём.
+	// Уникальность “все поля кроме id” должна быть обеспечена индексом в БД:
+	// prices_uniq_ci (created_at, lower(trim(name)), lower(trim(category)), price)
+	q := `
+		INSERT INTO prices (product_id, created_at, name, category, price, currency, quantity, unit, unit_size, backfill, upload_id)
+		SELECT t.product_id, t.created_at, t.name, t.category, t.price, NULLIF(t.currency, ''), NULLIF(t.quantity, 0),
+			NULLIF(t.unit, ''), NULLIF(t.unit_size, 0), $8, $9
+		FROM unnest($1::text[], $2::date[], $3::text[], $4::text[], $5::numeric[], $6::text[], $7::numeric[],
+			$10::text[], $11::numeric[])
+			AS t(product_id, created_at, name, category, price, currency, quantity, unit, unit_size)
+		ON CONFLICT DO NOTHING
+		RETURNING created_at, name, category, price;
+	`
+	if opts.OnDuplicate == "replace" && !opts.PriceList {
+		// on_duplicate=replace: совпавшая строка получает product_id, написание name и category,
+		// валюту, количество и единицу из файла. Если они не изменились, строка остаётся дублем.
+		q = `
+			INSERT INTO prices AS p (product_id, created_at, name, category, price, currency, quantity, unit, unit_size, backfill, upload_id)
+			SELECT t.product_id, t.created_at, t.name, t.category, t.price, NULLIF(t.currency, ''), NULLIF(t.quantity, 0),
+				NULLIF(t.unit, ''), NULLIF(t.unit_size, 0), $8, $9
+			FROM unnest($1::text[], $2::date[], $3::text[], $4::text[], $5::numeric[], $6::text[], $7::numeric[],
+				$10::text[], $11::numeric[])
+				AS t(product_id, created_at, name, category, price, currency, quantity, unit, unit_size)
+			ON CONFLICT (created_at, lower(trim(name)), lower(trim(category)), price)
+			DO UPDATE SET product_id = EXCLUDED.product_id, name = EXCLUDED.name, category = EXCLUDED.category,
+				currency = EXCLUDED.currency, quantity = EXCLUDED.quantity, unit = EXCLUDED.unit,
+				unit_size = EXCLUDED.unit_size, backfill = EXCLUDED.backfill, upload_id = EXCLUDED.upload_id
+			WHERE (p.product_id, p.name, p.category, p.currency, p.quantity, p.unit, p.unit_size)
+				IS DISTINCT FROM (EXCLUDED.product_id, EXCLUDED.name, EXCLUDED.category, EXCLUDED.currency,
+					EXCLUDED.quantity, EXCLUDED.unit, EXCLUDED.unit_size)
+			RETURNING created_at, name, category, price, p.xmax = 0;
+		`
+	}
+	if opts.IgnoreDate {
+		// Без даты: строки этого режима уникальны через частичный индекс prices_uniq_no_date_ci,
+		// а совпадения с обычными строками за другие даты отсекаем явной проверкой.
+		q = `
+			INSERT INTO prices (product_id, created_at, name, category, price, currency, quantity, unit, unit_size, backfill, upload_id, ignore_date)
+			SELECT t.product_id, t.created_at, t.name, t.category, t.price, NULLIF(t.currency, ''), NULLIF(t.quantity, 0),
+				NULLIF(t.unit, ''), NULLIF(t.unit_size, 0), $8, $9, true
+			FROM unnest($1::text[], $2::date[], $3::text[], $4::text[], $5::numeric[], $6::text[], $7::numeric[],
+				$10::text[], $11::numeric[])
+				AS t(product_id, created_at, name, category, price, currency, quantity, unit, unit_size)
+			WHERE NOT EXISTS (
+				SELECT 1 FROM prices p
+				WHERE lower(trim(p.name)) = lower(trim(t.name)) AND lower(trim(p.category)) = lower(trim(t.category))
+				  AND p.price = t.price
+			)
+			ON CONFLICT DO NOTHING
+			RETURNING created_at, name, category, price;
+		`
+	}
+	if opts.PriceList {
+		// Прайс-лист: одна цена на (product_id, category, created_at) через частичный индекс
+		// prices_uniq_price_list, повтор обновляет строку. Совпадение по prices_uniq_ci с другой
+		// строкой (другого режима или товара) этим ON CONFLICT не ловится — отсекаем его заранее.
+		q = `
+			INSERT INTO prices AS p (product_id, created_at, name, category, price, currency, quantity, unit, unit_size, backfill, upload_id, price_list)
+			SELECT t.product_id, t.created_at, t.name, t.category, t.price, NULLIF(t.currency, ''), NULLIF(t.quantity, 0),
+				NULLIF(t.unit, ''), NULLIF(t.unit_size, 0), $8, $9, true
+			FROM unnest($1::text[], $2::date[], $3::text[], $4::text[], $5::numeric[], $6::text[], $7::numeric[],
+				$10::text[], $11::numeric[])
+				AS t(product_id, created_at, name, category, price, currency, quantity, unit, unit_size)
+			WHERE NOT EXISTS (
+				SELECT 1 FROM prices q
+				WHERE q.created_at = t.created_at
+				  AND lower(trim(q.name)) = lower(trim(t.name)) AND lower(trim(q.category)) = lower(trim(t.category))
+				  AND q.price = t.price
+				  AND NOT (q.price_list AND q.product_id = t.product_id)
+			)
+			ON CONFLICT (product_id, lower(trim(category)), created_at) WHERE price_list
+			DO UPDATE SET price = EXCLUDED.price, name = EXCLUDED.name, currency = EXCLUDED.currency,
+				quantity = EXCLUDED.quantity, unit = EXCLUDED.unit, unit_size = EXCLUDED.unit_size,
+				backfill = EXCLUDED.backfill, upload_id = EXCLUDED.upload_id
+			WHERE p.price <> EXCLUDED.price
+			RETURNING created_at, name, category, price, product_id, p.xmax = 0;
+		`
+	}
+	// Колонки пачки передаются массивами; для схемы 1 валюта и количество пишутся как NULL,
+	// для схем 1 и 2 — единица.
+	cols := struct {
+		ids, dates, names, categories, currencies, units []string
+		prices, quantities, unitSizes                    []float64
+	}{}
+	for _, r := range rows {
+		cols.ids = append(cols.ids, r.InputID)
+		cols.dates = append(cols.dates, r.CreatedAt.Format("2006-01-02"))
+		cols.names = append(cols.names, r.Name)
+		cols.categories = append(cols.categories, r.Category)
+		cols.prices = append(cols.prices, r.Price)
+		cols.currencies = append(cols.currencies, r.Currency)
+		cols.quantities = append(cols.quantities, r.Quantity)
+		cols.units = append(cols.units, r.Unit)
+		cols.unitSizes = append(cols.unitSizes, r.UnitSize)
+	}
+	res, err := tx.QueryContext(ctx, q, pq.Array(cols.ids), pq.Array(cols.dates), pq.Array(cols.names), pq.Array(cols.categories),
+		pq.Array(cols.prices), pq.Array(cols.currencies), pq.Array(cols.quantities), opts.Backfill, uploadID,
+		pq.Array(cols.units), pq.Array(cols.unitSizes))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	written := make(map[string]bool, len(rows))
+	for res.Next() {
+		var (
+			r        PriceRow
+			inserted = true
+		)
+		dest := []any{&r.CreatedAt, &r.Name, &r.Category, &r.Price}
+		// xmax = 0 — строка вставлена; иначе обновлена через ON CONFLICT DO UPDATE.
+		switch {
+		case opts.PriceList:
+			dest = append(dest, &r.InputID, &inserted)
+		case opts.OnDuplicate == "replace":
+			dest = append(dest, &inserted)
+		}
+		if err := res.Scan(dest...); err != nil {
+			return nil, err
+		}
+		written[opts.rowKey(r)] = !inserted
+	}
+	return written, res.Err()
+}
+
+// DatasetStats — итоги по всей БД: то, что видит ключ запроса.
+type DatasetStats struct {
+	Rows            int64   `json:"rows"`
+	TotalCategories int     `json:"total_categories"`
+	TotalProducts   int     `json:"total_products"` // name без учёта регистра и пробелов, как в ключе дубля
+	TotalPrice      float64 `json:"total_price"`
+	// FirstDate и LastDate — самая ранняя и самая поздняя create_date, YYYY-MM-DD; пусто — строк нет.
+	FirstDate string `json:"first_date,omitempty"`
+	LastDate  string `json:"last_date,omitempty"`
+	// LastIngestedAt — когда закончилась последняя загрузка, строки которой попали в prices.
+	LastIngestedAt *time.Time `json:"last_ingested_at,omitempty"`
+	// AsOf — as_of запроса: итоги на этот момент.
+	AsOf *time.Time `json:"as_of,omitempty"`
+}
+
+// queryDatasetStats считает итоги по БД на момент asOf (ноль — текущие);
+// db — *sql.DB или транзакция загрузки.
+func queryDatasetStats(ctx context.Context, db rowQuerier, scope []string, asOf time.Time) (DatasetStats, error) {
+	f := PriceFilter{AsOf: asOf}
+	src, args := f.from(1)
+	uploadsCond := ` AND status IN ('committed', 'approved')`
+	if !asOf.IsZero() {
+		// Загрузка, откаченная позже, в тот момент ещё была в prices.
+		uploadsCond = ` AND status IN ('committed', 'approved', 'rolled_back') AND finished_at <= $1`
+	}
+	// Одним запросом; ключ с ограничением видит итоги только по своим категориям.
+	// Время загрузки — общее: uploads не знает, каких категорий касалась загрузка.
+	cond, scopeArgs := scopeCond("category", scope, len(args)+1)
+	args = append(args, scopeArgs...)
+	q := `
+		SELECT
+			COUNT(*),
+			COUNT(DISTINCT category) AS total_categories,
+			COUNT(DISTINCT lower(trim(name))) AS total_products,
+			COALESCE(SUM(price), 0)  AS total_price,
+			to_char(MIN(created_at), 'YYYY-MM-DD'),
+			to_char(MAX(created_at), 'YYYY-MM-DD'),
+			(SELECT MAX(finished_at) FROM uploads WHERE 1=1` + uploadsCond + `)
+		FROM ` + src + `
+		WHERE 1=1` + cond
+	var (
+		s           DatasetStats
+		first, last sql.NullString
+		ingested    sql.NullTime
+	)
+	if err := db.QueryRowContext(ctx, q, args...).Scan(&s.Rows, &s.TotalCategories, &s.TotalProducts, &s.TotalPrice,
+		&first, &last, &ingested); err != nil {
+		return DatasetStats{}, err
 	}
 	// нормализуем до 2 знаков (на всякий случай)
-	totalPrice = math.Round(totalPrice*100) / 100
-	return totalCategories, totalPrice, nil
+	s.TotalPrice = math.Round(s.TotalPrice*100) / 100
+	s.FirstDate, s.LastDate = first.String, last.String
+	if ingested.Valid {
+		s.LastIngestedAt = &ingested.Time
+	}
+	if !asOf.IsZero() {
+		s.AsOf = &asOf
+	}
+	return s, nil
 }
 
 // ------------------------- GET -------------------------
 
-func handlePricesGet(db *sql.DB) http.HandlerFunc {
+func handlePricesGet(db *sql.DB, headers HeaderSchemes, signer *ExportSigner) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		// Параметры могут отсутствовать в любых комбинациях.
-		startStr := strings.TrimSpace(r.URL.Query().Get("start"))
-		endStr := strings.TrimSpace(r.URL.Query().Get("end"))
-		minStr := strings.TrimSpace(r.URL.Query().Get("min"))
-		maxStr := strings.TrimSpace(r.URL.Query().Get("max"))
+		f, err := parseRequestFilter(r)
+		sampleErr := f.parseSample(r.URL.Query())
+		asOfErr := f.parseAsOf(r.URL.Query())
+		opts, optsErr := parseExportOptions(r, headers, signer)
+		if err := mergeErrors(err, sampleErr, asOfErr, optsErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		if f.Sample > 0 {
+			w.Header().Set("X-Sample-Seed", strconv.FormatInt(f.SampleSeed, 10))
+		}
 
-		var (
-			startDate time.Time
-			endDate   time.Time
-			minPrice  float64
-			maxPrice  float64
-
-			hasStart bool
-			hasEnd   bool
-			hasMin   bool
-			hasMax   bool
-		)
+		query, args := buildGetQuery(f)
 
-		if startStr != "" {
-			d, err := time.Parse("2006-01-02", startStr)
-			if err != nil {
-				http.Error(w, "invalid start", http.StatusBadRequest)
-				return
-			}
-			startDate = d
-			hasStart = true
+		// Итоги, total и строки читаются в одной транзакции REPEATABLE READ — с одного снимка:
+		// заголовки совпадают с телом, даже если загрузка идёт параллельно.
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
 		}
+		defer tx.Rollback()
 
-		if endStr != "" {
-			d, err := time.Parse("2006-01-02", endStr)
+		// Постраничная выгрузка — только если клиент сам передал limit; иначе отдаём всё, как раньше.
+		if r.URL.Query().Has("limit") {
+			page, err := parsePage(r.URL.Query(), 0, maxExportPageSize)
+			if err == nil && page.Limit == 0 {
+				err = fieldError("limit", r.URL.Query().Get("limit"), "expected integer 1.."+strconv.Itoa(maxExportPageSize))
+			}
 			if err != nil {
-				http.Error(w, "invalid end", http.StatusBadRequest)
+				writeErrorFrom(w, err)
 				return
 			}
-			endDate = d
-			hasEnd = true
-		}
-
-		// min/max по ТЗ — натуральные числа (>0) в основных единицах.
-		if minStr != "" {
-			i, err := strconv.Atoi(minStr)
-			if err != nil || i <= 0 {
-				http.Error(w, "invalid min", http.StatusBadRequest)
+			src, countArgs := f.from(1)
+			cond, condArgs := f.where(len(countArgs) + 1)
+			countArgs = append(countArgs, condArgs...)
+			var total int
+			if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+src+` WHERE 1=1`+cond, countArgs...).Scan(&total); err != nil {
+				writeErrorFrom(w, dbError("db query failed", err))
 				return
 			}
-			minPrice = float64(i)
-			hasMin = true
+			setLinkHeader(w, r, page, total)
+			query = fmt.Sprintf("%s LIMIT %d OFFSET %d", query, page.Limit, page.Offset)
 		}
 
-		if maxStr != "" {
-			i, err := strconv.Atoi(maxStr)
-			if err != nil || i <= 0 {
-				http.Error(w, "invalid max", http.StatusBadRequest)
-				return
+		stats, err := exportStats(ctx, tx, query, args)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		defer rows.Close()
+		export := &exportRows{rows: rows, stats: stats}
+		if opts.Manifest != nil {
+			m := opts.Manifest
+			m.Filters = f.echo()
+			if f.Sample > 0 {
+				m.Filters["sample"], m.Filters["sample_seed"] = f.Sample, f.SampleSeed
+			}
+			for _, key := range []string{"limit", "offset"} {
+				if v, err := strconv.Atoi(r.URL.Query().Get(key)); err == nil {
+					m.Filters[key] = v
+				}
 			}
-			maxPrice = float64(i)
-			hasMax = true
+			m.Rows, m.TotalPrice, m.Categories = export.stats.Rows, export.stats.TotalPrice, export.stats.Categories
+		}
+		w.Header().Set("X-Row-Count", strconv.FormatInt(export.stats.Rows, 10))
+		w.Header().Set("X-Total-Price", export.stats.TotalPrice)
+		w.Header().Set("X-Category-Count", strconv.FormatInt(export.stats.Categories, 10))
+
+		// Архив пишем прямо в ответ: полная выгрузка может быть больше 4 ГБ (Zip64)
+		// и не должна целиком держаться в памяти.
+		write := writeZipCSV
+		switch opts.Format {
+		case "zst":
+			write = writeZstdCSV
+			w.Header().Set("Content-Type", "application/zstd")
+			w.Header().Set("Content-Disposition", `attachment; filename="data.csv.zst"`)
+		case "csv":
+			write = writeCSVRows // без упаковки: строки идут в ответ по мере чтения
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `inline; filename="data.csv"`)
+		default:
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", `attachment; filename="data.zip"`)
 		}
+		w.Header().Set("Vary", "Accept")
+		w.WriteHeader(http.StatusOK)
 
-		if hasMin && hasMax && minPrice > maxPrice {
-			// можно и просто вернуть пустой набор, но явная ошибка понятнее пользователю
-			http.Error(w, "min > max", http.StatusBadRequest)
-			return
+		if err := write(w, export, opts); err != nil {
+			// Статус уже отправлен. Обрываем соединение, чтобы клиент не принял
+			// обрезанный архив за целый.
+			log.Printf("export: %v", err)
+			panic(http.ErrAbortHandler)
 		}
+	}
+}
+
+// PriceFilter — фильтры выборки из prices. Параметры могут отсутствовать в любых комбинациях.
+type PriceFilter struct {
+	StartDate time.Time
+	EndDate   time.Time
+	MinPrice  float64
+	MaxPrice  float64
+
+	HasStart bool
+	HasEnd   bool
+	HasMin   bool
+	HasMax   bool
+
+	Categories        []string // category=food&category=drinks
+	ExcludeCategories []string // exclude_category=...
+	Subcategories     bool     // subcategories=true: category и exclude_category — вместе с подкатегориями
+	Scope             []string // категории ключа API (lower(trim)), см. parseRequestFilter; nil — все
+
+	Dates []time.Time // dates=2024-01-31,2024-02-29 — конкретные дни, вместе со start/end
+
+	NamePrefix string // name_prefix — LIKE 'abc%', использует idx_prices_name_pattern
+	NameExact  string // name_exact
+
+	Exprs []filterExpr // filter=category:in(food,drinks);price:gte(100), см. parseFilterExprs
+
+	Sample     float64 // sample=0.01 — доля строк, только для выгрузки; 0 — все строки
+	SampleSeed int64   // sample_seed: с тем же seed отбираются те же строки
+
+	AsOf time.Time // as_of — данные на этот момент (см. pricesAsOf), только для выгрузки; ноль — текущие
+}
+
+// maxExportPageSize — верхняя граница limit для постраничной zip-выгрузки.
+const maxExportPageSize = 1_000_000
+
+// maxFilterDates ограничивает длину списка dates, чтобы не собирать гигантский IN.
+const maxFilterDates = 1000
+
+func parsePriceFilter(q url.Values) (PriceFilter, error) {
+	var (
+		f    PriceFilter
+		errs ValidationErrors
+	)
 
-		query, args := buildGetQuery(hasStart, hasEnd, hasMin, hasMax, startDate, endDate, minPrice, maxPrice)
+	startStr := strings.TrimSpace(q.Get("start"))
+	endStr := strings.TrimSpace(q.Get("end"))
+	minStr := strings.TrimSpace(q.Get("min"))
+	maxStr := strings.TrimSpace(q.Get("max"))
 
-		rows, err := db.QueryContext(ctx, query, args...)
+	if startStr != "" {
+		d, err := time.Parse("2006-01-02", startStr)
 		if err != nil {
-			http.Error(w, "db query failed", http.StatusInternalServerError)
-			return
+			errs.add("start", startStr, "expected YYYY-MM-DD")
+		} else {
+			f.StartDate = d
+			f.HasStart = true
 		}
-		defer rows.Close()
+	}
 
-		var data []DBRow
-		for rows.Next() {
-			var rr DBRow
-			if err := rows.Scan(&rr.ID, &rr.Name, &rr.Category, &rr.Price, &rr.CreatedAt); err != nil {
-				http.Error(w, "db scan failed", http.StatusInternalServerError)
-				return
-			}
-			data = append(data, rr)
+	if endStr != "" {
+		d, err := time.Parse("2006-01-02", endStr)
+		if err != nil {
+			errs.add("end", endStr, "expected YYYY-MM-DD")
+		} else {
+			f.EndDate = d
+			f.HasEnd = true
 		}
-		if err := rows.Err(); err != nil {
-			http.Error(w, "db rows failed", http.StatusInternalServerError)
-			return
+	}
+
+	// min/max по ТЗ — натуральные числа (>0) в основных единицах.
+	if minStr != "" {
+		i, err := strconv.Atoi(minStr)
+		if err != nil || i <= 0 {
+			errs.add("min", minStr, "expected positive integer")
+		} else {
+			f.MinPrice = float64(i)
+			f.HasMin = true
 		}
+	}
 
-		zipBytes, err := buildZipCSV(data)
-		if err != nil {
-			http.Error(w, "failed to build zip", http.StatusInternalServerError)
-			return
+	if maxStr != "" {
+		i, err := strconv.Atoi(maxStr)
+		if err != nil || i <= 0 {
+			errs.add("max", maxStr, "expected positive integer")
+		} else {
+			f.MaxPrice = float64(i)
+			f.HasMax = true
 		}
+	}
 
-		w.Header().Set("Content-Type", "application/zip")
-		w.Header().Set("Content-Disposition", `attachment; filename="data.zip"`)
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(zipBytes)
+	if f.HasMin && f.HasMax && f.MinPrice > f.MaxPrice {
+		// можно и просто вернуть пустой набор, но явная ошибка понятнее пользователю
+		errs.add("min", minStr, "must not exceed max")
 	}
+
+	f.Categories = nonEmptyValues(q["category"])
+	f.ExcludeCategories = nonEmptyValues(q["exclude_category"])
+	switch s := strings.TrimSpace(q.Get("subcategories")); s {
+	case "", "false":
+	case "true":
+		f.Subcategories = true
+	default:
+		errs.add("subcategories", s, "expected true or false")
+	}
+
+	for _, v := range q["dates"] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			d, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				errs.add("dates", s, "expected comma-separated YYYY-MM-DD")
+				continue
+			}
+			f.Dates = append(f.Dates, d)
+		}
+	}
+	if len(f.Dates) > maxFilterDates {
+		errs.add("dates", strconv.Itoa(len(f.Dates))+" dates", "expected at most "+strconv.Itoa(maxFilterDates)+" dates")
+	}
+
+	f.NamePrefix = strings.TrimSpace(q.Get("name_prefix"))
+	f.NameExact = strings.TrimSpace(q.Get("name_exact"))
+
+	f.Exprs = parseFilterExprs(q["filter"], &errs)
+
+	return f, errs.err()
 }
 
-func buildGetQuery(hasStart, hasEnd, hasMin, hasMax bool, startDate, endDate time.Time, minPrice, maxPrice float64) (string, []any) {
-	sb := strings.Builder{}
-	sb.WriteString(`
-		SELECT id, name, category, price, created_at
-		FROM prices
-		WHERE 1=1
-	`)
+// echo — заданные фильтры в нормализованном виде для ответа клиенту.
+func (f PriceFilter) echo() map[string]any {
+	out := map[string]any{}
+	if !f.AsOf.IsZero() {
+		out["as_of"] = f.AsOf.Format(time.RFC3339)
+	}
+	if f.HasStart {
+		out["start"] = f.StartDate.Format("2006-01-02")
+	}
+	if f.HasEnd {
+		out["end"] = f.EndDate.Format("2006-01-02")
+	}
+	if f.HasMin {
+		out["min"] = f.MinPrice
+	}
+	if f.HasMax {
+		out["max"] = f.MaxPrice
+	}
+	if len(f.Categories) > 0 {
+		out["category"] = f.Categories
+	}
+	if len(f.ExcludeCategories) > 0 {
+		out["exclude_category"] = f.ExcludeCategories
+	}
+	if f.Subcategories {
+		out["subcategories"] = true
+	}
+	if len(f.Dates) > 0 {
+		dates := make([]string, len(f.Dates))
+		for i, d := range f.Dates {
+			dates[i] = d.Format("2006-01-02")
+		}
+		out["dates"] = dates
+	}
+	if f.NamePrefix != "" {
+		out["name_prefix"] = f.NamePrefix
+	}
+	if f.NameExact != "" {
+		out["name_exact"] = f.NameExact
+	}
+	if len(f.Exprs) > 0 {
+		exprs := make([]string, len(f.Exprs))
+		for i, e := range f.Exprs {
+			exprs[i] = e.text
+		}
+		out["filter"] = exprs
+	}
+	return out
+}
 
+// where возвращает условия вида " AND ..." и аргументы, нумерация плейсхолдеров — с argN.
+func (f PriceFilter) where(argN int) (string, []any) {
+	sb := strings.Builder{}
 	var args []any
-	argN := 1
 
-	if hasStart {
+	if f.HasStart {
 		sb.WriteString(fmt.Sprintf(" AND created_at >= $%d", argN))
-		args = append(args, startDate)
+		args = append(args, f.StartDate)
 		argN++
 	}
 
-	if hasEnd {
+	if f.HasEnd {
 		sb.WriteString(fmt.Sprintf(" AND created_at <= $%d", argN))
-		args = append(args, endDate)
+		args = append(args, f.EndDate)
 		argN++
 	}
 
-	if hasMin {
+	if f.HasMin {
 		sb.WriteString(fmt.Sprintf(" AND price >= $%d", argN))
-		args = append(args, minPrice)
+		args = append(args, f.MinPrice)
 		argN++
 	}
 
-	if hasMax {
+	if f.HasMax {
 		sb.WriteString(fmt.Sprintf(" AND price <= $%d", argN))
-		args = append(args, maxPrice)
+		args = append(args, f.MaxPrice)
+		argN++
+	}
+
+	if len(f.Categories) > 0 {
+		cond, catArgs := categoryCond(f.Categories, f.Subcategories, argN)
+		sb.WriteString(" AND " + cond)
+		args = append(args, catArgs...)
+		argN += len(catArgs)
+	}
+
+	if len(f.ExcludeCategories) > 0 {
+		cond, catArgs := categoryCond(f.ExcludeCategories, f.Subcategories, argN)
+		sb.WriteString(" AND NOT " + cond)
+		args = append(args, catArgs...)
+		argN += len(catArgs)
+	}
+
+	if cond, scopeArgs := scopeCond("category", f.Scope, argN); cond != "" {
+		sb.WriteString(cond)
+		args = append(args, scopeArgs...)
+		argN++
+	}
+
+	if len(f.Dates) > 0 {
+		sb.WriteString(" AND created_at IN (" + placeholders(argN, len(f.Dates)) + ")")
+		for _, d := range f.Dates {
+			args = append(args, d)
+		}
+		argN += len(f.Dates)
+	}
+
+	if f.NamePrefix != "" {
+		sb.WriteString(fmt.Sprintf(" AND name LIKE $%d", argN))
+		args = append(args, escapeLike(f.NamePrefix)+"%")
+		argN++
+	}
+
+	if f.NameExact != "" {
+		sb.WriteString(fmt.Sprintf(" AND name = $%d", argN))
+		args = append(args, f.NameExact)
 		argN++
 	}
 
-	sb.WriteString(" ORDER BY created_at, id;")
+	for _, e := range f.Exprs {
+		cond, exprArgs := e.cond(argN)
+		sb.WriteString(cond)
+		args = append(args, exprArgs...)
+		argN += len(exprArgs)
+	}
+
+	if f.Sample > 0 && f.Sample < 1 {
+		cond, sampleArgs := f.sampleCond(argN)
+		sb.WriteString(cond)
+		args = append(args, sampleArgs...)
+		argN += len(sampleArgs)
+	}
+
+	return sb.String(), args
+}
+
+func buildGetQuery(f PriceFilter) (string, []any) {
+	src, args := f.from(1)
+	sb := strings.Builder{}
+	sb.WriteString(`
+		SELECT id, name, category, price, created_at
+		FROM ` + src + `
+		WHERE 1=1
+	`)
+
+	cond, condArgs := f.where(len(args) + 1)
+	sb.WriteString(cond)
+	args = append(args, condArgs...)
+
+	// без ";" — вызывающий может дописать LIMIT/OFFSET
+	sb.WriteString(" ORDER BY created_at, id")
 	return sb.String(), args
 }
 
-func buildZipCSV(rows []DBRow) ([]byte, error) {
-	var buf bytes.Buffer
-	zw := zip.NewWriter(&buf)
+// ExportStats — итоги выгрузки для заголовков X-Row-Count, X-Total-Price, X-Category-Count.
+type ExportStats struct {
+	Rows       int64
+	TotalPrice string // точная сумма NUMERIC с 2 знаками, без округлений float
+	Categories int64
+}
+
+// exportStats — итоги выборки query (с учётом limit/offset) отдельным агрегатом: их нужно
+// знать до первой строки, а строки идут потоком и целиком не материализуются. Вызывать
+// в той же транзакции REPEATABLE READ, что и саму выборку.
+func exportStats(ctx context.Context, tx *sql.Tx, query string, args []any) (ExportStats, error) {
+	var s ExportStats
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(price), 0)::numeric(20,2)::text, COUNT(DISTINCT category)
+		FROM (`+query+`) sel`, args...).Scan(&s.Rows, &s.TotalPrice, &s.Categories)
+	return s, err
+}
+
+// exportRows — строки выгрузки и итоги exportStats по ним.
+type exportRows struct {
+	rows  *sql.Rows
+	row   DBRow
+	stats ExportStats
+}
+
+// next переходит к следующей строке; false — строки кончились.
+func (e *exportRows) next() (bool, error) {
+	if !e.rows.Next() {
+		if err := e.rows.Err(); err != nil {
+			return false, fmt.Errorf("db rows: %w", err)
+		}
+		return false, nil
+	}
+	r := &e.row
+	if err := e.rows.Scan(&r.ID, &r.Name, &r.Category, &r.Price, &r.CreatedAt); err != nil {
+		return false, fmt.Errorf("db scan: %w", err)
+	}
+	return true, nil
+}
+
+// writeZipCSV потоково пишет строки выборки в zip с data.csv. archive/zip сам переходит
+// на Zip64, если data.csv больше 4 ГБ. При ошибке архив не закрывается — оборванный
+// zip без центрального каталога клиент не откроет как целый.
+func writeZipCSV(w io.Writer, rows *exportRows, opts ExportOptions) error {
+	zw := zip.NewWriter(w)
 
-	fw, err := zw.Create("data.csv")
+	fw, err := createExportEntry(zw, "data.csv", opts)
 	if err != nil {
-		_ = zw.Close()
-		return nil, err
+		return err
+	}
+	out, sum := fw, sha256.New()
+	if opts.Signer != nil || opts.Manifest != nil {
+		out = io.MultiWriter(fw, sum)
+	}
+	if err := writeCSVRows(out, rows, opts); err != nil {
+		return err
+	}
+	if err := closeExportEntry(fw); err != nil {
+		return err
+	}
+	if opts.Signer != nil {
+		if err := opts.Signer.writeSignature(zw, sum.Sum(nil), opts); err != nil {
+			return err
+		}
 	}
+	if opts.Manifest != nil {
+		if err := writeManifest(zw, hex.EncodeToString(sum.Sum(nil)), opts); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
 
-	cw := csv.NewWriter(fw)
-	cw.Comma = ','
+// writeManifest дописывает manifest.json после data.csv, когда известна его контрольная сумма.
+func writeManifest(zw *zip.Writer, sum string, opts ExportOptions) error {
+	m := *opts.Manifest
+	m.SHA256 = sum
+	m.GeneratedAt = time.Now().UTC()
+	fw, err := createExportEntry(zw, "manifest.json", opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	return closeExportEntry(fw)
+}
 
-	if err := cw.Write([]string{"id", "name", "category", "price", "create_date"}); err != nil {
-		cw.Flush()
-		_ = zw.Close()
-		return nil, err
+// createExportEntry добавляет файл в архив выгрузки, зашифрованный, если задан пароль.
+func createExportEntry(zw *zip.Writer, name string, opts ExportOptions) (io.Writer, error) {
+	if opts.Password != "" {
+		return createEncryptedZipFile(zw, name, opts.Password)
 	}
+	return zw.Create(name)
+}
 
-	for _, r := range rows {
+// closeExportEntry закрывает зашифрованную запись: она дописывает код аутентификации
+// и должна быть закрыта до следующей записи или zw.Close.
+func closeExportEntry(fw io.Writer) error {
+	if c, ok := fw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// writeZstdCSV — то же без zip: data.csv, сжатый zstd. Незавершённый поток zstd
+// при ошибке так же не пройдёт проверку у клиента.
+func writeZstdCSV(w io.Writer, rows *exportRows, opts ExportOptions) error {
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := writeCSVRows(enc, rows, opts); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func writeCSVRows(w io.Writer, rows *exportRows, opts ExportOptions) error {
+	cw := opts.newCSVWriter(w)
+
+	if err := cw.Write(opts.Header); err != nil {
+		return err
+	}
+
+	for {
+		ok, err := rows.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		r := rows.row
+		name, category := r.Name, r.Category
+		if opts.EscapeFormulas {
+			name, category = escapeFormula(name), escapeFormula(category)
+		}
 		rec := []string{
 			strconv.FormatInt(r.ID, 10),
-			r.Name,
-			r.Category,
+			name,
+			category,
 			formatMoney(r.Price),
 			r.CreatedAt.Format("2006-01-02"),
 		}
 		if err := cw.Write(rec); err != nil {
-			cw.Flush()
-			_ = zw.Close()
-			return nil, err
+			return err
 		}
 	}
 
 	cw.Flush()
-	if err := cw.Error(); err != nil {
-		_ = zw.Close()
-		return nil, err
-	}
-
-	if err := zw.Close(); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return cw.Error()
 }
 
 func formatMoney(v float64) string {
@@ -584,9 +2884,86 @@ func formatMoney(v float64) string {
 
 // ------------------------- util -------------------------
 
+// lookupEnv — переопределение из таблицы settings (только для runtimeSettingDefs),
+// иначе переменная окружения.
+func lookupEnv(key string) string {
+	if v, ok := runtimeSettings.lookup(key); ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
 func env(key, def string) string {
-	if v := os.Getenv(key); v != "" {
+	if v := lookupEnv(key); v != "" {
 		return v
 	}
 	return def
 }
+
+// envDuration читает длительность вида "30s"; при пустом или некорректном значении — def.
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := lookupEnv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Printf("env %s: invalid duration %q, using %s", key, v, def)
+	}
+	return def
+}
+
+// envBool читает флаг вида "true"/"false"/"1"/"0"; при пустом или некорректном значении — def.
+func envBool(key string, def bool) bool {
+	if v := lookupEnv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+		log.Printf("env %s: invalid bool %q, using %t", key, v, def)
+	}
+	return def
+}
+
+// envInt64 читает целое положительное число; при пустом или некорректном значении — def.
+func envInt64(key string, def int64) int64 {
+	if v := lookupEnv(key); v != "" {
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil && i > 0 {
+			return i
+		}
+		log.Printf("env %s: invalid value %q, using %d", key, v, def)
+	}
+	return def
+}
+
+// newID — случайный идентификатор для фоновых задач и т.п.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand не должен падать; на всякий случай — время
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// nonEmptyValues — значения повторяющегося query-параметра без пустых строк.
+func nonEmptyValues(vals []string) []string {
+	var out []string
+	for _, v := range vals {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// escapeLike экранирует спецсимволы LIKE (escape-символ по умолчанию — обратный слэш).
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// placeholders возвращает "$n, $n+1, ..." из cnt элементов.
+func placeholders(n, cnt int) string {
+	ps := make([]string, cnt)
+	for i := range ps {
+		ps[i] = "$" + strconv.Itoa(n+i)
+	}
+	return strings.Join(ps, ", ")
+}
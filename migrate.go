@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- migrations -------------------------
+
+// Базовая схема создаётся db/10-init.sql при инициализации контейнера Postgres.
+// Всё, что меняется после, — в db/migrations/NNN_name.sql: файлы применяются при старте
+// по порядку имён, каждый в своей транзакции, и записываются в schema_migrations.
+//
+//go:embed db/migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationsLockID — ключ pg_advisory_lock, чтобы несколько экземпляров не мигрировали одновременно.
+const migrationsLockID = 7_000_001
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockID); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationsLockID)
+	}()
+
+	const createTable = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    TEXT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`
+	if _, err := conn.ExecContext(ctx, createTable); err != nil {
+		return fmt.Errorf("schema_migrations: %w", err)
+	}
+
+	files, err := fs.Glob(migrationsFS, "db/migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		version := strings.TrimSuffix(path.Base(f), ".sql")
+
+		var applied bool
+		if err := conn.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version,
+		).Scan(&applied); err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		body, err := migrationsFS.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(ctx, conn, version, string(body)); err != nil {
+			return fmt.Errorf("%s: %w", version, err)
+		}
+		log.Printf("migration applied: %s", version)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, version, body string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ------------------------- blocked migration -------------------------
+
+// migrationBlockedCode — SQLSTATE, которым миграция отказывается применяться, пока данные
+// не приведены в порядок вручную (RAISE ... USING ERRCODE = 'UD001', в HINT — что сделать).
+// Так миграция 011 не удаляет молча накопившиеся дубли, а оставляет чистку администратору.
+const migrationBlockedCode = "UD001"
+
+// migrationBlocked — err от migrate означает остановку на данных, а не сбой.
+func migrationBlocked(err error) bool {
+	var pe *pq.Error
+	return errors.As(err, &pe) && pe.Code == migrationBlockedCode
+}
+
+// serveMigrationCleanup поднимает сервис только с отчётом и чисткой дублей, когда миграция
+// остановилась на данных: остальные эндпоинты зависят от неприменённых миграций и отвечают
+// 503 с причиной. Чистка — как обычно: dry_run, затем confirm; после неё сервис перезапускают,
+// и миграции продолжаются.
+func serveMigrationCleanup(db *sql.DB, cause error) {
+	msg := cause.Error()
+	var pe *pq.Error
+	if errors.As(cause, &pe) && pe.Hint != "" {
+		msg += ": " + pe.Hint
+	}
+	log.Printf("db migrate blocked, serving only duplicate cleanup: %s", msg)
+
+	rollups := startRollupRefresher(db)
+	readOnly := newReadOnlyMode()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("GET /api/v0/admin/duplicates", requireAdmin(handleDuplicatesReport(db)))
+	mux.HandleFunc("POST /api/v0/admin/dedupe", requireAdmin(handleDedupeStart(db, rollups, readOnly)))
+	mux.HandleFunc("GET /api/v0/admin/dedupe/{id}", requireAdmin(handleDedupeStatus()))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, CodeDBUnavailable, "database migration is pending: "+msg)
+	})
+
+	addr := env("HTTP_ADDR", ":8080")
+	log.Printf("listening on %s", addr)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("http server error: %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// ------------------------- parallel parsing -------------------------
+
+// Разбор и проверка строк (декодирование, CSV, parseRecord, хеши ключей дублей) не трогают
+// БД, поэтому файлы архива разбираются заранее, в несколько потоков, а ingestCSV получает
+// готовые строки по порядку файлов и вставляет их одной транзакцией, как раньше. Дубли между
+// файлами и сквозные номера строк — по-прежнему в ingestCSV: они зависят от порядка.
+
+// parseAheadBatches — сколько разобранных пачек держится впереди вставки: одна очередь на
+// все файлы, кроме вставляемого, и столько же у вставляемого. Вместе с пачками, которые
+// воркеры собирают прямо сейчас, это и есть всё, что разбор добавляет к памяти загрузки, —
+// при любом INGEST_PARSE_WORKERS.
+const parseAheadBatches = 16
+
+// ingestParseWorkers — сколько файлов архива разбирается одновременно (INGEST_PARSE_WORKERS).
+func ingestParseWorkers() int {
+	return int(min(max(envInt64("INGEST_PARSE_WORKERS", int64(runtime.GOMAXPROCS(0))), 1), 64))
+}
+
+// parsedRow — строка файла после parseRecord, до поиска дублей между файлами.
+type parsedRow struct {
+	line       int      // номер строки в своём файле
+	rec        []string // запись как в файле — для errors и rejected.csv
+	row        PriceRow
+	reason     string     // причина отказа; пусто — строка валидна
+	fix        string     // исправление fitColumns
+	keys       [][16]byte // хеши opts.fileKeys(row) для валидной строки
+	rejectFile bool       // columns=reject_file и колонок не столько, сколько в схеме: загрузка отклоняется
+}
+
+// parsedBatch — пачка разобранных строк; budget — она заняла место в fileParser.budget.
+type parsedBatch struct {
+	rows   []parsedRow
+	budget bool
+}
+
+// parsedFile — разобранный файл: строки пачками по порядку. name, lines и err
+// заполняются до закрытия rows и читаются после него.
+type parsedFile struct {
+	rows   chan parsedBatch
+	name   string
+	lines  int   // строк в файле, см. lineCounter.total
+	err    error // разбор прерван: битый CSV, лимит архива или отмена
+	budget chan struct{}
+	head   chan struct{} // закрыт, когда файл начали вставлять: дальше пачки идут без budget
+}
+
+// fileParser разбирает файлы загрузки впереди вставки и отдаёт их по порядку (next).
+type fileParser struct {
+	files  chan *parsedFile
+	budget chan struct{} // общая очередь пачек файлов, которые ещё не вставляются
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// parseFiles запускает разбор csvs. Записи zip читаются независимо и разбираются
+// параллельно, не больше INGEST_PARSE_WORKERS сразу; остальные источники (tar, 7z,
+// единственный поток) — по одному файлу, но тоже впереди вставки. Вызывающий обязан
+// вызвать stop, прежде чем закрыть csvs.
+func parseFiles(ctx context.Context, csvs csvFiles, rules ValidationRules, opts IngestOptions) *fileParser {
+	ctx, cancel := context.WithCancel(ctx)
+	workers := ingestParseWorkers()
+	p := &fileParser{
+		files:  make(chan *parsedFile, workers),
+		budget: make(chan struct{}, parseAheadBatches),
+		cancel: cancel,
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(p.files)
+		if s, ok := csvs.(splitFiles); ok {
+			if parts := s.split(); parts != nil {
+				p.parallel(ctx, parts, workers, rules, opts)
+				return
+			}
+		}
+		for {
+			name, r, err := csvs.next()
+			if err == io.EOF {
+				return
+			}
+			pf := p.newFile()
+			if !p.send(ctx, pf) {
+				return
+			}
+			// Следующий файл — только когда этот дочитан: tar читается одним потоком.
+			if !pf.parse(ctx, name, r, err, rules, opts) {
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// parallel разбирает файлы parts, каждый в своей горутине, не больше workers одновременно.
+func (p *fileParser) parallel(ctx context.Context, parts []csvFiles, workers int, rules ValidationRules, opts IngestOptions) {
+	sem := make(chan struct{}, workers)
+	for _, part := range parts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		pf := p.newFile()
+		if !p.send(ctx, pf) {
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() { <-sem }()
+			defer part.Close()
+			name, r, err := part.next()
+			pf.parse(ctx, name, r, err, rules, opts)
+		}()
+	}
+}
+
+func (p *fileParser) send(ctx context.Context, pf *parsedFile) bool {
+	select {
+	case p.files <- pf:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// next — следующий файл по порядку; false — файлов больше нет. С этого момента файл
+// вставляется, и его пачки больше не занимают общую очередь.
+func (p *fileParser) next() (*parsedFile, bool) {
+	pf, ok := <-p.files
+	if ok {
+		close(pf.head)
+	}
+	return pf, ok
+}
+
+// release освобождает место пачки b в общей очереди, когда вставка её забрала.
+func (p *fileParser) release(b parsedBatch) {
+	if b.budget {
+		<-p.budget
+	}
+}
+
+// stop прерывает разбор и ждёт, пока горутины перестанут читать файлы.
+func (p *fileParser) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+func (p *fileParser) newFile() *parsedFile {
+	return &parsedFile{
+		rows:   make(chan parsedBatch, parseAheadBatches),
+		budget: p.budget,
+		head:   make(chan struct{}),
+	}
+}
+
+// parse разбирает файл name, открытый csvFiles.next с ошибкой openErr, и закрывает rows.
+// false — разбор не удался, дальше читать файлы нельзя.
+func (pf *parsedFile) parse(ctx context.Context, name string, r io.Reader, openErr error, rules ValidationRules, opts IngestOptions) bool {
+	defer close(pf.rows)
+	pf.name, pf.err = name, openErr
+	if pf.err == nil {
+		pf.err = pf.parseCSV(ctx, r, rules, opts)
+	}
+	return pf.err == nil
+}
+
+// parseCSV — разбор одного файла: заголовок, колонки, parseRecord и ключи дублей.
+func (pf *parsedFile) parseCSV(ctx context.Context, r io.Reader, rules ValidationRules, opts IngestOptions) error {
+	text, _, err := opts.decodeCSV(r)
+	if err != nil {
+		return err
+	}
+	// Строки считаются уже в UTF-8: в UTF-16 байт 0x0A бывает и внутри символа.
+	lc := &lineCounter{r: text}
+	cr, _, err := opts.csvReader(lc)
+	if err != nil {
+		return err
+	}
+	cr.ReuseRecord = true
+
+	batchSize := ingestBatchSize()
+	batch := make([]parsedRow, 0, batchSize)
+	emit := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		// Пока файл ждёт своей очереди, каждая пачка занимает место в общей очереди.
+		// Вставляемому файлу место не нужно: иначе пачки следующих файлов могли бы
+		// занять всю очередь, и вставка ждала бы их вечно.
+		b := parsedBatch{rows: batch}
+		select {
+		case pf.budget <- struct{}{}:
+			b.budget = true
+		case <-pf.head:
+		case <-ctx.Done():
+			return false
+		}
+		select {
+		case pf.rows <- b:
+			batch = make([]parsedRow, 0, batchSize)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// Заголовок — у каждого файла свой.
+	first := true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var ae *apiError
+		if errors.As(err, &ae) {
+			// ошибка распаковки или лимита, а не формата CSV
+			return err
+		}
+		if err != nil {
+			return codedError(CodeCSVInvalid, "invalid csv in "+pf.name)
+		}
+		rec = slices.Clone(rec)
+		fitted, fix, fits := opts.fitColumns(rec)
+		if first {
+			first = false
+			if opts.isHeader(fitted, rules) {
+				continue
+			}
+		}
+
+		line, _ := cr.FieldPos(0)
+		p := parsedRow{line: line, rec: rec, fix: fix}
+		if !fits && opts.Columns == "reject_file" {
+			p.rejectFile = true
+			batch = append(batch, p)
+			break
+		}
+		p.row, p.reason = parseRecord(fitted, rules, opts.Schema)
+		if p.reason == "" {
+			p.keys = keyHashes(opts.fileKeys(p.row))
+		}
+		if batch = append(batch, p); len(batch) == batchSize && !emit() {
+			return ctx.Err()
+		}
+	}
+	if !emit() {
+		return ctx.Err()
+	}
+	pf.lines = lc.total()
+	return nil
+}
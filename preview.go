@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ------------------------- upload preview -------------------------
+
+// PreviewResponse — что сервер увидит в первом CSV-файле загрузки: первые строки, разобранные
+// и проверенные теми же правилами, что и при загрузке. В базу ничего не пишется.
+type PreviewResponse struct {
+	File          string       `json:"file"` // имя файла в архиве; data.csv — для загрузки без архива
+	SchemaVersion string       `json:"schema_version"`
+	Columns       []string     `json:"columns"`    // колонки, которые ожидает схема
+	Header        []string     `json:"header"`     // первая строка файла как есть
+	HasHeader     bool         `json:"has_header"` // первая строка — заголовок, а не данные (has_header)
+	Delimiter     string       `json:"delimiter"`
+	Encoding      string       `json:"encoding"` // кодировка, из которой файл перекодирован в UTF-8
+	Rows          []PreviewRow `json:"rows"`
+	Valid         int          `json:"valid"`
+	Rejected      int          `json:"rejected"`
+	Truncated     bool         `json:"truncated"` // в файле есть строки дальше n
+	Warnings      []string     `json:"warnings"`
+}
+
+type PreviewRow struct {
+	Line   int           `json:"line"` // номер строки в файле, с 1
+	Values []string      `json:"values"`
+	Valid  bool          `json:"valid"`
+	Error  string        `json:"error,omitempty"` // причина отказа, см. parseRecord; duplicate_in_file — дубль строки выше
+	Parsed *PreviewPrice `json:"parsed,omitempty"`
+}
+
+// PreviewPrice — строка в том виде, в каком она была бы сохранена.
+type PreviewPrice struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	CreateDate string  `json:"create_date"`
+	Currency   string  `json:"currency,omitempty"`
+	Quantity   float64 `json:"quantity,omitempty"`
+	Unit       string  `json:"unit,omitempty"`       // базовая единица: l, kg, m или pc
+	UnitSize   float64 `json:"unit_size,omitempty"`  // в базовых единицах: 500 ml — 0.5
+	UnitPrice  float64 `json:"unit_price,omitempty"` // цена за базовую единицу
+}
+
+// handlePricesPreview принимает то же, что POST /api/v0/prices, но разбирает только первые n строк.
+// Дубли с уже сохранёнными строками не проверяются — только внутри просмотренной части.
+func handlePricesPreview(rules *liveRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs ValidationErrors
+		n := intParam(r.URL.Query(), "n", "PREVIEW_ROWS", 20, 1, 1000, &errs)
+		if err := errs.err(); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		opts, files, cleanup, ok := receiveUpload(w, r)
+		if !ok {
+			return
+		}
+		defer cleanup()
+
+		// Показываем первый файл архива: остальные разбираются по тем же правилам.
+		name, csvRC, err := files.next()
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		rules := rules.get().forUpload(opts)
+		resp, err := previewCSV(csvRC, rules, opts, n)
+		resp.File = name
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func previewCSV(csvStream io.Reader, rules ValidationRules, opts IngestOptions, n int) (PreviewResponse, error) {
+	resp := PreviewResponse{
+		SchemaVersion: opts.Schema.Version,
+		Columns:       opts.Schema.Columns,
+		Rows:          []PreviewRow{},
+		Warnings:      []string{},
+	}
+
+	text, encoding, err := opts.decodeCSV(csvStream)
+	if err != nil {
+		return resp, err
+	}
+	resp.Encoding = encoding
+	if opts.Encoding == "auto" && (encoding == "windows-1251" || encoding == "koi8-r") {
+		resp.Warnings = append(resp.Warnings, "file is not UTF-8 and is read as "+encoding+" by guess; pass encoding= if the text looks garbled")
+	}
+
+	br := bufio.NewReaderSize(text, 64<<10)
+	head, err := br.Peek(64 << 10)
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return resp, err
+	}
+	detected := detectDelimiter(head)
+
+	// Разбор — как в ingestCSV.
+	cr, delimiter, err := opts.csvReader(br)
+	if err != nil {
+		return resp, err
+	}
+	resp.Delimiter = delimiter
+	if delimiter != detected {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("columns are split by %q, but the first line looks delimited by %q", delimiter, detected))
+	}
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		resp.Warnings = append(resp.Warnings, "data.csv is empty")
+		return resp, nil
+	}
+	if err != nil {
+		return resp, previewReadError(&resp, err)
+	}
+	resp.Header = header
+	fittedHeader, _, _ := opts.fitColumns(header)
+	resp.HasHeader = opts.isHeader(fittedHeader, rules)
+	switch {
+	case !resp.HasHeader && opts.HasHeader == "auto":
+		resp.Warnings = append(resp.Warnings, "no header detected; the first line is read as data")
+	case resp.HasHeader && !headerMatches(fittedHeader, opts.Schema.Columns):
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("header does not match schema %s columns %s; the first line is skipped as a header anyway",
+			opts.Schema.Version, strings.Join(opts.Schema.Columns, ",")))
+	}
+
+	seenKeys := make(map[[16]byte]struct{})
+	rejectFileWarned := false
+	// Первая строка без заголовка — уже данные: разбираем её вместе с остальными.
+	rec := header
+	if resp.HasHeader {
+		rec, err = cr.Read()
+	}
+	for ; ; rec, err = cr.Read() {
+		if err == io.EOF {
+			return resp, nil
+		}
+		if err != nil {
+			return resp, previewReadError(&resp, err)
+		}
+		if len(resp.Rows) == n {
+			resp.Truncated = true
+			return resp, nil
+		}
+
+		line, _ := cr.FieldPos(0)
+		pr := PreviewRow{Line: line, Values: rec}
+		fitted, _, fits := opts.fitColumns(rec)
+		if !fits && opts.Columns == "reject_file" && !rejectFileWarned {
+			rejectFileWarned = true
+			resp.Warnings = append(resp.Warnings, fmt.Sprintf("line %d has %d columns, upload will be rejected with columns=reject_file", line, len(rec)))
+		}
+		row, reason := parseRecord(fitted, rules, opts.Schema)
+		if reason == "" {
+			if seen(seenKeys, opts.fileKeys(row)) {
+				reason = "duplicate_in_file"
+			}
+		}
+		if reason != "" {
+			pr.Error = reason
+			resp.Rejected++
+		} else {
+			pr.Valid = true
+			pr.Parsed = &PreviewPrice{
+				ID:         row.InputID,
+				Name:       row.Name,
+				Category:   row.Category,
+				Price:      row.Price,
+				CreateDate: row.CreatedAt.Format("2006-01-02"),
+				Currency:   row.Currency,
+				Quantity:   row.Quantity,
+				Unit:       row.Unit,
+				UnitSize:   row.UnitSize,
+				UnitPrice:  row.unitPrice(),
+			}
+			resp.Valid++
+		}
+		resp.Rows = append(resp.Rows, pr)
+	}
+}
+
+// previewReadError: ошибка архива отдаётся как при загрузке, а битый CSV — предупреждением,
+// чтобы пользователь увидел строки до него. Полная загрузка такого файла вернёт CSV_INVALID.
+func previewReadError(resp *PreviewResponse, err error) error {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return err
+	}
+	resp.Warnings = append(resp.Warnings, "invalid csv, upload will be rejected: "+err.Error())
+	return nil
+}
+
+func headerMatches(header, columns []string) bool {
+	if len(header) != len(columns) {
+		return false
+	}
+	for i, h := range header {
+		h = strings.TrimPrefix(strings.TrimSpace(h), "\uFEFF")
+		if !strings.EqualFold(h, columns[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// detectDelimiter выбирает самый частый из , ; \t | в первой строке вне кавычек.
+func detectDelimiter(head []byte) string {
+	candidates := []byte{',', ';', '\t', '|'}
+	counts := make([]int, len(candidates))
+	inQuotes := false
+	for _, b := range head {
+		if b == '"' {
+			inQuotes = !inQuotes
+			continue
+		}
+		if inQuotes {
+			continue
+		}
+		if b == '\n' {
+			break
+		}
+		if i := slices.Index(candidates, b); i >= 0 {
+			counts[i]++
+		}
+	}
+	best := 0
+	for i := range counts {
+		if counts[i] > counts[best] {
+			best = i
+		}
+	}
+	return string(candidates[best])
+}
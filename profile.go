@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- column profile -------------------------
+
+// Профиль хранимых данных по колонкам prices — для проверок качества данных (data
+// governance), которые раньше делали разовыми SQL-запросами: сколько значений пусто или
+// заполнено заглушками, сколько разных, длины текста, диапазоны и самые частые категории.
+
+// profileColumn — колонка профиля: имя в ответе, выражение и вид значений.
+type profileColumn struct {
+	name string
+	expr string
+	kind string // text, number или date
+}
+
+// profileColumns — колонки prices в порядке ответа. id — product_id из входного файла.
+var profileColumns = []profileColumn{
+	{"id", "product_id", "text"},
+	{"name", "name", "text"},
+	{"category", "category", "text"},
+	{"price", "price", "number"},
+	{"create_date", "created_at", "date"},
+	{"currency", "currency", "text"},
+	{"quantity", "quantity", "number"},
+	{"unit", "unit", "text"},
+	{"unit_size", "unit_size", "number"},
+	{"unit_price", "unit_price", "number"},
+}
+
+// ColumnProfile — профиль одной колонки. Для текста null_equivalent складывает NULL,
+// пустые строки и заглушки вроде "n/a"; для чисел и дат это только NULL.
+type ColumnProfile struct {
+	Column         string           `json:"column"`
+	Type           string           `json:"type"` // text, number или date
+	Nulls          int64            `json:"nulls"`
+	Empty          int64            `json:"empty,omitempty"`        // пустая строка или одни пробелы
+	Placeholders   int64            `json:"placeholders,omitempty"` // значения из PROFILE_NULL_VALUES
+	NullEquivalent int64            `json:"null_equivalent"`
+	Distinct       int64            `json:"distinct"`
+	MinLength      *int64           `json:"min_length,omitempty"` // в символах, только текст
+	MaxLength      *int64           `json:"max_length,omitempty"`
+	Min            any              `json:"min,omitempty"` // число или YYYY-MM-DD
+	Max            any              `json:"max,omitempty"`
+	Top            []ValueFrequency `json:"top,omitempty"` // только category
+}
+
+// ValueFrequency — значение и сколько строк его содержат.
+type ValueFrequency struct {
+	Value string  `json:"value"`
+	Rows  int64   `json:"rows"`
+	Share float64 `json:"share"` // доля строк выборки, 0..1
+}
+
+// DataProfile — тело GET /api/v0/stats/profile.
+type DataProfile struct {
+	Rows        int64           `json:"rows"`
+	Columns     []ColumnProfile `json:"columns"`
+	Filters     map[string]any  `json:"filters"`
+	GeneratedAt time.Time       `json:"generated_at"`
+}
+
+// handleDataProfile считает профиль строк prices под фильтром выгрузки (start, end,
+// category, filter=…) с учётом категорий ключа. top — сколько самых частых категорий
+// показать (по умолчанию 10).
+func handleDataProfile(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs ValidationErrors
+		top := intParam(r.URL.Query(), "top", "PROFILE_TOP", 10, 1, 100, &errs)
+		f, filterErr := parseRequestFilter(r)
+		if err := mergeErrors(errs.err(), filterErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		p, err := profilePrices(r.Context(), db, f, top)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		p.Filters = f.echo()
+		p.Filters["top"] = top
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p)
+	}
+}
+
+// profileNullValues — заглушки вместо пустого значения, без учёта регистра и пробелов.
+func profileNullValues() []string {
+	var out []string
+	for _, v := range strings.Split(env("PROFILE_NULL_VALUES", "null,none,nil,n/a,na,nan,-,?"), ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func profilePrices(ctx context.Context, db *sql.DB, f PriceFilter, top int) (DataProfile, error) {
+	cond, args := f.where(1)
+	nullsArg := len(args) + 1
+	args = append(args, pq.Array(profileNullValues()))
+
+	// Все колонки — одним проходом по таблице. Имена колонок — константы profileColumns.
+	exprs := []string{"COUNT(*)"}
+	for _, c := range profileColumns {
+		exprs = append(exprs,
+			fmt.Sprintf("COUNT(*) FILTER (WHERE %s IS NULL)", c.expr),
+			fmt.Sprintf("COUNT(DISTINCT %s)", c.expr))
+		switch c.kind {
+		case "text":
+			exprs = append(exprs,
+				fmt.Sprintf("COUNT(*) FILTER (WHERE trim(%s) = '')", c.expr),
+				fmt.Sprintf("COUNT(*) FILTER (WHERE lower(trim(%s)) = ANY($%d))", c.expr, nullsArg),
+				fmt.Sprintf("MIN(char_length(%s))", c.expr),
+				fmt.Sprintf("MAX(char_length(%s))", c.expr))
+		case "number":
+			exprs = append(exprs, fmt.Sprintf("MIN(%s)::float8", c.expr), fmt.Sprintf("MAX(%s)::float8", c.expr))
+		case "date":
+			exprs = append(exprs, fmt.Sprintf("to_char(MIN(%s), 'YYYY-MM-DD')", c.expr), fmt.Sprintf("to_char(MAX(%s), 'YYYY-MM-DD')", c.expr))
+		}
+	}
+
+	var (
+		p    = DataProfile{Columns: make([]ColumnProfile, len(profileColumns)), GeneratedAt: time.Now().UTC()}
+		dest = []any{&p.Rows}
+		// Временные значения, которые могут быть NULL: MIN/MAX по пустой выборке.
+		minLen  = make([]sql.NullInt64, len(profileColumns))
+		maxLen  = make([]sql.NullInt64, len(profileColumns))
+		minNum  = make([]sql.NullFloat64, len(profileColumns))
+		maxNum  = make([]sql.NullFloat64, len(profileColumns))
+		minDate = make([]sql.NullString, len(profileColumns))
+		maxDate = make([]sql.NullString, len(profileColumns))
+	)
+	for i, c := range profileColumns {
+		cp := &p.Columns[i]
+		cp.Column, cp.Type = c.name, c.kind
+		dest = append(dest, &cp.Nulls, &cp.Distinct)
+		switch c.kind {
+		case "text":
+			dest = append(dest, &cp.Empty, &cp.Placeholders, &minLen[i], &maxLen[i])
+		case "number":
+			dest = append(dest, &minNum[i], &maxNum[i])
+		case "date":
+			dest = append(dest, &minDate[i], &maxDate[i])
+		}
+	}
+	q := "SELECT " + strings.Join(exprs, ",\n\t\t") + "\nFROM prices WHERE 1=1" + cond
+	if err := db.QueryRowContext(ctx, q, args...).Scan(dest...); err != nil {
+		return DataProfile{}, err
+	}
+
+	for i := range p.Columns {
+		cp := &p.Columns[i]
+		cp.NullEquivalent = cp.Nulls + cp.Empty + cp.Placeholders
+		if minLen[i].Valid {
+			cp.MinLength, cp.MaxLength = &minLen[i].Int64, &maxLen[i].Int64
+		}
+		if minNum[i].Valid {
+			cp.Min, cp.Max = minNum[i].Float64, maxNum[i].Float64
+		}
+		if minDate[i].Valid {
+			cp.Min, cp.Max = minDate[i].String, maxDate[i].String
+		}
+		if cp.Column == "category" {
+			var err error
+			if cp.Top, err = topValues(ctx, db, f, "category", top, p.Rows); err != nil {
+				return DataProfile{}, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// topValues — самые частые значения колонки column (константа) под фильтром f.
+func topValues(ctx context.Context, db *sql.DB, f PriceFilter, column string, limit int, total int64) ([]ValueFrequency, error) {
+	cond, args := f.where(1)
+	args = append(args, limit)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %[1]s, COUNT(*) FROM prices WHERE %[1]s IS NOT NULL%[2]s
+		GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $%[3]d`, column, cond, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ValueFrequency{}
+	for rows.Next() {
+		var v ValueFrequency
+		if err := rows.Scan(&v.Value, &v.Rows); err != nil {
+			return nil, err
+		}
+		if total > 0 {
+			v.Share = float64(v.Rows) / float64(total)
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- upload quarantine -------------------------
+
+// UploadInfo — загрузка в карантине и её итоги.
+type UploadInfo struct {
+	ID              int64      `json:"id"`
+	UploadedAt      time.Time  `json:"uploaded_at"`
+	Supplier        string     `json:"supplier"`
+	SchemaVersion   string     `json:"schema_version"`
+	Dedupe          string     `json:"dedupe"`
+	Backfill        bool       `json:"backfill"`
+	Status          string     `json:"status"` // committed, pending, approved, rejected или rolled_back
+	ReviewedAt      *time.Time `json:"reviewed_at,omitempty"`
+	TotalCount      int        `json:"total_count"`
+	DuplicatesCount int        `json:"duplicates_count"`
+	TotalItems      int        `json:"total_items"`
+
+	counts DuplicateCounts // раскладка duplicates_count; approve добавляет к ней дубли строк БД
+	apiKey string          // ключ, которым сделана загрузка
+}
+
+// StagedRow — строка, ожидающая проверки. Action — что с ней сделает approve, если БД
+// к тому моменту не изменится: insert, update (только price_list) или duplicate.
+type StagedRow struct {
+	Line       int     `json:"line"`
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Category   string  `json:"category"`
+	Price      float64 `json:"price"`
+	CreateDate string  `json:"create_date"`
+	Currency   string  `json:"currency,omitempty"`
+	Quantity   float64 `json:"quantity,omitempty"`
+	Unit       string  `json:"unit,omitempty"`
+	UnitSize   float64 `json:"unit_size,omitempty"`
+	UnitPrice  float64 `json:"unit_price,omitempty"`
+	Action     string  `json:"action"`
+}
+
+// UploadPreview — ответ GET /api/v0/uploads/{id}/preview.
+type UploadPreview struct {
+	Upload      UploadInfo  `json:"upload"`
+	Rows        []StagedRow `json:"rows"`
+	Total       int         `json:"total"` // строк в staged_prices
+	Page        PageInfo    `json:"page"`
+	GeneratedAt time.Time   `json:"generated_at"`
+}
+
+var errUploadNotFound = codedError(CodeNotFound, "upload not found")
+
+// stageRowsTx откладывает пачку строк загрузки в staged_prices.
+func stageRowsTx(ctx context.Context, tx *sql.Tx, uploadID int64, rows []PriceRow) error {
+	cols := struct {
+		lines                                            []int64
+		ids, dates, names, categories, currencies, units []string
+		prices, quantities, unitSizes                    []float64
+	}{}
+	for _, r := range rows {
+		cols.lines = append(cols.lines, int64(r.Line))
+		cols.ids = append(cols.ids, r.InputID)
+		cols.dates = append(cols.dates, r.CreatedAt.Format("2006-01-02"))
+		cols.names = append(cols.names, r.Name)
+		cols.categories = append(cols.categories, r.Category)
+		cols.prices = append(cols.prices, r.Price)
+		cols.currencies = append(cols.currencies, r.Currency)
+		cols.quantities = append(cols.quantities, r.Quantity)
+		cols.units = append(cols.units, r.Unit)
+		cols.unitSizes = append(cols.unitSizes, r.UnitSize)
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO staged_prices (upload_id, line, product_id, created_at, name, category, price, currency, quantity, unit, unit_size)
+		SELECT $1, t.line, t.product_id, t.created_at, t.name, t.category, t.price, NULLIF(t.currency, ''), NULLIF(t.quantity, 0),
+			NULLIF(t.unit, ''), NULLIF(t.unit_size, 0)
+		FROM unnest($2::int[], $3::text[], $4::date[], $5::text[], $6::text[], $7::numeric[], $8::text[], $9::numeric[],
+			$10::text[], $11::numeric[])
+			AS t(line, product_id, created_at, name, category, price, currency, quantity, unit, unit_size);
+	`, uploadID, pq.Array(cols.lines), pq.Array(cols.ids), pq.Array(cols.dates), pq.Array(cols.names),
+		pq.Array(cols.categories), pq.Array(cols.prices), pq.Array(cols.currencies), pq.Array(cols.quantities),
+		pq.Array(cols.units), pq.Array(cols.unitSizes))
+	return err
+}
+
+func uploadIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	s := r.PathValue("id")
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		writeErrorFrom(w, fieldError("id", s, "expected positive integer"))
+		return 0, false
+	}
+	return id, true
+}
+
+func getUploadInfo(ctx context.Context, db rowQuerier, id int64, lock bool) (UploadInfo, error) {
+	q := `
+		SELECT id, uploaded_at, supplier, schema_version, dedupe, backfill, status, reviewed_at,
+			total_count, duplicates_count, total_items, file_duplicates, db_duplicates, invalid_rows, api_key
+		FROM uploads WHERE id = $1`
+	if lock {
+		q += ` FOR UPDATE`
+	}
+	var u UploadInfo
+	err := db.QueryRowContext(ctx, q, id).Scan(&u.ID, &u.UploadedAt, &u.Supplier, &u.SchemaVersion, &u.Dedupe,
+		&u.Backfill, &u.Status, &u.ReviewedAt, &u.TotalCount, &u.DuplicatesCount, &u.TotalItems,
+		&u.counts.FileDuplicates, &u.counts.DBDuplicates, &u.counts.InvalidRows, &u.apiKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, errUploadNotFound
+	}
+	if err != nil {
+		return u, dbError("db query failed", err)
+	}
+	return u, nil
+}
+
+// options восстанавливает параметры исходной загрузки для approve.
+func (u UploadInfo) options() (IngestOptions, error) {
+	opts := IngestOptions{Supplier: u.Supplier, Backfill: u.Backfill}
+	schema, ok := findInputSchema(u.SchemaVersion)
+	if !ok || !opts.setDedupe(u.Dedupe) {
+		return opts, fmt.Errorf("upload %d: unsupported schema %s or dedupe %s", u.ID, u.SchemaVersion, u.Dedupe)
+	}
+	opts.Schema = schema
+	return opts, nil
+}
+
+// handleUploadPreview показывает строки загрузки в карантине и что с ними сделает approve.
+func handleUploadPreview(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id, ok := uploadIDParam(w, r)
+		if !ok {
+			return
+		}
+		page, err := parsePage(r.URL.Query(), 100, 1000)
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		u, err := getUploadInfo(ctx, db, id, false)
+		if err == nil && !uploadVisible(r, u.apiKey) {
+			err = errUploadNotFound
+		}
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		opts, err := u.options()
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		rows, total, err := stagedRows(ctx, db, id, opts, page, categoryScope(r))
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		page.Returned = len(rows)
+		page.HasMore = page.Offset+len(rows) < total
+		setLinkHeader(w, r, page, total)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(UploadPreview{Upload: u, Rows: rows, Total: total, Page: page, GeneratedAt: time.Now().UTC()})
+	}
+}
+
+// stagedRows читает страницу staged_prices и для каждой строки проверяет, с чем она совпадёт
+// в prices по ключу режима загрузки — тем же, что у insertPricesTx.
+func stagedRows(ctx context.Context, db *sql.DB, id int64, opts IngestOptions, page PageInfo, scope []string) ([]StagedRow, int, error) {
+	cond, args := scopeCond("s.category", scope, 2)
+	args = append([]any{id}, args...)
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM staged_prices s WHERE s.upload_id = $1`+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	const ci = `lower(trim(p.name)) = lower(trim(s.name)) AND lower(trim(p.category)) = lower(trim(s.category)) AND p.price = s.price`
+	dup := ci + ` AND p.created_at = s.created_at`
+	listed := `false`
+	switch {
+	case opts.IgnoreDate:
+		dup = ci
+	case opts.PriceList:
+		listed = `EXISTS (SELECT 1 FROM prices p WHERE p.price_list AND p.product_id = s.product_id
+			AND lower(trim(p.category)) = lower(trim(s.category)) AND p.created_at = s.created_at)`
+		dup = `p.created_at = s.created_at AND (` + ci + ` OR (p.price_list AND p.product_id = s.product_id
+			AND lower(trim(p.category)) = lower(trim(s.category)) AND p.price = s.price))`
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT s.line, s.product_id, s.name, s.category, s.price, s.created_at,
+			COALESCE(s.currency, ''), COALESCE(s.quantity, 0), COALESCE(s.unit, ''), COALESCE(s.unit_size, 0),
+			EXISTS (SELECT 1 FROM prices p WHERE %s), %s
+		FROM staged_prices s
+		WHERE s.upload_id = $1%s
+		ORDER BY s.line
+		LIMIT %d OFFSET %d`, dup, listed, cond, page.Limit, page.Offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	out := []StagedRow{}
+	for rows.Next() {
+		var (
+			s               StagedRow
+			createdAt       time.Time
+			isDup, isListed bool
+		)
+		if err := rows.Scan(&s.Line, &s.ID, &s.Name, &s.Category, &s.Price, &createdAt,
+			&s.Currency, &s.Quantity, &s.Unit, &s.UnitSize, &isDup, &isListed); err != nil {
+			return nil, 0, err
+		}
+		s.CreateDate = createdAt.Format("2006-01-02")
+		s.UnitPrice = PriceRow{Price: s.Price, UnitSize: s.UnitSize}.unitPrice()
+		switch {
+		case isDup:
+			s.Action = "duplicate"
+		case isListed:
+			s.Action = "update"
+		default:
+			s.Action = "insert"
+		}
+		out = append(out, s)
+	}
+	return out, total, rows.Err()
+}
+
+// handleUploadApprove переносит строки загрузки из карантина в prices теми же пачками и с теми же
+// проверками дублей, что и обычная загрузка, затем обновляет сводные таблицы и проверяет оповещения.
+func handleUploadApprove(db *sql.DB, rollups *rollupRefresher, alerts *Alerting) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := uploadIDParam(w, r)
+		if !ok {
+			return
+		}
+		var split bool
+		if s := strings.TrimSpace(r.URL.Query().Get("split_counts")); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				writeErrorFrom(w, fieldError("split_counts", s, "expected true or false"))
+				return
+			}
+			split = b
+		}
+		var backfill bool
+		ev, err := retryDB(r.Context(), "approve upload", func() (ev UploadEvent, err error) {
+			ev, backfill, err = approveUpload(r.Context(), db, id)
+			return ev, err
+		})
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		ev.afterCommit(rollups, alerts, backfill)
+		ev.Response = IngestOptions{SplitCounts: split}.response(ev.Response)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ev.Response)
+	}
+}
+
+func approveUpload(ctx context.Context, db *sql.DB, id int64) (UploadEvent, bool, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return UploadEvent{}, false, dbError("db begin failed", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// FOR UPDATE: второй approve или reject той же загрузки ждёт и затем видит новый статус.
+	u, err := getUploadInfo(ctx, tx, id, true)
+	if err != nil {
+		return UploadEvent{}, false, err
+	}
+	if u.Status != uploadPending {
+		return UploadEvent{}, false, codedError(CodeConflict, "upload is "+u.Status+", not pending")
+	}
+	opts, err := u.options()
+	if err != nil {
+		return UploadEvent{}, false, err
+	}
+
+	ins := batchInserter{
+		opts:           opts,
+		uploadID:       id,
+		ev:             UploadEvent{ID: id, Supplier: u.Supplier, Inserted: map[string]CategoryDelta{}},
+		conflictsLimit: int(envInt64("CONFLICTS_REPORT_LIMIT", 1000)),
+		rowErrors:      newRowErrors(),
+	}
+	// Пачки читаются по ключу line: открытый курсор и вставка в одной транзакции lib/pq не совмещает.
+	batchSize, after := ingestBatchSize(), 0
+	for {
+		batch, err := stagedBatchTx(ctx, tx, id, after, batchSize)
+		if err != nil {
+			return UploadEvent{}, false, dbError("db query failed", err)
+		}
+		if err := ins.flush(ctx, tx, batch); err != nil {
+			return UploadEvent{}, false, err
+		}
+		if len(batch) < batchSize {
+			break
+		}
+		after = batch[len(batch)-1].Line
+	}
+
+	stats, err := queryDatasetStats(ctx, tx, nil, time.Time{})
+	if err != nil {
+		return UploadEvent{}, false, dbError("db stats failed", err)
+	}
+	newCategories, err := ins.newCategories(ctx, tx)
+	if err != nil {
+		return UploadEvent{}, false, dbError("db query failed", err)
+	}
+	ev := ins.ev
+	counts := u.counts
+	counts.DBDuplicates += ins.duplicates
+	ev.Response = PostResponse{
+		TotalCount:      u.TotalCount,
+		DuplicatesCount: u.DuplicatesCount + ins.duplicates,
+		TotalItems:      ins.inserted,
+		UpdatedCount:    ins.updated,
+		TotalCategories: stats.TotalCategories,
+		TotalProducts:   stats.TotalProducts,
+		TotalPrice:      stats.TotalPrice,
+		FirstDate:       stats.FirstDate,
+		LastDate:        stats.LastDate,
+		Inserted:        ins.insertedStats(),
+		NewCategories:   newCategories,
+		UploadID:        id,
+		Status:          uploadApproved,
+
+		Errors:          ins.rowErrors.list,
+		ErrorsTruncated: ins.rowErrors.truncated,
+		RejectReasons:   ins.rowErrors.counts,
+		DuplicateCounts: &counts,
+	}
+	if err := updateUploadTx(ctx, tx, id, ev.Response, false); err != nil {
+		return UploadEvent{}, false, dbError("db update failed", err)
+	}
+	if err := finishReviewTx(ctx, tx, id); err != nil {
+		return UploadEvent{}, false, dbError("db update failed", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return UploadEvent{}, false, dbError("db commit failed", err)
+	}
+	return ev, u.Backfill, nil
+}
+
+func stagedBatchTx(ctx context.Context, tx *sql.Tx, id int64, after, limit int) ([]PriceRow, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT line, product_id, created_at, name, category, price, COALESCE(currency, ''), COALESCE(quantity, 0),
+			COALESCE(unit, ''), COALESCE(unit_size, 0)
+		FROM staged_prices
+		WHERE upload_id = $1 AND line > $2
+		ORDER BY line
+		LIMIT $3`, id, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []PriceRow
+	for rows.Next() {
+		var r PriceRow
+		if err := rows.Scan(&r.Line, &r.InputID, &r.CreatedAt, &r.Name, &r.Category, &r.Price, &r.Currency, &r.Quantity,
+			&r.Unit, &r.UnitSize); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// finishReviewTx отмечает время решения и удаляет строки карантина: после approve они уже
+// в prices, после reject — не нужны.
+func finishReviewTx(ctx context.Context, tx *sql.Tx, id int64) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE uploads SET reviewed_at = now() WHERE id = $1`, id); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM staged_prices WHERE upload_id = $1`, id)
+	return err
+}
+
+// handleUploadReject отклоняет загрузку в карантине: её строки удаляются, в prices ничего не попадает.
+func handleUploadReject(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id, ok := uploadIDParam(w, r)
+		if !ok {
+			return
+		}
+		u, err := retryDB(ctx, "reject upload", func() (UploadInfo, error) {
+			return rejectUpload(ctx, db, id)
+		})
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(u)
+	}
+}
+
+func rejectUpload(ctx context.Context, db *sql.DB, id int64) (UploadInfo, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return UploadInfo{}, dbError("db begin failed", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	u, err := getUploadInfo(ctx, tx, id, true)
+	if err != nil {
+		return u, err
+	}
+	if u.Status != uploadPending {
+		return u, codedError(CodeConflict, "upload is "+u.Status+", not pending")
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE uploads SET status = $2 WHERE id = $1`, id, uploadRejected); err != nil {
+		return u, dbError("db update failed", err)
+	}
+	if err := finishReviewTx(ctx, tx, id); err != nil {
+		return u, dbError("db update failed", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return u, dbError("db commit failed", err)
+	}
+	now := time.Now().UTC()
+	u.Status, u.ReviewedAt = uploadRejected, &now
+	return u, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ------------------------- read-only mode -------------------------
+
+// readOnlyMode — глобальный запрет изменений данных (переключение на реплику, заморозка
+// отчётности в конце квартала). Чтение продолжает работать. Включается переменной READ_ONLY
+// при запуске или админским эндпоинтом на лету; переключение действует на этот экземпляр.
+type readOnlyMode struct {
+	mu    sync.RWMutex
+	state ReadOnlyState
+}
+
+// ReadOnlyState — тело GET/PUT /api/v0/admin/read-only.
+type ReadOnlyState struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"` // попадает в текст ошибки для клиентов
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+func newReadOnlyMode() *readOnlyMode {
+	m := &readOnlyMode{}
+	if envBool("READ_ONLY", false) {
+		m.set(ReadOnlyState{Enabled: true, Reason: env("READ_ONLY_REASON", "")})
+	}
+	return m
+}
+
+func (m *readOnlyMode) get() ReadOnlyState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+func (m *readOnlyMode) set(s ReadOnlyState) ReadOnlyState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !s.Enabled:
+		s = ReadOnlyState{}
+	case m.state.Enabled:
+		s.Since = m.state.Since // смена причины не сбрасывает время включения
+	default:
+		now := time.Now().UTC()
+		s.Since = &now
+	}
+	if s.Enabled != m.state.Enabled {
+		log.Printf("read-only mode: enabled=%t reason=%q", s.Enabled, s.Reason)
+	}
+	m.state = s
+	return s
+}
+
+// reject отвечает 503, если включён режим только для чтения; true — запрос уже обработан.
+func (m *readOnlyMode) reject(w http.ResponseWriter) bool {
+	s := m.get()
+	if !s.Enabled {
+		return false
+	}
+	msg := "service is in read-only mode, changes are temporarily disabled"
+	if s.Reason != "" {
+		msg += ": " + s.Reason
+	}
+	writeError(w, CodeReadOnly, msg)
+	return true
+}
+
+// guard закрывает изменяющий эндпоинт на время режима только для чтения.
+func (m *readOnlyMode) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.reject(w) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ------------------------- handlers -------------------------
+
+func handleReadOnlyGet(m *readOnlyMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(m.get())
+	}
+}
+
+// handleReadOnlySet включает или выключает режим: {"enabled": true, "reason": "quarter close"}.
+func handleReadOnlySet(m *readOnlyMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReadOnlyState
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, CodeInvalidJSON, "invalid json")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(m.set(ReadOnlyState{Enabled: req.Enabled, Reason: req.Reason}))
+	}
+}
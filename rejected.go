@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- rejected rows -------------------------
+
+// rejectWriter сохраняет отклонённые строки загрузки в rejected_rows, чтобы их можно было
+// скачать как rejected.csv, исправить и загрузить заново. Дубли строк БД не сохраняются:
+// исправлять в них нечего. Строки копятся пачками по INGEST_BATCH_SIZE, как и вставка.
+type rejectWriter struct {
+	uploadID  int64
+	batchSize int
+	limit     int // REJECTED_ROWS_LIMIT; дальше строки только считаются
+	stored    int
+	truncated bool
+
+	lines   []int
+	records [][]byte // строка файла в CSV, байты как пришли: в них бывают NUL и невалидный UTF-8
+	reasons []string
+
+	// Сводка по причине и колонке — по всем отклонённым строкам, без лимита.
+	schema  InputSchema
+	summary map[rejectKey]*RejectGroup
+
+	buf bytes.Buffer
+	cw  *csv.Writer
+}
+
+func newRejectWriter(uploadID int64, schema InputSchema) *rejectWriter {
+	rw := &rejectWriter{
+		uploadID:  uploadID,
+		batchSize: ingestBatchSize(),
+		limit:     int(min(max(envInt64("REJECTED_ROWS_LIMIT", 100_000), 0), 10_000_000)),
+		schema:    schema,
+		summary:   map[rejectKey]*RejectGroup{},
+	}
+	rw.cw = csv.NewWriter(&rw.buf)
+	return rw
+}
+
+func (rw *rejectWriter) add(ctx context.Context, tx *sql.Tx, line int, rec []string, reason string) error {
+	rw.count(line, rec, reason)
+	if rw.stored+len(rw.lines) >= rw.limit {
+		rw.truncated = rw.limit > 0
+		return nil
+	}
+	rw.buf.Reset()
+	if err := rw.cw.Write(rec); err != nil {
+		return err
+	}
+	rw.cw.Flush()
+	rw.lines = append(rw.lines, line)
+	rw.records = append(rw.records, bytes.Clone(bytes.TrimSuffix(rw.buf.Bytes(), []byte("\n"))))
+	rw.reasons = append(rw.reasons, reason)
+	if len(rw.lines) == rw.batchSize {
+		return rw.flush(ctx, tx)
+	}
+	return nil
+}
+
+func (rw *rejectWriter) flush(ctx context.Context, tx *sql.Tx) error {
+	if len(rw.lines) == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO rejected_rows (upload_id, line, record, reason)
+		SELECT $1, * FROM unnest($2::int[], $3::bytea[], $4::text[]);
+	`, rw.uploadID, pq.Array(rw.lines), pq.Array(rw.records), pq.Array(rw.reasons))
+	if err != nil {
+		return dbError("db insert failed", err)
+	}
+	rw.stored += len(rw.lines)
+	rw.lines, rw.records, rw.reasons = rw.lines[:0], rw.records[:0], rw.reasons[:0]
+	return nil
+}
+
+// rejectedURL — где скачать отклонённые строки загрузки; пусто, если их нет.
+func (rw *rejectWriter) rejectedURL() string {
+	if rw.stored == 0 {
+		return ""
+	}
+	return rejectedURL(rw.uploadID)
+}
+
+func rejectedURL(uploadID int64) string {
+	return fmt.Sprintf("/api/v0/imports/%d/rejected", uploadID)
+}
+
+// handleRejectedRows отдаёт rejected.csv загрузки: строки как в исходном файле плюс колонка reason.
+// Заголовок — колонки схемы загрузки. Если строк было больше REJECTED_ROWS_LIMIT,
+// сохранены первые, а в ответе — X-Rejected-Truncated: true.
+func handleRejectedRows(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := uploadIDParam(w, r)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+
+		var (
+			version, owner string
+			truncated      bool
+		)
+		err := db.QueryRowContext(ctx, `SELECT schema_version, rejected_truncated, api_key FROM uploads WHERE id = $1`, id).Scan(&version, &truncated, &owner)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && !uploadVisible(r, owner) {
+			writeError(w, CodeNotFound, "upload not found")
+			return
+		}
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		columns := []string{"id", "name", "category", "price", "create_date"}
+		if s, ok := findInputSchema(version); ok {
+			columns = s.Columns
+		}
+
+		rows, err := db.QueryContext(ctx, `SELECT record, reason FROM rejected_rows WHERE upload_id = $1 ORDER BY line`, id)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		defer rows.Close()
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="rejected-%d.csv"`, id))
+		if truncated {
+			w.Header().Set("X-Rejected-Truncated", "true")
+		}
+		cw := csv.NewWriter(w)
+		_ = cw.Write(slices.Concat(columns, []string{"reason"}))
+		cw.Flush()
+		// Строка уже в CSV: дописываем к ней reason, не разбирая заново. Причины — имена
+		// без запятых и кавычек, экранировать их не нужно.
+		for rows.Next() {
+			var (
+				record []byte
+				reason string
+			)
+			if err := rows.Scan(&record, &reason); err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "%s,%s\n", record, reason); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ------------------------- reject summary -------------------------
+
+// rejectSampleLines — сколько номеров строк показывать в сводке для примера.
+const rejectSampleLines = 5
+
+type rejectKey struct{ reason, column string }
+
+// RejectGroup — отклонённые строки загрузки с одной причиной в одной колонке.
+type RejectGroup struct {
+	Reason      string `json:"reason"`
+	Column      string `json:"column,omitempty"`       // колонка схемы; нет — причина во всей строке
+	ColumnIndex int    `json:"column_index,omitempty"` // номер колонки в файле, с 1
+	Rows        int    `json:"rows"`
+	FirstLines  []int  `json:"first_lines,omitempty"` // первые строки с этой причиной
+	Message     string `json:"message"`               // например "312 rows had unparseable dates in column 5 (create_date)"
+}
+
+// RejectColumn — сколько строк отклонено из-за значения колонки, по всем причинам.
+type RejectColumn struct {
+	Column      string `json:"column"`
+	ColumnIndex int    `json:"column_index"`
+	Rows        int    `json:"rows"`
+}
+
+// UploadSummary — тело GET /api/v0/uploads/{id}/summary.
+type UploadSummary struct {
+	UploadID      int64          `json:"upload_id"`
+	TotalCount    int            `json:"total_count"`
+	TotalItems    int            `json:"total_items"`
+	RejectedCount int            `json:"rejected_count"`
+	Reasons       []RejectGroup  `json:"reasons"`   // по убыванию rows
+	ByReason      map[string]int `json:"by_reason"` // rows по причине
+	ByColumn      []RejectColumn `json:"by_column"` // по убыванию rows
+	RejectedURL   string         `json:"rejected_url,omitempty"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+}
+
+// reasonColumns — колонка, значение которой нарушает правило. empty_field и control_chars
+// относятся к той колонке, где пусто или нашлись управляющие символы (см. rejectColumn).
+var reasonColumns = map[string]string{
+	"invalid_date":          "create_date",
+	"date_before_from":      "create_date",
+	"date_after_to":         "create_date",
+	"invalid_price":         "price",
+	"price_below_min":       "price",
+	"price_above_max":       "price",
+	"name_too_long":         "name",
+	"category_too_long":     "category",
+	"category_not_allowed":  "category",
+	"category_out_of_scope": "category",
+	"invalid_currency":      "currency",
+	"invalid_quantity":      "quantity",
+	"invalid_unit":          "unit",
+	"invalid_unit_size":     "unit_size",
+}
+
+// reasonMessages — причина отказа словами, для message сводки.
+var reasonMessages = map[string]string{
+	"column_count":          "had the wrong number of columns",
+	"empty_field":           "had an empty required field",
+	"control_chars":         "had control characters or invalid UTF-8",
+	"invalid_date":          "had unparseable dates",
+	"date_before_from":      "had dates before VALID_DATE_FROM",
+	"date_after_to":         "had dates after VALID_DATE_TO",
+	"invalid_price":         "had unparseable prices",
+	"price_below_min":       "had prices below VALID_PRICE_MIN",
+	"price_above_max":       "had prices above VALID_PRICE_MAX",
+	"name_too_long":         "had names longer than VALID_NAME_MAX_LEN",
+	"category_too_long":     "had categories longer than VALID_CATEGORY_MAX_LEN",
+	"category_not_allowed":  "had categories not in VALID_CATEGORIES",
+	"category_out_of_scope": "had categories outside the API key scope",
+	"invalid_currency":      "had invalid currency codes",
+	"invalid_quantity":      "had invalid quantities",
+	"invalid_unit":          "had unknown units or a unit_size without a unit",
+	"invalid_unit_size":     "had invalid unit sizes",
+	"duplicate_in_file":     "repeated an earlier row of the file",
+	"duplicate_in_db":       "duplicated rows already in the database",
+}
+
+// rejectColumn находит колонку, из-за которой строка rec отклонена с причиной reason.
+// Пусто — причина во всей строке (column_count, duplicate_in_file).
+func (rw *rejectWriter) rejectColumn(reason string, rec []string) (string, int) {
+	col := reasonColumns[reason]
+	switch reason {
+	case "empty_field":
+		for i, c := range rw.schema.Columns[:min(5, len(rw.schema.Columns), len(rec))] {
+			if strings.TrimSpace(rec[i]) == "" {
+				col = c
+				break
+			}
+		}
+	case "control_chars":
+		for i, c := range rw.schema.Columns[:min(3, len(rec))] {
+			if !utf8.ValidString(rec[i]) || strings.IndexFunc(rec[i], unicode.IsControl) >= 0 {
+				col = c
+				break
+			}
+		}
+	}
+	if i := slices.Index(rw.schema.Columns, col); i >= 0 {
+		return col, i + 1
+	}
+	return "", 0
+}
+
+func (rw *rejectWriter) count(line int, rec []string, reason string) {
+	col, idx := rw.rejectColumn(reason, rec)
+	g := rw.summary[rejectKey{reason, col}]
+	if g == nil {
+		g = &RejectGroup{Reason: reason, Column: col, ColumnIndex: idx}
+		rw.summary[rejectKey{reason, col}] = g
+	}
+	g.Rows++
+	if len(g.FirstLines) < rejectSampleLines {
+		g.FirstLines = append(g.FirstLines, line)
+	}
+}
+
+// saveSummary записывает сводку в upload_reject_summary, в транзакции загрузки.
+func (rw *rejectWriter) saveSummary(ctx context.Context, tx *sql.Tx) error {
+	for _, g := range rw.summary {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO upload_reject_summary (upload_id, reason, column_name, column_index, rows, first_lines)
+			VALUES ($1, $2, $3, $4, $5, $6);
+		`, rw.uploadID, g.Reason, g.Column, g.ColumnIndex, g.Rows, pq.Array(g.FirstLines))
+		if err != nil {
+			return dbError("db insert failed", err)
+		}
+	}
+	return nil
+}
+
+// message — строка сводки: "312 rows had unparseable dates in column 5 (create_date)".
+func (g RejectGroup) message() string {
+	text, ok := reasonMessages[g.Reason]
+	if !ok {
+		text = "were rejected: " + g.Reason
+	}
+	rows := "rows"
+	if g.Rows == 1 {
+		rows = "row"
+	}
+	s := fmt.Sprintf("%d %s %s", g.Rows, rows, text)
+	if g.Column != "" {
+		s += fmt.Sprintf(" in column %d (%s)", g.ColumnIndex, g.Column)
+	}
+	return s
+}
+
+// handleUploadSummary отдаёт отчёт о качестве файла загрузки: сколько строк отклонено
+// по каждой причине и в какой колонке, с номерами первых таких строк. В отличие от
+// rejected.csv, считает все строки, а не первые REJECTED_ROWS_LIMIT, и дубли строк БД.
+func handleUploadSummary(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := uploadIDParam(w, r)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+		u, err := getUploadInfo(ctx, db, id, false)
+		if err == nil && !uploadVisible(r, u.apiKey) {
+			err = errUploadNotFound
+		}
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		rows, err := db.QueryContext(ctx, `
+			SELECT reason, column_name, column_index, rows, first_lines
+			FROM upload_reject_summary WHERE upload_id = $1`, id)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		defer rows.Close()
+		var groups []RejectGroup
+		for rows.Next() {
+			var (
+				g     RejectGroup
+				lines pq.Int64Array
+			)
+			if err := rows.Scan(&g.Reason, &g.Column, &g.ColumnIndex, &g.Rows, &lines); err != nil {
+				writeErrorFrom(w, dbError("db query failed", err))
+				return
+			}
+			for _, l := range lines {
+				g.FirstLines = append(g.FirstLines, int(l))
+			}
+			groups = append(groups, g)
+		}
+		if err := rows.Err(); err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		if n := u.counts.DBDuplicates; n > 0 {
+			groups = append(groups, RejectGroup{Reason: "duplicate_in_db", Rows: n})
+		}
+
+		var hasRejected bool
+		_ = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM rejected_rows WHERE upload_id = $1)`, id).Scan(&hasRejected)
+
+		s := UploadSummary{
+			UploadID:    id,
+			TotalCount:  u.TotalCount,
+			TotalItems:  u.TotalItems,
+			Reasons:     []RejectGroup{},
+			ByReason:    map[string]int{},
+			ByColumn:    []RejectColumn{},
+			GeneratedAt: time.Now().UTC(),
+		}
+		if hasRejected {
+			s.RejectedURL = rejectedURL(id)
+		}
+		byColumn := map[string]*RejectColumn{}
+		for _, g := range groups {
+			g.Message = g.message()
+			s.Reasons = append(s.Reasons, g)
+			s.ByReason[g.Reason] += g.Rows
+			s.RejectedCount += g.Rows
+			if g.Column == "" {
+				continue
+			}
+			c := byColumn[g.Column]
+			if c == nil {
+				c = &RejectColumn{Column: g.Column, ColumnIndex: g.ColumnIndex}
+				byColumn[g.Column] = c
+			}
+			c.Rows += g.Rows
+		}
+		for _, c := range byColumn {
+			s.ByColumn = append(s.ByColumn, *c)
+		}
+		slices.SortFunc(s.Reasons, func(a, b RejectGroup) int {
+			return cmp.Or(cmp.Compare(b.Rows, a.Rows), cmp.Compare(a.Reason, b.Reason), cmp.Compare(a.ColumnIndex, b.ColumnIndex))
+		})
+		slices.SortFunc(s.ByColumn, func(a, b RejectColumn) int {
+			return cmp.Or(cmp.Compare(b.Rows, a.Rows), cmp.Compare(a.ColumnIndex, b.ColumnIndex))
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s)
+	}
+}
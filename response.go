@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------- list responses -------------------------
+
+// ListEnvelope — обёртка JSON-списков: клиент видит, как сервер понял его запрос.
+type ListEnvelope struct {
+	Data        any            `json:"data"`
+	Filters     map[string]any `json:"filters"` // применённые параметры в нормализованном виде
+	Total       int            `json:"total"`   // всего подходящих элементов без учёта limit/offset
+	Page        PageInfo       `json:"page"`
+	GeneratedAt time.Time      `json:"generated_at"`
+}
+
+type PageInfo struct {
+	Limit    int  `json:"limit"`
+	Offset   int  `json:"offset"`
+	Returned int  `json:"returned"`
+	HasMore  bool `json:"has_more"`
+}
+
+// parsePage читает limit/offset; def — limit по умолчанию, max — верхняя граница.
+func parsePage(q url.Values, def, max int) (PageInfo, error) {
+	var errs ValidationErrors
+	p := PageInfo{Limit: def}
+	if s := strings.TrimSpace(q.Get("limit")); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 || i > max {
+			errs.add("limit", s, "expected integer 1.."+strconv.Itoa(max))
+		} else {
+			p.Limit = i
+		}
+	}
+	if s := strings.TrimSpace(q.Get("offset")); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			errs.add("offset", s, "expected non-negative integer")
+		} else {
+			p.Offset = i
+		}
+	}
+	return p, errs.err()
+}
+
+func writeList(w http.ResponseWriter, r *http.Request, data any, returned, total int, page PageInfo, filters map[string]any) {
+	page.Returned = returned
+	page.HasMore = page.Offset+returned < total
+	if filters == nil {
+		filters = map[string]any{}
+	}
+
+	setLinkHeader(w, r, page, total)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ListEnvelope{
+		Data:        data,
+		Filters:     filters,
+		Total:       total,
+		Page:        page,
+		GeneratedAt: time.Now().UTC(),
+	})
+}
+
+// pageTotal — total для writeList. COUNT(*) OVER () приходит только вместе со строками:
+// у страницы за последней строкой его нет, и total вышел бы 0 — тогда строки запроса base
+// (тот же запрос без LIMIT/OFFSET) считаются отдельно.
+func pageTotal(ctx context.Context, q rowQuerier, returned, total int, page PageInfo, base string, args ...any) (int, error) {
+	if returned > 0 || page.Offset == 0 {
+		return total, nil
+	}
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+base+") t", args...).Scan(&total)
+	return total, err
+}
+
+// setLinkHeader выставляет Link (RFC 8288) с rel="first"/"prev"/"next"/"last",
+// чтобы клиенты могли листать страницы, не собирая URL сами.
+func setLinkHeader(w http.ResponseWriter, r *http.Request, page PageInfo, total int) {
+	link := func(offset int, rel string) string {
+		u := *r.URL
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(page.Limit))
+		q.Set("offset", strconv.Itoa(offset))
+		u.RawQuery = q.Encode()
+		return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+	}
+
+	last := 0
+	if total > 0 {
+		last = (total - 1) / page.Limit * page.Limit
+	}
+
+	links := []string{link(0, "first")}
+	if page.Offset > 0 {
+		links = append(links, link(max(page.Offset-page.Limit, 0), "prev"))
+	}
+	if page.Offset+page.Limit < total {
+		links = append(links, link(page.Offset+page.Limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
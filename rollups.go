@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// ------------------------- rollups -------------------------
+
+// rollupViews обновляются после каждой загрузки/изменения данных и, при ROLLUP_REFRESH_INTERVAL, по расписанию.
+var rollupViews = []string{"prices_daily_rollup", "prices_monthly_rollup"}
+
+// rollupRefresher схлопывает запросы на обновление: пока идёт REFRESH, все новые запросы
+// превращаются в один следующий прогон.
+type rollupRefresher struct {
+	db   *sql.DB
+	kick chan struct{}
+}
+
+func startRollupRefresher(db *sql.DB) *rollupRefresher {
+	rr := &rollupRefresher{db: db, kick: make(chan struct{}, 1)}
+	go rr.loop(envDuration("ROLLUP_REFRESH_INTERVAL", 0))
+	return rr
+}
+
+// request помечает предагрегаты устаревшими; не блокируется.
+func (rr *rollupRefresher) request() {
+	select {
+	case rr.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (rr *rollupRefresher) loop(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-rr.kick:
+		case <-tick:
+		}
+		rr.refresh(context.Background())
+	}
+}
+
+func (rr *rollupRefresher) refresh(ctx context.Context) {
+	for _, v := range rollupViews {
+		// CONCURRENTLY не блокирует чтение; v — из фиксированного списка выше.
+		if _, err := rr.db.ExecContext(ctx, `REFRESH MATERIALIZED VIEW CONCURRENTLY `+v); err != nil {
+			log.Printf("rollup refresh %s: %v", v, err)
+		}
+	}
+}
+
+// rollupCompatible — фильтр использует только дату и категорию, которые есть в предагрегатах.
+// Новые поля PriceFilter, не относящиеся к дате/категории, должны делать его несовместимым.
+func (f PriceFilter) rollupCompatible() bool {
+	// filter= может ссылаться на id, name и price, которых в предагрегатах нет.
+	return !f.HasMin && !f.HasMax && f.NamePrefix == "" && f.NameExact == "" && len(f.Exprs) == 0
+}
+
+// monthAligned — start/end (если заданы) совпадают с границами месяцев, и месячного предагрегата хватает.
+func (f PriceFilter) monthAligned() bool {
+	if f.HasStart && f.StartDate.Day() != 1 {
+		return false
+	}
+	if f.HasEnd && f.EndDate.AddDate(0, 0, 1).Day() != 1 {
+		return false
+	}
+	return len(f.Dates) == 0
+}
+
+// rollupMetrics — метрики aggregate в терминах колонок предагрегата.
+var rollupMetrics = map[string]string{
+	"count": "SUM(rows)",
+	"sum":   "ROUND(SUM(total_price), 2)",
+	"avg":   "ROUND(SUM(total_price) / NULLIF(SUM(rows), 0), 2)",
+	"min":   "MIN(min_price)",
+	"max":   "MAX(max_price)",
+}
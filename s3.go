@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ------------------------- s3 import -------------------------
+
+// Импорт из объектного хранилища S3 или совместимого (MinIO, Ceph, Yandex Object Storage):
+// {"bucket": "...", "key": "..."} вместо url. Ночные выгрузки поставщиков падают в бакет,
+// и загрузить их можно одним вызовом API, не скачивая к себе. Адрес и ключи доступа — из
+// окружения, в запросе их нет. Запрос подписывается AWS Signature V4 — SDK ради одного GET
+// не нужен.
+
+// s3BucketName — имя бакета по правилам S3: 3–63 символа, строчные буквы, цифры, точки и дефисы.
+var s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// s3Config — настройки хранилища из окружения.
+type s3Config struct {
+	endpoint  *url.URL // S3_ENDPOINT; по умолчанию https://s3.<region>.amazonaws.com
+	region    string   // S3_REGION или AWS_REGION, по умолчанию us-east-1
+	pathStyle bool     // bucket в пути, а не в имени хоста
+	accessKey string
+	secretKey string
+	token     string // временные ключи STS
+}
+
+// s3Env — S3_<name>, а без неё — стандартная AWS_<name>.
+func s3Env(name string) string {
+	if v := env("S3_"+name, ""); v != "" {
+		return v
+	}
+	return env("AWS_"+name, "")
+}
+
+func loadS3Config() (s3Config, error) {
+	c := s3Config{
+		region:    s3Env("REGION"),
+		accessKey: s3Env("ACCESS_KEY_ID"),
+		secretKey: s3Env("SECRET_ACCESS_KEY"),
+		token:     s3Env("SESSION_TOKEN"),
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if (c.accessKey == "") != (c.secretKey == "") {
+		return c, codedError(CodeInternal, "s3 import is misconfigured: set both S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+	}
+	endpoint := env("S3_ENDPOINT", "")
+	if endpoint == "" {
+		// У AWS — виртуальные хосты bucket.s3.<region>.amazonaws.com.
+		endpoint = "https://s3." + c.region + ".amazonaws.com"
+		c.pathStyle = envBool("S3_PATH_STYLE", false)
+	} else {
+		// MinIO и большинство совместимых хранилищ по умолчанию ждут бакет в пути.
+		c.pathStyle = envBool("S3_PATH_STYLE", true)
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c, codedError(CodeInternal, "s3 import is misconfigured: S3_ENDPOINT must be an http or https url")
+	}
+	c.endpoint = u
+	return c, nil
+}
+
+// s3Source — скачивание объекта key из бакета bucket. Бакет — из S3_ALLOWED_BUCKETS
+// (через запятую), если список задан. Адрес хранилища задаёт администратор, поэтому
+// внутренние адреса (MinIO в той же сети) здесь разрешены, в отличие от url.
+func s3Source(bucket, key string) (importSource, error) {
+	bucket, key = strings.TrimSpace(bucket), strings.TrimLeft(key, "/")
+	switch {
+	case !s3BucketName.MatchString(bucket):
+		return importSource{}, codedError(CodeInvalidRequest, "bucket must be a valid s3 bucket name")
+	case key == "":
+		return importSource{}, codedError(CodeInvalidRequest, "key required")
+	}
+	if allowed := nonEmptyValues(strings.Split(env("S3_ALLOWED_BUCKETS", ""), ",")); len(allowed) > 0 &&
+		!slices.Contains(allowed, bucket) {
+		return importSource{}, codedError(CodeInvalidRequest, "bucket "+bucket+" is not in S3_ALLOWED_BUCKETS")
+	}
+	c, err := loadS3Config()
+	if err != nil {
+		return importSource{}, err
+	}
+
+	req, err := c.getObject(bucket, key, time.Now().UTC())
+	if err != nil {
+		return importSource{}, err
+	}
+	return importSource{
+		req: req,
+		client: &http.Client{
+			// Подписанный запрос на другой адрес не переносится: 301 от S3 (чужой регион) — ошибка.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		name: "s3://" + bucket + "/" + key,
+	}, nil
+}
+
+// getObject — запрос GET объекта key, подписанный на момент now, если заданы ключи.
+func (c s3Config) getObject(bucket, key string, now time.Time) (*http.Request, error) {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path += "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, codedError(CodeInvalidRequest, "invalid s3 object key")
+	}
+	if c.accessKey != "" {
+		c.sign(req, now)
+	}
+	return req, nil
+}
+
+// emptySHA256 — SHA-256 пустого тела GET.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign подписывает GET без тела по AWS Signature V4 (заголовок Authorization).
+func (c s3Config) sign(req *http.Request, now time.Time) {
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{"host": req.URL.Host, "x-amz-content-sha256": emptySHA256, "x-amz-date": amzDate}
+	// Range подписывается, если задан: заголовки в подписи — по алфавиту.
+	if r := req.Header.Get("Range"); r != "" {
+		headers = slices.Insert(headers, 1, "range")
+		values["range"] = r
+	}
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+		headers = append(headers, "x-amz-security-token")
+		values["x-amz-security-token"] = c.token
+	}
+
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n")
+	for _, h := range headers {
+		canonical.WriteString(h + ":" + values[h] + "\n")
+	}
+	signed := strings.Join(headers, ";")
+	canonical.WriteString("\n" + signed + "\n" + emptySHA256)
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// s3EscapePath кодирует путь так, как его кодирует подпись S3: всё, кроме A-Z a-z 0-9 - . _ ~ и /.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return b.String()
+}
+
+// s3ErrorCode — код ошибки S3 из тела ответа (": NoSuchKey", ": AccessDenied"), если он есть.
+// Подходит и для подписанных ссылок S3 в url.
+func s3ErrorCode(resp *http.Response) string {
+	var body struct {
+		Code string `xml:"Code"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if xml.Unmarshal(b, &body) != nil || body.Code == "" {
+		return ""
+	}
+	return ": " + body.Code
+}
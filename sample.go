@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------- random sample -------------------------
+
+// SampleRow — строка случайной выборки.
+type SampleRow struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Category  string  `json:"category"`
+	Price     float64 `json:"price"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// sampleOversample — во сколько раз больше строк, чем нужно, отбирает TABLESAMPLE,
+// чтобы случайный недобор почти никогда не требовал повторного запроса.
+const sampleOversample = 3
+
+// handlePricesSample отдаёт n случайных строк из подходящих под обычные фильтры выгрузки —
+// для выборочной проверки качества данных без многогигабайтной выгрузки.
+func handlePricesSample(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var errs ValidationErrors
+		n := intParam(q, "n", "SAMPLE_DEFAULT_SIZE", 100, 1, int(envInt64("SAMPLE_MAX_SIZE", 10000)), &errs)
+		f, err := parseRequestFilter(r)
+		if err := mergeErrors(errs.err(), err); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		rows, total, method, err := samplePrices(r.Context(), db, f, n)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		filters := f.echo()
+		filters["n"] = n
+		filters["method"] = method
+		// Страниц у выборки нет, поэтому без writeList и Link.
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ListEnvelope{
+			Data:        rows,
+			Filters:     filters,
+			Total:       total,
+			Page:        PageInfo{Limit: n, Returned: len(rows)},
+			GeneratedAt: time.Now().UTC(),
+		})
+	}
+}
+
+// samplePrices выбирает равномерную случайную выборку. Если подходящих строк не больше
+// SAMPLE_EXACT_MAX_ROWS, их сортируют по random() целиком (method=random). Иначе
+// TABLESAMPLE BERNOULLI отбирает каждую строку с одинаковой вероятностью с запасом
+// sampleOversample, и сортируется уже только отобранное (method=bernoulli).
+// SYSTEM не используется: он берёт страницы целиком, и строки одной загрузки идут кучно.
+func samplePrices(ctx context.Context, db *sql.DB, f PriceFilter, n int) ([]SampleRow, int, string, error) {
+	cond, args := f.where(1)
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM prices WHERE 1=1`+cond, args...).Scan(&total); err != nil {
+		return nil, 0, "", err
+	}
+	if total == 0 {
+		return []SampleRow{}, 0, "random", nil
+	}
+
+	if total > int(envInt64("SAMPLE_EXACT_MAX_ROWS", 100000)) {
+		// Каждая строка проходит отбор с вероятностью pct/100, фильтр применяется после,
+		// так что из total подходящих в среднем останется n*sampleOversample.
+		pct := min(100, 100*float64(n*sampleOversample)/float64(total))
+		cond, args := f.where(2)
+		query := fmt.Sprintf(`
+			SELECT id, name, category, price, created_at
+			FROM prices TABLESAMPLE BERNOULLI ($1::float4)
+			WHERE 1=1%s
+			ORDER BY random()
+			LIMIT %d`, cond, n)
+		rows, err := querySample(ctx, db, query, append([]any{pct}, args...)...)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if len(rows) == n || pct == 100 {
+			return rows, total, "bernoulli", nil
+		}
+		// Недобор — редкий случай, добираем точным способом.
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, name, category, price, created_at
+		FROM prices
+		WHERE 1=1%s
+		ORDER BY random()
+		LIMIT %d`, cond, n)
+	rows, err := querySample(ctx, db, query, args...)
+	return rows, total, "random", err
+}
+
+func querySample(ctx context.Context, db *sql.DB, query string, args ...any) ([]SampleRow, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []SampleRow{}
+	for rows.Next() {
+		var (
+			s         SampleRow
+			createdAt time.Time
+		)
+		if err := rows.Scan(&s.ID, &s.Name, &s.Category, &s.Price, &createdAt); err != nil {
+			return nil, err
+		}
+		s.CreatedAt = createdAt.Format("2006-01-02")
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// ------------------------- sampled export -------------------------
+
+// parseSample читает sample (доля строк, 0 < sample <= 1) и sample_seed выгрузки.
+func (f *PriceFilter) parseSample(q url.Values) error {
+	var errs ValidationErrors
+	if s := strings.TrimSpace(q.Get("sample")); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || !(v > 0 && v <= 1) {
+			errs.add("sample", s, "expected fraction in (0, 1]")
+		} else {
+			f.Sample = v
+		}
+	}
+	if s := strings.TrimSpace(q.Get("sample_seed")); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			errs.add("sample_seed", s, "expected integer")
+		} else if f.Sample == 0 {
+			errs.add("sample_seed", s, "requires sample")
+		} else {
+			f.SampleSeed = v
+		}
+	}
+	return errs.err()
+}
+
+// sampleCond отбирает строку, если хеш её id с seed попал в первую долю Sample диапазона.
+// В отличие от TABLESAMPLE ... REPEATABLE, выбор строки не зависит от расположения
+// страниц и остальных строк: с тем же seed повторная выгрузка вернёт те же строки,
+// а новые загрузки только добавят к ним свою долю.
+func (f PriceFilter) sampleCond(argN int) (string, []any) {
+	threshold := int64(math.Ldexp(f.Sample, 63))
+	return fmt.Sprintf(" AND (hashint8extended(id, $%d) & 9223372036854775807) < $%d", argN, argN+1),
+		[]any{f.SampleSeed, threshold}
+}
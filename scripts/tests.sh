@@ -38,5 +38,6 @@ curl -fsS -o "${OUT_ZIP}" "${BASE_URL}/api/v0/prices?start=2024-01-01&end=2024-1
 # проверяем что zip корректный и содержит data.csv
 unzip -l "${OUT_ZIP}" | grep -q "data.csv"
 unzip -p "${OUT_ZIP}" data.csv | head -n 1 | grep -q "^id,name,category,price,create_date"
+unzip -p "${OUT_ZIP}" manifest.json | grep -q '"sha256"'
 
 echo "==> All tests passed"
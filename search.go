@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------- search -------------------------
+
+type SearchHit struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Category  string  `json:"category"`
+	Price     float64 `json:"price"`
+	CreatedAt string  `json:"created_at"`
+	Rank      float64 `json:"rank"`
+	Highlight struct {
+		Name     string `json:"name"`
+		Category string `json:"category"`
+	} `json:"highlight"` // HTML: текст экранирован, совпадения обёрнуты в <b>…</b>
+}
+
+func handleSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var qErr error
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			qErr = fieldError("q", q, "required")
+		}
+
+		page, err := parsePage(r.URL.Query(), 20, 100)
+		if err := mergeErrors(qErr, err); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		hits, total, err := searchPrices(r.Context(), db, q, page, categoryScope(r))
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		writeList(w, r, hits, len(hits), total, page, map[string]any{"q": q})
+	}
+}
+
+func searchPrices(ctx context.Context, db *sql.DB, q string, page PageInfo, scope []string) ([]SearchHit, int, error) {
+	// ts_headline не экранирует текст: имя с <script> попало бы в HTML как есть. Совпадения
+	// помечаются случайными метками из букв и цифр, текст экранируется, и только потом метки
+	// становятся <b>…</b>.
+	start, stop := "hls"+newID(), "hle"+newID()
+	opts := "StartSel=" + start + ", StopSel=" + stop + ", HighlightAll=true"
+	cond, scopeArgs := scopeCond("p.category", scope, 3)
+	// websearch_to_tsquery понимает "кавычки", OR и -исключения и не падает на произвольном вводе.
+	query := `
+		WITH q AS (
+			SELECT websearch_to_tsquery('russian', $1) || websearch_to_tsquery('english', $1) AS tsq
+		)
+		SELECT
+			p.id, p.name, p.category, p.price, p.created_at,
+			ts_rank(p.search_tsv, q.tsq) AS rank,
+			ts_headline('russian', p.name, q.tsq, $2),
+			ts_headline('russian', p.category, q.tsq, $2),
+			COUNT(*) OVER ()
+		FROM prices p, q
+		WHERE p.search_tsv @@ q.tsq` + cond + `
+		ORDER BY rank DESC, p.id`
+	args := append([]any{q, opts}, scopeArgs...)
+	rows, err := db.QueryContext(ctx, query+fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		hits  = []SearchHit{}
+		total int
+	)
+	for rows.Next() {
+		var (
+			h         SearchHit
+			createdAt time.Time
+		)
+		if err := rows.Scan(&h.ID, &h.Name, &h.Category, &h.Price, &createdAt, &h.Rank,
+			&h.Highlight.Name, &h.Highlight.Category, &total); err != nil {
+			return nil, 0, err
+		}
+		h.CreatedAt = createdAt.Format("2006-01-02")
+		h.Highlight.Name = highlightHTML(h.Highlight.Name, start, stop)
+		h.Highlight.Category = highlightHTML(h.Highlight.Category, start, stop)
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	total, err = pageTotal(ctx, db, len(hits), total, page, query, args...)
+	return hits, total, err
+}
+
+// highlightHTML экранирует текст ts_headline и заменяет метки совпадений на <b>…</b>.
+func highlightHTML(s, start, stop string) string {
+	return strings.NewReplacer(start, "<b>", stop, "</b>").Replace(html.EscapeString(s))
+}
+
+// ------------------------- similar names -------------------------
+
+type SimilarName struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"` // similarity() из pg_trgm, 0..1
+	Rows  int     `json:"rows"`  // сколько строк с таким именем
+}
+
+func handleSimilarNames(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs ValidationErrors
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		if name == "" {
+			errs.add("name", name, "required")
+		}
+
+		threshold := 0.3 // значение pg_trgm по умолчанию
+		if s := strings.TrimSpace(r.URL.Query().Get("threshold")); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil || f <= 0 || f > 1 {
+				errs.add("threshold", s, "expected number in (0, 1]")
+			} else {
+				threshold = f
+			}
+		}
+
+		page, err := parsePage(r.URL.Query(), 10, 100)
+		if err := mergeErrors(errs.err(), err); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		names, total, err := similarNames(r.Context(), db, name, threshold, page, categoryScope(r))
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+
+		writeList(w, r, names, len(names), total, page, map[string]any{"name": name, "threshold": threshold})
+	}
+}
+
+func similarNames(ctx context.Context, db *sql.DB, name string, threshold float64, page PageInfo, scope []string) ([]SimilarName, int, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Оператор % использует GIN-индекс, но порог берёт из настройки — выставляем её на транзакцию.
+	if _, err := tx.ExecContext(ctx, `SELECT set_config('pg_trgm.similarity_threshold', $1, true)`,
+		strconv.FormatFloat(threshold, 'f', -1, 64)); err != nil {
+		return nil, 0, err
+	}
+
+	cond, scopeArgs := scopeCond("category", scope, 2)
+	q := `
+		SELECT name, similarity(name, $1) AS score, COUNT(*), COUNT(*) OVER ()
+		FROM prices
+		WHERE name % $1` + cond + `
+		GROUP BY name
+		ORDER BY score DESC, name`
+	args := append([]any{name}, scopeArgs...)
+	rows, err := tx.QueryContext(ctx, q+fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		out   = []SimilarName{}
+		total int
+	)
+	for rows.Next() {
+		var s SimilarName
+		if err := rows.Scan(&s.Name, &s.Score, &s.Rows, &total); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	_ = rows.Close() // до следующего запроса в той же транзакции
+	total, err = pageTotal(ctx, tx, len(out), total, page, q, args...)
+	return out, total, err
+}
+
+// ------------------------- autocomplete -------------------------
+
+type AutocompleteItem struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// autocompleteFields — разрешённые поля; имя колонки в SQL берётся только отсюда.
+var autocompleteFields = map[string]string{
+	"name":     "name",
+	"category": "category",
+}
+
+// ttlCache — маленький кэш в памяти процесса с временем жизни записей.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]ttlEntry[V]
+}
+
+type ttlEntry[V any] struct {
+	val     V
+	expires time.Time
+}
+
+func newTTLCache[V any](ttl time.Duration, max int) *ttlCache[V] {
+	return &ttlCache[V]{ttl: ttl, max: max, entries: make(map[string]ttlEntry[V])}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		var zero V
+		return zero, false
+	}
+	return e.val, true
+}
+
+func (c *ttlCache[V]) set(key string, val V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		// Кэш короткоживущий, поэтому при переполнении просто начинаем заново.
+		c.entries = make(map[string]ttlEntry[V])
+	}
+	c.entries[key] = ttlEntry[V]{val: val, expires: time.Now().Add(c.ttl)}
+}
+
+type autocompletePage struct {
+	items []AutocompleteItem
+	total int
+}
+
+func handleAutocomplete(db *sql.DB) http.HandlerFunc {
+	cache := newTTLCache[autocompletePage](envDuration("AUTOCOMPLETE_TTL", 30*time.Second), 1000)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var fieldErr error
+		field := strings.TrimSpace(r.URL.Query().Get("field"))
+		column, ok := autocompleteFields[field]
+		if !ok {
+			fieldErr = fieldError("field", field, "expected name or category")
+		}
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+		page, err := parsePage(r.URL.Query(), 10, 50)
+		if err := mergeErrors(fieldErr, err); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		// Ключи с разными категориями видят разные подсказки — категории входят в ключ кэша.
+		scope := categoryScope(r)
+		key := field + "|" + strings.ToLower(q) + "|" + strconv.Itoa(page.Limit) + "|" + strconv.Itoa(page.Offset) +
+			"|" + strings.Join(scope, "\x00")
+		res, ok := cache.get(key)
+		if !ok {
+			res.items, res.total, err = autocomplete(r.Context(), db, column, q, page, scope)
+			if err != nil {
+				writeErrorFrom(w, dbError("db query failed", err))
+				return
+			}
+			cache.set(key, res)
+		}
+
+		writeList(w, r, res.items, len(res.items), res.total, page, map[string]any{"field": field, "q": q})
+	}
+}
+
+func autocomplete(ctx context.Context, db *sql.DB, column, prefix string, page PageInfo, scope []string) ([]AutocompleteItem, int, error) {
+	cond, scopeArgs := scopeCond("category", scope, 2)
+	// ILIKE по префиксу для name обслуживается триграммным индексом.
+	q := `
+		SELECT ` + column + `, COUNT(*), COUNT(*) OVER ()
+		FROM prices
+		WHERE ` + column + ` ILIKE $1` + cond + `
+		GROUP BY ` + column + `
+		ORDER BY COUNT(*) DESC, ` + column
+	args := append([]any{escapeLike(prefix) + "%"}, scopeArgs...)
+	rows, err := db.QueryContext(ctx, q+fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		items = []AutocompleteItem{}
+		total int
+	)
+	for rows.Next() {
+		var it AutocompleteItem
+		if err := rows.Scan(&it.Value, &it.Count, &total); err != nil {
+			return nil, 0, err
+		}
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	total, err = pageTotal(ctx, db, len(items), total, page, q, args...)
+	return items, total, err
+}
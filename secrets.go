@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ------------------------- secrets -------------------------
+
+// secretNames — переменные с секретами. Каждую можно передать не только напрямую, но и
+// файлом (POSTGRES_PASSWORD_FILE=/run/secrets/db_password, как у образа postgres) или
+// взять из Vault, чтобы пароль не был виден в `docker inspect` и в окружении контейнера.
+var secretNames = []string{
+	"DATABASE_URL", // с паролем внутри
+	"POSTGRES_USER",
+	"POSTGRES_PASSWORD",
+	"ADMIN_TOKEN",
+	"API_KEYS",
+	"EXPORT_SIGNING_KEY",
+	"EXPORT_PASSWORD_SECRET",
+	"SMTP_USERNAME",
+	"SMTP_PASSWORD",
+	"ALERT_NOTIFIERS", // адреса вебхуков часто содержат токен
+	"S3_ACCESS_KEY_ID",
+	"S3_SECRET_ACCESS_KEY",
+	"S3_SESSION_TOKEN",
+	"KAFKA_PASSWORD",
+}
+
+// loadSecrets при запуске дополняет окружение секретами из файлов *_FILE и из Vault.
+// Порядок: сама переменная, затем её *_FILE, затем Vault. Дальше секреты читаются через
+// env, как обычно; в окружение контейнера они не попадают — только в память процесса.
+func loadSecrets() error {
+	for _, name := range secretNames {
+		file := os.Getenv(name + "_FILE")
+		if file == "" {
+			continue
+		}
+		if os.Getenv(name) != "" {
+			return fmt.Errorf("%s and %s_FILE are both set", name, name)
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		// Файлы секретов обычно заканчиваются переводом строки.
+		if err := os.Setenv(name, strings.TrimRight(string(b), "\r\n")); err != nil {
+			return err
+		}
+	}
+	return loadVaultSecrets()
+}
+
+// loadVaultSecrets читает секрет VAULT_SECRET_PATH из Vault (KV v1 или v2) по адресу
+// VAULT_ADDR с токеном VAULT_TOKEN (или VAULT_TOKEN_FILE) и заполняет ещё не заданные
+// переменные из secretNames одноимёнными ключами секрета. VAULT_ADDR не задан — Vault
+// не используется. Недоступный Vault — ошибка запуска: без пароля к БД сервис всё равно
+// не заработает, а без ADMIN_TOKEN молча выключил бы админку.
+func loadVaultSecrets() error {
+	addr := strings.TrimRight(env("VAULT_ADDR", ""), "/")
+	if addr == "" {
+		return nil
+	}
+	secretPath := strings.Trim(env("VAULT_SECRET_PATH", ""), "/")
+	if secretPath == "" {
+		return fmt.Errorf("VAULT_SECRET_PATH is required with VAULT_ADDR, e.g. secret/data/prices-service")
+	}
+	token := env("VAULT_TOKEN", "")
+	if file := env("VAULT_TOKEN_FILE", ""); token == "" && file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("VAULT_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return fmt.Errorf("VAULT_TOKEN or VAULT_TOKEN_FILE is required with VAULT_ADDR")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("VAULT_TIMEOUT", 10*time.Second))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+secretPath, nil)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := env("VAULT_NAMESPACE", ""); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault: GET %s: %s", secretPath, resp.Status)
+	}
+
+	// KV v2 вкладывает значения в data.data, KV v1 — прямо в data.
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("vault: invalid response: %w", err)
+	}
+	values := body.Data
+	if inner, ok := values["data"]; ok {
+		if err := json.Unmarshal(inner, &values); err != nil {
+			return fmt.Errorf("vault: invalid kv v2 response: %w", err)
+		}
+	}
+
+	var loaded []string
+	for _, name := range secretNames {
+		raw, ok := values[name]
+		if !ok || os.Getenv(name) != "" {
+			continue
+		}
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("vault: %s: expected a string", name)
+		}
+		if err := os.Setenv(name, v); err != nil {
+			return err
+		}
+		loaded = append(loaded, name)
+	}
+	slog.Info("secrets loaded from vault", "path", secretPath, "keys", loaded)
+	return nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- runtime settings -------------------------
+
+// runtimeSettingDefs — переменные окружения, которые можно переопределить на лету через
+// PUT /api/v0/admin/settings, и проверка значения. Все они читаются при каждом запросе
+// (или, как VALID_* и DISABLED_FEATURES, пересчитываются при изменении). Адреса, секреты
+// и размеры пулов читаются один раз при запуске — их меняет только перезапуск.
+var runtimeSettingDefs = map[string]func(string) error{
+	// лимиты
+	"MAX_UPLOAD_SIZE":        positiveSetting,
+	"ARCHIVE_MAX_DEPTH":      intSetting(0, 100),
+	"ARCHIVE_MAX_ENTRIES":    intSetting(1, 1_000_000),
+	"ARCHIVE_MAX_ENTRY_SIZE": positiveSetting,
+	"ARCHIVE_MAX_TOTAL_SIZE": positiveSetting,
+	"ARCHIVE_MAX_RATIO":      positiveSetting,
+	"ARCHIVE_XZ_MAX_DICT":    positiveSetting,
+	"ROW_ERRORS_LIMIT":       positiveSetting,
+	"CONFLICTS_REPORT_LIMIT": positiveSetting,
+	"REJECTED_ROWS_LIMIT":    positiveSetting,
+	"INGEST_BATCH_SIZE":      intSetting(1, 10000),
+	"INGEST_PARSE_WORKERS":   intSetting(1, 64),
+	"PREVIEW_ROWS":           intSetting(1, 1000),
+	"SAMPLE_DEFAULT_SIZE":    positiveSetting,
+	"SAMPLE_MAX_SIZE":        positiveSetting,
+	"TREND_WINDOW":           intSetting(1, 366),
+	"FORECAST_HISTORY":       intSetting(1, 366),
+	"FORECAST_HORIZON":       intSetting(1, 366),
+	"UPLOAD_DEDUPE_WINDOW":   durationSetting,
+	"IDEMPOTENCY_KEY_TTL":    durationSetting,
+	"DB_RETRY_ATTEMPTS":      positiveSetting,
+	"DB_RETRY_BACKOFF":       durationSetting,
+	"DB_RETRY_AFTER":         durationSetting,
+
+	// умолчания загрузки и выгрузки
+	"ARCHIVE_FILES":      globSetting,
+	"DEDUPE_KEY":         oneOfSetting("full", "no_date", "price_list"),
+	"CSV_HAS_HEADER":     oneOfSetting("true", "false", "auto"),
+	"CSV_COLUMNS_POLICY": oneOfSetting(columnPolicies...),
+	"CSV_DELIMITER":      oneOfSetting(slices.Collect(maps.Keys(csvDelimiters))...),
+	"CSV_LAZY_QUOTES":    boolSetting,
+	"CSV_ENCODING":       oneOfSetting(slices.Collect(maps.Keys(csvEncodings))...),
+	"CSV_DATE_FORMATS": func(s string) error {
+		_, err := parseDateFormats(s)
+		return err
+	},
+	"ON_DUPLICATE":          oneOfSetting("skip", "replace", "error"),
+	"UPLOAD_QUARANTINE":     boolSetting,
+	"UPLOAD_DEFAULT_TYPE":   oneOfSetting(append([]string{"auto"}, archiveTypes...)...),
+	"UPLOAD_REQUIRE_TYPE":   boolSetting,
+	"EXPORT_FORMULA_ESCAPE": boolSetting,
+	"EXPORT_MANIFEST":       boolSetting,
+
+	// правила валидации и выключенные эндпоинты: проверяются целиком, см. checkSettings
+	"VALID_PRICE_MIN":          nil,
+	"VALID_PRICE_MAX":          nil,
+	"VALID_DATE_FROM":          nil,
+	"VALID_DATE_TO":            nil,
+	"VALID_CATEGORIES":         nil,
+	"VALID_NAME_MAX_LEN":       nil,
+	"VALID_CATEGORY_MAX_LEN":   nil,
+	"VALID_CONTROL_CHARS":      nil,
+	"CATEGORY_MAP":             nil,
+	"DISABLED_FEATURES":        nil,
+	"DISABLED_FEATURES_STATUS": nil,
+}
+
+func positiveSetting(s string) error {
+	if i, err := strconv.ParseInt(s, 10, 64); err != nil || i <= 0 {
+		return fmt.Errorf("expected a positive integer")
+	}
+	return nil
+}
+
+func intSetting(lo, hi int) func(string) error {
+	return func(s string) error {
+		if i, err := strconv.Atoi(s); err != nil || i < lo || i > hi {
+			return fmt.Errorf("expected integer %d..%d", lo, hi)
+		}
+		return nil
+	}
+}
+
+func durationSetting(s string) error {
+	if d, err := time.ParseDuration(s); err != nil || d < 0 {
+		return fmt.Errorf("expected a duration like 30s or 10m")
+	}
+	return nil
+}
+
+func boolSetting(s string) error {
+	if _, err := strconv.ParseBool(s); err != nil {
+		return fmt.Errorf("expected true or false")
+	}
+	return nil
+}
+
+func globSetting(s string) error {
+	if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("expected a glob pattern like *.csv")
+	}
+	return nil
+}
+
+func oneOfSetting(values ...string) func(string) error {
+	values = slices.Sorted(slices.Values(values)) // копия: values может быть общим срезом вроде columnPolicies
+	return func(s string) error {
+		if !slices.Contains(values, s) {
+			return fmt.Errorf("expected one of %s", strings.Join(values, ", "))
+		}
+		return nil
+	}
+}
+
+// settingsStore — переопределения из таблицы settings. env и env* смотрят сюда раньше,
+// чем в переменные окружения, поэтому новое значение действует со следующего запроса.
+// Все экземпляры узнают об изменении по NOTIFY settings_changed, а на случай потерянного
+// уведомления ещё и перечитывают таблицу раз в SETTINGS_REFRESH_INTERVAL.
+type settingsStore struct {
+	values atomic.Pointer[map[string]storedSetting]
+
+	mu       sync.Mutex // один reload за раз
+	onChange []func()
+}
+
+type storedSetting struct {
+	value     string
+	updatedAt time.Time
+}
+
+var runtimeSettings = &settingsStore{}
+
+// lookup — переопределение key из таблицы settings, если оно есть.
+func (s *settingsStore) lookup(key string) (string, bool) {
+	m := s.values.Load()
+	if m == nil {
+		return "", false
+	}
+	v, ok := (*m)[key]
+	return v.value, ok
+}
+
+// reload перечитывает таблицу и, если что-то поменялось, пересчитывает зависимое
+// (правила валидации, выключенные эндпоинты).
+func (s *settingsStore) reload(ctx context.Context, db *sql.DB) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := db.QueryContext(ctx, `SELECT key, value, updated_at FROM settings`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	next := map[string]storedSetting{}
+	for rows.Next() {
+		var (
+			key string
+			v   storedSetting
+		)
+		if err := rows.Scan(&key, &v.value, &v.updatedAt); err != nil {
+			return err
+		}
+		if _, ok := runtimeSettingDefs[key]; !ok {
+			// строка от более новой версии сервиса или внесённая руками
+			slog.Warn("unknown runtime setting ignored", "key", key)
+			continue
+		}
+		next[key] = v
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	prev := s.values.Load()
+	if prev != nil && maps.EqualFunc(*prev, next, func(a, b storedSetting) bool { return a.value == b.value }) {
+		s.values.Store(&next)
+		return nil
+	}
+	s.values.Store(&next)
+	if prev != nil {
+		for key := range runtimeSettingDefs {
+			if a, b := (*prev)[key], next[key]; a.value != b.value {
+				slog.Info("runtime setting changed", "key", key, "value", b.value)
+			}
+		}
+	}
+	for _, fn := range s.onChange {
+		fn()
+	}
+	return nil
+}
+
+// watch перечитывает настройки по NOTIFY settings_changed и по таймеру, пока жив процесс.
+func (s *settingsStore) watch(db *sql.DB, dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("settings listener", "error", err)
+		}
+	})
+	if err := listener.Listen("settings_changed"); err != nil {
+		slog.Warn("settings listener: listen failed, falling back to polling", "error", err)
+	}
+
+	var tick <-chan time.Time
+	if every := envDuration("SETTINGS_REFRESH_INTERVAL", time.Minute); every > 0 {
+		t := time.NewTicker(every)
+		tick = t.C
+	}
+	go func() {
+		for {
+			select {
+			case <-listener.Notify:
+				// nil после переподключения: уведомления за время обрыва потеряны.
+			case <-tick:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := s.reload(ctx, db); err != nil {
+				slog.Warn("settings reload failed", "error", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// settingsEnv — как env, но с переопределениями overrides вместо текущих: так checkSettings
+// проверяет набор целиком до сохранения.
+func settingsEnv(overrides map[string]string) func(key, def string) string {
+	return func(key, def string) string {
+		if v, ok := overrides[key]; ok {
+			return v
+		}
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return def
+	}
+}
+
+// checkSettings проверяет правила валидации и выключенные эндпоинты с новыми значениями:
+// VALID_DATE_FROM или DISABLED_FEATURES нельзя проверить по одному ключу.
+func checkSettings(overrides map[string]string) error {
+	get := settingsEnv(overrides)
+	if _, err := parseValidationRules(get); err != nil {
+		return err
+	}
+	fs, err := parseFeatures(get)
+	if err != nil {
+		return err
+	}
+	if _, ok := overrides["DISABLED_FEATURES"]; ok && fs.disabled["admin"] {
+		// иначе вернуть настройку обратно можно было бы только через БД
+		return fmt.Errorf("DISABLED_FEATURES: admin can be disabled only by environment")
+	}
+	return nil
+}
+
+// ------------------------- handlers -------------------------
+
+// Setting — настройка в GET/PUT /api/v0/admin/settings.
+type Setting struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`         // действующее значение; пусто — умолчание сервиса
+	Source    string     `json:"source"`        // settings, env или default
+	Env       string     `json:"env,omitempty"` // значение окружения, скрытое переопределением
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func listSettings() []Setting {
+	out := make([]Setting, 0, len(runtimeSettingDefs))
+	for _, key := range slices.Sorted(maps.Keys(runtimeSettingDefs)) {
+		st := Setting{Key: key, Source: "default", Env: os.Getenv(key)}
+		if m := runtimeSettings.values.Load(); m != nil {
+			if v, ok := (*m)[key]; ok {
+				st.Value, st.Source = v.value, "settings"
+				st.UpdatedAt = &v.updatedAt
+			}
+		}
+		if st.Source == "default" && st.Env != "" {
+			st.Value, st.Source, st.Env = st.Env, "env", ""
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+func handleSettingsGet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(listSettings())
+	}
+}
+
+// handleSettingsSet меняет настройки на всех экземплярах: {"ARCHIVE_MAX_ENTRIES": 5000,
+// "CSV_DELIMITER": ";", "DEDUPE_KEY": null}; null снимает переопределение. Ключи, которых
+// нет в теле, не меняются. Набор применяется целиком или не применяется вовсе.
+func handleSettingsSet(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || len(req) == 0 {
+			writeError(w, CodeInvalidJSON, "invalid json: expected an object of settings")
+			return
+		}
+
+		overrides := map[string]string{}
+		if m := runtimeSettings.values.Load(); m != nil {
+			for k, v := range *m {
+				overrides[k] = v.value
+			}
+		}
+		var problems []string
+		for _, key := range slices.Sorted(maps.Keys(req)) {
+			check, ok := runtimeSettingDefs[key]
+			if !ok {
+				problems = append(problems, key+": not a runtime setting")
+				continue
+			}
+			raw := strings.TrimSpace(string(req[key]))
+			if raw == "null" {
+				delete(overrides, key)
+				continue
+			}
+			value := raw
+			if strings.HasPrefix(raw, `"`) {
+				if err := json.Unmarshal(req[key], &value); err != nil {
+					problems = append(problems, key+": invalid string")
+					continue
+				}
+			}
+			if value == "" {
+				problems = append(problems, key+": empty value, use null to remove the override")
+				continue
+			}
+			if check != nil {
+				if err := check(value); err != nil {
+					problems = append(problems, key+": "+err.Error())
+					continue
+				}
+			}
+			overrides[key] = value
+		}
+		if len(problems) == 0 {
+			if err := checkSettings(overrides); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			writeError(w, CodeInvalidRequest, strings.Join(problems, "; "))
+			return
+		}
+
+		ctx := r.Context()
+		if _, err := retryDB(ctx, "settings", func() (struct{}, error) {
+			return struct{}{}, saveSettings(ctx, db, req, overrides)
+		}); err != nil {
+			writeErrorFrom(w, dbError("db update failed", err))
+			return
+		}
+		// Этот экземпляр не ждёт своего же уведомления.
+		if err := runtimeSettings.reload(ctx, db); err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(listSettings())
+	}
+}
+
+// saveSettings записывает изменённые ключи req и рассылает settings_changed в той же транзакции:
+// уведомление уходит только после фиксации.
+func saveSettings(ctx context.Context, db *sql.DB, req map[string]json.RawMessage, overrides map[string]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for key := range req {
+		value, ok := overrides[key]
+		if !ok {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM settings WHERE key = $1`, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO settings (key, value, updated_at) VALUES ($1, $2, now())
+			ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()
+			WHERE settings.value <> EXCLUDED.value`, key, value); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_notify('settings_changed', '')`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ------------------------- export signing -------------------------
+
+// Подписанная выгрузка кладёт рядом с data.csv два файла:
+//   - data.csv.sha256 — строка "<sha256>  data.csv\n", её проверяет `sha256sum -c`;
+//   - data.csv.sig    — подпись Ed25519 (64 байта) содержимого data.csv.sha256.
+//
+// Подписываем хеш, а не сам data.csv: выгрузка пишется потоком и может быть больше памяти,
+// а Ed25519 требует сообщение целиком.
+
+const (
+	signedFile    = "data.csv"
+	signatureFile = "data.csv.sig"
+	digestFile    = "data.csv.sha256"
+)
+
+// ExportSigner подписывает выгрузки ключом из EXPORT_SIGNING_KEY.
+type ExportSigner struct {
+	key ed25519.PrivateKey
+}
+
+// loadExportSigner читает EXPORT_SIGNING_KEY — закрытый ключ Ed25519 в PEM (PKCS#8),
+// как его создаёт `openssl genpkey -algorithm ed25519`. Не задан — подпись выключена (nil).
+func loadExportSigner() (*ExportSigner, error) {
+	s := env("EXPORT_SIGNING_KEY", "")
+	if s == "" {
+		return nil, nil
+	}
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("EXPORT_SIGNING_KEY: expected PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("EXPORT_SIGNING_KEY: %w", err)
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("EXPORT_SIGNING_KEY: expected Ed25519 key")
+	}
+	return &ExportSigner{key: ed}, nil
+}
+
+func (s *ExportSigner) public() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// digestLine — содержимое data.csv.sha256 в формате sha256sum.
+func digestLine(sum []byte) []byte {
+	return []byte(hex.EncodeToString(sum) + "  " + signedFile + "\n")
+}
+
+// writeSignature дописывает в архив data.csv.sha256 и data.csv.sig для уже записанного data.csv.
+func (s *ExportSigner) writeSignature(zw *zip.Writer, sum []byte, opts ExportOptions) error {
+	line := digestLine(sum)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{digestFile, line},
+		{signatureFile, ed25519.Sign(s.key, line)},
+	}
+	for _, f := range files {
+		fw, err := createExportEntry(zw, f.name, opts)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(f.data); err != nil {
+			return err
+		}
+		if err := closeExportEntry(fw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ------------------------- handlers -------------------------
+
+var errSigningDisabled = codedError(CodeNotFound, "export signing is not configured")
+
+// handleExportPublicKey отдаёт открытый ключ в PEM — для проверки подписи без нашего сервиса:
+// openssl pkeyutl -verify -pubin -inkey key.pem -rawin -in data.csv.sha256 -sigfile data.csv.sig
+func handleExportPublicKey(signer *ExportSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if signer == nil {
+			writeErrorFrom(w, errSigningDisabled)
+			return
+		}
+		der, err := x509.MarshalPKIXPublicKey(signer.public())
+		if err != nil {
+			writeError(w, CodeInternal, "failed to encode public key")
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_ = pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+}
+
+// VerifyResponse — результат проверки выгрузки. Неверная подпись — не ошибка запроса,
+// поэтому отвечаем 200 с valid=false и причиной.
+type VerifyResponse struct {
+	Valid  bool   `json:"valid"`
+	SHA256 string `json:"sha256,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleExportVerify принимает архив из GET /api/v0/prices?sign=true (как есть или
+// в multipart-поле file) и проверяет, что data.csv не менялся и подписан нашим ключом.
+func handleExportVerify(signer *ExportSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if signer == nil {
+			writeErrorFrom(w, errSigningDisabled)
+			return
+		}
+
+		body, size, password, ok := receiveBody(w, r)
+		if !ok {
+			return
+		}
+		defer removeSpool(body)
+
+		resp, err := verifyExport(body, size, password, signer.public())
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func verifyExport(ra io.ReaderAt, size int64, password string, pub ed25519.PublicKey) (VerifyResponse, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return VerifyResponse{}, codedError(CodeArchiveInvalid, "invalid zip archive")
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	if files[signedFile] == nil {
+		return VerifyResponse{}, codedError(CodeArchiveNotFound, "data.csv not found in archive")
+	}
+	if files[digestFile] == nil || files[signatureFile] == nil {
+		return VerifyResponse{Reason: "archive is not signed"}, nil
+	}
+
+	maxEntry := envInt64("ARCHIVE_MAX_ENTRY_SIZE", 200<<20)
+	h := sha256.New()
+	if err := readZipEntry(files[signedFile], password, maxEntry, h); err != nil {
+		return VerifyResponse{}, err
+	}
+	var line, sig bytes.Buffer
+	if err := readZipEntry(files[digestFile], password, 1<<10, &line); err != nil {
+		return VerifyResponse{}, err
+	}
+	if err := readZipEntry(files[signatureFile], password, 1<<10, &sig); err != nil {
+		return VerifyResponse{}, err
+	}
+
+	sum := h.Sum(nil)
+	resp := VerifyResponse{SHA256: hex.EncodeToString(sum)}
+	switch {
+	case !ed25519.Verify(pub, line.Bytes(), sig.Bytes()):
+		resp.Reason = "signature does not match"
+	case !bytes.Equal(line.Bytes(), digestLine(sum)):
+		resp.Reason = "data.csv does not match data.csv.sha256"
+	default:
+		resp.Valid = true
+	}
+	return resp, nil
+}
+
+// readZipEntry копирует запись архива в dst, расшифровывая при необходимости; больше max байт — ошибка.
+func readZipEntry(f *zip.File, password string, max int64, dst io.Writer) error {
+	var (
+		rc  io.ReadCloser
+		err error
+	)
+	if zipEncrypted(f) {
+		rc, err = openEncryptedZipFile(f, password)
+	} else if rc, err = f.Open(); err != nil {
+		err = codedError(CodeArchiveInvalid, "failed to open "+f.Name)
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(dst, io.LimitReader(rc, max+1))
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		return err
+	case err != nil:
+		return codedError(CodeArchiveInvalid, "failed to read "+f.Name+" from archive")
+	case n > max:
+		return codedError(CodeLimitExceeded, fmt.Sprintf("%s exceeds %d bytes", f.Name, max))
+	}
+	return nil
+}
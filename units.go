@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ------------------------- unit price -------------------------
+
+// Цена за единицу: схема 3 добавляет колонки unit и unit_size (0.5 и l — бутылка 0,5 л),
+// и каждая строка получает unit_price — цену за одну базовую единицу (литр, килограмм,
+// метр, штуку). Сравнивать бутылки 0,5 и 1 л по цене бессмысленно, по unit_price — можно.
+// Единица приводится к базовой при загрузке: 500 ml хранится как 0.5 l. unit_price —
+// генерируемая колонка prices (миграция 025), она пересчитывается при смене цены.
+
+// unitScale — базовая единица и сколько базовых единиц в одной единице из файла.
+type unitScale struct {
+	base  string
+	scale float64
+}
+
+// units — принимаемые обозначения единиц, без учёта регистра.
+var units = map[string]unitScale{
+	"l": {"l", 1}, "л": {"l", 1}, "dl": {"l", 0.1}, "cl": {"l", 0.01}, "ml": {"l", 0.001}, "мл": {"l", 0.001},
+	"kg": {"kg", 1}, "кг": {"kg", 1}, "g": {"kg", 0.001}, "г": {"kg", 0.001}, "гр": {"kg", 0.001},
+	"mg": {"kg", 0.000001}, "мг": {"kg", 0.000001},
+	"m": {"m", 1}, "м": {"m", 1}, "cm": {"m", 0.01}, "см": {"m", 0.01}, "mm": {"m", 0.001}, "мм": {"m", 0.001},
+	"pc": {"pc", 1}, "pcs": {"pc", 1}, "шт": {"pc", 1},
+}
+
+// parseUnit разбирает unit и unit_size строки и приводит их к базовой единице:
+// ("ml", "500") — ("l", 0.5). Без unit_size — одна единица (цена за кг). Обе колонки
+// пустые — единица не задана. Ошибка — errUnit (неизвестная единица или размер без
+// единицы) или errUnitSize.
+func parseUnit(unit, size string) (string, float64, error) {
+	unit = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(unit), ".")))
+	size = strings.ReplaceAll(strings.TrimSpace(size), ",", ".")
+	if unit == "" {
+		if size != "" {
+			return "", 0, errUnit
+		}
+		return "", 0, nil
+	}
+	u, ok := units[unit]
+	if !ok {
+		return "", 0, errUnit
+	}
+	n := 1.0
+	if size != "" {
+		var err error
+		if n, err = strconv.ParseFloat(size, 64); err != nil || n <= 0 || math.IsInf(n, 0) {
+			return "", 0, errUnitSize
+		}
+	}
+	// До 6 знаков: 1 мг — 0.000001 кг.
+	n = math.Round(n*u.scale*1e6) / 1e6
+	if n <= 0 {
+		return "", 0, errUnitSize
+	}
+	return u.base, n, nil
+}
+
+var (
+	errUnit     = errors.New("invalid unit")
+	errUnitSize = errors.New("invalid unit size")
+)
+
+// unitPrice — цена за базовую единицу, как её считает колонка prices.unit_price; 0 — единица не задана.
+func (r PriceRow) unitPrice() float64 {
+	if r.UnitSize <= 0 {
+		return 0
+	}
+	return math.Round(r.Price/r.UnitSize*1e4) / 1e4
+}
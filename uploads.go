@@ -0,0 +1,630 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ------------------------- upload statistics -------------------------
+
+// maxSupplierLen — предельная длина имени поставщика в X-Supplier.
+const maxSupplierLen = 100
+
+// UploadEvent — итоги завершённой загрузки для проверок после неё (правила оповещений).
+type UploadEvent struct {
+	ID       int64 // uploads.id
+	Supplier string
+	Response PostResponse
+	Replayed bool // ответ сохранён загрузкой с тем же Idempotency-Key, ничего не записано
+
+	InsertedPrice float64                  // сумма цен вставленных строк
+	Inserted      map[string]CategoryDelta // вставленные строки по категориям
+}
+
+type CategoryDelta struct {
+	Rows  int
+	Total float64
+}
+
+// afterCommit обновляет сводные таблицы и проверяет оповещения, когда строки загрузки попали в prices.
+func (ev UploadEvent) afterCommit(rollups *rollupRefresher, alerts *Alerting, backfill bool) {
+	if ev.Response.TotalItems > 0 || ev.Response.UpdatedCount > 0 {
+		rollups.request()
+	}
+	// Перенос истории заведомо «скачет» по ценам и объёму — правила на него не рассчитаны.
+	if !backfill {
+		alerts.check(ev)
+	}
+}
+
+// Статусы uploads.status.
+const (
+	uploadCommitted  = "committed" // строки записаны сразу
+	uploadPending    = "pending"   // карантин: строки в staged_prices, ждут approve или reject
+	uploadApproved   = "approved"
+	uploadRejected   = "rejected"
+	uploadRolledBack = "rolled_back" // строки удалены через DELETE /api/v0/imports/{id}
+)
+
+func recordUploadTx(ctx context.Context, tx *sql.Tx, opts IngestOptions, resp PostResponse) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO uploads (supplier, schema_version, dedupe, total_count, duplicates_count,
+			total_items, total_categories, total_price, file_sha256, updated_count, status, backfill,
+			archive_type, archive_size, api_key, idempotency_key, ingest_options)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11, $12, $13, $14, $15, NULLIF($16, ''), $17)
+		RETURNING id;
+	`, opts.Supplier, opts.Schema.Version, opts.dedupeName(), resp.TotalCount, resp.DuplicatesCount,
+		resp.TotalItems, resp.TotalCategories, resp.TotalPrice, opts.FileSHA256, resp.UpdatedCount,
+		opts.uploadStatus(), opts.Backfill, opts.ArchiveType, opts.ArchiveSize, opts.KeyName, opts.IdempotencyKey, opts.fingerprint()).Scan(&id)
+	return id, err
+}
+
+// updateUploadTx записывает итоги загрузки, заведённой в начале разбора, и итоги approve.
+// Пустой resp.Status оставляет статус как есть. finished_at — время на часах, а не начало
+// транзакции, как у now().
+func updateUploadTx(ctx context.Context, tx *sql.Tx, id int64, resp PostResponse, rejectedTruncated bool) error {
+	var c DuplicateCounts
+	if resp.DuplicateCounts != nil {
+		c = *resp.DuplicateCounts
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE uploads
+		SET total_count = $2, duplicates_count = $3, total_items = $4, updated_count = $5,
+			total_categories = $6, total_price = $7, status = COALESCE(NULLIF($8, ''), status),
+			rejected_truncated = rejected_truncated OR $9,
+			file_duplicates = $10, db_duplicates = $11, invalid_rows = $12, finished_at = clock_timestamp(),
+			total_products = $13
+		WHERE id = $1;
+	`, id, resp.TotalCount, resp.DuplicatesCount, resp.TotalItems, resp.UpdatedCount,
+		resp.TotalCategories, resp.TotalPrice, resp.Status, rejectedTruncated,
+		c.FileDuplicates, c.DBDuplicates, c.InvalidRows, resp.TotalProducts)
+	return err
+}
+
+func (o IngestOptions) uploadStatus() string {
+	if o.Quarantine {
+		return uploadPending
+	}
+	return uploadCommitted
+}
+
+func (o IngestOptions) dedupeName() string {
+	switch {
+	case o.IgnoreDate:
+		return "no_date"
+	case o.PriceList:
+		return "price_list"
+	}
+	return "full"
+}
+
+// ------------------------- repeated uploads -------------------------
+
+// fileSHA256 считает хеш принятого архива и возвращает файл в начало.
+func fileSHA256(f io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// rowQuerier — *sql.DB или *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// findRepeatedUpload ищет загрузку того же файла с теми же параметрами разбора (fingerprint)
+// от того же ключа API за последние UPLOAD_DEDUPE_WINDOW и возвращает её ответ с
+// duplicate_upload=true.
+// Итоги по БД (total_categories, total_price) — на момент исходной загрузки.
+func findRepeatedUpload(ctx context.Context, db rowQuerier, opts IngestOptions) (PostResponse, bool, error) {
+	window := envDuration("UPLOAD_DEDUPE_WINDOW", 10*time.Minute)
+	if opts.FileSHA256 == "" || window <= 0 || opts.Backfill {
+		return PostResponse{}, false, nil
+	}
+	var (
+		resp   = PostResponse{DuplicateCounts: &DuplicateCounts{}}
+		status string
+	)
+	err := db.QueryRowContext(ctx, `
+		SELECT id, total_count, duplicates_count, total_items, updated_count, total_categories, total_price, status,
+			file_duplicates, db_duplicates, invalid_rows, total_products
+		FROM uploads
+		WHERE file_sha256 = $1 AND ingest_options = $2 AND api_key = $3 AND status NOT IN ('rejected', 'rolled_back')
+		  AND uploaded_at > now() - make_interval(secs => $4)
+		ORDER BY id DESC
+		LIMIT 1;
+	`, opts.FileSHA256, opts.fingerprint(), opts.KeyName, window.Seconds()).Scan(
+		&resp.OriginalUploadID, &resp.TotalCount, &resp.DuplicatesCount, &resp.TotalItems, &resp.UpdatedCount, &resp.TotalCategories, &resp.TotalPrice, &status,
+		&resp.FileDuplicates, &resp.DBDuplicates, &resp.InvalidRows, &resp.TotalProducts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PostResponse{}, false, nil
+	}
+	if err != nil {
+		return PostResponse{}, false, err
+	}
+	resp.DuplicateUpload = true
+	if status != uploadCommitted {
+		resp.UploadID, resp.Status = resp.OriginalUploadID, status
+	}
+	return resp, true, nil
+}
+
+// fingerprint — отпечаток всего, что влияет на разбор файла и на итоги загрузки. Тот же
+// файл с другим filename=, delimiter=, columns=, on_duplicate= или в карантин — другая
+// загрузка, а не повтор (см. findRepeatedUpload).
+func (o IngestOptions) fingerprint() string {
+	b, _ := json.Marshal(struct {
+		Schema      string
+		Dedupe      string
+		HasHeader   string
+		Columns     string
+		Delimiter   string
+		DateLayouts []string
+		Encoding    string
+		LazyQuotes  bool
+		Scope       []string
+		Quarantine  bool
+		OnDuplicate string
+		ArchiveType string
+		Files       string
+		Single      bool
+		Sheet       string
+		MaxDepth    int
+	}{
+		o.Schema.Version, o.dedupeName(), o.HasHeader, o.Columns, o.Delimiter, o.DateLayouts,
+		o.Encoding, o.LazyQuotes, o.Scope, o.Quarantine, o.OnDuplicate, o.ArchiveType,
+		o.Archive.Files, o.Archive.Single, o.Archive.Sheet, o.Archive.MaxDepth,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// lockUploadHashTx не даёт двум одновременным загрузкам одного файла обе пройти проверку
+// findRepeatedUpload: вторая ждёт коммита первой и затем находит её.
+func lockUploadHashTx(ctx context.Context, tx *sql.Tx, opts IngestOptions) error {
+	if opts.FileSHA256 == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, opts.FileSHA256)
+	return err
+}
+
+// UploadStats — итоги загрузок одного поставщика за один интервал.
+type UploadStats struct {
+	Bucket          string  `json:"bucket"` // начало интервала, YYYY-MM-DD
+	Supplier        string  `json:"supplier"`
+	Uploads         int     `json:"uploads"`
+	TotalCount      int     `json:"total_count"`
+	DuplicatesCount int     `json:"duplicates_count"`
+	TotalItems      int     `json:"total_items"`
+	DuplicateRate   float64 `json:"duplicate_rate"` // duplicates_count / total_count, 0..1
+}
+
+// uploadBuckets — интервалы группировки, единицы date_trunc.
+var uploadBuckets = []string{"day", "week", "month"}
+
+// UploadStatsFilter — параметры GET /api/v0/uploads/stats.
+type UploadStatsFilter struct {
+	Bucket    string
+	Start     time.Time // по uploaded_at, включительно
+	End       time.Time // по uploaded_at, весь день включительно
+	Suppliers []string
+	Owner     string // uploadOwner запроса: только загрузки этого ключа; пусто — все
+}
+
+func parseUploadStatsFilter(q url.Values) (UploadStatsFilter, error) {
+	var (
+		f    = UploadStatsFilter{Bucket: "week"}
+		errs ValidationErrors
+	)
+	if s := strings.TrimSpace(q.Get("bucket")); s != "" {
+		if !slices.Contains(uploadBuckets, s) {
+			errs.add("bucket", s, "expected day, week or month")
+		} else {
+			f.Bucket = s
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"start", &f.Start}, {"end", &f.End}} {
+		s := strings.TrimSpace(q.Get(p.name))
+		if s == "" {
+			continue
+		}
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			errs.add(p.name, s, "expected YYYY-MM-DD")
+			continue
+		}
+		*p.dst = d
+	}
+	// Поставщик может быть пустым (не указан), поэтому пустые значения не отбрасываются.
+	f.Suppliers = q["supplier"]
+	return f, errs.err()
+}
+
+func (f UploadStatsFilter) echo() map[string]any {
+	out := map[string]any{"bucket": f.Bucket}
+	if !f.Start.IsZero() {
+		out["start"] = f.Start.Format("2006-01-02")
+	}
+	if !f.End.IsZero() {
+		out["end"] = f.End.Format("2006-01-02")
+	}
+	if f.Suppliers != nil {
+		out["supplier"] = f.Suppliers
+	}
+	return out
+}
+
+// handleUploadStats отдаёт объём загрузок и долю дублей по поставщикам и интервалам —
+// ряды для графиков, по одному на (bucket, supplier).
+func handleUploadStats(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f, err := parseUploadStatsFilter(q)
+		page, pageErr := parsePage(q, 1000, 10000)
+		if err := mergeErrors(err, pageErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		f.Owner = uploadOwner(r)
+		stats, total, err := uploadStats(r.Context(), db, f, page)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		writeList(w, r, stats, len(stats), total, page, f.echo())
+	}
+}
+
+func uploadStats(ctx context.Context, db *sql.DB, f UploadStatsFilter, page PageInfo) ([]UploadStats, int, error) {
+	var (
+		sb   strings.Builder
+		args = []any{f.Bucket}
+	)
+	// Интервалы считаются по UTC, чтобы неделя начиналась с понедельника одинаково для всех.
+	sb.WriteString(`
+		SELECT
+			to_char(date_trunc($1, uploaded_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD') AS bucket,
+			supplier,
+			COUNT(*),
+			SUM(total_count),
+			SUM(duplicates_count),
+			SUM(total_items),
+			COUNT(*) OVER ()
+		FROM uploads
+		WHERE 1=1`)
+	if !f.Start.IsZero() {
+		args = append(args, f.Start)
+		sb.WriteString(fmt.Sprintf(" AND uploaded_at >= $%d", len(args)))
+	}
+	if !f.End.IsZero() {
+		args = append(args, f.End.AddDate(0, 0, 1))
+		sb.WriteString(fmt.Sprintf(" AND uploaded_at < $%d", len(args)))
+	}
+	if f.Suppliers != nil {
+		sb.WriteString(" AND supplier IN (" + placeholders(len(args)+1, len(f.Suppliers)) + ")")
+		for _, s := range f.Suppliers {
+			args = append(args, strings.TrimSpace(s))
+		}
+	}
+	if f.Owner != "" {
+		args = append(args, f.Owner)
+		sb.WriteString(fmt.Sprintf(" AND api_key = $%d", len(args)))
+	}
+	sb.WriteString(" GROUP BY 1, 2 ORDER BY 1, 2")
+	base := sb.String()
+	sb.WriteString(fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset))
+
+	rows, err := db.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		out   = []UploadStats{}
+		total int
+	)
+	for rows.Next() {
+		var s UploadStats
+		if err := rows.Scan(&s.Bucket, &s.Supplier, &s.Uploads, &s.TotalCount, &s.DuplicatesCount, &s.TotalItems, &total); err != nil {
+			return nil, 0, err
+		}
+		if s.TotalCount > 0 {
+			s.DuplicateRate = float64(s.DuplicatesCount) / float64(s.TotalCount)
+		}
+		out = append(out, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	total, err = pageTotal(ctx, db, len(out), total, page, base, args...)
+	return out, total, err
+}
+
+// ------------------------- GET /api/v0/imports -------------------------
+
+// Import — одна загрузка в истории импортов: когда, что прислали и её итоги.
+type Import struct {
+	ID            int64      `json:"id"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"` // нет у загрузок до истории импортов
+	Supplier      string     `json:"supplier"`
+	SchemaVersion string     `json:"schema_version"`
+	Dedupe        string     `json:"dedupe"`
+	Status        string     `json:"status"`
+	Backfill      bool       `json:"backfill"`
+	ArchiveType   string     `json:"archive_type,omitempty"`
+	ArchiveSize   int64      `json:"archive_size,omitempty"`
+
+	TotalCount      int     `json:"total_count"`
+	DuplicatesCount int     `json:"duplicates_count"`
+	FileDuplicates  int     `json:"file_duplicates"`
+	DBDuplicates    int     `json:"db_duplicates"`
+	InvalidRows     int     `json:"invalid_rows"`
+	TotalItems      int     `json:"total_items"`
+	UpdatedCount    int     `json:"updated_count"`
+	TotalCategories int     `json:"total_categories"` // по всей БД на момент загрузки
+	TotalProducts   int     `json:"total_products"`
+	TotalPrice      float64 `json:"total_price"`
+
+	RejectedURL string `json:"rejected_url,omitempty"`
+}
+
+// ImportFilter — параметры GET /api/v0/imports.
+type ImportFilter struct {
+	Start     time.Time // по uploaded_at, включительно
+	End       time.Time // по uploaded_at, весь день включительно
+	Suppliers []string
+	Statuses  []string
+	Owner     string // uploadOwner запроса: только загрузки этого ключа; пусто — все
+}
+
+var uploadStatuses = []string{uploadCommitted, uploadPending, uploadApproved, uploadRejected, uploadRolledBack}
+
+func parseImportFilter(q url.Values) (ImportFilter, error) {
+	var (
+		f    ImportFilter
+		errs ValidationErrors
+	)
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"start", &f.Start}, {"end", &f.End}} {
+		s := strings.TrimSpace(q.Get(p.name))
+		if s == "" {
+			continue
+		}
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			errs.add(p.name, s, "expected YYYY-MM-DD")
+			continue
+		}
+		*p.dst = d
+	}
+	// Как в статистике загрузок: пустой поставщик — «не указан».
+	f.Suppliers = q["supplier"]
+	f.Statuses = nonEmptyValues(q["status"])
+	for _, s := range f.Statuses {
+		if !slices.Contains(uploadStatuses, s) {
+			errs.add("status", s, "expected one of "+strings.Join(uploadStatuses, ", "))
+		}
+	}
+	return f, errs.err()
+}
+
+func (f ImportFilter) echo() map[string]any {
+	out := map[string]any{}
+	if !f.Start.IsZero() {
+		out["start"] = f.Start.Format("2006-01-02")
+	}
+	if !f.End.IsZero() {
+		out["end"] = f.End.Format("2006-01-02")
+	}
+	if f.Suppliers != nil {
+		out["supplier"] = f.Suppliers
+	}
+	if f.Statuses != nil {
+		out["status"] = f.Statuses
+	}
+	return out
+}
+
+// handleImports отдаёт историю импортов, новые первыми. Строки prices каждой загрузки
+// помечены её номером (prices.upload_id).
+func handleImports(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f, err := parseImportFilter(q)
+		page, pageErr := parsePage(q, 100, 1000)
+		if err := mergeErrors(err, pageErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		f.Owner = uploadOwner(r)
+		imports, total, err := queryImports(r.Context(), db, f, page)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		writeList(w, r, imports, len(imports), total, page, f.echo())
+	}
+}
+
+func queryImports(ctx context.Context, db *sql.DB, f ImportFilter, page PageInfo) ([]Import, int, error) {
+	var (
+		sb   strings.Builder
+		args []any
+	)
+	sb.WriteString(`
+		SELECT u.id, u.uploaded_at, u.finished_at, u.supplier, u.schema_version, u.dedupe, u.status, u.backfill,
+			u.archive_type, u.archive_size, u.total_count, u.duplicates_count, u.file_duplicates, u.db_duplicates,
+			u.invalid_rows, u.total_items, u.updated_count, u.total_categories, u.total_products, u.total_price,
+			EXISTS (SELECT 1 FROM rejected_rows rr WHERE rr.upload_id = u.id),
+			COUNT(*) OVER ()
+		FROM uploads u
+		WHERE 1=1`)
+	if !f.Start.IsZero() {
+		args = append(args, f.Start)
+		sb.WriteString(fmt.Sprintf(" AND u.uploaded_at >= $%d", len(args)))
+	}
+	if !f.End.IsZero() {
+		args = append(args, f.End.AddDate(0, 0, 1))
+		sb.WriteString(fmt.Sprintf(" AND u.uploaded_at < $%d", len(args)))
+	}
+	if f.Suppliers != nil {
+		sb.WriteString(" AND u.supplier IN (" + placeholders(len(args)+1, len(f.Suppliers)) + ")")
+		for _, s := range f.Suppliers {
+			args = append(args, strings.TrimSpace(s))
+		}
+	}
+	if f.Statuses != nil {
+		sb.WriteString(" AND u.status IN (" + placeholders(len(args)+1, len(f.Statuses)) + ")")
+		for _, s := range f.Statuses {
+			args = append(args, s)
+		}
+	}
+	if f.Owner != "" {
+		args = append(args, f.Owner)
+		sb.WriteString(fmt.Sprintf(" AND u.api_key = $%d", len(args)))
+	}
+	sb.WriteString(" ORDER BY u.id DESC")
+	base := sb.String()
+	sb.WriteString(fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset))
+
+	rows, err := db.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		out   = []Import{}
+		total int
+	)
+	for rows.Next() {
+		var (
+			im          Import
+			hasRejected bool
+		)
+		if err := rows.Scan(&im.ID, &im.StartedAt, &im.FinishedAt, &im.Supplier, &im.SchemaVersion, &im.Dedupe,
+			&im.Status, &im.Backfill, &im.ArchiveType, &im.ArchiveSize, &im.TotalCount, &im.DuplicatesCount,
+			&im.FileDuplicates, &im.DBDuplicates, &im.InvalidRows, &im.TotalItems, &im.UpdatedCount,
+			&im.TotalCategories, &im.TotalProducts, &im.TotalPrice, &hasRejected, &total); err != nil {
+			return nil, 0, err
+		}
+		if hasRejected {
+			im.RejectedURL = rejectedURL(im.ID)
+		}
+		out = append(out, im)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	total, err = pageTotal(ctx, db, len(out), total, page, base, args...)
+	return out, total, err
+}
+
+// ------------------------- DELETE /api/v0/imports/{id} -------------------------
+
+// ImportRollback — итог отката загрузки.
+type ImportRollback struct {
+	UploadID    int64  `json:"upload_id"`
+	Status      string `json:"status"` // rolled_back
+	DeletedRows int64  `json:"deleted_rows"`
+}
+
+// handleImportRollback удаляет строки prices, вставленные загрузкой, — отмена неудачного импорта
+// без ручного SQL. Загрузка остаётся в истории со статусом rolled_back.
+func handleImportRollback(db *sql.DB, rollups *rollupRefresher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := uploadIDParam(w, r)
+		if !ok {
+			return
+		}
+		res, err := retryDB(r.Context(), "rollback import", func() (ImportRollback, error) {
+			return rollbackImport(r.Context(), db, id)
+		})
+		if err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+		if res.DeletedRows > 0 {
+			rollups.request()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func rollbackImport(ctx context.Context, db *sql.DB, id int64) (ImportRollback, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return ImportRollback{}, dbError("db begin failed", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// FOR UPDATE: второй откат той же загрузки ждёт и затем видит rolled_back.
+	var (
+		status   string
+		updated  int
+		finished sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx, `SELECT status, updated_count, finished_at FROM uploads WHERE id = $1 FOR UPDATE`, id).Scan(&status, &updated, &finished)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ImportRollback{}, errUploadNotFound
+	}
+	if err != nil {
+		return ImportRollback{}, dbError("db query failed", err)
+	}
+	if status != uploadCommitted && status != uploadApproved {
+		return ImportRollback{}, codedError(CodeConflict, "upload is "+status+", not committed or approved")
+	}
+	// До истории импортов (миграция 017) строки загрузкой не помечались — удалять нечего.
+	if !finished.Valid {
+		return ImportRollback{}, codedError(CodeConflict, "upload predates import tracking and cannot be rolled back")
+	}
+	// Прежние значения обновлённых строк не хранятся: удалить их значило бы потерять строки,
+	// бывшие в БД до загрузки.
+	if updated > 0 {
+		return ImportRollback{}, codedError(CodeConflict, fmt.Sprintf("upload updated %d existing rows and cannot be rolled back", updated))
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM prices WHERE upload_id = $1`, id)
+	if err != nil {
+		return ImportRollback{}, dbError("db delete failed", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return ImportRollback{}, dbError("db delete failed", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE uploads SET status = $2 WHERE id = $1`, id, uploadRolledBack); err != nil {
+		return ImportRollback{}, dbError("db update failed", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return ImportRollback{}, dbError("db commit failed", err)
+	}
+	return ImportRollback{UploadID: id, Status: uploadRolledBack, DeletedRows: deleted}, nil
+}
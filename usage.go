@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- usage accounting -------------------------
+
+// usageKey — строка api_usage: ключ API за один день (UTC).
+type usageKey struct {
+	Day    string // YYYY-MM-DD
+	APIKey string
+}
+
+type usageCounts struct {
+	Requests int64
+	BytesIn  int64
+	BytesOut int64
+}
+
+// usageMeter считает трафик /api/* по ключам в памяти и раз в USAGE_FLUSH_INTERVAL
+// дописывает его в api_usage: запрос к БД на каждый вызов API был бы дороже самого учёта.
+// nil — учёт выключен (USAGE_ACCOUNTING=false).
+type usageMeter struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	counts map[usageKey]usageCounts
+}
+
+func startUsageMeter(db *sql.DB) *usageMeter {
+	if !envBool("USAGE_ACCOUNTING", true) {
+		return nil
+	}
+	m := &usageMeter{db: db, counts: make(map[usageKey]usageCounts)}
+	go m.loop(envDuration("USAGE_FLUSH_INTERVAL", time.Minute))
+	return m
+}
+
+// middleware учитывает запросы к /api/*. Должен стоять после APIKeys.middleware:
+// имя ключа берётся из контекста запроса.
+func (m *usageMeter) middleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+
+		// Тело, которое обработчик не дочитал (например, отказ по параметрам), клиент всё равно прислал.
+		in := max(body.n, r.ContentLength)
+		m.add(usageKey{Day: time.Now().UTC().Format("2006-01-02"), APIKey: apiKeyName(r)}, in, cw.n)
+	})
+}
+
+func (m *usageMeter) add(k usageKey, in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counts[k]
+	c.Requests++
+	c.BytesIn += in
+	c.BytesOut += out
+	m.counts[k] = c
+}
+
+func (m *usageMeter) loop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		m.flush(context.Background())
+	}
+}
+
+// flush дописывает накопленное в api_usage. При ошибке счётчики возвращаются
+// и уйдут со следующим сбросом, а не теряются.
+func (m *usageMeter) flush(ctx context.Context) {
+	m.mu.Lock()
+	counts := m.counts
+	m.counts = make(map[usageKey]usageCounts)
+	m.mu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	var (
+		days, keys             []string
+		requests, bytesIn, out []int64
+	)
+	for k, c := range counts {
+		days = append(days, k.Day)
+		keys = append(keys, k.APIKey)
+		requests = append(requests, c.Requests)
+		bytesIn = append(bytesIn, c.BytesIn)
+		out = append(out, c.BytesOut)
+	}
+	_, err := m.db.ExecContext(ctx, `
+		INSERT INTO api_usage (day, api_key, requests, bytes_in, bytes_out)
+		SELECT * FROM unnest($1::date[], $2::text[], $3::bigint[], $4::bigint[], $5::bigint[])
+		ON CONFLICT (day, api_key) DO UPDATE SET
+			requests  = api_usage.requests + EXCLUDED.requests,
+			bytes_in  = api_usage.bytes_in + EXCLUDED.bytes_in,
+			bytes_out = api_usage.bytes_out + EXCLUDED.bytes_out;
+	`, pq.Array(days), pq.Array(keys), pq.Array(requests), pq.Array(bytesIn), pq.Array(out))
+	if err == nil {
+		return
+	}
+	log.Printf("usage flush: %v", err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, c := range counts {
+		cur := m.counts[k]
+		cur.Requests += c.Requests
+		cur.BytesIn += c.BytesIn
+		cur.BytesOut += c.BytesOut
+		m.counts[k] = cur
+	}
+}
+
+// countingReader считает прочитанные байты тела запроса.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter считает байты тела ответа. Unwrap нужен http.ResponseController
+// (Flush, дедлайны записи) у обработчиков за ним.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+// ------------------------- GET /api/v0/usage -------------------------
+
+// Usage — трафик одного ключа за один день.
+type Usage struct {
+	Day      string `json:"day"`
+	APIKey   string `json:"api_key"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// UsageFilter — параметры GET /api/v0/usage.
+type UsageFilter struct {
+	Start time.Time // включительно
+	End   time.Time // включительно
+	Keys  []string
+}
+
+func parseUsageFilter(q url.Values) (UsageFilter, error) {
+	var (
+		f    UsageFilter
+		errs ValidationErrors
+	)
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"start", &f.Start}, {"end", &f.End}} {
+		s := strings.TrimSpace(q.Get(p.name))
+		if s == "" {
+			continue
+		}
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			errs.add(p.name, s, "expected YYYY-MM-DD")
+			continue
+		}
+		*p.dst = d
+	}
+	f.Keys = nonEmptyValues(q["key"])
+	return f, errs.err()
+}
+
+func (f UsageFilter) echo() map[string]any {
+	out := map[string]any{}
+	if !f.Start.IsZero() {
+		out["start"] = f.Start.Format("2006-01-02")
+	}
+	if !f.End.IsZero() {
+		out["end"] = f.End.Format("2006-01-02")
+	}
+	if f.Keys != nil {
+		out["key"] = f.Keys
+	}
+	return out
+}
+
+// handleUsage отдаёт трафик по ключам и дням — для внутренних расчётов между командами.
+// Последние USAGE_FLUSH_INTERVAL ещё в памяти и появятся со следующим сбросом.
+func handleUsage(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f, err := parseUsageFilter(q)
+		page, pageErr := parsePage(q, 1000, 10000)
+		if err := mergeErrors(err, pageErr); err != nil {
+			writeErrorFrom(w, err)
+			return
+		}
+
+		usage, total, err := queryUsage(r.Context(), db, f, page)
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		writeList(w, r, usage, len(usage), total, page, f.echo())
+	}
+}
+
+func queryUsage(ctx context.Context, db *sql.DB, f UsageFilter, page PageInfo) ([]Usage, int, error) {
+	var (
+		sb   strings.Builder
+		args []any
+	)
+	sb.WriteString(`
+		SELECT to_char(day, 'YYYY-MM-DD'), api_key, requests, bytes_in, bytes_out, COUNT(*) OVER ()
+		FROM api_usage
+		WHERE 1=1`)
+	if !f.Start.IsZero() {
+		args = append(args, f.Start)
+		sb.WriteString(fmt.Sprintf(" AND day >= $%d", len(args)))
+	}
+	if !f.End.IsZero() {
+		args = append(args, f.End)
+		sb.WriteString(fmt.Sprintf(" AND day <= $%d", len(args)))
+	}
+	if f.Keys != nil {
+		args = append(args, pq.Array(f.Keys))
+		sb.WriteString(fmt.Sprintf(" AND api_key = ANY($%d)", len(args)))
+	}
+	sb.WriteString(" ORDER BY day, api_key")
+	base := sb.String()
+	sb.WriteString(fmt.Sprintf(" LIMIT %d OFFSET %d;", page.Limit, page.Offset))
+
+	rows, err := db.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		out   = []Usage{}
+		total int
+	)
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.Day, &u.APIKey, &u.Requests, &u.BytesIn, &u.BytesOut, &total); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	total, err = pageTotal(ctx, db, len(out), total, page, base, args...)
+	return out, total, err
+}
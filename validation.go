@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// ------------------------- validation rules -------------------------
+
+// ValidationRules — бизнес-правила для строк сверх базового формата.
+// Нулевые значения означают "без ограничения".
+type ValidationRules struct {
+	MinPrice   float64
+	MaxPrice   float64
+	DateFrom   time.Time
+	DateTo     time.Time
+	Categories []string // белый список категорий
+
+	CategoryMap map[string]string // CATEGORY_MAP: категория файла (lower(trim)) -> путь в иерархии, см. mapCategory
+
+	NameMaxLen     int  // максимальная длина name в символах
+	CategoryMaxLen int  // максимальная длина category в символах
+	RejectControl  bool // управляющие символы: true — отклонять строку, false — вырезать
+
+	DateLayouts []string // форматы create_date (layout time.Parse) по порядку; nil — defaultDateLayouts
+	LegacyDates bool     // принимать даты старых выгрузок (см. legacyDateLayouts); только backfill
+
+	Scope []string // категории ключа API, lower(trim); nil — все
+}
+
+// liveRules — действующие правила валидации. Пересчитываются, когда в таблице settings
+// меняются VALID_*; загрузка берёт снимок правил в начале и работает с ним до конца.
+type liveRules struct {
+	cur atomic.Pointer[ValidationRules]
+}
+
+func newLiveRules() (*liveRules, error) {
+	v, err := loadValidationRules()
+	if err != nil {
+		return nil, err
+	}
+	l := &liveRules{}
+	l.cur.Store(&v)
+	return l, nil
+}
+
+func (l *liveRules) get() ValidationRules {
+	return *l.cur.Load()
+}
+
+// reload перечитывает правила; при ошибке остаются прежние.
+func (l *liveRules) reload() error {
+	v, err := loadValidationRules()
+	if err != nil {
+		return err
+	}
+	l.cur.Store(&v)
+	return nil
+}
+
+// legacyDateLayouts — форматы create_date из выгрузок прошлых лет, которые принимаются при backfill.
+var legacyDateLayouts = []string{"02.01.2006", "2006/01/02", "20060102", "2006-01-02 15:04:05", time.RFC3339}
+
+// dateFormats — форматы create_date для date_formats= и CSV_DATE_FORMATS.
+var dateFormats = map[string]string{
+	"YYYY-MM-DD":          "2006-01-02",
+	"DD.MM.YYYY":          "02.01.2006",
+	"DD/MM/YYYY":          "02/01/2006",
+	"MM/DD/YYYY":          "01/02/2006",
+	"YYYY/MM/DD":          "2006/01/02",
+	"YYYYMMDD":            "20060102",
+	"YYYY-MM-DD HH:MM:SS": "2006-01-02 15:04:05",
+	"RFC3339":             time.RFC3339, // и с долями секунды
+}
+
+// defaultDateFormats — CSV_DATE_FORMATS по умолчанию: дата и полная метка времени ISO.
+const defaultDateFormats = "YYYY-MM-DD,RFC3339"
+
+var defaultDateLayouts = []string{"2006-01-02", time.RFC3339}
+
+// parseDateFormats разбирает список форматов через запятую в layout для time.Parse.
+func parseDateFormats(s string) ([]string, error) {
+	var layouts []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		layout, ok := dateFormats[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown date format %s, expected some of %s", name, strings.Join(slices.Sorted(maps.Keys(dateFormats)), ", "))
+		}
+		layouts = append(layouts, layout)
+	}
+	if len(layouts) == 0 {
+		return nil, fmt.Errorf("expected at least one date format")
+	}
+	return layouts, nil
+}
+
+// forBackfill — правила для переноса истории: без окна дат VALID_DATE_FROM/VALID_DATE_TO
+// и со старыми форматами дат. Остальные правила действуют как обычно.
+func (v ValidationRules) forBackfill() ValidationRules {
+	v.DateFrom, v.DateTo = time.Time{}, time.Time{}
+	v.LegacyDates = true
+	return v
+}
+
+// forUpload — правила для конкретной загрузки: backfill и ограничение категорий ключа API.
+func (v ValidationRules) forUpload(opts IngestOptions) ValidationRules {
+	if opts.Backfill {
+		v = v.forBackfill()
+	}
+	v.Scope = opts.Scope
+	if opts.DateLayouts != nil {
+		v.DateLayouts = opts.DateLayouts
+	}
+	return v
+}
+
+// parseDate разбирает create_date по DateLayouts — первый подошедший формат, а при LegacyDates
+// и по legacyDateLayouts. Время отбрасывается: остаётся дата в часовом поясе самого значения
+// (2024-01-01T23:30:00-05:00 — 1 января), поэтому дубли ищутся по дате, как и раньше.
+func (v ValidationRules) parseDate(s string) (time.Time, error) {
+	layouts := v.DateLayouts
+	if layouts == nil {
+		layouts = defaultDateLayouts
+	}
+	if v.LegacyDates {
+		layouts = append(slices.Clip(layouts), legacyDateLayouts...)
+	}
+	var firstErr error
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return time.Time{}, firstErr
+}
+
+// Длины по умолчанию: name и category вместе попадают в btree-индекс UNIQUE,
+// а у него предел ~2.7 КБ на запись — без ограничения одна строка валит всю загрузку.
+const (
+	defaultNameMaxLen     = 500
+	defaultCategoryMaxLen = 500
+)
+
+func (v ValidationRules) MarshalJSON() ([]byte, error) {
+	out := struct {
+		MinPrice   float64  `json:"min_price,omitempty"`
+		MaxPrice   float64  `json:"max_price,omitempty"`
+		DateFrom   string   `json:"date_from,omitempty"`
+		DateTo     string   `json:"date_to,omitempty"`
+		Categories []string `json:"categories,omitempty"`
+
+		CategoryMap map[string]string `json:"category_map,omitempty"`
+
+		NameMaxLen     int    `json:"name_max_len,omitempty"`
+		CategoryMaxLen int    `json:"category_max_len,omitempty"`
+		ControlChars   string `json:"control_chars"`
+	}{
+		MinPrice: v.MinPrice, MaxPrice: v.MaxPrice, Categories: v.Categories, CategoryMap: v.CategoryMap,
+		NameMaxLen: v.NameMaxLen, CategoryMaxLen: v.CategoryMaxLen, ControlChars: "strip",
+	}
+	if v.RejectControl {
+		out.ControlChars = "reject"
+	}
+	if !v.DateFrom.IsZero() {
+		out.DateFrom = v.DateFrom.Format("2006-01-02")
+	}
+	if !v.DateTo.IsZero() {
+		out.DateTo = v.DateTo.Format("2006-01-02")
+	}
+	return json.Marshal(out)
+}
+
+func loadValidationRules() (ValidationRules, error) {
+	return parseValidationRules(env)
+}
+
+// parseValidationRules собирает правила из настроек VALID_*; get — как env. Через get
+// PUT /api/v0/admin/settings проверяет новые значения до сохранения.
+func parseValidationRules(get func(key, def string) string) (ValidationRules, error) {
+	var (
+		v   = ValidationRules{NameMaxLen: defaultNameMaxLen, CategoryMaxLen: defaultCategoryMaxLen}
+		err error
+	)
+	if s := get("VALID_PRICE_MIN", ""); s != "" {
+		if v.MinPrice, err = strconv.ParseFloat(s, 64); err != nil {
+			return v, fmt.Errorf("VALID_PRICE_MIN: %w", err)
+		}
+	}
+	if s := get("VALID_PRICE_MAX", ""); s != "" {
+		if v.MaxPrice, err = strconv.ParseFloat(s, 64); err != nil {
+			return v, fmt.Errorf("VALID_PRICE_MAX: %w", err)
+		}
+	}
+	if s := get("VALID_DATE_FROM", ""); s != "" {
+		if v.DateFrom, err = time.Parse("2006-01-02", s); err != nil {
+			return v, fmt.Errorf("VALID_DATE_FROM: %w", err)
+		}
+	}
+	if s := get("VALID_DATE_TO", ""); s != "" {
+		if v.DateTo, err = time.Parse("2006-01-02", s); err != nil {
+			return v, fmt.Errorf("VALID_DATE_TO: %w", err)
+		}
+	}
+	if s := get("VALID_CATEGORIES", ""); s != "" {
+		for _, c := range strings.Split(s, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				v.Categories = append(v.Categories, c)
+			}
+		}
+	}
+	if s := get("CATEGORY_MAP", ""); s != "" {
+		if v.CategoryMap, err = parseCategoryMap(s); err != nil {
+			return v, fmt.Errorf("CATEGORY_MAP: %w", err)
+		}
+	}
+	if s := get("VALID_NAME_MAX_LEN", ""); s != "" {
+		if v.NameMaxLen, err = strconv.Atoi(s); err != nil || v.NameMaxLen < 0 {
+			return v, fmt.Errorf("VALID_NAME_MAX_LEN: invalid value %q", s)
+		}
+	}
+	if s := get("VALID_CATEGORY_MAX_LEN", ""); s != "" {
+		if v.CategoryMaxLen, err = strconv.Atoi(s); err != nil || v.CategoryMaxLen < 0 {
+			return v, fmt.Errorf("VALID_CATEGORY_MAX_LEN: invalid value %q", s)
+		}
+	}
+	switch s := get("VALID_CONTROL_CHARS", "strip"); s {
+	case "strip":
+	case "reject":
+		v.RejectControl = true
+	default:
+		return v, fmt.Errorf("VALID_CONTROL_CHARS: must be strip or reject, got %q", s)
+	}
+	return v, nil
+}
+
+// clean убирает из текстового поля управляющие символы (включая NUL) и битый UTF-8 —
+// Postgres не примет их в TEXT и уронит всю загрузку. При RejectControl поле не меняется,
+// а возвращается имя нарушенного правила.
+func (v ValidationRules) clean(s string) (string, string) {
+	bad := func(r rune) bool { return r == utf8.RuneError || unicode.IsControl(r) }
+	if utf8.ValidString(s) && strings.IndexFunc(s, bad) < 0 {
+		return s, ""
+	}
+	if v.RejectControl {
+		return s, "control_chars"
+	}
+	s = strings.Map(func(r rune) rune {
+		if bad(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, ""))
+	return strings.TrimSpace(s), ""
+}
+
+// check возвращает имя нарушенного правила или "" если строка проходит.
+func (v ValidationRules) check(createdAt time.Time, name, category string, price float64) string {
+	switch {
+	case v.NameMaxLen > 0 && utf8.RuneCountInString(name) > v.NameMaxLen:
+		return "name_too_long"
+	case v.CategoryMaxLen > 0 && utf8.RuneCountInString(category) > v.CategoryMaxLen:
+		return "category_too_long"
+	case v.MinPrice > 0 && price < v.MinPrice:
+		return "price_below_min"
+	case v.MaxPrice > 0 && price > v.MaxPrice:
+		return "price_above_max"
+	case !v.DateFrom.IsZero() && createdAt.Before(v.DateFrom):
+		return "date_before_from"
+	case !v.DateTo.IsZero() && createdAt.After(v.DateTo):
+		return "date_after_to"
+	case len(v.Categories) > 0 && !slices.Contains(v.Categories, category):
+		return "category_not_allowed"
+	case v.Scope != nil && !slices.Contains(v.Scope, normalizeKeyPart(category)):
+		return "category_out_of_scope"
+	}
+	return ""
+}
+
+// sqlConditions — те же правила в виде условий нарушения для SQL-аудита.
+func (v ValidationRules) sqlConditions() []auditCond {
+	var conds []auditCond
+	if v.MinPrice > 0 {
+		conds = append(conds, auditCond{"price_below_min", "price < $1", v.MinPrice})
+	}
+	if v.MaxPrice > 0 {
+		conds = append(conds, auditCond{"price_above_max", "price > $1", v.MaxPrice})
+	}
+	if !v.DateFrom.IsZero() {
+		conds = append(conds, auditCond{"date_before_from", "created_at < $1", v.DateFrom})
+	}
+	if !v.DateTo.IsZero() {
+		conds = append(conds, auditCond{"date_after_to", "created_at > $1", v.DateTo})
+	}
+	if len(v.Categories) > 0 {
+		conds = append(conds, auditCond{"category_not_allowed", "NOT (category = ANY($1))", pq.Array(v.Categories)})
+	}
+	if v.NameMaxLen > 0 {
+		conds = append(conds, auditCond{"name_too_long", "char_length(name) > $1", v.NameMaxLen})
+	}
+	if v.CategoryMaxLen > 0 {
+		conds = append(conds, auditCond{"category_too_long", "char_length(category) > $1", v.CategoryMaxLen})
+	}
+	conds = append(conds, auditCond{"control_chars", "(name ~ $1 OR category ~ $1)", "[[:cntrl:]]"})
+	return conds
+}
+
+type auditCond struct {
+	Rule string
+	Expr string
+	Arg  any
+}
+
+// ------------------------- audit -------------------------
+
+type AuditViolation struct {
+	Rule      string          `json:"rule"`
+	Count     int             `json:"count"`
+	SampleIDs json.RawMessage `json:"sample_ids"`
+}
+
+type AuditReport struct {
+	Rules      ValidationRules  `json:"rules"`
+	TotalRows  int              `json:"total_rows"`
+	Violations []AuditViolation `json:"violations"`
+}
+
+func handleAudit(db *sql.DB, rules *liveRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := auditPrices(r.Context(), db, rules.get())
+		if err != nil {
+			writeErrorFrom(w, dbError("db query failed", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
+
+func auditPrices(ctx context.Context, db *sql.DB, rules ValidationRules) (AuditReport, error) {
+	report := AuditReport{Rules: rules, Violations: []AuditViolation{}}
+
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM prices;`).Scan(&report.TotalRows); err != nil {
+		return AuditReport{}, err
+	}
+
+	for _, c := range rules.sqlConditions() {
+		q := `
+			SELECT
+				(SELECT COUNT(*) FROM prices WHERE ` + c.Expr + `),
+				(SELECT COALESCE(json_agg(id), '[]') FROM (
+					SELECT id FROM prices WHERE ` + c.Expr + ` ORDER BY id LIMIT 10
+				) s);
+		`
+		var (
+			v   = AuditViolation{Rule: c.Rule}
+			ids []byte
+		)
+		if err := db.QueryRowContext(ctx, q, c.Arg).Scan(&v.Count, &ids); err != nil {
+			return AuditReport{}, err
+		}
+		v.SampleIDs = ids
+		report.Violations = append(report.Violations, v)
+	}
+	return report, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ------------------------- xlsx -------------------------
+
+// xlsxContentType — Content-Type книги Excel; с ним тип загрузки — xlsx, как text/csv — csv.
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// oleMagic — сигнатура контейнера OLE: так выглядят зашифрованная книга xlsx и старый .xls.
+var oleMagic = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+func isXlsxContentType(ct string) bool {
+	mt, _, _ := mime.ParseMediaType(ct)
+	return mt == xlsxContentType
+}
+
+// isXlsxZip — zip с записью xl/workbook.xml: это книга Excel, а не архив с CSV.
+// Порядок записей в книге не задан, поэтому смотрим оглавление zip, а не начало файла.
+func isXlsxZip(f *os.File) bool {
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	zr, err := zip.NewReader(f, st.Size())
+	if err != nil {
+		return false
+	}
+	for _, zf := range zr.File {
+		if zf.Name == "xl/workbook.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+// openCSVFromXlsx открывает книгу Excel и отдаёт лист sheet= (по умолчанию первый) как
+// CSV-файл: колонки по-прежнему сопоставляются по заголовку, а строки проходят ту же
+// валидацию, дедупликацию и вставку, что и data.csv. Номер строки CSV — номер строки листа.
+func openCSVFromXlsx(ra io.ReaderAt, size int64, opts ArchiveOptions) (csvFiles, error) {
+	head := make([]byte, len(oleMagic))
+	_, _ = ra.ReadAt(head, 0)
+	encrypted := bytes.Equal(head, oleMagic)
+	if encrypted && opts.Password == "" {
+		return nil, codedError(CodeArchivePassword, "workbook is encrypted or in the legacy .xls format: pass the password in X-Archive-Password or save it as .xlsx")
+	}
+	if !encrypted {
+		// Лимиты распаковки проверяем сами: excelize сообщил бы о них ошибкой без кода.
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return nil, codedError(CodeArchiveInvalid, "invalid xlsx workbook")
+		}
+		total := archiveTotal{max: opts.MaxTotalSize}
+		for _, f := range zr.File {
+			if err := total.add(f.UncompressedSize64); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	f, err := excelize.OpenReader(io.NewSectionReader(ra, 0, size), excelize.Options{
+		Password:       opts.Password,
+		UnzipSizeLimit: opts.MaxTotalSize,
+		// Дата в формате ячейки «Краткая дата» — в виде, который понимает create_date.
+		ShortDatePattern: "yyyy-mm-dd",
+	})
+	switch {
+	case encrypted && (errors.Is(err, excelize.ErrWorkbookPassword) || errors.Is(err, excelize.ErrWorkbookFileFormat)):
+		return nil, codedError(CodeArchivePassword, "workbook password is incorrect")
+	case err != nil:
+		if f != nil {
+			_ = f.Close()
+		}
+		return nil, codedError(CodeArchiveInvalid, "invalid xlsx workbook")
+	}
+
+	sheet, err := xlsxSheet(f, opts.Sheet)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &xlsxFile{f: f, sheet: sheet, opts: opts}, nil
+}
+
+// xlsxSheet находит лист по имени или номеру (с 1); пустое имя — первый лист книги.
+func xlsxSheet(f *excelize.File, name string) (string, error) {
+	sheets := f.GetSheetList()
+	if len(sheets) == 0 {
+		return "", codedError(CodeArchiveNotFound, "workbook has no sheets")
+	}
+	if name == "" {
+		return sheets[0], nil
+	}
+	for _, s := range sheets {
+		if strings.EqualFold(s, name) {
+			return s, nil
+		}
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 1 && i <= len(sheets) {
+		return sheets[i-1], nil
+	}
+	return "", codedError(CodeArchiveNotFound, "sheet "+name+" not found in workbook, sheets: "+strings.Join(sheets, ", "))
+}
+
+// xlsxFile — загрузка из одного листа. Лист переводится в CSV по мере чтения, в горутине.
+type xlsxFile struct {
+	f     *excelize.File
+	sheet string
+	opts  ArchiveOptions
+
+	pr   *io.PipeReader
+	done chan struct{}
+}
+
+func (x *xlsxFile) next() (string, io.Reader, error) {
+	if x.pr != nil {
+		return "", nil, io.EOF
+	}
+	pr, pw := io.Pipe()
+	x.pr, x.done = pr, make(chan struct{})
+	go func() {
+		defer close(x.done)
+		pw.CloseWithError(writeSheetCSV(x.f, x.sheet, pw))
+	}()
+	return x.sheet, x.opts.limitCSV(x.sheet, pr, func() {}), nil
+}
+
+func (x *xlsxFile) Close() error {
+	if x.pr != nil {
+		// Остановить запись листа, если файл дочитан не до конца.
+		_ = x.pr.Close()
+		<-x.done
+	}
+	return x.f.Close()
+}
+
+// writeSheetCSV пишет строки листа в CSV. Пустые ячейки в конце строки отбрасываются,
+// пустая строка листа становится пустой строкой CSV — её пропустит разбор, но номера
+// следующих строк совпадут с номерами строк в Excel.
+func writeSheetCSV(f *excelize.File, sheet string, w io.Writer) error {
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		return codedError(CodeArchiveInvalid, "invalid xlsx sheet "+sheet)
+	}
+	defer rows.Close()
+	cw := csv.NewWriter(w)
+	for rows.Next() {
+		cells, err := rows.Columns()
+		if err != nil {
+			return codedError(CodeArchiveInvalid, "invalid xlsx sheet "+sheet)
+		}
+		for len(cells) > 0 && strings.TrimSpace(cells[len(cells)-1]) == "" {
+			cells = cells[:len(cells)-1]
+		}
+		if len(cells) == 0 {
+			cw.Flush()
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := cw.Write(cells); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return rows.Error()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+// ------------------------- xz -------------------------
+
+var xzMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+
+// newXzReader открывает поток xz. Декодер выделяет словарь того размера, что записан
+// в файле (по формату — до 1,5 ГБ), поэтому словарь первого блока сверяется с
+// ARCHIVE_XZ_MAX_DICT (по умолчанию 64 МБ, как окно zstd). xz -9 пишет словарь 64 МБ.
+func newXzReader(r io.Reader) (*xz.Reader, error) {
+	br := bufio.NewReaderSize(r, 4096)
+	head, _ := br.Peek(12 + 1024) // заголовок потока и заголовок первого блока
+	if dict, ok := xzDictSize(head); ok {
+		if limit := envInt64("ARCHIVE_XZ_MAX_DICT", 64<<20); dict > limit {
+			return nil, codedError(CodeLimitExceeded, fmt.Sprintf("xz dictionary %d bytes exceeds %d", dict, limit))
+		}
+	}
+	dec, err := xz.NewReader(br)
+	if err != nil {
+		return nil, codedError(CodeArchiveInvalid, "invalid xz stream")
+	}
+	return dec, nil
+}
+
+// openCSVFromXz — загрузка одним data.csv, сжатым xz (.csv.xz).
+func openCSVFromXz(r io.Reader, opts ArchiveOptions) (csvFiles, error) {
+	dec, err := newXzReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return singleFile(opts.limitCSV(singleCSVName, dec, func() {})), nil
+}
+
+// openTarXz — tar, сжатый xz (.tar.xz): дальше те же проверки, что у tar.
+func openTarXz(r io.Reader, opts ArchiveOptions) (csvFiles, error) {
+	dec, err := newXzReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return openCSVFromTar(dec, opts, func() {})
+}
+
+// xzDictSize достаёт размер словаря LZMA2 из заголовка первого блока
+// (формат .xz, разделы 2.1.1 и 5.3.1). ok=false — блока нет или заголовок не разобран;
+// тогда решает сам декодер.
+func xzDictSize(b []byte) (int64, bool) {
+	if len(b) < 14 {
+		return 0, false
+	}
+	b = b[12:]
+	size := (int(b[0]) + 1) * 4
+	if b[0] == 0 || len(b) < size {
+		return 0, false // индекс вместо блока или обрезанный заголовок
+	}
+	flags := b[1]
+	p := b[2:size]
+	varint := func() (uint64, bool) {
+		var v uint64
+		for i := 0; i < 9 && i < len(p); i++ {
+			v |= uint64(p[i]&0x7F) << (7 * i)
+			if p[i]&0x80 == 0 {
+				p = p[i+1:]
+				return v, true
+			}
+		}
+		return 0, false
+	}
+	for _, bit := range []byte{0x40, 0x80} { // compressed и uncompressed size
+		if flags&bit != 0 {
+			if _, ok := varint(); !ok {
+				return 0, false
+			}
+		}
+	}
+	for n := int(flags&0x03) + 1; n > 0; n-- {
+		id, ok1 := varint()
+		propsLen, ok2 := varint()
+		if !ok1 || !ok2 || uint64(len(p)) < propsLen {
+			return 0, false
+		}
+		if id == 0x21 && propsLen == 1 { // LZMA2
+			code := p[0] & 0x3F
+			if code > 40 {
+				return 0, false
+			}
+			if code == 40 {
+				return 1<<32 - 1, true
+			}
+			return int64(2|code&1) << (code/2 + 11), true
+		}
+		p = p[propsLen:]
+	}
+	return 0, false
+}
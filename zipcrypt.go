@@ -0,0 +1,394 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ------------------------- encrypted zip -------------------------
+
+// archive/zip не умеет расшифровывать, поэтому берём сырые данные через OpenRaw
+// и снимаем шифрование сами: ZipCrypto (традиционное PKWARE) и WinZip AES (метод 99).
+
+const zipMethodAES = 99
+
+func zipEncrypted(f *zip.File) bool {
+	return f.Flags&0x1 != 0 || f.Method == zipMethodAES
+}
+
+var (
+	errArchivePassword = codedError(CodeArchivePassword, "archive password required or incorrect")
+	errArchiveAuth     = codedError(CodeArchiveInvalid, "encrypted archive failed integrity check")
+)
+
+// openEncryptedZipFile расшифровывает и распаковывает запись зашифрованного zip.
+func openEncryptedZipFile(f *zip.File, password string) (io.ReadCloser, error) {
+	if password == "" {
+		return nil, errArchivePassword
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, codedError(CodeArchiveInvalid, "failed to open data.csv")
+	}
+
+	var (
+		plain    io.Reader
+		method   = f.Method
+		checkCRC = true
+	)
+	if f.Method == zipMethodAES {
+		ae, ok := parseAESExtra(f.Extra)
+		if !ok {
+			return nil, codedError(CodeArchiveInvalid, "invalid AES extra field")
+		}
+		if plain, err = newAESReader(raw, int64(f.CompressedSize64), ae, password); err != nil {
+			return nil, err
+		}
+		method = ae.method
+		// В AE-2 CRC не записывается, целостность проверяет HMAC.
+		checkCRC = ae.version == 1
+	} else {
+		// Контрольный байт: старший байт CRC, а при data descriptor — времени изменения.
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&0x8 != 0 {
+			check = byte(f.ModifiedTime >> 8)
+		}
+		if plain, err = newZipCryptoReader(raw, password, check); err != nil {
+			return nil, err
+		}
+	}
+
+	var rc io.ReadCloser
+	switch method {
+	case zip.Store:
+		rc = io.NopCloser(plain)
+	case zip.Deflate:
+		rc = flate.NewReader(plain)
+	default:
+		return nil, codedError(CodeArchiveInvalid, "unsupported zip compression method")
+	}
+	if f.Method == zipMethodAES {
+		rc = &authReader{rc: rc, src: plain}
+	}
+	if checkCRC {
+		return &crcReader{rc: rc, hash: crc32.NewIEEE(), want: f.CRC32}, nil
+	}
+	return rc, nil
+}
+
+// ------------------------- ZipCrypto -------------------------
+
+type zipCryptoKeys [3]uint32
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+func (k *zipCryptoKeys) decrypt(b byte) byte {
+	t := uint16(k[2] | 2)
+	b ^= byte((t * (t ^ 1)) >> 8)
+	k.update(b)
+	return b
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys zipCryptoKeys
+}
+
+func newZipCryptoReader(r io.Reader, password string, check byte) (io.Reader, error) {
+	z := &zipCryptoReader{r: r, keys: zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}}
+	for i := 0; i < len(password); i++ {
+		z.keys.update(password[i])
+	}
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, codedError(CodeArchiveInvalid, "truncated encrypted entry")
+	}
+	for i := range header {
+		header[i] = z.keys.decrypt(header[i])
+	}
+	if header[11] != check {
+		return nil, errArchivePassword
+	}
+	return z, nil
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] = z.keys.decrypt(p[i])
+	}
+	return n, err
+}
+
+// ------------------------- WinZip AES -------------------------
+
+type aesExtra struct {
+	version  uint16 // 1 = AE-1, 2 = AE-2
+	strength byte   // 1/2/3 = AES-128/192/256
+	method   uint16 // настоящий метод сжатия
+}
+
+// parseAESExtra ищет extra-поле 0x9901 с параметрами WinZip AES.
+func parseAESExtra(extra []byte) (aesExtra, bool) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			break
+		}
+		if tag == 0x9901 && size >= 7 {
+			d := extra[4 : 4+size]
+			ae := aesExtra{
+				version:  binary.LittleEndian.Uint16(d[0:2]),
+				strength: d[4],
+				method:   binary.LittleEndian.Uint16(d[5:7]),
+			}
+			return ae, ae.strength >= 1 && ae.strength <= 3
+		}
+		extra = extra[4+size:]
+	}
+	return aesExtra{}, false
+}
+
+// winzipCTR — AES-CTR в варианте WinZip: счётчик little-endian, начиная с 1.
+type winzipCTR struct {
+	block  cipher.Block
+	ctr    [aes.BlockSize]byte
+	stream [aes.BlockSize]byte
+	pos    int
+}
+
+func newWinzipCTR(key []byte) (*winzipCTR, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &winzipCTR{block: block, pos: aes.BlockSize}, nil
+}
+
+func (c *winzipCTR) xor(p []byte) {
+	for i := range p {
+		if c.pos == aes.BlockSize {
+			for j := range c.ctr { // инкремент little-endian
+				c.ctr[j]++
+				if c.ctr[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.ctr[:])
+			c.pos = 0
+		}
+		p[i] ^= c.stream[c.pos]
+		c.pos++
+	}
+}
+
+// aesKeys выводит из пароля ключ шифрования, ключ HMAC и 2-байтовый верификатор пароля.
+func aesKeys(password string, salt []byte, keyLen int) (encKey, macKey, verifier []byte) {
+	keys := pbkdf2.Key([]byte(password), salt, 1000, 2*keyLen+2, sha1.New)
+	return keys[:keyLen], keys[keyLen : 2*keyLen], keys[2*keyLen:]
+}
+
+// aesReader расшифровывает запись WinZip AES и проверяет HMAC-SHA1 в конце.
+type aesReader struct {
+	data io.Reader // зашифрованные данные без соли, верификатора и кода аутентификации
+	tail io.Reader // 10 байт кода аутентификации
+	ctr  *winzipCTR
+	mac  hash.Hash
+	err  error // итог проверки кода аутентификации, после конца данных
+}
+
+func newAESReader(raw io.Reader, size int64, ae aesExtra, password string) (io.Reader, error) {
+	keyLen := 8 + 8*int(ae.strength) // 16/24/32
+	saltLen := keyLen / 2
+	const verifierLen, authLen = 2, 10
+	if size < int64(saltLen+verifierLen+authLen) {
+		return nil, codedError(CodeArchiveInvalid, "truncated encrypted entry")
+	}
+
+	head := make([]byte, saltLen+verifierLen)
+	if _, err := io.ReadFull(raw, head); err != nil {
+		return nil, codedError(CodeArchiveInvalid, "truncated encrypted entry")
+	}
+	encKey, macKey, verifier := aesKeys(password, head[:saltLen], keyLen)
+	if subtle.ConstantTimeCompare(verifier, head[saltLen:]) != 1 {
+		return nil, errArchivePassword
+	}
+
+	ctr, err := newWinzipCTR(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &aesReader{
+		data: io.LimitReader(raw, size-int64(saltLen+verifierLen+authLen)),
+		tail: raw,
+		ctr:  ctr,
+		mac:  hmac.New(sha1.New, macKey),
+	}, nil
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+	n, err := a.data.Read(p)
+	a.mac.Write(p[:n])
+	a.ctr.xor(p[:n])
+	if err == io.EOF {
+		a.err = io.EOF
+		var auth [10]byte
+		if _, terr := io.ReadFull(a.tail, auth[:]); terr != nil || !hmac.Equal(auth[:], a.mac.Sum(nil)[:10]) {
+			a.err = errArchiveAuth
+		}
+		err = a.err
+	}
+	return n, err
+}
+
+// ------------------------- encrypted export -------------------------
+
+// createEncryptedZipFile добавляет в архив запись, зашифрованную AES-256 (AE-2, deflate).
+// Запись пишется потоком: размеры уходят в data descriptor, поэтому Close обязателен
+// до zw.Close — он дописывает код аутентификации и обновляет заголовок.
+func createEncryptedZipFile(zw *zip.Writer, name, password string) (io.WriteCloser, error) {
+	const keyLen, saltLen = 32, 16
+
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   zipMethodAES,
+		Flags:    0x1 | 0x8, // зашифровано; размеры — в data descriptor
+		Modified: time.Now(),
+		// AE-2 (CRC не пишется), vendor "AE", AES-256, внутри deflate.
+		Extra: []byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, byte(zip.Deflate), 0},
+	}
+	raw, err := zw.CreateRaw(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	encKey, macKey, verifier := aesKeys(password, salt, keyLen)
+	ctr, err := newWinzipCTR(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aw := &aesWriter{fh: fh, raw: raw, ctr: ctr, mac: hmac.New(sha1.New, macKey)}
+	if err := aw.writeRaw(append(salt, verifier...)); err != nil {
+		return nil, err
+	}
+	aw.fw, _ = flate.NewWriter(writerFunc(aw.writeEncrypted), flate.DefaultCompression)
+	return aw, nil
+}
+
+// aesWriter сжимает, шифрует и считает HMAC записи WinZip AES.
+type aesWriter struct {
+	fh    *zip.FileHeader
+	raw   io.Writer
+	fw    *flate.Writer
+	ctr   *winzipCTR
+	mac   hash.Hash
+	buf   []byte
+	plain uint64 // байт до сжатия
+	out   uint64 // байт записано в архив
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	a.plain += uint64(len(p))
+	return a.fw.Write(p)
+}
+
+func (a *aesWriter) writeEncrypted(p []byte) (int, error) {
+	a.buf = append(a.buf[:0], p...)
+	a.ctr.xor(a.buf)
+	a.mac.Write(a.buf)
+	if err := a.writeRaw(a.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *aesWriter) writeRaw(p []byte) error {
+	n, err := a.raw.Write(p)
+	a.out += uint64(n)
+	return err
+}
+
+func (a *aesWriter) Close() error {
+	if err := a.fw.Close(); err != nil {
+		return err
+	}
+	if err := a.writeRaw(a.mac.Sum(nil)[:10]); err != nil {
+		return err
+	}
+	// zip.Writer читает размеры из того же заголовка при записи data descriptor и центрального каталога.
+	a.fh.CompressedSize64 = a.out
+	a.fh.UncompressedSize64 = a.plain
+	a.fh.CompressedSize = uint32(min(a.out, math.MaxUint32))
+	a.fh.UncompressedSize = uint32(min(a.plain, math.MaxUint32))
+	return nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// ------------------------- crc -------------------------
+
+// crcReader сверяет CRC32 распакованных данных в конце потока.
+type crcReader struct {
+	rc   io.ReadCloser
+	hash hash.Hash32
+	want uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && c.hash.Sum32() != c.want {
+		return n, errArchiveAuth
+	}
+	return n, err
+}
+
+func (c *crcReader) Close() error { return c.rc.Close() }
+
+// authReader дочитывает расшифрованные данные, когда распаковка закончилась: deflate
+// останавливается на последнем блоке и может не дойти до кода аутентификации WinZip AES.
+type authReader struct {
+	rc  io.ReadCloser
+	src io.Reader
+}
+
+func (a *authReader) Read(p []byte) (int, error) {
+	n, err := a.rc.Read(p)
+	if err == io.EOF {
+		if _, derr := io.Copy(io.Discard, a.src); derr != nil {
+			return n, derr
+		}
+	}
+	return n, err
+}
+
+func (a *authReader) Close() error { return a.rc.Close() }
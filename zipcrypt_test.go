@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Архивы в testdata сделаны сторонними программами, а не этим кодом:
+//   - aes-ae2.zip, aes-ae2-deflate.zip — 7-Zip, AES-256, AE-2, store и deflate, пароль golang
+//     (из тестов github.com/alexmullins/zip);
+//   - aes-ae1.zip — aes-ae2.zip с версией AE-1 и настоящим CRC в заголовках, как пишет WinZip;
+//   - zipcrypto-dd.zip — Info-ZIP zip -P: ZipCrypto, data descriptor, контрольный байт из времени;
+//   - zipcrypto.zip — Info-ZIP zipcloak: ZipCrypto без data descriptor, контрольный байт из CRC.
+
+const testCSV = "id,name,category,price,create_date\n" +
+	"1,iPhone 13,Electronics,799.99,2024-01-01\n" +
+	"2,Samsung Galaxy,Electronics,699.99,2024-01-02\n"
+
+func openTestZip(t *testing.T, name string) *zip.File {
+	t.Helper()
+	zr, err := zip.OpenReader("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { zr.Close() })
+	if len(zr.File) != 1 {
+		t.Fatalf("%s: %d entries, want 1", name, len(zr.File))
+	}
+	return zr.File[0]
+}
+
+func readEncrypted(f *zip.File, password string) (string, error) {
+	rc, err := openEncryptedZipFile(f, password)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	return string(b), err
+}
+
+func TestOpenEncryptedZipFile(t *testing.T) {
+	tests := []struct {
+		file     string
+		password string
+		want     string // содержимое целиком
+		contains string // или его часть, если файл большой
+	}{
+		{file: "aes-ae1.zip", password: "golang", want: "Hello World\r\n"},
+		{file: "aes-ae2.zip", password: "golang", want: "Hello World\r\n"},
+		{file: "aes-ae2-deflate.zip", password: "golang", contains: "Exeunt"},
+		{file: "zipcrypto.zip", password: "secret", want: testCSV},
+		{file: "zipcrypto-dd.zip", password: "secret", want: testCSV},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f := openTestZip(t, tt.file)
+			if !zipEncrypted(f) {
+				t.Fatal("entry is not reported as encrypted")
+			}
+			got, err := readEncrypted(f, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contains != "" {
+				if !strings.Contains(got, tt.contains) {
+					t.Errorf("decrypted %d bytes without %q", len(got), tt.contains)
+				}
+			} else if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			for _, pw := range []string{"", "wrong"} {
+				if _, err := readEncrypted(f, pw); err != errArchivePassword {
+					t.Errorf("password %q: err = %v, want %v", pw, err, errArchivePassword)
+				}
+			}
+		})
+	}
+}
+
+// TestOpenEncryptedZipFileCorrupt — испорченные данные не отдаются молча: AE-2 ловит HMAC,
+// AE-1 и ZipCrypto — CRC.
+func TestOpenEncryptedZipFileCorrupt(t *testing.T) {
+	tests := []struct {
+		file     string
+		password string
+		offset   int64 // смещение испорченного байта от начала данных записи
+	}{
+		{file: "aes-ae2.zip", password: "golang", offset: 16 + 2}, // первый байт после соли и верификатора
+		{file: "aes-ae1.zip", password: "golang", offset: 16 + 2},
+		{file: "aes-ae2-deflate.zip", password: "golang", offset: 1000},
+		{file: "zipcrypto.zip", password: "secret", offset: 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b, err := os.ReadFile("testdata/" + tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, err := zr.File[0].DataOffset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b[start+tt.offset] ^= 0x01
+
+			if _, err := readEncrypted(zr.File[0], tt.password); err == nil {
+				t.Fatal("corrupted entry decrypted without error")
+			}
+		})
+	}
+}
+
+func TestCreateEncryptedZipFile(t *testing.T) {
+	// Несколько блоков AES и несколько вызовов Write.
+	want := strings.Repeat(testCSV, 200)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := createEncryptedZipFile(zw, "data.csv", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(want); i += 1000 {
+		if _, err := io.WriteString(w, want[i:min(i+1000, len(want))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := zr.File[0]
+	if f.Name != "data.csv" || !zipEncrypted(f) || f.UncompressedSize64 != uint64(len(want)) {
+		t.Fatalf("entry %q encrypted=%v size=%d", f.Name, zipEncrypted(f), f.UncompressedSize64)
+	}
+	if ae, ok := parseAESExtra(f.Extra); !ok || ae.version != 2 || ae.strength != 3 || ae.method != zip.Deflate {
+		t.Errorf("AES extra = %+v, %v; want AE-2, AES-256, deflate", ae, ok)
+	}
+	got, err := readEncrypted(f, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("round trip: got %d bytes, want %d", len(got), len(want))
+	}
+	if _, err := readEncrypted(f, "Secret"); err != errArchivePassword {
+		t.Errorf("wrong password: err = %v, want %v", err, errArchivePassword)
+	}
+}
+
+// TestAESKeys сверяет верификатор пароля с тем, что записал 7-Zip.
+func TestAESKeys(t *testing.T) {
+	f := openTestZip(t, "aes-ae2.zip")
+	raw, err := f.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 16+2) // соль AES-256 и верификатор
+	if _, err := io.ReadFull(raw, head); err != nil {
+		t.Fatal(err)
+	}
+
+	encKey, macKey, verifier := aesKeys("golang", head[:16], 32)
+	if len(encKey) != 32 || len(macKey) != 32 || len(verifier) != 2 {
+		t.Fatalf("key lengths %d, %d, %d; want 32, 32, 2", len(encKey), len(macKey), len(verifier))
+	}
+	if !bytes.Equal(verifier, head[16:]) {
+		t.Errorf("verifier = %x, want %x", verifier, head[16:])
+	}
+	if _, _, v := aesKeys("golang1", head[:16], 32); bytes.Equal(v, head[16:]) {
+		t.Error("another password gives the same verifier")
+	}
+}
+
+// TestWinzipCTR — счётчик little-endian с единицы, перенос между байтами, и поток
+// не зависит от того, как данные нарезаны на вызовы xor.
+func TestWinzipCTR(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystream := func(n uint64) []byte {
+		var ctr, out [aes.BlockSize]byte
+		binary.LittleEndian.PutUint64(ctr[:], n)
+		block.Encrypt(out[:], ctr[:])
+		return out[:]
+	}
+
+	const blocks = 300
+	whole := make([]byte, blocks*aes.BlockSize)
+	c, err := newWinzipCTR(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.xor(whole)
+	for _, i := range []int{0, 1, 254, 255, 256, blocks - 1} {
+		if got, want := whole[i*aes.BlockSize:(i+1)*aes.BlockSize], keystream(uint64(i+1)); !bytes.Equal(got, want) {
+			t.Errorf("block %d: %x, want %x", i, got, want)
+		}
+	}
+
+	pieces := make([]byte, len(whole))
+	c, _ = newWinzipCTR(key)
+	for i, n := 0, 1; i < len(pieces); i, n = i+n, n%37+1 {
+		c.xor(pieces[i:min(i+n, len(pieces))])
+	}
+	if !bytes.Equal(pieces, whole) {
+		t.Error("keystream depends on how xor calls are split")
+	}
+}